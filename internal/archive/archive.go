@@ -0,0 +1,678 @@
+// Package archive keeps the raw bodies of report requests in an
+// S3-compatible object store for forensic retention.
+package archive
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	segmentExt     = ".ndjson.gz"
+	activeExt      = segmentExt + ".part"
+	segmentLayout  = "20060102T150405.000Z"
+	minPartSize    = 5 << 20
+	defaultSegment = 64 << 20
+)
+
+// ErrQueueFull is returned by Archive when a record is dropped because
+// MaxPending records are already waiting to be written.
+var ErrQueueFull = errors.New("archive queue full, dropped record")
+
+// Config configures an Archive.
+type Config struct {
+	// Endpoint is the URL of the object store, e.g. `http://localhost:9000`
+	// for a local MinIO. An `http` scheme disables TLS. Defaults to
+	// `https://s3.amazonaws.com`.
+	Endpoint string
+
+	// Bucket receives the segments. It must already exist.
+	Bucket string
+
+	// Prefix is prepended to every object key, before the
+	// `year=/month=/day=/hour=` partitions.
+	Prefix string
+
+	// Region of the bucket. Empty looks it up.
+	Region string
+
+	// AccessKey and SecretKey authenticate to the store. Empty values fall
+	// back to the AWS_* and MINIO_* environment variables and then to the
+	// EC2/ECS instance role.
+	AccessKey string
+	SecretKey string
+
+	// PathStyle addresses the bucket in the path rather than the host name,
+	// as most self-hosted stores require. By default the style is chosen
+	// from the endpoint.
+	PathStyle bool
+
+	// SpoolDir holds segments being written and segments waiting to be
+	// uploaded. Segments left by a previous run are uploaded on start.
+	SpoolDir string
+
+	// SegmentSize starts a new segment once the current one holds this many
+	// uncompressed bytes. Defaults to 64MiB.
+	SegmentSize int64
+
+	// SegmentInterval starts a new segment once the current one has been
+	// open this long. Defaults to 5m. A segment never spans more than one
+	// hour partition.
+	SegmentInterval time.Duration
+
+	// PartSize is the part size of multipart uploads, which are used for
+	// segments larger than it. Defaults to 16MiB and can't be less than
+	// 5MiB.
+	PartSize int64
+
+	// MaxPending caps the records waiting to be written to the spool.
+	// Records beyond it are dropped rather than holding up the request
+	// they came from. Defaults to 1000.
+	MaxPending int
+
+	// MinBackoff and MaxBackoff bound the delay between upload retries. The
+	// delay doubles after each failure. Default to 1s and 5m.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+
+	// Host names the collector in object keys so that several collectors
+	// can share a prefix. Defaults to the hostname.
+	Host string
+
+	// Metrics, if set, counts uploads and dropped records and tracks the
+	// size of the spool.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background writes and uploads.
+	OnError func(error)
+}
+
+// Record is a single report request as received. Body holds the bytes
+// received, still encoded as described by ContentEncoding.
+type Record struct {
+	ReceivedAt      time.Time
+	Handler         string
+	Path            string
+	ContentType     string
+	ContentEncoding string
+	UserAgent       string
+	Body            []byte
+}
+
+// pending is a record waiting to be written, or, if written is set, a
+// marker that closes written once everything queued before it has been
+// written.
+type pending struct {
+	rec     Record
+	written chan struct{}
+}
+
+// line is the NDJSON representation of a Record. Bodies that aren't valid
+// UTF-8 are kept byte for byte in BodyBase64.
+type line struct {
+	ReceivedAt      time.Time `json:"received_at"`
+	Handler         string    `json:"handler"`
+	Path            string    `json:"path"`
+	ContentType     string    `json:"content_type,omitempty"`
+	ContentEncoding string    `json:"content_encoding,omitempty"`
+	UserAgent       string    `json:"user_agent,omitempty"`
+	Body            *string   `json:"body,omitempty"`
+	BodyBase64      []byte    `json:"body_base64,omitempty"`
+}
+
+// Archive appends records to gzipped NDJSON segments in a local spool and
+// uploads completed segments to the object store, both from background
+// goroutines. Segments that fail to upload stay in the spool and are
+// retried with backoff.
+type Archive struct {
+	cfg    Config
+	client *minio.Client
+	now    func() time.Time
+
+	mu        sync.Mutex
+	f         *os.File
+	zw        *gzip.Writer
+	path      string
+	partition string
+	size      int64
+	opened    time.Time
+	seq       int
+
+	// uploading serialises uploads between the background loop and Flush.
+	uploading sync.Mutex
+
+	// queue holds records waiting to be written. queueMu guards sending
+	// to it against Close.
+	queue       chan pending
+	queueMu     sync.RWMutex
+	queueClosed bool
+
+	kick      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// New creates the store client, queues segments left in the spool by a
+// previous run and starts the upload loop.
+func New(cfg Config) (*Archive, error) {
+	if cfg.Bucket == "" {
+		return nil, fmt.Errorf("archive bucket is not set")
+	}
+	if cfg.SpoolDir == "" {
+		return nil, fmt.Errorf("archive spool directory is not set")
+	}
+	if cfg.Endpoint == "" {
+		cfg.Endpoint = "https://s3.amazonaws.com"
+	}
+	u, err := url.Parse(cfg.Endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("invalid archive endpoint '%s', expected http(s)://host:port", cfg.Endpoint)
+	}
+	if cfg.PartSize == 0 {
+		cfg.PartSize = 16 << 20
+	}
+	if cfg.PartSize < minPartSize {
+		return nil, fmt.Errorf("archive part size must be at least 5MiB")
+	}
+	if cfg.SegmentSize <= 0 {
+		cfg.SegmentSize = defaultSegment
+	}
+	if cfg.SegmentInterval <= 0 {
+		cfg.SegmentInterval = 5 * time.Minute
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = time.Second
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 5 * time.Minute
+	}
+	if cfg.MaxPending <= 0 {
+		cfg.MaxPending = 1000
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	cfg.Prefix = strings.Trim(cfg.Prefix, "/")
+
+	creds := credentials.NewChainCredentials([]credentials.Provider{
+		&credentials.EnvAWS{},
+		&credentials.EnvMinio{},
+		&credentials.IAM{},
+	})
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, "")
+	}
+	lookup := minio.BucketLookupAuto
+	if cfg.PathStyle {
+		lookup = minio.BucketLookupPath
+	}
+	client, err := minio.New(u.Host, &minio.Options{
+		Creds:        creds,
+		Secure:       u.Scheme == "https",
+		Region:       cfg.Region,
+		BucketLookup: lookup,
+		// Failed uploads are retried from the spool.
+		MaxRetries: 1,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(cfg.SpoolDir, 0o755); err != nil {
+		return nil, err
+	}
+
+	a := &Archive{
+		cfg:    cfg,
+		client: client,
+		now:    time.Now,
+		queue:  make(chan pending, cfg.MaxPending),
+		kick:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	if err := a.recover(); err != nil {
+		return nil, err
+	}
+
+	a.wg.Add(2)
+	go a.run()
+	go a.writeQueued()
+	a.wakeUp()
+
+	return a, nil
+}
+
+// Archive queues rec to be appended to the current segment by a background
+// goroutine, so that spool IO doesn't hold up the request. If MaxPending
+// records are already queued, rec is dropped and ErrQueueFull returned.
+func (a *Archive) Archive(rec Record) error {
+	a.queueMu.RLock()
+	defer a.queueMu.RUnlock()
+
+	if a.queueClosed {
+		return os.ErrClosed
+	}
+	select {
+	case a.queue <- pending{rec: rec}:
+		return nil
+	default:
+		if a.cfg.Metrics != nil {
+			a.cfg.Metrics.ArchiveDropped.Inc()
+		}
+		return ErrQueueFull
+	}
+}
+
+// writeQueued writes queued records until the archive is closed.
+func (a *Archive) writeQueued() {
+	defer a.wg.Done()
+
+	for {
+		select {
+		case <-a.done:
+			return
+		case p := <-a.queue:
+			if err := a.writePending(p); err != nil && a.cfg.OnError != nil {
+				a.cfg.OnError(err)
+			}
+		}
+	}
+}
+
+// drain writes the records still queued once writeQueued has stopped.
+func (a *Archive) drain() error {
+	var errs []error
+	for {
+		select {
+		case p := <-a.queue:
+			if err := a.writePending(p); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			return errors.Join(errs...)
+		}
+	}
+}
+
+func (a *Archive) writePending(p pending) error {
+	if p.written != nil {
+		close(p.written)
+		return nil
+	}
+	if err := a.write(p.rec); err != nil {
+		return fmt.Errorf("unable to archive %s request: %w", p.rec.Path, err)
+	}
+	return nil
+}
+
+// write appends rec to the current segment, starting a new one first if
+// rec belongs to a different hour or the segment is due for rotation.
+func (a *Archive) write(rec Record) error {
+	l := line{
+		ReceivedAt:      rec.ReceivedAt.UTC(),
+		Handler:         rec.Handler,
+		Path:            rec.Path,
+		ContentType:     rec.ContentType,
+		ContentEncoding: rec.ContentEncoding,
+		UserAgent:       rec.UserAgent,
+	}
+	if utf8.Valid(rec.Body) {
+		body := string(rec.Body)
+		l.Body = &body
+	} else {
+		l.BodyBase64 = rec.Body
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	partition := partitionOf(l.ReceivedAt)
+	if a.f != nil && (partition != a.partition || a.dueLocked(int64(len(data)))) {
+		if err := a.rotateLocked(); err != nil {
+			return err
+		}
+		a.wakeUp()
+	}
+	if a.f == nil {
+		if err := a.openLocked(partition); err != nil {
+			return err
+		}
+	}
+
+	n, err := a.zw.Write(data)
+	a.size += int64(n)
+	return err
+}
+
+// Flush writes the records queued so far, completes the current segment
+// and uploads every spooled segment, retrying with backoff until they are
+// stored or ctx is done.
+func (a *Archive) Flush(ctx context.Context) error {
+	if err := a.waitWritten(ctx); err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	err := a.rotateLocked()
+	a.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	backoff := a.cfg.MinBackoff
+	for {
+		err := a.upload(ctx)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, a.cfg.MaxBackoff)
+	}
+}
+
+// waitWritten waits until the records queued before it was called have
+// been written.
+func (a *Archive) waitWritten(ctx context.Context) error {
+	written := make(chan struct{})
+
+	a.queueMu.RLock()
+	if a.queueClosed {
+		a.queueMu.RUnlock()
+		return os.ErrClosed
+	}
+	select {
+	case a.queue <- pending{written: written}:
+	case <-ctx.Done():
+	}
+	a.queueMu.RUnlock()
+
+	select {
+	case <-written:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Close stops the background goroutines, writes the records still queued,
+// completes the current segment and makes a final attempt to upload the
+// spool. Segments that can't be uploaded are kept for the next run.
+func (a *Archive) Close() error {
+	a.queueMu.Lock()
+	a.queueClosed = true
+	a.queueMu.Unlock()
+
+	a.closeOnce.Do(func() { close(a.done) })
+	a.wg.Wait()
+
+	err := a.drain()
+	a.mu.Lock()
+	err = errors.Join(err, a.rotateLocked())
+	a.mu.Unlock()
+	return errors.Join(err, a.upload(context.Background()))
+}
+
+func (a *Archive) run() {
+	defer a.wg.Done()
+
+	// Check often enough that a quiet collector doesn't hold on to a
+	// segment for much longer than SegmentInterval.
+	ticker := time.NewTicker(max(a.cfg.SegmentInterval/4, time.Second))
+	defer ticker.Stop()
+
+	backoff := a.cfg.MinBackoff
+	for {
+		select {
+		case <-a.done:
+			return
+		case <-ticker.C:
+		case <-a.kick:
+		}
+
+		a.mu.Lock()
+		var err error
+		if a.f != nil && a.dueLocked(0) {
+			err = a.rotateLocked()
+		}
+		a.mu.Unlock()
+		if err != nil && a.cfg.OnError != nil {
+			a.cfg.OnError(err)
+		}
+
+		if err := a.upload(context.Background()); err != nil {
+			if a.cfg.OnError != nil {
+				a.cfg.OnError(fmt.Errorf("%w (retrying in %s)", err, backoff))
+			}
+			select {
+			case <-a.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, a.cfg.MaxBackoff)
+			a.wakeUp()
+			continue
+		}
+		backoff = a.cfg.MinBackoff
+	}
+}
+
+func (a *Archive) wakeUp() {
+	select {
+	case a.kick <- struct{}{}:
+	default:
+	}
+}
+
+// upload stores the spooled segments oldest first, removing each once it
+// has been stored. It stops at the first failure so that segments are
+// uploaded in order.
+func (a *Archive) upload(ctx context.Context) error {
+	a.uploading.Lock()
+	defer a.uploading.Unlock()
+
+	segments, err := a.segments(segmentExt)
+	if err != nil {
+		return err
+	}
+	defer a.updateSpoolSize()
+
+	for _, file := range segments {
+		key, err := filepath.Rel(a.cfg.SpoolDir, file)
+		if err != nil {
+			return err
+		}
+		key = path.Join(a.cfg.Prefix, filepath.ToSlash(key))
+
+		if err := a.put(ctx, key, file); err != nil {
+			a.count("failed")
+			return fmt.Errorf("unable to upload %s: %w", key, err)
+		}
+		a.count("uploaded")
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+
+		// Hold a.mu so that a segment isn't being started in the
+		// directory.
+		a.mu.Lock()
+		removeEmptyDirs(a.cfg.SpoolDir, filepath.Dir(file))
+		a.mu.Unlock()
+	}
+	return nil
+}
+
+// put uploads path as key. Segments larger than PartSize are sent as a
+// multipart upload.
+func (a *Archive) put(ctx context.Context, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	_, err = a.client.PutObject(ctx, a.cfg.Bucket, key, f, info.Size(), minio.PutObjectOptions{
+		ContentType:     "application/x-ndjson",
+		ContentEncoding: "gzip",
+		PartSize:        uint64(a.cfg.PartSize),
+	})
+	return err
+}
+
+// recover queues segments that were still being written when a previous
+// run stopped. Their gzip stream may be truncated, which most tools
+// tolerate after reading the complete records.
+func (a *Archive) recover() error {
+	active, err := a.segments(activeExt)
+	if err != nil {
+		return err
+	}
+	for _, path := range active {
+		if err := os.Rename(path, strings.TrimSuffix(path, ".part")); err != nil {
+			return err
+		}
+	}
+	a.updateSpoolSize()
+	return nil
+}
+
+// segments returns the files in the spool ending in ext, oldest first.
+func (a *Archive) segments(ext string) ([]string, error) {
+	var segments []string
+	err := filepath.WalkDir(a.cfg.SpoolDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(path, ext) {
+			segments = append(segments, path)
+		}
+		return nil
+	})
+
+	// The partitions and the timestamp in the name sort chronologically.
+	sort.Strings(segments)
+	return segments, err
+}
+
+// openLocked starts a segment in partition. The caller must hold a.mu.
+func (a *Archive) openLocked(partition string) error {
+	now := a.now()
+	a.seq++
+	name := fmt.Sprintf("%s-%s-%d%s", a.cfg.Host, now.UTC().Format(segmentLayout), a.seq, activeExt)
+	dir := filepath.Join(a.cfg.SpoolDir, filepath.FromSlash(partition))
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	a.f = f
+	a.zw = gzip.NewWriter(f)
+	a.path = f.Name()
+	a.partition = partition
+	a.size = 0
+	a.opened = now
+	return nil
+}
+
+// dueLocked reports whether writing n more bytes requires a new segment.
+// The caller must hold a.mu.
+func (a *Archive) dueLocked(n int64) bool {
+	if a.size == 0 {
+		return false
+	}
+	return a.size+n > a.cfg.SegmentSize || a.now().Sub(a.opened) >= a.cfg.SegmentInterval
+}
+
+// rotateLocked completes the current segment, if any, and queues it for
+// upload. The caller must hold a.mu.
+func (a *Archive) rotateLocked() error {
+	if a.f == nil {
+		return nil
+	}
+
+	err := a.zw.Close()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	path := a.path
+	a.f, a.zw, a.path = nil, nil, ""
+	if err != nil {
+		return err
+	}
+	return os.Rename(path, strings.TrimSuffix(path, ".part"))
+}
+
+func (a *Archive) updateSpoolSize() {
+	if a.cfg.Metrics == nil {
+		return
+	}
+	var total int64
+	_ = filepath.WalkDir(a.cfg.SpoolDir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				total += info.Size()
+			}
+		}
+		return nil
+	})
+	a.cfg.Metrics.ArchiveSpoolBytes.Set(float64(total))
+}
+
+func (a *Archive) count(result string) {
+	if a.cfg.Metrics == nil {
+		return
+	}
+	a.cfg.Metrics.ArchiveUploads.WithLabelValues(result).Inc()
+}
+
+// partitionOf returns the key prefix of the hour t falls in, without the
+// configured prefix.
+func partitionOf(t time.Time) string {
+	return t.UTC().Format("year=2006/month=01/day=02/hour=15")
+}
+
+// removeEmptyDirs removes dir and its parents up to, but not including,
+// root while they are empty.
+func removeEmptyDirs(root, dir string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		if os.Remove(dir) != nil {
+			return
+		}
+		dir = filepath.Dir(dir)
+	}
+}
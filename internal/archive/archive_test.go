@@ -0,0 +1,393 @@
+package archive
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeS3 implements just enough of the S3 API for single and multipart
+// uploads into a bucket called `reports`.
+type fakeS3 struct {
+	mu      sync.Mutex
+	fail    bool
+	objects map[string][]byte
+	headers map[string]http.Header
+	parts   map[string]map[int][]byte
+	uploads int
+	multi   int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		objects: make(map[string][]byte),
+		headers: make(map[string]http.Header),
+		parts:   make(map[string]map[int][]byte),
+	}
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprint(w, `<Error><Code>SlowDown</Code><Message>unavailable</Message></Error>`)
+		return
+	}
+
+	key, ok := strings.CutPrefix(r.URL.Path, "/reports/")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `<Error><Code>NoSuchBucket</Code></Error>`)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	if strings.HasPrefix(r.Header.Get("Content-Encoding"), "aws-chunked") {
+		body = decodeAWSChunked(body)
+		r.Header.Set("Content-Encoding", strings.TrimPrefix(strings.TrimPrefix(r.Header.Get("Content-Encoding"), "aws-chunked"), ","))
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.uploads++
+		id := fmt.Sprint(s.uploads)
+		s.parts[id] = make(map[int][]byte)
+		s.headers[key] = r.Header.Clone()
+		fmt.Fprintf(w, `<InitiateMultipartUploadResult><Bucket>reports</Bucket><Key>%s</Key><UploadId>%s</UploadId></InitiateMultipartUploadResult>`, key, id)
+	case r.Method == http.MethodPut && query.Has("partNumber"):
+		var n int
+		fmt.Sscan(query.Get("partNumber"), &n)
+		s.parts[query.Get("uploadId")][n] = body
+		w.Header().Set("ETag", fmt.Sprintf(`"part-%d"`, n))
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		parts := s.parts[query.Get("uploadId")]
+		numbers := make([]int, 0, len(parts))
+		for n := range parts {
+			numbers = append(numbers, n)
+		}
+		sort.Ints(numbers)
+		var object []byte
+		for _, n := range numbers {
+			object = append(object, parts[n]...)
+		}
+		s.objects[key] = object
+		s.multi++
+		fmt.Fprintf(w, `<CompleteMultipartUploadResult><Bucket>reports</Bucket><Key>%s</Key><ETag>"done"</ETag></CompleteMultipartUploadResult>`, key)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		s.headers[key] = r.Header.Clone()
+		w.Header().Set("ETag", `"done"`)
+	default:
+		w.WriteHeader(http.StatusNotImplemented)
+	}
+}
+
+// decodeAWSChunked strips the chunk headers of a body sent with a streaming
+// signature: `<hex size>;chunk-signature=<sig>\r\n<data>\r\n`.
+func decodeAWSChunked(body []byte) []byte {
+	var out []byte
+	for len(body) > 0 {
+		header, rest, _ := bytes.Cut(body, []byte("\r\n"))
+		size, _ := strconv.ParseInt(string(bytes.SplitN(header, []byte(";"), 2)[0]), 16, 64)
+		if size == 0 {
+			break
+		}
+		out = append(out, rest[:size]...)
+		body = rest[size+2:]
+	}
+	return out
+}
+
+func (s *fakeS3) keys() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var keys []string
+	for k := range s.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (s *fakeS3) setFail(fail bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fail = fail
+}
+
+func newTestArchive(t *testing.T, url, spool string, m *metrics.Metrics) *Archive {
+	t.Helper()
+	a, err := New(Config{
+		Endpoint:        url,
+		Bucket:          "reports",
+		Prefix:          "raw",
+		Region:          "us-east-1",
+		AccessKey:       "minio",
+		SecretKey:       "minio123",
+		PathStyle:       true,
+		SpoolDir:        spool,
+		SegmentInterval: time.Hour,
+		PartSize:        minPartSize,
+		MinBackoff:      time.Millisecond,
+		MaxBackoff:      5 * time.Millisecond,
+		Host:            "collector-1",
+		Metrics:         m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func decodeSegment(t *testing.T, data []byte) []map[string]interface{} {
+	t.Helper()
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(zr)
+	scanner.Buffer(nil, 16<<20)
+	for scanner.Scan() {
+		var l map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &l); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, l)
+	}
+	return lines
+}
+
+func TestArchiveUploadsPartitionedSegments(t *testing.T) {
+	store := newFakeS3()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	a := newTestArchive(t, server.URL, t.TempDir(), m)
+	defer a.Close()
+
+	body := `{"csp-report": {"document-uri": "https://example.com/?a=1&b=<2>"}}`
+	records := []Record{
+		{ReceivedAt: time.Date(2024, 5, 1, 12, 10, 0, 0, time.UTC), Handler: "csp", Path: "/csp", ContentType: "application/csp-report", ContentEncoding: "gzip", Body: []byte(body)},
+		{ReceivedAt: time.Date(2024, 5, 1, 12, 20, 0, 0, time.UTC), Handler: "nel", Path: "/nel", Body: []byte{0xff, 0xfe}},
+		{ReceivedAt: time.Date(2024, 5, 1, 13, 0, 0, 0, time.UTC), Handler: "csp", Path: "/csp", Body: []byte(body)},
+	}
+	for _, rec := range records {
+		if err := a.Archive(rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := store.keys()
+	if len(keys) != 2 {
+		t.Fatalf("expected a segment per hour, got %v", keys)
+	}
+	if !strings.HasPrefix(keys[0], "raw/year=2024/month=05/day=01/hour=12/collector-1-") ||
+		!strings.HasPrefix(keys[1], "raw/year=2024/month=05/day=01/hour=13/collector-1-") ||
+		!strings.HasSuffix(keys[0], ".ndjson.gz") {
+		t.Errorf("unexpected keys %v", keys)
+	}
+	if h := store.headers[keys[0]]; h.Get("Content-Type") != "application/x-ndjson" || h.Get("Content-Encoding") != "gzip" {
+		t.Errorf("unexpected object headers %v", h)
+	}
+
+	lines := decodeSegment(t, store.objects[keys[0]])
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 records in the first segment, got %d", len(lines))
+	}
+	if lines[0]["body"] != body || lines[0]["handler"] != "csp" || lines[0]["content_encoding"] != "gzip" || lines[0]["received_at"] != "2024-05-01T12:10:00Z" {
+		t.Errorf("unexpected record %v", lines[0])
+	}
+	if lines[1]["body_base64"] != "//4=" || lines[1]["body"] != nil {
+		t.Errorf("expected a binary body to be base64 encoded, got %v", lines[1])
+	}
+
+	if got := testutil.ToFloat64(m.ArchiveUploads.WithLabelValues("uploaded")); got != 2 {
+		t.Errorf("archive_uploads_total{result=uploaded} = %v, want 2", got)
+	}
+}
+
+func TestArchiveSpoolsWhileStoreIsUnavailable(t *testing.T) {
+	store := newFakeS3()
+	store.setFail(true)
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	spool := t.TempDir()
+	m := metrics.New(prometheus.NewRegistry())
+	a := newTestArchive(t, server.URL, spool, m)
+
+	if err := a.Archive(Record{ReceivedAt: time.Now(), Handler: "csp", Path: "/csp", Body: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := a.Flush(ctx); err == nil {
+		t.Fatal("expected flush to fail while the store is unavailable")
+	}
+	if err := a.Close(); err == nil {
+		t.Fatal("expected close to report the failed upload")
+	}
+	if testutil.ToFloat64(m.ArchiveUploads.WithLabelValues("failed")) == 0 || testutil.ToFloat64(m.ArchiveSpoolBytes) == 0 {
+		t.Error("expected failed uploads and a non-empty spool to be reported")
+	}
+
+	// A segment that was still being written when the collector stopped
+	// is uploaded too.
+	partial := filepath.Join(spool, "year=2024", "month=05", "day=01", "hour=12", "collector-1-20240501T120000.000Z-1.ndjson.gz.part")
+	if err := os.MkdirAll(filepath.Dir(partial), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(partial, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	store.setFail(false)
+	a = newTestArchive(t, server.URL, spool, m)
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if keys := store.keys(); len(keys) != 2 || keys[0] != "raw/year=2024/month=05/day=01/hour=12/collector-1-20240501T120000.000Z-1.ndjson.gz" {
+		t.Errorf("expected the spooled and partial segments to be uploaded, got %v", keys)
+	}
+	if entries, _ := os.ReadDir(spool); len(entries) != 0 {
+		t.Errorf("expected an empty spool, got %v", entries)
+	}
+	if got := testutil.ToFloat64(m.ArchiveSpoolBytes); got != 0 {
+		t.Errorf("archive_spool_bytes = %v, want 0", got)
+	}
+}
+
+func TestArchiveUsesMultipartForLargeSegments(t *testing.T) {
+	store := newFakeS3()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	a := newTestArchive(t, server.URL, t.TempDir(), nil)
+	defer a.Close()
+
+	// Random bytes don't compress, so the segment ends up larger than the
+	// 5MiB part size.
+	noise := make([]byte, 4<<20)
+	_, _ = rand.Read(noise)
+	for i := 0; i < 2; i++ {
+		if err := a.Archive(Record{ReceivedAt: time.Now(), Handler: "csp", Path: "/csp", Body: noise}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := store.keys()
+	if len(keys) != 1 || store.multi != 1 {
+		t.Fatalf("expected a single multipart upload, got %v (%d multipart)", keys, store.multi)
+	}
+	lines := decodeSegment(t, store.objects[keys[0]])
+	if len(lines) != 2 || len(lines[1]["body_base64"].(string)) == 0 {
+		t.Errorf("expected both records in the uploaded segment, got %d", len(lines))
+	}
+}
+
+func TestArchiveDropsRecordsWhileWritesAreBehind(t *testing.T) {
+	store := newFakeS3()
+	server := httptest.NewServer(store)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	a, err := New(Config{
+		Endpoint:   server.URL,
+		Bucket:     "reports",
+		Region:     "us-east-1",
+		AccessKey:  "minio",
+		SecretKey:  "minio123",
+		PathStyle:  true,
+		SpoolDir:   t.TempDir(),
+		MaxPending: 1,
+		Metrics:    m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	// Holding the segment stalls the writer, which mustn't stall Archive.
+	a.mu.Lock()
+	accepted := 0
+	for i := 0; i < 3; i++ {
+		err := a.Archive(Record{ReceivedAt: time.Now(), Handler: "csp", Path: "/csp", Body: []byte("{}")})
+		switch {
+		case err == nil:
+			accepted++
+		case !errors.Is(err, ErrQueueFull):
+			t.Fatal(err)
+		}
+	}
+	a.mu.Unlock()
+
+	if dropped := testutil.ToFloat64(m.ArchiveDropped); dropped == 0 || int(dropped)+accepted != 3 {
+		t.Errorf("expected the records that didn't fit to be counted, %v dropped and %d accepted", dropped, accepted)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := a.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	keys := store.keys()
+	if len(keys) != 1 {
+		t.Fatalf("expected a single segment, got %v", keys)
+	}
+	if lines := decodeSegment(t, store.objects[keys[0]]); len(lines) != accepted {
+		t.Errorf("expected the %d accepted records to be archived, got %d", accepted, len(lines))
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	cases := []Config{
+		{SpoolDir: t.TempDir()},
+		{Bucket: "reports"},
+		{Bucket: "reports", SpoolDir: t.TempDir(), Endpoint: "localhost:9000"},
+		{Bucket: "reports", SpoolDir: t.TempDir(), PartSize: 1 << 20},
+	}
+	for _, cfg := range cases {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
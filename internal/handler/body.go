@@ -0,0 +1,218 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jacobbednarz/go-csp-collector/internal/archive"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+var (
+	// errDecompressedBodyTooLarge is returned when a compressed body expands
+	// beyond the configured decompressed size limit.
+	errDecompressedBodyTooLarge = errors.New("decompressed body too large")
+
+	// errUnsupportedContentEncoding is returned for `Content-Encoding`
+	// values the collector can't decode.
+	errUnsupportedContentEncoding = errors.New("unsupported content encoding")
+)
+
+// Archiver keeps the raw body of every report request, see the archive
+// package.
+type Archiver interface {
+	Archive(archive.Record) error
+}
+
+// BodyHandler reads the request body up front, enforcing MaxBodySize on the
+// bytes received and transparently decoding `Content-Encoding: gzip`,
+// `deflate` and `br` bodies up to MaxDecompressedSize. The wrapped Handler
+// always sees an uncompressed, fully buffered body. A limit of zero disables
+// the corresponding check. If Archiver is set, it is given the bytes
+// received for every body that could be decoded, before the wrapped Handler
+// sees it.
+type BodyHandler struct {
+	Handler             http.Handler
+	HandlerName         string
+	MaxBodySize         int64
+	MaxDecompressedSize int64
+	Archiver            Archiver
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+}
+
+func (h *BodyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.Body == nil {
+		h.Handler.ServeHTTP(w, r)
+		return
+	}
+
+	if h.MaxBodySize > 0 && r.ContentLength > h.MaxBodySize {
+		h.tooLarge(w, fmt.Sprintf("content length %d exceeds limit of %d bytes", r.ContentLength, h.MaxBodySize))
+		return
+	}
+
+	var body io.Reader = r.Body
+	if h.MaxBodySize > 0 {
+		body = http.MaxBytesReader(w, r.Body, h.MaxBodySize)
+	}
+	defer r.Body.Close()
+
+	encoding := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding")))
+	_, span := tracer.Start(r.Context(), "decode body")
+	span.SetAttributes(attribute.String("http.request.header.content-encoding", encoding))
+
+	// The body is read as received first, so that it can be archived
+	// byte for byte.
+	raw, err := io.ReadAll(body)
+	if err != nil {
+		endSpan(span, err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			h.tooLarge(w, err.Error())
+			return
+		}
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "read_error").Inc()
+		}
+		http.Error(w, "unable to read body", http.StatusBadRequest)
+		h.Logger.Debugf("unable to read payload: %s", err)
+		return
+	}
+
+	decoded, err := decompressBody(encoding, bytes.NewReader(raw))
+	if err != nil {
+		endSpan(span, err)
+		switch {
+		case errors.Is(err, errUnsupportedContentEncoding):
+			if h.Metrics != nil {
+				h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "unsupported_content_encoding").Inc()
+			}
+			http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			h.Logger.Debugf("received payload with %s", err)
+		default:
+			if h.Metrics != nil {
+				h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "decompress_error").Inc()
+			}
+			http.Error(w, "unable to decode body", http.StatusBadRequest)
+			h.Logger.Debugf("unable to decompress %s payload: %s", encoding, err)
+		}
+		return
+	}
+
+	if h.MaxDecompressedSize > 0 && encoding != "" && encoding != "identity" {
+		decoded = &limitedReader{r: decoded, n: h.MaxDecompressedSize}
+	}
+
+	payload, err := io.ReadAll(decoded)
+	if err != nil {
+		endSpan(span, err)
+		if errors.Is(err, errDecompressedBodyTooLarge) {
+			h.tooLarge(w, err.Error())
+			return
+		}
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "decompress_error").Inc()
+		}
+		http.Error(w, "unable to decode body", http.StatusBadRequest)
+		h.Logger.Debugf("unable to decompress %s payload: %s", encoding, err)
+		return
+	}
+
+	span.SetAttributes(attribute.Int("http.request.body.size", len(payload)))
+	endSpan(span, nil)
+
+	if h.Archiver != nil {
+		err := h.Archiver.Archive(archive.Record{
+			ReceivedAt:      time.Now(),
+			Handler:         h.HandlerName,
+			Path:            r.URL.Path,
+			ContentType:     r.Header.Get("Content-Type"),
+			ContentEncoding: r.Header.Get("Content-Encoding"),
+			UserAgent:       r.UserAgent(),
+			Body:            raw,
+		})
+		// A full queue is counted by the archive and would otherwise be
+		// logged for every request while the spool is slow.
+		if err != nil && !errors.Is(err, archive.ErrQueueFull) {
+			h.Logger.Warnf("unable to archive payload: %s", err)
+		}
+	}
+
+	r.Header.Del("Content-Encoding")
+	r.Header.Set("Content-Length", strconv.Itoa(len(payload)))
+	r.ContentLength = int64(len(payload))
+	r.Body = io.NopCloser(bytes.NewReader(payload))
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+func (h *BodyHandler) tooLarge(w http.ResponseWriter, reason string) {
+	if h.Metrics != nil {
+		h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "body_too_large").Inc()
+	}
+	http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+	h.Logger.Debugf("received oversized payload: %s", reason)
+}
+
+// decompressBody wraps body in a reader for the given content encoding.
+func decompressBody(encoding string, body io.Reader) (io.Reader, error) {
+	switch encoding {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		// HTTP "deflate" is meant to be zlib wrapped but some clients send a
+		// raw deflate stream, so sniff for the zlib header.
+		br := bufio.NewReader(body)
+		header, err := br.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if (uint16(header[0])<<8|uint16(header[1]))%31 == 0 && header[0]&0x0f == 8 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return brotli.NewReader(body), nil
+	default:
+		return nil, fmt.Errorf("%w: '%s'", errUnsupportedContentEncoding, encoding)
+	}
+}
+
+// limitedReader behaves like io.LimitedReader but returns
+// errDecompressedBodyTooLarge instead of io.EOF once the limit is exceeded.
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n < 0 {
+		return 0, errDecompressedBodyTooLarge
+	}
+	if int64(len(p)) > l.n+1 {
+		p = p[:l.n+1]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	if l.n < 0 {
+		return n, errDecompressedBodyTooLarge
+	}
+	return n, err
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/jacobbednarz/go-csp-collector/internal/archive"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func compress(t *testing.T, encoding string, payload []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	default:
+		t.Fatalf("unknown encoding %s", encoding)
+	}
+
+	if _, err := w.Write(payload); err != nil {
+		t.Fatalf("failed to compress payload: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("failed to close compressor: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func newEchoBodyHandler(m *metrics.Metrics, maxBodySize, maxDecompressedSize int64) (*BodyHandler, *bytes.Buffer) {
+	var received bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	return &BodyHandler{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(&received, r.Body)
+		}),
+		HandlerName:         "csp",
+		MaxBodySize:         maxBodySize,
+		MaxDecompressedSize: maxDecompressedSize,
+		Logger:              l,
+		Metrics:             m,
+	}, &received
+}
+
+func TestBodyHandlerDecompresses(t *testing.T) {
+	payload := []byte(legacyCSPPayload)
+
+	for _, encoding := range []string{"gzip", "deflate", "raw-deflate", "br"} {
+		t.Run(encoding, func(t *testing.T) {
+			h, received := newEchoBodyHandler(nil, 1<<20, 1<<20)
+
+			req := httptest.NewRequest("POST", "/csp", bytes.NewReader(compress(t, encoding, payload)))
+			req.Header.Set("Content-Encoding", strings.TrimPrefix(encoding, "raw-"))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %d", rr.Code)
+			}
+			if received.String() != string(payload) {
+				t.Fatalf("expected decompressed payload, got %q", received.String())
+			}
+		})
+	}
+}
+
+func TestBodyHandlerRejectsOversizedBody(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	h, _ := newEchoBodyHandler(m, 16, 0)
+
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(legacyCSPPayload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("csp", "body_too_large")); got != 1 {
+		t.Fatalf("reports_errors_total body_too_large = %v, want 1", got)
+	}
+}
+
+func TestBodyHandlerRejectsOversizedChunkedBody(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	h, _ := newEchoBodyHandler(m, 16, 0)
+
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(legacyCSPPayload))
+	req.ContentLength = -1
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+}
+
+func TestBodyHandlerRejectsZipBomb(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	h, received := newEchoBodyHandler(m, 1<<20, 1<<10)
+
+	bomb := compress(t, "gzip", bytes.Repeat([]byte("a"), 1<<20))
+	req := httptest.NewRequest("POST", "/csp", bytes.NewReader(bomb))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", rr.Code)
+	}
+	if received.Len() != 0 {
+		t.Fatalf("expected wrapped handler not to be called")
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("csp", "body_too_large")); got != 1 {
+		t.Fatalf("reports_errors_total body_too_large = %v, want 1", got)
+	}
+}
+
+func TestBodyHandlerUnsupportedEncoding(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	h, _ := newEchoBodyHandler(m, 1<<20, 1<<20)
+
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(legacyCSPPayload))
+	req.Header.Set("Content-Encoding", "zstd")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnsupportedMediaType {
+		t.Fatalf("expected 415, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("csp", "unsupported_content_encoding")); got != 1 {
+		t.Fatalf("reports_errors_total unsupported_content_encoding = %v, want 1", got)
+	}
+}
+
+func TestBodyHandlerCorruptBody(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	h, _ := newEchoBodyHandler(m, 1<<20, 1<<20)
+
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader("definitely not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("csp", "decompress_error")); got != 1 {
+		t.Fatalf("reports_errors_total decompress_error = %v, want 1", got)
+	}
+}
+
+type recordingArchiver struct {
+	records []archive.Record
+}
+
+func (a *recordingArchiver) Archive(rec archive.Record) error {
+	a.records = append(a.records, rec)
+	return nil
+}
+
+func TestBodyHandlerArchivesRawBody(t *testing.T) {
+	h, received := newEchoBodyHandler(nil, 1<<20, 1<<20)
+	archiver := &recordingArchiver{}
+	h.Archiver = archiver
+
+	compressed := compress(t, "gzip", []byte(legacyCSPPayload))
+	req := httptest.NewRequest("POST", "/csp/report-only", bytes.NewReader(compressed))
+	req.Header.Set("Content-Encoding", "GZIP")
+	req.Header.Set("Content-Type", "application/csp-report")
+	req.Header.Set("User-Agent", "Mozilla/5.0")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	// Bodies that can't be decoded are not archived.
+	req = httptest.NewRequest("POST", "/csp", strings.NewReader("definitely not gzip"))
+	req.Header.Set("Content-Encoding", "gzip")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(archiver.records) != 1 {
+		t.Fatalf("expected 1 archived body, got %d", len(archiver.records))
+	}
+	rec := archiver.records[0]
+	if !bytes.Equal(rec.Body, compressed) || rec.Handler != "csp" || rec.Path != "/csp/report-only" ||
+		rec.ContentType != "application/csp-report" || rec.ContentEncoding != "GZIP" || rec.UserAgent != "Mozilla/5.0" || rec.ReceivedAt.IsZero() {
+		t.Errorf("unexpected archive record %+v", rec)
+	}
+	if received.String() != legacyCSPPayload {
+		t.Errorf("expected the handler to see the decoded body, got %q", received.String())
+	}
+}
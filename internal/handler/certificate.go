@@ -0,0 +1,41 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"time"
+)
+
+// summariseCertificateChain converts a list of PEM encoded certificates, as
+// found in Expect-CT and HPKP reports, into short human readable summaries
+// so that full PEM blobs don't end up in the logs.
+func summariseCertificateChain(chain []string) []string {
+	summaries := make([]string, 0, len(chain))
+	for _, encoded := range chain {
+		summaries = append(summaries, summariseCertificate(encoded))
+	}
+	return summaries
+}
+
+func summariseCertificate(encoded string) string {
+	block, _ := pem.Decode([]byte(encoded))
+	if block == nil {
+		return "unparseable certificate"
+	}
+
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return "unparseable certificate"
+	}
+
+	fingerprint := sha256.Sum256(cert.Raw)
+	return fmt.Sprintf("subject=%q issuer=%q not_after=%s sha256=%s",
+		cert.Subject.CommonName,
+		cert.Issuer.CommonName,
+		cert.NotAfter.UTC().Format(time.RFC3339),
+		hex.EncodeToString(fingerprint[:]),
+	)
+}
@@ -0,0 +1,127 @@
+package handler
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// CrashReport is the structure of a single crash report as delivered by the
+// Reporting API (https://wicg.github.io/crash-reporting/).
+type CrashReport struct {
+	Age       int             `json:"age"`
+	Body      CrashReportBody `json:"body"`
+	Type      string          `json:"type"`
+	URL       string          `json:"url"`
+	UserAgent string          `json:"user_agent"`
+}
+
+// CrashReportBody contains the fields nested within each crash report. The
+// reason is typically `oom` or `unresponsive` but may be absent.
+type CrashReportBody struct {
+	Reason          string `json:"reason,omitempty"`
+	Stack           string `json:"stack,omitempty"`
+	IsTopLevel      *bool  `json:"is_top_level,omitempty"`
+	VisibilityState string `json:"visibility_state,omitempty"`
+}
+
+// CrashReportHandler handles incoming crash reports.
+type CrashReportHandler struct {
+	TruncateQueryStringFragment bool
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *CrashReportHandler) batch() *reportBatch[CrashReport] {
+	return &reportBatch[CrashReport]{
+		name:           "crash",
+		metadataObject: h.MetadataObject,
+		logger:         h.Logger,
+		metrics:        h.Metrics,
+		logReport:      h.logReport,
+	}
+}
+
+func (h *CrashReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.batch().ServeHTTP(w, r)
+}
+
+// ProcessReport handles a single crash report dispatched from the generic
+// Reporting API endpoint.
+func (h *CrashReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	report := CrashReport{
+		Age:       envelope.Age,
+		Type:      envelope.Type,
+		URL:       envelope.URL,
+		UserAgent: envelope.UserAgent,
+	}
+	// Unlike other reports, crash reports may come without a body.
+	body := envelope.Body
+	if len(body) == 0 {
+		body = json.RawMessage("{}")
+	}
+	return h.batch().process(r, &report, &report.Body, body)
+}
+
+func (h *CrashReportHandler) logReport(r *http.Request, report CrashReport, metadata interface{}) {
+	url := report.URL
+	if h.TruncateQueryStringFragment {
+		url = utils.TruncateQueryStringFragment(url)
+	}
+
+	lf := log.Fields{
+		"report_type":      "crash",
+		"url":              url,
+		"reason":           report.Body.Reason,
+		"stack":            report.Body.Stack,
+		"visibility_state": report.Body.VisibilityState,
+		"metadata":         metadata,
+		"path":             r.URL.Path,
+	}
+
+	if report.Body.IsTopLevel != nil {
+		lf["is_top_level"] = *report.Body.IsTopLevel
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "crash",
+		Type:       report.Type,
+		ReportOnly: false,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.CrashReports.WithLabelValues(crashReasonLabel(report.Body.Reason)).Inc()
+	}
+}
+
+// crashReasonLabel maps the browser supplied crash reason onto a fixed set of
+// metric label values so that arbitrary payloads can't blow up cardinality.
+func crashReasonLabel(reason string) string {
+	switch reason {
+	case "oom", "unresponsive":
+		return reason
+	case "":
+		return "unknown"
+	default:
+		return "other"
+	}
+}
+
+func (r CrashReport) reportType() string { return r.Type }
+func (r CrashReport) reportURL() string  { return r.URL }
+
+// validateBody accepts any body, as every field of a crash report is
+// optional.
+func (r CrashReport) validateBody() error { return nil }
@@ -0,0 +1,79 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestCrashHandlerLogsExpectedFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &CrashReportHandler{Logger: l, TruncateQueryStringFragment: true}
+	body := []byte(`[{"type":"crash","url":"https://example.com/checkout?session=abc","body":{"reason":"oom","is_top_level":true,"visibility_state":"visible"}}]`)
+	req := httptest.NewRequest("POST", "/reporting-api/crash", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"report_type=crash", "reason=oom", "is_top_level=true", "visibility_state=visible"} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+	if strings.Contains(out, "session=abc") {
+		t.Errorf("expected query string to be truncated, got: %s", out)
+	}
+}
+
+func TestCrashHandlerMetricsByReason(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &CrashReportHandler{Logger: l, Metrics: m}
+	body := []byte(`[
+		{"type":"crash","url":"https://example.com/a","body":{"reason":"oom"}},
+		{"type":"crash","url":"https://example.com/b","body":{"reason":"unresponsive"}},
+		{"type":"crash","url":"https://example.com/c","body":{"reason":"made-up-reason"}},
+		{"type":"crash","url":"https://example.com/d","body":{}}
+	]`)
+	req := httptest.NewRequest("POST", "/reporting-api/crash", bytes.NewBuffer(body))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, reason := range []string{"oom", "unresponsive", "other", "unknown"} {
+		if got := testutil.ToFloat64(m.CrashReports.WithLabelValues(reason)); got != 1 {
+			t.Errorf("crash_reports_total{reason=%q} = %v, want 1", reason, got)
+		}
+	}
+}
+
+func TestCrashProcessReportWithoutBody(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &CrashReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api", nil)
+	if err := h.ProcessReport(req, ReportAPIEnvelope{Type: "crash", URL: "https://example.com/"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := testutil.ToFloat64(m.CrashReports.WithLabelValues("unknown")); got != 1 {
+		t.Fatalf("crash_reports_total{reason=unknown} = %v, want 1", got)
+	}
+}
@@ -0,0 +1,243 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// COOPReportBody contains the fields nested within a Cross-Origin-Opener-Policy
+// report (https://html.spec.whatwg.org/multipage/browsers.html#coop-violation-report).
+// Which URL fields are populated depends on the report's Type.
+type COOPReportBody struct {
+	Type                string `json:"type"`
+	Disposition         string `json:"disposition"`
+	EffectivePolicy     string `json:"effectivePolicy"`
+	PreviousResponseURL string `json:"previousResponseURL,omitempty"`
+	NextResponseURL     string `json:"nextResponseURL,omitempty"`
+	Referrer            string `json:"referrer,omitempty"`
+	Property            string `json:"property,omitempty"`
+	OpenerURL           string `json:"openerURL,omitempty"`
+	OpeneeURL           string `json:"openeeURL,omitempty"`
+	OtherDocumentURL    string `json:"otherDocumentURL,omitempty"`
+	InitialPopupURL     string `json:"initialPopupURL,omitempty"`
+	SourceFile          string `json:"sourceFile,omitempty"`
+	LineNumber          int    `json:"lineNumber,omitempty"`
+	ColumnNumber        int    `json:"columnNumber,omitempty"`
+}
+
+// COEPReportBody contains the fields nested within a
+// Cross-Origin-Embedder-Policy report
+// (https://html.spec.whatwg.org/multipage/browsers.html#coep-report-type).
+type COEPReportBody struct {
+	Type        string `json:"type"`
+	BlockedURL  string `json:"blockedURL"`
+	Destination string `json:"destination"`
+	Disposition string `json:"disposition"`
+}
+
+// coopReportTypes and coepReportTypes are the body types defined by the HTML
+// specification. Anything else is reported as `other` in metrics.
+var (
+	coopReportTypes = []string{
+		"navigation-from-response",
+		"navigation-to-response",
+		"access-from-coop-page-to-opener",
+		"access-from-coop-page-to-openee",
+		"access-from-coop-page-to-other",
+		"access-to-coop-page-from-opener",
+		"access-to-coop-page-from-openee",
+		"access-to-coop-page-from-other",
+	}
+	coepReportTypes = []string{
+		"corp",
+		"navigation",
+		"worker initialization",
+	}
+)
+
+// CrossOriginReportHandler handles incoming `coop` and `coep` reports.
+type CrossOriginReportHandler struct {
+	TruncateQueryStringFragment bool
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *CrossOriginReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var reports []ReportAPIEnvelope
+
+	err := decoder.Decode(&reports)
+	if err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("cross_origin", "decode_error").Inc()
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		h.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	var accepted []log.Fields
+	for _, report := range reports {
+		if report.Type != "coop" && report.Type != "coep" {
+			if h.Metrics != nil {
+				h.Metrics.ReportIgnored.WithLabelValues("cross_origin", "unsupported_type").Inc()
+			}
+			continue
+		}
+
+		lf, err := h.decodeReport(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			h.Logger.Debugf("received invalid payload: %s", err.Error())
+			return
+		}
+		accepted = append(accepted, lf)
+	}
+
+	metadata := requestMetadata(r, h.MetadataObject)
+	for _, lf := range accepted {
+		h.logReport(r, lf, metadata)
+	}
+}
+
+// ProcessReport handles a single coop or coep report dispatched from the
+// generic Reporting API endpoint.
+func (h *CrossOriginReportHandler) ProcessReport(r *http.Request, report ReportAPIEnvelope) error {
+	lf, err := h.decodeReport(report)
+	if err != nil {
+		return err
+	}
+
+	h.logReport(r, lf, requestMetadata(r, h.MetadataObject))
+	return nil
+}
+
+// decodeReport decodes and validates the body of a coop or coep report,
+// returning the type specific log fields.
+func (h *CrossOriginReportHandler) decodeReport(report ReportAPIEnvelope) (log.Fields, error) {
+	if !strings.HasPrefix(report.URL, "http") {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("cross_origin", "validation_error").Inc()
+		}
+		return nil, fmt.Errorf("url ('%s') is invalid", report.URL)
+	}
+
+	truncate := func(s string) string {
+		if h.TruncateQueryStringFragment {
+			return utils.TruncateQueryStringFragment(s)
+		}
+		return s
+	}
+
+	var lf log.Fields
+	switch report.Type {
+	case "coop":
+		var body COOPReportBody
+		if err := json.Unmarshal(report.Body, &body); err != nil {
+			if h.Metrics != nil {
+				h.Metrics.ReportErrors.WithLabelValues("cross_origin", "decode_error").Inc()
+			}
+			return nil, fmt.Errorf("unable to decode coop body: %w", err)
+		}
+
+		lf = log.Fields{
+			"type":                  body.Type,
+			"disposition":           body.Disposition,
+			"effective_policy":      body.EffectivePolicy,
+			"previous_response_url": truncate(body.PreviousResponseURL),
+			"next_response_url":     truncate(body.NextResponseURL),
+			"referrer":              truncate(body.Referrer),
+			"property":              body.Property,
+			"opener_url":            truncate(body.OpenerURL),
+			"openee_url":            truncate(body.OpeneeURL),
+			"other_document_url":    truncate(body.OtherDocumentURL),
+			"initial_popup_url":     truncate(body.InitialPopupURL),
+			"source_file":           truncate(body.SourceFile),
+			"line_number":           body.LineNumber,
+			"column_number":         body.ColumnNumber,
+		}
+	case "coep":
+		var body COEPReportBody
+		if err := json.Unmarshal(report.Body, &body); err != nil {
+			if h.Metrics != nil {
+				h.Metrics.ReportErrors.WithLabelValues("cross_origin", "decode_error").Inc()
+			}
+			return nil, fmt.Errorf("unable to decode coep body: %w", err)
+		}
+
+		lf = log.Fields{
+			"type":        body.Type,
+			"disposition": body.Disposition,
+			"blocked_uri": truncate(body.BlockedURL),
+			"destination": body.Destination,
+		}
+	default:
+		return nil, fmt.Errorf("unsupported report type ('%s')", report.Type)
+	}
+
+	lf["report_type"] = report.Type
+	lf["report_only"] = lf["disposition"] == "reporting"
+	lf["url"] = truncate(report.URL)
+
+	return lf, nil
+}
+
+func (h *CrossOriginReportHandler) logReport(r *http.Request, lf log.Fields, metadata interface{}) {
+	lf["metadata"] = metadata
+	lf["path"] = r.URL.Path
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "cross_origin",
+		Type:       lf["report_type"].(string),
+		ReportOnly: lf["report_only"] == true,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		policy, _ := lf["report_type"].(string)
+		bodyType, _ := lf["type"].(string)
+		mode := "enforced"
+		if lf["report_only"] == true {
+			mode = "report_only"
+		}
+		h.Metrics.CrossOriginReports.WithLabelValues(policy, crossOriginTypeLabel(policy, bodyType), mode).Inc()
+	}
+}
+
+// crossOriginTypeLabel maps the body type onto the set defined by the
+// specification so that arbitrary payloads can't blow up metric cardinality.
+func crossOriginTypeLabel(policy, bodyType string) string {
+	known := coopReportTypes
+	if policy == "coep" {
+		known = coepReportTypes
+	}
+
+	for _, t := range known {
+		if t == bodyType {
+			return t
+		}
+	}
+
+	return "other"
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+var crossOriginBatch = []byte(`[
+	{
+		"type": "coop",
+		"url": "https://example.com/checkout",
+		"body": {
+			"type": "navigation-to-response",
+			"disposition": "reporting",
+			"effectivePolicy": "same-origin",
+			"previousResponseURL": "https://partner.example.net/login?token=abc",
+			"referrer": "https://partner.example.net/"
+		}
+	},
+	{
+		"type": "coep",
+		"url": "https://example.com/checkout",
+		"body": {
+			"type": "corp",
+			"blockedURL": "https://cdn.example.org/widget.js",
+			"destination": "script",
+			"disposition": "enforce"
+		}
+	}
+]`)
+
+func TestCrossOriginHandlerLogsExpectedFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &CrossOriginReportHandler{Logger: l, TruncateQueryStringFragment: true}
+	req := httptest.NewRequest("POST", "/reporting-api/cross-origin", bytes.NewBuffer(crossOriginBatch))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %s", len(lines), logBuf.String())
+	}
+
+	for _, needle := range []string{"report_type=coop", "report_only=true", "effective_policy=same-origin", "type=navigation-to-response", "previous_response_url=\"https://partner.example.net/login\""} {
+		if !strings.Contains(lines[0], needle) {
+			t.Errorf("expected %q in coop log line, got: %s", needle, lines[0])
+		}
+	}
+	for _, needle := range []string{"report_type=coep", "report_only=false", "blocked_uri=\"https://cdn.example.org/widget.js\"", "destination=script", "type=corp"} {
+		if !strings.Contains(lines[1], needle) {
+			t.Errorf("expected %q in coep log line, got: %s", needle, lines[1])
+		}
+	}
+}
+
+func TestCrossOriginHandlerInvalidURLReturns400(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &CrossOriginReportHandler{Logger: l}
+	body := []byte(`[{"type":"coep","url":"about:blank","body":{"type":"corp","disposition":"enforce"}}]`)
+	req := httptest.NewRequest("POST", "/reporting-api/cross-origin", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestCrossOriginHandlerMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &CrossOriginReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api/cross-origin", bytes.NewBuffer(crossOriginBatch))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(m.CrossOriginReports.WithLabelValues("coop", "navigation-to-response", "report_only")); got != 1 {
+		t.Errorf("cross_origin_reports_total coop = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.CrossOriginReports.WithLabelValues("coep", "corp", "enforced")); got != 1 {
+		t.Errorf("cross_origin_reports_total coep = %v, want 1", got)
+	}
+}
+
+func TestCrossOriginTypeLabel(t *testing.T) {
+	cases := []struct {
+		policy, bodyType, want string
+	}{
+		{"coop", "access-from-coop-page-to-opener", "access-from-coop-page-to-opener"},
+		{"coep", "worker initialization", "worker initialization"},
+		{"coep", "navigation-to-response", "other"},
+		{"coop", "something-else", "other"},
+	}
+
+	for _, tc := range cases {
+		if got := crossOriginTypeLabel(tc.policy, tc.bodyType); got != tc.want {
+			t.Errorf("crossOriginTypeLabel(%q, %q) = %q, want %q", tc.policy, tc.bodyType, got, tc.want)
+		}
+	}
+}
@@ -1,14 +1,16 @@
 package handler
 
 import (
+	"bytes"
 	"encoding/json"
-	"fmt"
+	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
-	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -69,6 +71,7 @@ type CSPViolationReportHandler struct {
 
 	Logger  *log.Logger
 	Metrics *metrics.Metrics
+	Sink    sink.Sink
 }
 
 func (vrh *CSPViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -77,133 +80,126 @@ func (vrh *CSPViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var report CSPReport
-
-	err := decoder.Decode(&report)
+	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		if vrh.Metrics != nil {
-			vrh.Metrics.ReportErrors.WithLabelValues("csp", "decode_error").Inc()
+			vrh.Metrics.ReportErrors.WithLabelValues("csp", "read_error").Inc()
 		}
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		vrh.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		vrh.Logger.Debugf("unable to read payload: %s", err)
 		return
 	}
 
 	defer r.Body.Close()
 
-	for _, value := range vrh.BlockedURIs {
-		if strings.HasPrefix(report.Body.BlockedURI, value) {
-			if vrh.Metrics != nil {
-				vrh.Metrics.ReportFiltered.WithLabelValues("csp", "blocked_uri").Inc()
-			}
-			http.Error(w, fmt.Sprintf("blocked URI ('%s') is an invalid resource", value), http.StatusBadRequest)
-			vrh.Logger.Debugf("received invalid payload: blocked URI ('%s') is an invalid resource", value)
-			return
-		}
+	// Allow the same URL to be used for both `report-uri` and `report-to`.
+	if isReportAPIPayload(requestMediaType(r), body) {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		vrh.reportAPIHandler().ServeHTTP(w, r)
+		return
 	}
 
-	if isBlockedByDomain(report.Body.BlockedURI, vrh.BlockedDomains) {
+	var report CSPReport
+	err = json.Unmarshal(body, &report)
+	if err != nil {
 		if vrh.Metrics != nil {
-			vrh.Metrics.ReportFiltered.WithLabelValues("csp", "blocked_domain").Inc()
+			vrh.Metrics.ReportErrors.WithLabelValues("csp", "decode_error").Inc()
 		}
-		http.Error(w, fmt.Sprintf("blocked URI ('%s') is an invalid resource", report.Body.BlockedURI), http.StatusBadRequest)
-		vrh.Logger.Debugf("received invalid payload: blocked URI ('%s') is an invalid resource", report.Body.BlockedURI)
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		vrh.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
 		return
 	}
 
-	reportValidation := vrh.validateViolation(report)
-	if reportValidation != nil {
-		if vrh.Metrics != nil {
-			vrh.Metrics.ReportErrors.WithLabelValues("csp", "validation_error").Inc()
-		}
-		http.Error(w, reportValidation.Error(), http.StatusBadRequest)
-		vrh.Logger.Debugf("received invalid payload: %s", reportValidation.Error())
+	v := report.Body.violation()
+	v.ReportOnly = v.ReportOnly || vrh.ReportOnly
+
+	p := vrh.pipeline()
+	if reason, err := p.filter(r.Context(), v); err != nil {
+		p.reject(reason)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		vrh.Logger.Debugf("received invalid payload: %s", err.Error())
 		return
 	}
 
-	var metadata interface{}
-	if vrh.MetadataObject {
-		metadataMap := make(map[string]string)
-		query := r.URL.Query()
+	p.accept(r, v, requestMetadata(r, vrh.MetadataObject))
+}
 
-		for k, v := range query {
-			metadataMap[k] = v[0]
-		}
+func (vrh *CSPViolationReportHandler) pipeline() *violationPipeline {
+	return &violationPipeline{
+		Handler:                     "csp",
+		TruncateQueryStringFragment: vrh.TruncateQueryStringFragment,
+		BlockedURIs:                 vrh.BlockedURIs,
+		BlockedDomains:              vrh.BlockedDomains,
 
-		metadata = metadataMap
-	} else {
-		metadatas, gotMetadata := r.URL.Query()["metadata"]
-		if gotMetadata {
-			metadata = metadatas[0]
-		}
-	}
+		LogClientIP:          vrh.LogClientIP,
+		LogTruncatedClientIP: vrh.LogTruncatedClientIP,
 
-	lf := log.Fields{
-		"report_only":         vrh.ReportOnly,
-		"document_uri":        report.Body.DocumentURI,
-		"referrer":            report.Body.Referrer,
-		"blocked_uri":         report.Body.BlockedURI,
-		"violated_directive":  report.Body.ViolatedDirective,
-		"effective_directive": report.Body.EffectiveDirective,
-		"original_policy":     report.Body.OriginalPolicy,
-		"disposition":         report.Body.Disposition,
-		"script_sample":       report.Body.ScriptSample,
-		"status_code":         report.Body.StatusCode,
-		"source_file":         report.Body.SourceFile,
-		"line_number":         report.Body.LineNumber,
-		"column_number":       report.Body.ColumnNumber,
-		"metadata":            metadata,
-		"path":                r.URL.Path,
+		Logger:  vrh.Logger,
+		Metrics: vrh.Metrics,
+		Sink:    vrh.Sink,
 	}
+}
 
-	if vrh.TruncateQueryStringFragment {
-		lf["document_uri"] = utils.TruncateQueryStringFragment(report.Body.DocumentURI)
-		lf["referrer"] = utils.TruncateQueryStringFragment(report.Body.Referrer)
-		lf["blocked_uri"] = utils.TruncateQueryStringFragment(report.Body.BlockedURI)
-		lf["source_file"] = utils.TruncateQueryStringFragment(report.Body.SourceFile)
-	}
+// reportAPIHandler returns a Reporting API handler sharing this handler's
+// configuration, used when a Reporting API batch arrives on a CSP endpoint.
+func (vrh *CSPViolationReportHandler) reportAPIHandler() *ReportAPIViolationReportHandler {
+	return &ReportAPIViolationReportHandler{
+		TruncateQueryStringFragment: vrh.TruncateQueryStringFragment,
+		BlockedURIs:                 vrh.BlockedURIs,
+		BlockedDomains:              vrh.BlockedDomains,
 
-	if vrh.LogClientIP {
-		ip, err := utils.GetClientIP(r)
-		if err != nil {
-			vrh.Logger.Warnf("unable to parse client ip: %s", err)
-		}
-		lf["client_ip"] = ip.String()
-	}
+		LogClientIP:          vrh.LogClientIP,
+		LogTruncatedClientIP: vrh.LogTruncatedClientIP,
+		MetadataObject:       vrh.MetadataObject,
 
-	if vrh.LogTruncatedClientIP {
-		ip, err := utils.GetClientIP(r)
-		if err != nil {
-			vrh.Logger.Warnf("unable to parse client ip: %s", err)
-		}
-		lf["client_ip"] = utils.TruncateClientIP(ip)
+		Logger:  vrh.Logger,
+		Metrics: vrh.Metrics,
+		Sink:    vrh.Sink,
 	}
+}
 
-	vrh.Logger.WithFields(lf).Info()
-	if vrh.Metrics != nil {
-		mode := "enforced"
-		if vrh.ReportOnly {
-			mode = "report_only"
-		}
-		vrh.Metrics.Reports.WithLabelValues("csp", mode).Inc()
+// violation adapts a legacy `report-uri` body. Browsers send either or both
+// of the violated and effective directive, so each falls back to the other.
+// The disposition is only present in newer browsers; the handler also marks
+// reports received on a report-only endpoint.
+func (b CSPReportBody) violation() Violation {
+	violatedDirective := b.ViolatedDirective
+	if violatedDirective == "" {
+		violatedDirective = b.EffectiveDirective
+	}
+	effectiveDirective := b.EffectiveDirective
+	if effectiveDirective == "" {
+		effectiveDirective = b.ViolatedDirective
+	}
+
+	var statusCode int
+	switch v := b.StatusCode.(type) {
+	case float64:
+		statusCode = int(v)
+	case string:
+		statusCode, _ = strconv.Atoi(v)
+	}
+
+	return Violation{
+		Source:             SourceReportURI,
+		Type:               "csp-violation",
+		ReportOnly:         b.Disposition == "report",
+		URL:                b.DocumentURI,
+		Referrer:           b.Referrer,
+		StatusCode:         statusCode,
+		BlockedURL:         b.BlockedURI,
+		ViolatedDirective:  violatedDirective,
+		EffectiveDirective: effectiveDirective,
+		OriginalPolicy:     b.OriginalPolicy,
+		Disposition:        b.Disposition,
+		Sample:             b.ScriptSample,
+		SourceFile:         b.SourceFile,
+		LineNumber:         int(b.LineNumber),
+		ColumnNumber:       int(b.ColumnNumber),
 	}
 }
 
 func (vrh *CSPViolationReportHandler) validateViolation(r CSPReport) error {
-	for _, value := range vrh.BlockedURIs {
-		if strings.HasPrefix(r.Body.BlockedURI, value) {
-			return fmt.Errorf("blocked URI ('%s') is an invalid resource", value)
-		}
-	}
-
-	if isBlockedByDomain(r.Body.BlockedURI, vrh.BlockedDomains) {
-		return fmt.Errorf("blocked URI ('%s') is an invalid resource", r.Body.BlockedURI)
-	}
-
-	if !strings.HasPrefix(r.Body.DocumentURI, "http") {
-		return fmt.Errorf("document URI ('%s') is invalid", r.Body.DocumentURI)
-	}
-
-	return nil
+	_, err := vrh.pipeline().check(r.Body.violation())
+	return err
 }
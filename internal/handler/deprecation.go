@@ -0,0 +1,169 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// DeprecationReport is the structure of a single deprecation report as
+// delivered by the Reporting API
+// (https://wicg.github.io/deprecation-reporting/).
+type DeprecationReport struct {
+	Age       int                   `json:"age"`
+	Body      DeprecationReportBody `json:"body"`
+	Type      string                `json:"type"`
+	URL       string                `json:"url"`
+	UserAgent string                `json:"user_agent"`
+}
+
+// DeprecationReportBody contains the fields nested within each deprecation
+// report.
+type DeprecationReportBody struct {
+	ID                 string `json:"id"`
+	AnticipatedRemoval string `json:"anticipatedRemoval,omitempty"`
+	Message            string `json:"message"`
+	SourceFile         string `json:"sourceFile,omitempty"`
+	LineNumber         int    `json:"lineNumber,omitempty"`
+	ColumnNumber       int    `json:"columnNumber,omitempty"`
+}
+
+// DeprecationReportHandler handles incoming deprecation reports.
+type DeprecationReportHandler struct {
+	TruncateQueryStringFragment bool
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *DeprecationReportHandler) batch() *reportBatch[DeprecationReport] {
+	return &reportBatch[DeprecationReport]{
+		name:           "deprecation",
+		metadataObject: h.MetadataObject,
+		logger:         h.Logger,
+		metrics:        h.Metrics,
+		logReport:      h.logReport,
+	}
+}
+
+func (h *DeprecationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.batch().ServeHTTP(w, r)
+}
+
+// ProcessReport handles a single deprecation report dispatched from the
+// generic Reporting API endpoint.
+func (h *DeprecationReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	report := DeprecationReport{
+		Age:       envelope.Age,
+		Type:      envelope.Type,
+		URL:       envelope.URL,
+		UserAgent: envelope.UserAgent,
+	}
+	return h.batch().process(r, &report, &report.Body, envelope.Body)
+}
+
+func (h *DeprecationReportHandler) logReport(r *http.Request, report DeprecationReport, metadata interface{}) {
+	url := report.URL
+	sourceFile := report.Body.SourceFile
+	if h.TruncateQueryStringFragment {
+		url = utils.TruncateQueryStringFragment(url)
+		sourceFile = utils.TruncateQueryStringFragment(sourceFile)
+	}
+
+	lf := log.Fields{
+		"report_type":         "deprecation",
+		"url":                 url,
+		"id":                  report.Body.ID,
+		"message":             report.Body.Message,
+		"anticipated_removal": report.Body.AnticipatedRemoval,
+		"source_file":         sourceFile,
+		"line_number":         report.Body.LineNumber,
+		"column_number":       report.Body.ColumnNumber,
+		"metadata":            metadata,
+		"path":                r.URL.Path,
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "deprecation",
+		Type:       report.Type,
+		ReportOnly: false,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.DeprecationReports.WithLabelValues(deprecationIDLabel(report.Body.ID)).Inc()
+	}
+}
+
+// knownDeprecationIDs are the deprecation IDs browsers are known to send
+// that get their own metric label value.
+var knownDeprecationIDs = map[string]bool{
+	"AuthorizationCoveredByWildcard":                 true,
+	"CanRequestURLHTTPContainingNewline":             true,
+	"CookieWithTruncatingChar":                       true,
+	"CrossOriginAccessBasedOnDocumentDomain":         true,
+	"DocumentDomainSettingWithoutOriginAgentCluster": true,
+	"EventPath":                                               true,
+	"ExpectCTHeader":                                          true,
+	"GeolocationInsecureOrigin":                               true,
+	"GetUserMediaInsecureOrigin":                              true,
+	"HostCandidateAttributeGetter":                            true,
+	"InsecurePrivateNetworkSubresourceRequest":                true,
+	"MediaSourceAbortRemove":                                  true,
+	"NavigatorVibrate":                                        true,
+	"NoSysexWebMIDIWithoutPermission":                         true,
+	"NotificationInsecureOrigin":                              true,
+	"NotificationPermissionRequestedIframe":                   true,
+	"ObsoleteWebRtcCipherSuite":                               true,
+	"PaymentInstruments":                                      true,
+	"PersistentQuotaType":                                     true,
+	"PictureSourceSrc":                                        true,
+	"PrefixedCancelAnimationFrame":                            true,
+	"PrefixedRequestAnimationFrame":                           true,
+	"PrefixedStorageInfo":                                     true,
+	"PrefixedVideoEnterFullscreen":                            true,
+	"PrefixedVideoExitFullscreen":                             true,
+	"RangeExpand":                                             true,
+	"RequestedSubresourceWithEmbeddedCredentials":             true,
+	"RTCPeerConnectionGetStatsLegacyNonCompliant":             true,
+	"SharedArrayBufferConstructedWithoutIsolation":            true,
+	"ThirdPartyCookieAccessWarning":                           true,
+	"UnloadHandler":                                           true,
+	"WebSQL":                                                  true,
+	"XHRJSONEncodingDetection":                                true,
+	"XMLHttpRequestSynchronousInNonWorkerOutsideBeforeUnload": true,
+}
+
+// deprecationIDLabel maps the browser supplied deprecation ID onto a fixed
+// set of metric label values so that arbitrary payloads can't blow up
+// cardinality. The full ID is still logged.
+func deprecationIDLabel(id string) string {
+	if knownDeprecationIDs[id] {
+		return id
+	}
+	return "other"
+}
+
+func (h *DeprecationReportHandler) validateReports(reports []DeprecationReport) error {
+	return h.batch().validate(reports)
+}
+
+func (r DeprecationReport) reportType() string { return r.Type }
+func (r DeprecationReport) reportURL() string  { return r.URL }
+
+func (r DeprecationReport) validateBody() error {
+	if r.Body.ID == "" {
+		return fmt.Errorf("deprecation report for '%s' is missing an id", r.URL)
+	}
+	return nil
+}
@@ -0,0 +1,161 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func sampleDeprecationReport(url string) []DeprecationReport {
+	return []DeprecationReport{
+		{
+			Age:       10,
+			Type:      "deprecation",
+			URL:       url,
+			UserAgent: "Mozilla/5.0",
+			Body: DeprecationReportBody{
+				ID:                 "NavigatorVibrate",
+				AnticipatedRemoval: "2026-12-01",
+				Message:            "navigator.vibrate() is deprecated and will be removed.",
+				SourceFile:         "https://example.com/app.js?v=123",
+				LineNumber:         12,
+				ColumnNumber:       34,
+			},
+		},
+	}
+}
+
+func TestDeprecationValidateReportsInvalidURL(t *testing.T) {
+	h := &DeprecationReportHandler{}
+	err := h.validateReports(sampleDeprecationReport("about:blank"))
+	if err == nil {
+		t.Fatal("expected error but got nil")
+	}
+	if !strings.Contains(err.Error(), "url ('about:blank') is invalid") {
+		t.Errorf("unexpected error message: %s", err)
+	}
+}
+
+func TestDeprecationValidateReportsMissingID(t *testing.T) {
+	h := &DeprecationReportHandler{}
+	reports := sampleDeprecationReport("https://example.com/")
+	reports[0].Body.ID = ""
+	if err := h.validateReports(reports); err == nil {
+		t.Fatal("expected error for missing id but got nil")
+	}
+}
+
+func TestDeprecationHandlerLogsExpectedFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &DeprecationReportHandler{Logger: l, TruncateQueryStringFragment: true}
+	payload, _ := json.Marshal(sampleDeprecationReport("https://example.com/page?secret=1"))
+	req := httptest.NewRequest("POST", "/reporting-api/deprecation?metadata=abc", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"report_type=deprecation", "id=NavigatorVibrate", "anticipated_removal=2026-12-01", "line_number=12", "column_number=34", "metadata=abc"} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+	if strings.Contains(out, "secret=1") || strings.Contains(out, "v=123") {
+		t.Errorf("expected query strings to be truncated, got: %s", out)
+	}
+}
+
+func TestDeprecationHandlerClientIP(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &DeprecationReportHandler{Logger: l, LogTruncatedClientIP: true}
+	payload, _ := json.Marshal(sampleDeprecationReport("https://example.com/"))
+	req := httptest.NewRequest("POST", "/reporting-api/deprecation", bytes.NewBuffer(payload))
+	req.RemoteAddr = "192.0.2.55:1234"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if !strings.Contains(logBuf.String(), "client_ip=192.0.2.0/24") {
+		t.Errorf("expected truncated client ip in log output, got: %s", logBuf.String())
+	}
+}
+
+func TestDeprecationHandlerMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &DeprecationReportHandler{Logger: l, Metrics: m}
+	reports := append(sampleDeprecationReport("https://example.com/"), DeprecationReport{Type: "csp-violation"})
+	payload, _ := json.Marshal(reports)
+	req := httptest.NewRequest("POST", "/reporting-api/deprecation", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.DeprecationReports.WithLabelValues("NavigatorVibrate")); got != 1 {
+		t.Fatalf("deprecation_reports_total = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.ReportIgnored.WithLabelValues("deprecation", "unsupported_type")); got != 1 {
+		t.Fatalf("reports_ignored_total = %v, want 1", got)
+	}
+}
+
+func TestDeprecationProcessReport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &DeprecationReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api", nil)
+	err := h.ProcessReport(req, ReportAPIEnvelope{
+		Type: "deprecation",
+		URL:  "https://example.com/",
+		Body: json.RawMessage(`{"id":"PrefixedStorageInfo","message":"window.webkitStorageInfo is deprecated."}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := testutil.ToFloat64(m.DeprecationReports.WithLabelValues("PrefixedStorageInfo")); got != 1 {
+		t.Fatalf("deprecation_reports_total = %v, want 1", got)
+	}
+}
+
+func TestDeprecationMetricsBucketUnknownIDs(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &DeprecationReportHandler{Logger: l, Metrics: m}
+	reports := sampleDeprecationReport("https://example.com/")
+	reports[0].Body.ID = "RandomID12345"
+	payload, _ := json.Marshal(reports)
+	req := httptest.NewRequest("POST", "/reporting-api/deprecation", bytes.NewBuffer(payload))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(m.DeprecationReports.WithLabelValues("other")); got != 1 {
+		t.Errorf("deprecation_reports_total{id=other} = %v, want 1", got)
+	}
+	if got := testutil.CollectAndCount(m.DeprecationReports); got != 1 {
+		t.Errorf("expected a single series, got %d", got)
+	}
+}
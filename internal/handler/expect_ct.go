@@ -0,0 +1,120 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// ExpectCTReport is the structure of the HTTP payload sent for an Expect-CT
+// failure (https://www.rfc-editor.org/rfc/rfc9163#section-3.1).
+type ExpectCTReport struct {
+	Body ExpectCTReportBody `json:"expect-ct-report"`
+}
+
+// ExpectCTReportBody contains the fields nested within the Expect-CT report.
+type ExpectCTReportBody struct {
+	DateTime                  string        `json:"date-time"`
+	Hostname                  string        `json:"hostname"`
+	Port                      int           `json:"port"`
+	Scheme                    string        `json:"scheme,omitempty"`
+	EffectiveExpirationDate   string        `json:"effective-expiration-date"`
+	ServedCertificateChain    []string      `json:"served-certificate-chain"`
+	ValidatedCertificateChain []string      `json:"validated-certificate-chain"`
+	SCTs                      []ExpectCTSCT `json:"scts"`
+	TestReport                bool          `json:"test-report,omitempty"`
+}
+
+// ExpectCTSCT describes a single Signed Certificate Timestamp received for
+// the connection.
+type ExpectCTSCT struct {
+	Version       int    `json:"version"`
+	Status        string `json:"status"`
+	Source        string `json:"source"`
+	SerializedSCT string `json:"serialized_sct"`
+}
+
+// ExpectCTReportHandler handles incoming Expect-CT reports.
+type ExpectCTReportHandler struct {
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *ExpectCTReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var report ExpectCTReport
+
+	err := decoder.Decode(&report)
+	if err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("expect_ct", "decode_error").Inc()
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		h.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if err := h.validateReport(report); err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("expect_ct", "validation_error").Inc()
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.Logger.Debugf("received invalid payload: %s", err.Error())
+		return
+	}
+
+	scts := make([]string, 0, len(report.Body.SCTs))
+	for _, sct := range report.Body.SCTs {
+		scts = append(scts, fmt.Sprintf("%s:%s", sct.Source, sct.Status))
+	}
+
+	lf := log.Fields{
+		"report_type":                 "expect-ct",
+		"date_time":                   report.Body.DateTime,
+		"hostname":                    report.Body.Hostname,
+		"port":                        report.Body.Port,
+		"scheme":                      report.Body.Scheme,
+		"effective_expiration_date":   report.Body.EffectiveExpirationDate,
+		"served_certificate_chain":    summariseCertificateChain(report.Body.ServedCertificateChain),
+		"validated_certificate_chain": summariseCertificateChain(report.Body.ValidatedCertificateChain),
+		"scts":                        scts,
+		"test_report":                 report.Body.TestReport,
+		"metadata":                    requestMetadata(r, h.MetadataObject),
+		"path":                        r.URL.Path,
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "expect_ct",
+		Type:       "expect-ct",
+		ReportOnly: false,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.LegacyReports.WithLabelValues("expect_ct").Inc()
+	}
+}
+
+func (h *ExpectCTReportHandler) validateReport(report ExpectCTReport) error {
+	if report.Body.Hostname == "" {
+		return fmt.Errorf("hostname is missing")
+	}
+	return nil
+}
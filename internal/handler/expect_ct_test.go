@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// testCertificatePEM returns a freshly generated self-signed certificate for
+// commonName in PEM form.
+func testCertificatePEM(t *testing.T, commonName string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		NotAfter:     time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+func TestSummariseCertificateChain(t *testing.T) {
+	certPEM := testCertificatePEM(t, "www.example.com")
+
+	summaries := summariseCertificateChain([]string{certPEM, "not a certificate"})
+	if len(summaries) != 2 {
+		t.Fatalf("expected 2 summaries, got %d", len(summaries))
+	}
+	if !strings.Contains(summaries[0], `subject="www.example.com"`) || !strings.Contains(summaries[0], "not_after=2030-01-01T00:00:00Z") {
+		t.Errorf("unexpected certificate summary: %s", summaries[0])
+	}
+	if strings.Contains(summaries[0], "BEGIN CERTIFICATE") {
+		t.Errorf("summary should not contain the PEM body: %s", summaries[0])
+	}
+	if summaries[1] != "unparseable certificate" {
+		t.Errorf("expected unparseable marker, got: %s", summaries[1])
+	}
+}
+
+func TestExpectCTHandlerLogsSummarisedChain(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	certPEM := testCertificatePEM(t, "www.example.com")
+	report := ExpectCTReport{Body: ExpectCTReportBody{
+		DateTime:                  "2024-04-06T13:00:50Z",
+		Hostname:                  "www.example.com",
+		Port:                      443,
+		Scheme:                    "https",
+		EffectiveExpirationDate:   "2024-05-01T12:40:50Z",
+		ServedCertificateChain:    []string{certPEM},
+		ValidatedCertificateChain: []string{certPEM},
+		SCTs:                      []ExpectCTSCT{{Version: 1, Status: "invalid", Source: "embedded"}},
+	}}
+	payload, _ := json.Marshal(report)
+
+	h := &ExpectCTReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/expect-ct", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"report_type=expect-ct", "hostname=www.example.com", "port=443", "embedded:invalid", "sha256="} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+	if strings.Contains(out, "BEGIN CERTIFICATE") {
+		t.Errorf("expected PEM bodies to be summarised, got: %s", out)
+	}
+	if got := testutil.ToFloat64(m.LegacyReports.WithLabelValues("expect_ct")); got != 1 {
+		t.Fatalf("legacy_reports_total expect_ct = %v, want 1", got)
+	}
+}
+
+func TestExpectCTHandlerMissingHostname(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &ExpectCTReportHandler{Logger: l}
+	req := httptest.NewRequest("POST", "/expect-ct", strings.NewReader(`{"expect-ct-report":{"port":443}}`))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
@@ -2,8 +2,29 @@ package handler
 
 import (
 	"net/http"
+	"sync/atomic"
 )
 
 func HealthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusOK)
 }
+
+// Healthcheck answers health checks until Fail is called, after which it
+// answers with 503 so that load balancers stop sending reports to a
+// collector that is shutting down.
+type Healthcheck struct {
+	failing atomic.Bool
+}
+
+// Fail makes every following health check fail.
+func (h *Healthcheck) Fail() {
+	h.failing.Store(true)
+}
+
+func (h *Healthcheck) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.failing.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	HealthcheckHandler(w, r)
+}
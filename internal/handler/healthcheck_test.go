@@ -0,0 +1,24 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthcheckFailsOnceShuttingDown(t *testing.T) {
+	h := &Healthcheck{}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_healthcheck", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("expected a healthy collector to answer 200, got %d", rec.Code)
+	}
+
+	h.Fail()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/_healthcheck", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected a collector shutting down to answer 503, got %d", rec.Code)
+	}
+}
@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	log "github.com/sirupsen/logrus"
+)
+
+// HPKPReport is the structure of the HTTP payload sent for a Public Key
+// Pinning validation failure (https://www.rfc-editor.org/rfc/rfc7469#section-3).
+type HPKPReport struct {
+	DateTime                  string   `json:"date-time"`
+	Hostname                  string   `json:"hostname"`
+	Port                      int      `json:"port"`
+	EffectiveExpirationDate   string   `json:"effective-expiration-date"`
+	IncludeSubdomains         bool     `json:"include-subdomains"`
+	NotedHostname             string   `json:"noted-hostname"`
+	ServedCertificateChain    []string `json:"served-certificate-chain"`
+	ValidatedCertificateChain []string `json:"validated-certificate-chain"`
+	KnownPins                 []string `json:"known-pins"`
+}
+
+// HPKPReportHandler handles incoming HPKP reports.
+type HPKPReportHandler struct {
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *HPKPReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var report HPKPReport
+
+	err := decoder.Decode(&report)
+	if err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("hpkp", "decode_error").Inc()
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		h.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if err := h.validateReport(report); err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("hpkp", "validation_error").Inc()
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		h.Logger.Debugf("received invalid payload: %s", err.Error())
+		return
+	}
+
+	lf := log.Fields{
+		"report_type":                 "hpkp",
+		"date_time":                   report.DateTime,
+		"hostname":                    report.Hostname,
+		"port":                        report.Port,
+		"effective_expiration_date":   report.EffectiveExpirationDate,
+		"include_subdomains":          report.IncludeSubdomains,
+		"noted_hostname":              report.NotedHostname,
+		"served_certificate_chain":    summariseCertificateChain(report.ServedCertificateChain),
+		"validated_certificate_chain": summariseCertificateChain(report.ValidatedCertificateChain),
+		"known_pins":                  report.KnownPins,
+		"metadata":                    requestMetadata(r, h.MetadataObject),
+		"path":                        r.URL.Path,
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "hpkp",
+		Type:       "hpkp",
+		ReportOnly: false,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.LegacyReports.WithLabelValues("hpkp").Inc()
+	}
+}
+
+func (h *HPKPReportHandler) validateReport(report HPKPReport) error {
+	if report.Hostname == "" {
+		return fmt.Errorf("hostname is missing")
+	}
+	return nil
+}
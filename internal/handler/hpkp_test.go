@@ -0,0 +1,73 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func TestHPKPHandlerLogsSummarisedChain(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	certPEM := testCertificatePEM(t, "legacy.example.com")
+	report := HPKPReport{
+		DateTime:                  "2024-04-06T13:00:50Z",
+		Hostname:                  "legacy.example.com",
+		Port:                      443,
+		EffectiveExpirationDate:   "2024-05-01T12:40:50Z",
+		IncludeSubdomains:         true,
+		NotedHostname:             "example.com",
+		ServedCertificateChain:    []string{certPEM},
+		ValidatedCertificateChain: []string{certPEM},
+		KnownPins:                 []string{`pin-sha256="d6qzRu9zOECb90Uez27xWltNsj0e1Md7GkYYkVoZWmM="`},
+	}
+	payload, _ := json.Marshal(report)
+
+	h := &HPKPReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/hpkp", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"report_type=hpkp", "hostname=legacy.example.com", "noted_hostname=example.com", "include_subdomains=true", "pin-sha256"} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+	if strings.Contains(out, "BEGIN CERTIFICATE") {
+		t.Errorf("expected PEM bodies to be summarised, got: %s", out)
+	}
+	if got := testutil.ToFloat64(m.LegacyReports.WithLabelValues("hpkp")); got != 1 {
+		t.Fatalf("legacy_reports_total hpkp = %v, want 1", got)
+	}
+}
+
+func TestHPKPHandlerInvalidJSON(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &HPKPReportHandler{Logger: l}
+	req := httptest.NewRequest("POST", "/hpkp", strings.NewReader("not json"))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rr.Code)
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// InterventionReport is the structure of a single intervention report as
+// delivered by the Reporting API
+// (https://wicg.github.io/intervention-reporting/). Interventions are sent
+// when the browser refuses to do something the page asked for, such as
+// blocking a heavy ad or a parser-blocking document.write.
+type InterventionReport struct {
+	Age       int                    `json:"age"`
+	Body      InterventionReportBody `json:"body"`
+	Type      string                 `json:"type"`
+	URL       string                 `json:"url"`
+	UserAgent string                 `json:"user_agent"`
+}
+
+// InterventionReportBody contains the fields nested within each intervention
+// report.
+type InterventionReportBody struct {
+	ID           string `json:"id"`
+	Message      string `json:"message"`
+	SourceFile   string `json:"sourceFile,omitempty"`
+	LineNumber   int    `json:"lineNumber,omitempty"`
+	ColumnNumber int    `json:"columnNumber,omitempty"`
+}
+
+// InterventionReportHandler handles incoming intervention reports.
+type InterventionReportHandler struct {
+	TruncateQueryStringFragment bool
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func (h *InterventionReportHandler) batch() *reportBatch[InterventionReport] {
+	return &reportBatch[InterventionReport]{
+		name:           "intervention",
+		metadataObject: h.MetadataObject,
+		logger:         h.Logger,
+		metrics:        h.Metrics,
+		logReport:      h.logReport,
+	}
+}
+
+func (h *InterventionReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.batch().ServeHTTP(w, r)
+}
+
+// ProcessReport handles a single intervention report dispatched from the
+// generic Reporting API endpoint.
+func (h *InterventionReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	report := InterventionReport{
+		Age:       envelope.Age,
+		Type:      envelope.Type,
+		URL:       envelope.URL,
+		UserAgent: envelope.UserAgent,
+	}
+	return h.batch().process(r, &report, &report.Body, envelope.Body)
+}
+
+func (h *InterventionReportHandler) logReport(r *http.Request, report InterventionReport, metadata interface{}) {
+	url := report.URL
+	sourceFile := report.Body.SourceFile
+	if h.TruncateQueryStringFragment {
+		url = utils.TruncateQueryStringFragment(url)
+		sourceFile = utils.TruncateQueryStringFragment(sourceFile)
+	}
+
+	lf := log.Fields{
+		"report_type":   "intervention",
+		"url":           url,
+		"id":            report.Body.ID,
+		"message":       report.Body.Message,
+		"source_file":   sourceFile,
+		"line_number":   report.Body.LineNumber,
+		"column_number": report.Body.ColumnNumber,
+		"metadata":      metadata,
+		"path":          r.URL.Path,
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "intervention",
+		Type:       report.Type,
+		ReportOnly: false,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.InterventionReports.WithLabelValues(interventionIDLabel(report.Body.ID)).Inc()
+	}
+}
+
+// interventionIDLabel maps the browser supplied intervention ID onto a fixed
+// set of metric label values so that arbitrary payloads can't blow up
+// cardinality. The full ID is still logged.
+func interventionIDLabel(id string) string {
+	switch id {
+	case "HeavyAdIntervention", "NavigatorVibrate", "audio-no-gesture":
+		return id
+	default:
+		return "other"
+	}
+}
+
+func (r InterventionReport) reportType() string { return r.Type }
+func (r InterventionReport) reportURL() string  { return r.URL }
+
+func (r InterventionReport) validateBody() error {
+	if r.Body.ID == "" {
+		return fmt.Errorf("intervention report for '%s' is missing an id", r.URL)
+	}
+	return nil
+}
@@ -0,0 +1,106 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func sampleInterventionReport(url string) []InterventionReport {
+	return []InterventionReport{
+		{
+			Age:  10,
+			Type: "intervention",
+			URL:  url,
+			Body: InterventionReportBody{
+				ID:           "HeavyAdIntervention",
+				Message:      "Ad was removed because its network usage exceeded the limit.",
+				SourceFile:   "https://ads.example.net/frame.js",
+				LineNumber:   1,
+				ColumnNumber: 2,
+			},
+		},
+	}
+}
+
+func TestInterventionHandlerLogsExpectedFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &InterventionReportHandler{Logger: l}
+	payload, _ := json.Marshal(sampleInterventionReport("https://example.com/"))
+	req := httptest.NewRequest("POST", "/reporting-api/intervention", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"report_type=intervention", "id=HeavyAdIntervention", "source_file=\"https://ads.example.net/frame.js\"", "line_number=1"} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+}
+
+func TestInterventionHandlerInvalidURLReturns400(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &InterventionReportHandler{Logger: l}
+	payload, _ := json.Marshal(sampleInterventionReport("about:blank"))
+	req := httptest.NewRequest("POST", "/reporting-api/intervention", bytes.NewBuffer(payload))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", rr.Code)
+	}
+}
+
+func TestInterventionHandlerMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &InterventionReportHandler{Logger: l, Metrics: m}
+	payload, _ := json.Marshal(sampleInterventionReport("https://example.com/"))
+	req := httptest.NewRequest("POST", "/reporting-api/intervention", bytes.NewBuffer(payload))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(m.InterventionReports.WithLabelValues("HeavyAdIntervention")); got != 1 {
+		t.Fatalf("intervention_reports_total = %v, want 1", got)
+	}
+}
+
+func TestInterventionMetricsBucketUnknownIDs(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &InterventionReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api", nil)
+	err := h.ProcessReport(req, ReportAPIEnvelope{
+		Type: "intervention",
+		URL:  "https://example.com/",
+		Body: json.RawMessage(`{"id":"made-up-by-a-client","message":"..."}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := testutil.ToFloat64(m.InterventionReports.WithLabelValues("other")); got != 1 {
+		t.Errorf("intervention_reports_total{id=other} = %v, want 1", got)
+	}
+}
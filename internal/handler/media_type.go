@@ -0,0 +1,109 @@
+package handler
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// MediaTypeCSPReport is sent by browsers delivering reports via the
+	// legacy CSP `report-uri` directive.
+	MediaTypeCSPReport = "application/csp-report"
+
+	// MediaTypeReportsJSON is sent by browsers delivering a batch of reports
+	// via the Reporting API.
+	MediaTypeReportsJSON = "application/reports+json"
+
+	// MediaTypeExpectCTReport is sent by browsers delivering Expect-CT
+	// reports.
+	MediaTypeExpectCTReport = "application/expect-ct-report+json"
+
+	// MediaTypeJSON is accepted by every endpoint for clients that don't send
+	// a more specific media type.
+	MediaTypeJSON = "application/json"
+)
+
+var (
+	// CSPMediaTypes are accepted by the CSP endpoints which understand both
+	// the legacy and Reporting API payload shapes.
+	CSPMediaTypes = []string{MediaTypeCSPReport, MediaTypeReportsJSON, MediaTypeJSON}
+
+	// ReportAPIMediaTypes are accepted by the endpoints receiving Reporting
+	// API batches.
+	ReportAPIMediaTypes = []string{MediaTypeReportsJSON, MediaTypeJSON}
+
+	// ExpectCTMediaTypes are accepted by the Expect-CT endpoint.
+	ExpectCTMediaTypes = []string{MediaTypeExpectCTReport, MediaTypeJSON}
+
+	// HPKPMediaTypes are accepted by the HPKP endpoint.
+	HPKPMediaTypes = []string{MediaTypeJSON}
+)
+
+// MediaTypeHandler rejects requests with an unexpected `Content-Type` before
+// handing them to Handler. Unless Strict is set every request is passed
+// through so that misbehaving clients are still collected.
+type MediaTypeHandler struct {
+	Handler     http.Handler
+	HandlerName string
+	MediaTypes  []string
+	Strict      bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+}
+
+func (h *MediaTypeHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if h.Strict && r.Method == http.MethodPost {
+		mediaType := requestMediaType(r)
+		if !containsMediaType(h.MediaTypes, mediaType) {
+			if h.Metrics != nil {
+				h.Metrics.ReportErrors.WithLabelValues(h.HandlerName, "unsupported_media_type").Inc()
+			}
+			w.Header().Set("Accept-Post", strings.Join(h.MediaTypes, ", "))
+			http.Error(w, "unsupported media type", http.StatusUnsupportedMediaType)
+			h.Logger.Debugf("received payload with unsupported media type: '%s'", r.Header.Get("Content-Type"))
+			return
+		}
+	}
+
+	h.Handler.ServeHTTP(w, r)
+}
+
+// requestMediaType returns the lower cased media type of the request without
+// any parameters, or an empty string when it is missing or unparseable.
+func requestMediaType(r *http.Request) string {
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return ""
+	}
+	return mediaType
+}
+
+func containsMediaType(mediaTypes []string, mediaType string) bool {
+	for _, t := range mediaTypes {
+		if t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// isReportAPIPayload reports whether a payload is a Reporting API batch
+// rather than a legacy `report-uri` object. An explicit media type wins;
+// otherwise the shape of the JSON document decides.
+func isReportAPIPayload(mediaType string, body []byte) bool {
+	switch mediaType {
+	case MediaTypeReportsJSON:
+		return true
+	case MediaTypeCSPReport:
+		return false
+	}
+
+	trimmed := bytes.TrimLeft(body, " \t\r\n")
+	return len(trimmed) > 0 && trimmed[0] == '['
+}
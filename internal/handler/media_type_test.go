@@ -0,0 +1,183 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	legacyCSPPayload    = `{"csp-report":{"document-uri":"https://example.com","blocked-uri":"https://cdn.example.com/app.js","violated-directive":"script-src","script-sample":"alert(1)"}}`
+	reportAPICSPPayload = `[{"type":"csp-violation","url":"https://example.com","body":{"blockedURL":"https://cdn.example.com/app.js","documentURL":"https://example.com","effectiveDirective":"script-src-elem","disposition":"report"}}]`
+)
+
+func TestIsReportAPIPayload(t *testing.T) {
+	cases := []struct {
+		name      string
+		mediaType string
+		body      string
+		want      bool
+	}{
+		{"reports+json wins over shape", MediaTypeReportsJSON, `{}`, true},
+		{"csp-report wins over shape", MediaTypeCSPReport, `[]`, false},
+		{"json array", MediaTypeJSON, " \n[{}]", true},
+		{"json object", MediaTypeJSON, `{"csp-report":{}}`, false},
+		{"no media type array", "", `[]`, true},
+		{"empty body", "", ``, false},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := isReportAPIPayload(tc.mediaType, []byte(tc.body)); got != tc.want {
+				t.Errorf("isReportAPIPayload(%q, %q) = %v, want %v", tc.mediaType, tc.body, got, tc.want)
+			}
+		})
+	}
+}
+
+func TestMediaTypeHandlerStrict(t *testing.T) {
+	cases := []struct {
+		contentType string
+		wantCode    int
+	}{
+		{"application/csp-report", http.StatusOK},
+		{"application/reports+json; charset=utf-8", http.StatusOK},
+		{"Application/JSON", http.StatusOK},
+		{"text/plain", http.StatusUnsupportedMediaType},
+		{"", http.StatusUnsupportedMediaType},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.contentType, func(t *testing.T) {
+			registry := prometheus.NewRegistry()
+			m := metrics.New(registry)
+			l := logrus.New()
+			l.SetOutput(bytes.NewBuffer(nil))
+
+			h := &MediaTypeHandler{
+				Handler:     http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}),
+				HandlerName: "csp",
+				MediaTypes:  CSPMediaTypes,
+				Strict:      true,
+				Logger:      l,
+				Metrics:     m,
+			}
+
+			req := httptest.NewRequest("POST", "/csp", strings.NewReader("{}"))
+			if tc.contentType != "" {
+				req.Header.Set("Content-Type", tc.contentType)
+			}
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d", tc.wantCode, rr.Code)
+			}
+
+			wantErrors := 0.0
+			if tc.wantCode == http.StatusUnsupportedMediaType {
+				wantErrors = 1
+				if rr.Header().Get("Accept-Post") == "" {
+					t.Errorf("expected Accept-Post header on 415 response")
+				}
+			}
+			if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("csp", "unsupported_media_type")); got != wantErrors {
+				t.Errorf("reports_errors_total unsupported_media_type = %v, want %v", got, wantErrors)
+			}
+		})
+	}
+}
+
+func TestMediaTypeHandlerLenient(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &MediaTypeHandler{
+		Handler:     http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {}),
+		HandlerName: "csp",
+		MediaTypes:  CSPMediaTypes,
+		Logger:      l,
+	}
+
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader("{}"))
+	req.Header.Set("Content-Type", "text/plain")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200 when not strict, got %d", rr.Code)
+	}
+}
+
+func TestCSPHandlerAcceptsReportAPIBatch(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &CSPViolationReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/csp", strings.NewReader(reportAPICSPPayload))
+	req.Header.Set("Content-Type", MediaTypeReportsJSON)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if !strings.Contains(logBuf.String(), "effective_directive=script-src-elem") {
+		t.Errorf("expected Reporting API report to be logged, got: %s", logBuf.String())
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("reporting_api_csp", "report_only")); got != 1 {
+		t.Fatalf("reports_total report_only = %v, want 1", got)
+	}
+}
+
+func TestReportAPICSPHandlerAcceptsLegacyReport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &ReportAPIViolationReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api/csp", strings.NewReader(legacyCSPPayload))
+	req.Header.Set("Content-Type", MediaTypeCSPReport)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if !strings.Contains(logBuf.String(), "effective_directive=script-src") {
+		t.Errorf("expected legacy report to be logged, got: %s", logBuf.String())
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("reporting_api_csp", "enforced")); got != 1 {
+		t.Fatalf("reports_total enforced = %v, want 1", got)
+	}
+}
+
+func TestReportAPIHandlerAcceptsLegacyReport(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	req := httptest.NewRequest("POST", "/reporting-api", strings.NewReader(legacyCSPPayload))
+	rr := httptest.NewRecorder()
+	newReportAPIHandler(l, m).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("reporting_api_csp", "enforced")); got != 1 {
+		t.Fatalf("reports_total enforced = %v, want 1", got)
+	}
+}
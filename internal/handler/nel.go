@@ -4,10 +4,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/http"
-	"strings"
 
 	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
-	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -45,6 +44,7 @@ type NELViolationReportHandler struct {
 
 	Logger  *log.Logger
 	Metrics *metrics.Metrics
+	Sink    sink.Sink
 }
 
 func (h *NELViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -68,95 +68,106 @@ func (h *NELViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Req
 
 	defer r.Body.Close()
 
-	if err := h.validateReports(reports); err != nil {
-		if h.Metrics != nil {
-			h.Metrics.ReportErrors.WithLabelValues("nel", "validation_error").Inc()
-		}
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		h.Logger.Debugf("received invalid payload: %s", err.Error())
-		return
-	}
-
-	var metadata interface{}
-	if h.MetadataObject {
-		metadataMap := make(map[string]string)
-		for k, v := range r.URL.Query() {
-			metadataMap[k] = v[0]
-		}
-		metadata = metadataMap
-	} else {
-		if metadatas, ok := r.URL.Query()["metadata"]; ok {
-			metadata = metadatas[0]
-		}
-	}
-
+	p := h.pipeline()
+	violations := make([]Violation, 0, len(reports))
 	for _, report := range reports {
 		if report.Type != "network-error" {
-			if h.Metrics != nil {
-				h.Metrics.ReportIgnored.WithLabelValues("nel", "unsupported_type").Inc()
-			}
 			continue
 		}
 
-		url := report.URL
-		referrer := report.Body.Referrer
-		if h.TruncateQueryStringFragment {
-			url = utils.TruncateQueryStringFragment(url)
-			referrer = utils.TruncateQueryStringFragment(referrer)
-		}
-
-		lf := log.Fields{
-			"report_only":       h.ReportOnly,
-			"url":               url,
-			"referrer":          referrer,
-			"type":              report.Body.Type,
-			"phase":             report.Body.Phase,
-			"protocol":          report.Body.Protocol,
-			"method":            report.Body.Method,
-			"status_code":       report.Body.StatusCode,
-			"elapsed_time":      report.Body.ElapsedTime,
-			"server_ip":         report.Body.ServerIP,
-			"sampling_fraction": report.Body.SamplingFraction,
-			"metadata":          metadata,
-			"path":              r.URL.Path,
+		v := report.violation()
+		v.ReportOnly = h.ReportOnly
+		if reason, err := p.filter(r.Context(), v); err != nil {
+			p.reject(reason)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			h.Logger.Debugf("received invalid payload: %s", err.Error())
+			return
 		}
+		violations = append(violations, v)
+	}
 
-		if h.LogClientIP {
-			ip, err := utils.GetClientIP(r)
-			if err != nil {
-				h.Logger.Warnf("unable to parse client ip: %s", err)
-			} else {
-				lf["client_ip"] = ip.String()
-			}
-		}
+	if ignored := len(reports) - len(violations); ignored > 0 && h.Metrics != nil {
+		h.Metrics.ReportIgnored.WithLabelValues("nel", "unsupported_type").Add(float64(ignored))
+	}
 
-		if h.LogTruncatedClientIP {
-			ip, err := utils.GetClientIP(r)
-			if err != nil {
-				h.Logger.Warnf("unable to parse client ip: %s", err)
-			} else {
-				lf["client_ip"] = utils.TruncateClientIP(ip)
-			}
-		}
+	metadata := requestMetadata(r, h.MetadataObject)
+	for _, v := range violations {
+		p.accept(r, v, metadata)
+	}
+}
 
-		h.Logger.WithFields(lf).Info()
+// ProcessReport handles a single network-error report dispatched from the
+// generic Reporting API endpoint.
+func (h *NELViolationReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	report := NELReport{
+		Age:       envelope.Age,
+		Type:      envelope.Type,
+		URL:       envelope.URL,
+		UserAgent: envelope.UserAgent,
+	}
+	if err := json.Unmarshal(envelope.Body, &report.Body); err != nil {
 		if h.Metrics != nil {
-			mode := "enforced"
-			if h.ReportOnly {
-				mode = "report_only"
-			}
-			h.Metrics.NELReports.WithLabelValues(mode).Inc()
+			h.Metrics.ReportErrors.WithLabelValues("nel", "decode_error").Inc()
 		}
+		return fmt.Errorf("unable to decode network-error body: %w", err)
+	}
+
+	v := report.violation()
+	v.ReportOnly = h.ReportOnly
+
+	p := h.pipeline()
+	if reason, err := p.filter(r.Context(), v); err != nil {
+		p.reject(reason)
+		return err
+	}
+
+	p.accept(r, v, requestMetadata(r, h.MetadataObject))
+	return nil
+}
+
+func (h *NELViolationReportHandler) pipeline() *violationPipeline {
+	return &violationPipeline{
+		Handler:                     "nel",
+		TruncateQueryStringFragment: h.TruncateQueryStringFragment,
+
+		LogClientIP:          h.LogClientIP,
+		LogTruncatedClientIP: h.LogTruncatedClientIP,
+
+		Logger:  h.Logger,
+		Metrics: h.Metrics,
+		Sink:    h.Sink,
+	}
+}
+
+// violation adapts a NEL report. NEL policies have no report-only mode of
+// their own, so ReportOnly is left for the handler to set from its endpoint.
+func (report NELReport) violation() Violation {
+	return Violation{
+		Source:           SourceReportingAPI,
+		Type:             report.Type,
+		Age:              report.Age,
+		UserAgent:        report.UserAgent,
+		URL:              report.URL,
+		Referrer:         report.Body.Referrer,
+		StatusCode:       report.Body.StatusCode,
+		ErrorType:        report.Body.Type,
+		Phase:            report.Body.Phase,
+		Protocol:         report.Body.Protocol,
+		Method:           report.Body.Method,
+		ServerIP:         report.Body.ServerIP,
+		ElapsedTime:      report.Body.ElapsedTime,
+		SamplingFraction: report.Body.SamplingFraction,
 	}
 }
 
 func (h *NELViolationReportHandler) validateReports(reports []NELReport) error {
+	p := h.pipeline()
 	for _, report := range reports {
 		if report.Type != "network-error" {
 			continue
 		}
-		if !strings.HasPrefix(report.URL, "http") {
-			return fmt.Errorf("url ('%s') is invalid", report.URL)
+		if _, err := p.check(report.violation()); err != nil {
+			return err
 		}
 	}
 	return nil
@@ -0,0 +1,214 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// PolicyViolationReport is the structure of a single
+// `permissions-policy-violation` or `document-policy-violation` report as
+// delivered by the Reporting API
+// (https://w3c.github.io/webappsec-permissions-policy/#reporting,
+// https://wicg.github.io/document-policy/#reporting).
+type PolicyViolationReport struct {
+	Age       int                       `json:"age"`
+	Body      PolicyViolationReportBody `json:"body"`
+	Type      string                    `json:"type"`
+	URL       string                    `json:"url"`
+	UserAgent string                    `json:"user_agent"`
+}
+
+// PolicyViolationReportBody contains the fields nested within each policy
+// violation report. Both report types share the same body shape.
+type PolicyViolationReportBody struct {
+	FeatureID    string `json:"featureId"`
+	Disposition  string `json:"disposition"`
+	Message      string `json:"message,omitempty"`
+	SourceFile   string `json:"sourceFile,omitempty"`
+	LineNumber   int    `json:"lineNumber,omitempty"`
+	ColumnNumber int    `json:"columnNumber,omitempty"`
+}
+
+// PolicyViolationReportHandler handles incoming Permissions-Policy and
+// Document-Policy violation reports.
+type PolicyViolationReportHandler struct {
+	TruncateQueryStringFragment bool
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+	MetadataObject       bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+func isPolicyViolationType(t string) bool {
+	return t == "permissions-policy-violation" || t == "document-policy-violation"
+}
+
+func (h *PolicyViolationReportHandler) batch() *reportBatch[PolicyViolationReport] {
+	return &reportBatch[PolicyViolationReport]{
+		name:           "policy",
+		match:          isPolicyViolationType,
+		metadataObject: h.MetadataObject,
+		logger:         h.Logger,
+		metrics:        h.Metrics,
+		logReport:      h.logReport,
+	}
+}
+
+func (h *PolicyViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.batch().ServeHTTP(w, r)
+}
+
+// ProcessReport handles a single policy violation report dispatched from the
+// generic Reporting API endpoint.
+func (h *PolicyViolationReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	report := PolicyViolationReport{
+		Age:       envelope.Age,
+		Type:      envelope.Type,
+		URL:       envelope.URL,
+		UserAgent: envelope.UserAgent,
+	}
+	return h.batch().process(r, &report, &report.Body, envelope.Body)
+}
+
+func (h *PolicyViolationReportHandler) logReport(r *http.Request, report PolicyViolationReport, metadata interface{}) {
+	url := report.URL
+	sourceFile := report.Body.SourceFile
+	if h.TruncateQueryStringFragment {
+		url = utils.TruncateQueryStringFragment(url)
+		sourceFile = utils.TruncateQueryStringFragment(sourceFile)
+	}
+
+	lf := log.Fields{
+		"report_type":   report.Type,
+		"report_only":   report.Body.Disposition == "report",
+		"url":           url,
+		"feature_id":    report.Body.FeatureID,
+		"disposition":   report.Body.Disposition,
+		"message":       report.Body.Message,
+		"source_file":   sourceFile,
+		"line_number":   report.Body.LineNumber,
+		"column_number": report.Body.ColumnNumber,
+		"metadata":      metadata,
+		"path":          r.URL.Path,
+	}
+
+	addClientIP(lf, r, h.LogClientIP, h.LogTruncatedClientIP, h.Logger)
+
+	writeReport(r, h.Sink, h.Logger, h.Metrics, sink.Report{
+		Handler:    "policy",
+		Type:       report.Type,
+		ReportOnly: lf["report_only"] == true,
+		Fields:     lf,
+	})
+	if h.Metrics != nil {
+		h.Metrics.PolicyViolations.WithLabelValues(
+			policyFeatureLabel(report.Body.FeatureID),
+			policyDispositionLabel(report.Body.Disposition),
+		).Inc()
+	}
+}
+
+// knownPolicyFeatures are the Permissions-Policy and Document-Policy
+// features that get their own metric label value.
+var knownPolicyFeatures = map[string]bool{
+	// Permissions-Policy.
+	"accelerometer":                   true,
+	"ambient-light-sensor":            true,
+	"attribution-reporting":           true,
+	"autoplay":                        true,
+	"bluetooth":                       true,
+	"browsing-topics":                 true,
+	"camera":                          true,
+	"clipboard-read":                  true,
+	"clipboard-write":                 true,
+	"compute-pressure":                true,
+	"cross-origin-isolated":           true,
+	"display-capture":                 true,
+	"document-domain":                 true,
+	"encrypted-media":                 true,
+	"execution-while-not-rendered":    true,
+	"execution-while-out-of-viewport": true,
+	"fullscreen":                      true,
+	"gamepad":                         true,
+	"geolocation":                     true,
+	"gyroscope":                       true,
+	"hid":                             true,
+	"identity-credentials-get":        true,
+	"idle-detection":                  true,
+	"interest-cohort":                 true,
+	"keyboard-map":                    true,
+	"local-fonts":                     true,
+	"magnetometer":                    true,
+	"microphone":                      true,
+	"midi":                            true,
+	"otp-credentials":                 true,
+	"payment":                         true,
+	"picture-in-picture":              true,
+	"publickey-credentials-create":    true,
+	"publickey-credentials-get":       true,
+	"screen-wake-lock":                true,
+	"serial":                          true,
+	"speaker-selection":               true,
+	"storage-access":                  true,
+	"sync-xhr":                        true,
+	"unload":                          true,
+	"usb":                             true,
+	"web-share":                       true,
+	"window-management":               true,
+	"xr-spatial-tracking":             true,
+
+	// Document-Policy.
+	"document-write":          true,
+	"font-display-late-swap":  true,
+	"force-load-at-top":       true,
+	"js-profiling":            true,
+	"layout-animations":       true,
+	"lossless-images-max-bpp": true,
+	"lossy-images-max-bpp":    true,
+	"oversized-images":        true,
+	"sync-script":             true,
+	"unsized-media":           true,
+}
+
+// policyFeatureLabel maps the browser supplied feature onto a fixed set of
+// metric label values so that arbitrary payloads can't blow up
+// cardinality. The full feature is still logged.
+func policyFeatureLabel(feature string) string {
+	if knownPolicyFeatures[feature] {
+		return feature
+	}
+	return "other"
+}
+
+// policyDispositionLabel is the disposition as a metric label value. Reports
+// with other dispositions fail validation, but the label doesn't rely on it.
+func policyDispositionLabel(disposition string) string {
+	switch disposition {
+	case "enforce", "report":
+		return disposition
+	default:
+		return "other"
+	}
+}
+
+func (r PolicyViolationReport) reportType() string { return r.Type }
+func (r PolicyViolationReport) reportURL() string  { return r.URL }
+
+func (r PolicyViolationReport) validateBody() error {
+	if r.Body.FeatureID == "" {
+		return fmt.Errorf("%s report for '%s' is missing a featureId", r.Type, r.URL)
+	}
+	if r.Body.Disposition != "enforce" && r.Body.Disposition != "report" {
+		return fmt.Errorf("disposition ('%s') is invalid", r.Body.Disposition)
+	}
+	return nil
+}
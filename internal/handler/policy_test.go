@@ -0,0 +1,133 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+var policyViolationBatch = []byte(`[
+	{
+		"type": "permissions-policy-violation",
+		"url": "https://example.com/store-locator",
+		"body": {
+			"featureId": "geolocation",
+			"disposition": "report",
+			"sourceFile": "https://example.com/js/map.js",
+			"lineNumber": 42,
+			"columnNumber": 7
+		}
+	},
+	{
+		"type": "document-policy-violation",
+		"url": "https://example.com/",
+		"body": {
+			"featureId": "sync-xhr",
+			"disposition": "enforce",
+			"message": "Synchronous XMLHttpRequest is disabled by document policy."
+		}
+	}
+]`)
+
+func TestPolicyViolationHandlerLogsExpectedFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	h := &PolicyViolationReportHandler{Logger: l}
+	req := httptest.NewRequest("POST", "/reporting-api/policy", bytes.NewBuffer(policyViolationBatch))
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+
+	lines := strings.Split(strings.TrimSpace(logBuf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 log lines, got %d: %s", len(lines), logBuf.String())
+	}
+	for _, needle := range []string{"report_type=permissions-policy-violation", "feature_id=geolocation", "report_only=true", "line_number=42"} {
+		if !strings.Contains(lines[0], needle) {
+			t.Errorf("expected %q in log line, got: %s", needle, lines[0])
+		}
+	}
+	for _, needle := range []string{"report_type=document-policy-violation", "feature_id=sync-xhr", "report_only=false", "message=\"Synchronous XMLHttpRequest"} {
+		if !strings.Contains(lines[1], needle) {
+			t.Errorf("expected %q in log line, got: %s", needle, lines[1])
+		}
+	}
+}
+
+func TestPolicyViolationValidateReports(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+	}{
+		{"invalid url", `[{"type":"permissions-policy-violation","url":"about:blank","body":{"featureId":"camera","disposition":"enforce"}}]`},
+		{"missing feature", `[{"type":"permissions-policy-violation","url":"https://example.com","body":{"disposition":"enforce"}}]`},
+		{"invalid disposition", `[{"type":"document-policy-violation","url":"https://example.com","body":{"featureId":"sync-xhr","disposition":"nope"}}]`},
+	}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			l := logrus.New()
+			l.SetOutput(bytes.NewBuffer(nil))
+			h := &PolicyViolationReportHandler{Logger: l}
+
+			req := httptest.NewRequest("POST", "/reporting-api/policy", strings.NewReader(tc.body))
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+
+			if rr.Code != http.StatusBadRequest {
+				t.Fatalf("expected 400, got %d", rr.Code)
+			}
+		})
+	}
+}
+
+func TestPolicyViolationHandlerMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &PolicyViolationReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api/policy", bytes.NewBuffer(policyViolationBatch))
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if got := testutil.ToFloat64(m.PolicyViolations.WithLabelValues("geolocation", "report")); got != 1 {
+		t.Errorf("policy_violations_total geolocation = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.PolicyViolations.WithLabelValues("sync-xhr", "enforce")); got != 1 {
+		t.Errorf("policy_violations_total sync-xhr = %v, want 1", got)
+	}
+}
+
+func TestPolicyViolationMetricsBucketUnknownFeatures(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	h := &PolicyViolationReportHandler{Logger: l, Metrics: m}
+	req := httptest.NewRequest("POST", "/reporting-api", nil)
+	err := h.ProcessReport(req, ReportAPIEnvelope{
+		Type: "permissions-policy-violation",
+		URL:  "https://example.com/",
+		Body: json.RawMessage(`{"featureId":"feature-0001","disposition":"enforce"}`),
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got := testutil.ToFloat64(m.PolicyViolations.WithLabelValues("other", "enforce")); got != 1 {
+		t.Errorf("policy_violations_total{feature=other} = %v, want 1", got)
+	}
+}
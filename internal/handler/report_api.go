@@ -0,0 +1,171 @@
+package handler
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+)
+
+// ReportAPIEnvelope is a single report delivered by the Reporting API
+// (https://www.w3.org/TR/reporting-1/). The body is kept undecoded so that it
+// can be handed to the processor registered for the report type.
+type ReportAPIEnvelope struct {
+	Age       int             `json:"age"`
+	Body      json.RawMessage `json:"body"`
+	Type      string          `json:"type"`
+	URL       string          `json:"url"`
+	UserAgent string          `json:"user_agent"`
+
+	// source is set to SourceReportURI when the envelope was built from a
+	// legacy `report-uri` payload, in which case Body holds the legacy
+	// `csp-report` object.
+	source string
+}
+
+// ReportProcessor handles Reporting API reports of a single type. It is
+// responsible for decoding the body, filtering, logging and metrics.
+type ReportProcessor interface {
+	ProcessReport(r *http.Request, report ReportAPIEnvelope) error
+}
+
+// ReportAPIHandler accepts an `application/reports+json` batch containing
+// any mix of report types and dispatches each report by its `type` field.
+// Reports without a registered processor are logged as-is and counted
+// instead of failing the whole batch.
+type ReportAPIHandler struct {
+	Processors     map[string]ReportProcessor
+	MetadataObject bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+}
+
+func (h *ReportAPIHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("reporting_api", "read_error").Inc()
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		h.Logger.Debugf("unable to read payload: %s", err)
+		return
+	}
+
+	var reports []ReportAPIEnvelope
+	if isReportAPIPayload(requestMediaType(r), body) {
+		err = json.Unmarshal(body, &reports)
+	} else {
+		// Allow the same URL to be used for both `report-uri` and `report-to`.
+		var envelope ReportAPIEnvelope
+		envelope, err = legacyCSPEnvelope(body)
+		reports = []ReportAPIEnvelope{envelope}
+	}
+	if err != nil {
+		if h.Metrics != nil {
+			h.Metrics.ReportErrors.WithLabelValues("reporting_api", "decode_error").Inc()
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		h.Logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	for _, report := range reports {
+		processor, ok := h.Processors[report.Type]
+		if !ok {
+			h.logUnsupported(r, report)
+			continue
+		}
+
+		if err := processor.ProcessReport(r, report); err != nil {
+			h.Logger.Debugf("received invalid %s report: %s", report.Type, err)
+		}
+	}
+}
+
+// legacyCSPEnvelope wraps a legacy `report-uri` payload in a csp-violation
+// envelope.
+func legacyCSPEnvelope(body []byte) (ReportAPIEnvelope, error) {
+	var report CSPReport
+	if err := json.Unmarshal(body, &report); err != nil {
+		return ReportAPIEnvelope{}, err
+	}
+
+	raw, err := json.Marshal(report.Body)
+	if err != nil {
+		return ReportAPIEnvelope{}, err
+	}
+
+	return ReportAPIEnvelope{
+		Body:   raw,
+		Type:   "csp-violation",
+		URL:    report.Body.DocumentURI,
+		source: SourceReportURI,
+	}, nil
+}
+
+func (h *ReportAPIHandler) logUnsupported(r *http.Request, report ReportAPIEnvelope) {
+	if h.Metrics != nil {
+		h.Metrics.ReportIgnored.WithLabelValues("reporting_api", "unsupported_type").Inc()
+	}
+
+	h.Logger.WithFields(log.Fields{
+		"report_type": report.Type,
+		"url":         report.URL,
+		"user_agent":  report.UserAgent,
+		"age":         report.Age,
+		"body":        string(report.Body),
+		"metadata":    requestMetadata(r, h.MetadataObject),
+		"path":        r.URL.Path,
+	}).Warn("unsupported report type")
+}
+
+// requestMetadata returns the metadata attached to the report URL. By default
+// this is the first `metadata` query parameter; when asObject is set every
+// query parameter is returned as a map.
+func requestMetadata(r *http.Request, asObject bool) interface{} {
+	if asObject {
+		metadataMap := make(map[string]string)
+		for k, v := range r.URL.Query() {
+			metadataMap[k] = v[0]
+		}
+		return metadataMap
+	}
+
+	if metadatas, ok := r.URL.Query()["metadata"]; ok {
+		return metadatas[0]
+	}
+
+	return nil
+}
+
+// addClientIP sets the `client_ip` field according to the configured client
+// IP logging options.
+func addClientIP(lf log.Fields, r *http.Request, full, truncated bool, logger *log.Logger) {
+	if !full && !truncated {
+		return
+	}
+
+	ip, err := utils.GetClientIP(r)
+	if err != nil {
+		logger.Warnf("unable to parse client ip: %s", err)
+		return
+	}
+
+	if truncated {
+		lf["client_ip"] = utils.TruncateClientIP(ip)
+		return
+	}
+
+	lf["client_ip"] = ip.String()
+}
@@ -3,10 +3,11 @@ package handler
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"net/http"
-	"strings"
 
 	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
 	"github.com/jacobbednarz/go-csp-collector/internal/utils"
 	log "github.com/sirupsen/logrus"
 )
@@ -49,6 +50,7 @@ type ReportAPIViolationReportHandler struct {
 
 	Logger  *log.Logger
 	Metrics *metrics.Metrics
+	Sink    sink.Sink
 }
 
 func (vrh *ReportAPIViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -57,10 +59,34 @@ func (vrh *ReportAPIViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *
 		return
 	}
 
-	decoder := json.NewDecoder(r.Body)
-	var reports_raw []ReportAPIReport
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		if vrh.Metrics != nil {
+			vrh.Metrics.ReportErrors.WithLabelValues("reporting_api_csp", "read_error").Inc()
+		}
+		w.WriteHeader(http.StatusBadRequest)
+		vrh.Logger.Debugf("unable to read payload: %s", err)
+		return
+	}
 
-	err := decoder.Decode(&reports_raw)
+	var violations []Violation
+	ignored := 0
+	if isReportAPIPayload(requestMediaType(r), body) {
+		var reports []ReportAPIReport
+		err = json.Unmarshal(body, &reports)
+		for _, report := range reports {
+			if report.Type != "csp-violation" {
+				ignored++
+				continue
+			}
+			violations = append(violations, report.violation())
+		}
+	} else {
+		// Allow the same URL to be used for both `report-uri` and `report-to`.
+		var report CSPReport
+		err = json.Unmarshal(body, &report)
+		violations = []Violation{report.Body.violation()}
+	}
 	if err != nil {
 		if vrh.Metrics != nil {
 			vrh.Metrics.ReportErrors.WithLabelValues("reporting_api_csp", "decode_error").Inc()
@@ -72,121 +98,118 @@ func (vrh *ReportAPIViolationReportHandler) ServeHTTP(w http.ResponseWriter, r *
 
 	defer r.Body.Close()
 
-	reports := ReportAPIReports{
-		Reports: reports_raw,
+	p := vrh.pipeline()
+	for _, v := range violations {
+		if reason, err := p.filter(r.Context(), v); err != nil {
+			p.reject(reason)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			vrh.Logger.Debugf("received invalid payload: %s", err.Error())
+			return
+		}
 	}
 
-	failureClass, reportValidation := vrh.validateViolationWithReason(reports)
-	if reportValidation != nil {
-		if vrh.Metrics != nil {
-			switch failureClass {
-			case "blocked_uri":
-				vrh.Metrics.ReportFiltered.WithLabelValues("reporting_api_csp", "blocked_uri").Inc()
-			case "blocked_domain":
-				vrh.Metrics.ReportFiltered.WithLabelValues("reporting_api_csp", "blocked_domain").Inc()
-			default:
-				vrh.Metrics.ReportErrors.WithLabelValues("reporting_api_csp", "validation_error").Inc()
-			}
-		}
-		http.Error(w, reportValidation.Error(), http.StatusBadRequest)
-		vrh.Logger.Debugf("received invalid payload: %s", reportValidation.Error())
-		return
+	if ignored > 0 && vrh.Metrics != nil {
+		vrh.Metrics.ReportIgnored.WithLabelValues("reporting_api_csp", "unsupported_type").Add(float64(ignored))
 	}
 
-	var metadata interface{}
-	if vrh.MetadataObject {
-		metadataMap := make(map[string]string)
-		query := r.URL.Query()
+	metadata := requestMetadata(r, vrh.MetadataObject)
+	for _, v := range violations {
+		p.accept(r, v, metadata)
+	}
+}
 
-		for k, v := range query {
-			metadataMap[k] = v[0]
+// ProcessReport handles a single csp-violation report dispatched from the
+// generic Reporting API endpoint.
+func (vrh *ReportAPIViolationReportHandler) ProcessReport(r *http.Request, envelope ReportAPIEnvelope) error {
+	var v Violation
+	if envelope.source == SourceReportURI {
+		var body CSPReportBody
+		if err := json.Unmarshal(envelope.Body, &body); err != nil {
+			if vrh.Metrics != nil {
+				vrh.Metrics.ReportErrors.WithLabelValues("reporting_api_csp", "decode_error").Inc()
+			}
+			return fmt.Errorf("unable to decode csp-report body: %w", err)
 		}
-
-		metadata = metadataMap
+		v = body.violation()
 	} else {
-		metadatas, gotMetadata := r.URL.Query()["metadata"]
-		if gotMetadata {
-			metadata = metadatas[0]
+		report := ReportAPIReport{
+			Age:       envelope.Age,
+			Type:      envelope.Type,
+			URL:       envelope.URL,
+			UserAgent: envelope.UserAgent,
 		}
+		if err := json.Unmarshal(envelope.Body, &report.Body); err != nil {
+			if vrh.Metrics != nil {
+				vrh.Metrics.ReportErrors.WithLabelValues("reporting_api_csp", "decode_error").Inc()
+			}
+			return fmt.Errorf("unable to decode csp-violation body: %w", err)
+		}
+		v = report.violation()
 	}
 
-	for _, violation := range reports.Reports {
-		report_only := violation.Body.Disposition == "report"
-		lf := log.Fields{
-			"report_only":         report_only,
-			"document_uri":        violation.Body.DocumentURL,
-			"referrer":            violation.Body.Referrer,
-			"blocked_uri":         violation.Body.BlockedURL,
-			"violated_directive":  violation.Body.EffectiveDirective,
-			"effective_directive": violation.Body.EffectiveDirective,
-			"original_policy":     violation.Body.OriginalPolicy,
-			"disposition":         violation.Body.Disposition,
-			"status_code":         violation.Body.StatusCode,
-			"source_file":         violation.Body.SourceFile,
-			"line_number":         violation.Body.LineNumber,
-			"column_number":       violation.Body.ColumnNumber,
-			"metadata":            metadata,
-			"path":                r.URL.Path,
-		}
+	p := vrh.pipeline()
+	if reason, err := p.filter(r.Context(), v); err != nil {
+		p.reject(reason)
+		return err
+	}
 
-		if vrh.TruncateQueryStringFragment {
-			lf["document_uri"] = utils.TruncateQueryStringFragment(violation.Body.DocumentURL)
-			lf["referrer"] = utils.TruncateQueryStringFragment(violation.Body.Referrer)
-			lf["blocked_uri"] = utils.TruncateQueryStringFragment(violation.Body.BlockedURL)
-			lf["source_file"] = utils.TruncateQueryStringFragment(violation.Body.SourceFile)
-		}
+	p.accept(r, v, requestMetadata(r, vrh.MetadataObject))
+	return nil
+}
 
-		if vrh.LogClientIP {
-			ip, err := utils.GetClientIP(r)
-			if err != nil {
-				vrh.Logger.Warnf("unable to parse client ip: %s", err)
-			}
-			lf["client_ip"] = ip.String()
-		}
+func (vrh *ReportAPIViolationReportHandler) pipeline() *violationPipeline {
+	return &violationPipeline{
+		Handler:                     "reporting_api_csp",
+		TruncateQueryStringFragment: vrh.TruncateQueryStringFragment,
+		BlockedURIs:                 vrh.BlockedURIs,
+		BlockedDomains:              vrh.BlockedDomains,
 
-		if vrh.LogTruncatedClientIP {
-			ip, err := utils.GetClientIP(r)
-			if err != nil {
-				vrh.Logger.Warnf("unable to parse client ip: %s", err)
-			}
-			lf["client_ip"] = utils.TruncateClientIP(ip)
-		}
+		LogClientIP:          vrh.LogClientIP,
+		LogTruncatedClientIP: vrh.LogTruncatedClientIP,
 
-		vrh.Logger.WithFields(lf).Info()
-		if vrh.Metrics != nil {
-			mode := "enforced"
-			if report_only {
-				mode = "report_only"
-			}
-			vrh.Metrics.Reports.WithLabelValues("reporting_api_csp", mode).Inc()
-		}
+		Logger:  vrh.Logger,
+		Metrics: vrh.Metrics,
+		Sink:    vrh.Sink,
 	}
 }
 
-func (vrh *ReportAPIViolationReportHandler) validateViolation(r ReportAPIReports) error {
-	_, err := vrh.validateViolationWithReason(r)
-	return err
+// violation adapts a Reporting API `csp-violation` report. The Reporting API
+// only carries the effective directive, which is also used as the violated
+// directive to match legacy reports.
+func (report ReportAPIReport) violation() Violation {
+	return Violation{
+		Source:             SourceReportingAPI,
+		Type:               report.Type,
+		ReportOnly:         report.Body.Disposition == "report",
+		Age:                report.Age,
+		UserAgent:          report.UserAgent,
+		URL:                report.Body.DocumentURL,
+		Referrer:           report.Body.Referrer,
+		StatusCode:         report.Body.StatusCode,
+		BlockedURL:         report.Body.BlockedURL,
+		ViolatedDirective:  report.Body.EffectiveDirective,
+		EffectiveDirective: report.Body.EffectiveDirective,
+		OriginalPolicy:     report.Body.OriginalPolicy,
+		Disposition:        report.Body.Disposition,
+		Sample:             report.Body.Sample,
+		SourceFile:         report.Body.SourceFile,
+		LineNumber:         report.Body.LineNumber,
+		ColumnNumber:       report.Body.ColumnNumber,
+	}
 }
 
-func (vrh *ReportAPIViolationReportHandler) validateViolationWithReason(r ReportAPIReports) (string, error) {
-	for _, violation := range r.Reports {
-		if violation.Type != "csp-violation" {
+func (vrh *ReportAPIViolationReportHandler) validateViolation(r ReportAPIReports) error {
+	p := vrh.pipeline()
+	for _, report := range r.Reports {
+		if report.Type != "csp-violation" {
 			continue
 		}
-		for _, value := range vrh.BlockedURIs {
-			if strings.HasPrefix(violation.Body.BlockedURL, value) {
-				return "blocked_uri", fmt.Errorf("blocked URI ('%s') is an invalid resource", value)
-			}
-		}
-		if isBlockedByDomain(violation.Body.BlockedURL, vrh.BlockedDomains) {
-			return "blocked_domain", fmt.Errorf("blocked URI ('%s') is an invalid resource", violation.Body.BlockedURL)
-		}
-		if !strings.HasPrefix(violation.Body.DocumentURL, "http") {
-			return "validation_error", fmt.Errorf("document URI ('%s') is invalid", violation.Body.DocumentURL)
+		if _, err := p.check(report.violation()); err != nil {
+			return err
 		}
 	}
 
-	return "", nil
+	return nil
 }
 
 func ReportAPICorsHandler(w http.ResponseWriter, r *http.Request) {
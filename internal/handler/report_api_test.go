@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+func newReportAPIHandler(l *logrus.Logger, m *metrics.Metrics) *ReportAPIHandler {
+	return &ReportAPIHandler{
+		Processors: map[string]ReportProcessor{
+			"csp-violation": &ReportAPIViolationReportHandler{Logger: l, Metrics: m, BlockedURIs: []string{"inline"}},
+			"network-error": &NELViolationReportHandler{Logger: l, Metrics: m},
+		},
+		Logger:  l,
+		Metrics: m,
+	}
+}
+
+func TestReportAPIHandlerDispatchesByType(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	body := []byte(`[
+		{"type":"csp-violation","url":"https://example.com/","body":{"blockedURL":"https://cdn.example.com/app.js","documentURL":"https://example.com/","effectiveDirective":"script-src-elem","disposition":"enforce"}},
+		{"type":"network-error","url":"https://example.com/img.png","body":{"type":"tcp.refused","phase":"connection"}},
+		{"type":"something-new","url":"https://example.com/","body":{"foo":"bar"}}
+	]`)
+	req := httptest.NewRequest("POST", "/reporting-api", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	newReportAPIHandler(l, m).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("reporting_api_csp", "enforced")); got != 1 {
+		t.Fatalf("reports_total enforced = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.NELReports.WithLabelValues("enforced")); got != 1 {
+		t.Fatalf("nel_reports_total enforced = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.ReportIgnored.WithLabelValues("reporting_api", "unsupported_type")); got != 1 {
+		t.Fatalf("reports_ignored_total unsupported_type = %v, want 1", got)
+	}
+
+	out := logBuf.String()
+	for _, needle := range []string{"effective_directive=script-src-elem", "phase=connection", "report_type=something-new"} {
+		if !strings.Contains(out, needle) {
+			t.Errorf("expected %q in log output, got: %s", needle, out)
+		}
+	}
+}
+
+func TestReportAPIHandlerFilteredReportDoesNotDropBatch(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	body := []byte(`[
+		{"type":"csp-violation","body":{"blockedURL":"inline","documentURL":"https://example.com","disposition":"enforce"}},
+		{"type":"csp-violation","body":{"blockedURL":"https://cdn.example.com/app.js","documentURL":"https://example.com","disposition":"report"}}
+	]`)
+	req := httptest.NewRequest("POST", "/reporting-api", bytes.NewBuffer(body))
+	rr := httptest.NewRecorder()
+	newReportAPIHandler(l, m).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportFiltered.WithLabelValues("reporting_api_csp", "blocked_uri")); got != 1 {
+		t.Fatalf("reports_filtered_total blocked_uri = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("reporting_api_csp", "report_only")); got != 1 {
+		t.Fatalf("reports_total report_only = %v, want 1", got)
+	}
+}
+
+func TestReportAPIHandlerDecodeError(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m := metrics.New(registry)
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	req := httptest.NewRequest("POST", "/reporting-api", strings.NewReader("bad-json"))
+	rr := httptest.NewRecorder()
+	newReportAPIHandler(l, m).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("expected 422, got %d", rr.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("reporting_api", "decode_error")); got != 1 {
+		t.Fatalf("reports_errors_total decode_error = %v, want 1", got)
+	}
+}
+
+func TestReportAPIHandlerDisallowedMethods(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+	h := newReportAPIHandler(l, nil)
+
+	for _, method := range []string{"GET", "PUT", "DELETE", "PATCH"} {
+		t.Run(method, func(t *testing.T) {
+			req := httptest.NewRequest(method, "/reporting-api", nil)
+			rr := httptest.NewRecorder()
+			h.ServeHTTP(rr, req)
+			if rr.Code != http.StatusMethodNotAllowed {
+				t.Errorf("expected 405, got %d", rr.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	log "github.com/sirupsen/logrus"
+)
+
+// batchReport is a single report in the batches the dedicated Reporting API
+// endpoints receive.
+type batchReport interface {
+	reportType() string
+	reportURL() string
+
+	// validateBody checks the fields specific to the report's type.
+	validateBody() error
+}
+
+// reportBatch holds what the handlers of the dedicated Reporting API
+// endpoints share: decoding and validating a batch of reports, logging each
+// report of the endpoint's type and counting the rest as ignored, and
+// handling the single reports the generic endpoint dispatches.
+type reportBatch[T batchReport] struct {
+	// name is the report type accepted, which also names the handler in
+	// metrics.
+	name string
+
+	// match, if set, decides which report types are accepted in place of
+	// name, for handlers of more than one type.
+	match func(reportType string) bool
+
+	metadataObject bool
+	logger         *log.Logger
+	metrics        *metrics.Metrics
+
+	logReport func(r *http.Request, report T, metadata interface{})
+}
+
+func (b *reportBatch[T]) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	decoder := json.NewDecoder(r.Body)
+	var reports []T
+
+	err := decoder.Decode(&reports)
+	if err != nil {
+		b.countError("decode_error")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		b.logger.Debugf("unable to decode invalid JSON payload: %s", err)
+		return
+	}
+
+	defer r.Body.Close()
+
+	if err := b.validate(reports); err != nil {
+		b.countError("validation_error")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		b.logger.Debugf("received invalid payload: %s", err.Error())
+		return
+	}
+
+	metadata := requestMetadata(r, b.metadataObject)
+
+	for _, report := range reports {
+		if !b.accepts(report.reportType()) {
+			if b.metrics != nil {
+				b.metrics.ReportIgnored.WithLabelValues(b.name, "unsupported_type").Inc()
+			}
+			continue
+		}
+
+		b.logReport(r, report, metadata)
+	}
+}
+
+// process handles a single report dispatched from the generic Reporting API
+// endpoint. body points into report and is decoded from raw.
+func (b *reportBatch[T]) process(r *http.Request, report *T, body interface{}, raw json.RawMessage) error {
+	if err := json.Unmarshal(raw, body); err != nil {
+		b.countError("decode_error")
+		return fmt.Errorf("unable to decode %s body: %w", (*report).reportType(), err)
+	}
+
+	if err := b.validate([]T{*report}); err != nil {
+		b.countError("validation_error")
+		return err
+	}
+
+	b.logReport(r, *report, requestMetadata(r, b.metadataObject))
+	return nil
+}
+
+// validate checks the reports of the endpoint's type, ignoring the rest.
+func (b *reportBatch[T]) validate(reports []T) error {
+	for _, report := range reports {
+		if !b.accepts(report.reportType()) {
+			continue
+		}
+		if !strings.HasPrefix(report.reportURL(), "http") {
+			return fmt.Errorf("url ('%s') is invalid", report.reportURL())
+		}
+		if err := report.validateBody(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// accepts reports whether the endpoint handles reports of reportType.
+func (b *reportBatch[T]) accepts(reportType string) bool {
+	if b.match != nil {
+		return b.match(reportType)
+	}
+	return reportType == b.name
+}
+
+func (b *reportBatch[T]) countError(kind string) {
+	if b.metrics != nil {
+		b.metrics.ReportErrors.WithLabelValues(b.name, kind).Inc()
+	}
+}
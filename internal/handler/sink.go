@@ -0,0 +1,59 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// writeReport hands an accepted report to s, falling back to logging it with
+// logger when no sink has been configured.
+func writeReport(r *http.Request, s sink.Sink, logger *log.Logger, m *metrics.Metrics, rep sink.Report) {
+	if rep.ReceivedAt.IsZero() {
+		rep.ReceivedAt = time.Now()
+	}
+	if s == nil {
+		s = sink.NewLogrus(logger)
+	}
+
+	ctx, span := tracer.Start(r.Context(), "write report")
+	span.SetAttributes(
+		attribute.String("csp_collector.handler", rep.Handler),
+		attribute.String("csp_collector.report_type", rep.Type),
+		attribute.Bool("csp_collector.report_only", rep.ReportOnly),
+	)
+	err := withoutBufferFull(s.Write(ctx, rep))
+	endSpan(span, err)
+	if err != nil {
+		if m != nil {
+			m.ReportErrors.WithLabelValues(rep.Handler, "sink_error").Inc()
+		}
+		logger.Warnf("unable to write %s report: %s", rep.Type, err)
+	}
+}
+
+// withoutBufferFull removes sink.ErrBufferFull from err, including from the
+// errors joined by sink.Multi. The report was still accepted, and the sink
+// counts the older report it dropped in sink_reports_total, so it is
+// neither an error of this report nor worth a warning on every write while
+// a backend is down.
+func withoutBufferFull(err error) error {
+	if errors.Is(err, sink.ErrBufferFull) {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			var errs []error
+			for _, e := range joined.Unwrap() {
+				errs = append(errs, withoutBufferFull(e))
+			}
+			return errors.Join(errs...)
+		}
+		if err == sink.ErrBufferFull {
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package handler
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+// recordingSink keeps every report written to it, optionally failing.
+type recordingSink struct {
+	reports []sink.Report
+	err     error
+}
+
+func (s *recordingSink) Write(_ context.Context, r sink.Report) error {
+	s.reports = append(s.reports, r)
+	return s.err
+}
+
+func (s *recordingSink) Flush(context.Context) error { return nil }
+func (s *recordingSink) Close() error                { return nil }
+
+func TestHandlerWritesReportToSink(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	s := &recordingSink{}
+	h := &DeprecationReportHandler{Logger: l, Sink: s}
+
+	payload, _ := json.Marshal(sampleDeprecationReport("https://example.com/"))
+	req := httptest.NewRequest(http.MethodPost, "/reporting-api/deprecation", bytes.NewReader(payload))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+	if len(s.reports) != 1 {
+		t.Fatalf("expected 1 report written to the sink, got %d", len(s.reports))
+	}
+
+	rep := s.reports[0]
+	if rep.Handler != "deprecation" || rep.Type != "deprecation" {
+		t.Errorf("unexpected handler/type: %s/%s", rep.Handler, rep.Type)
+	}
+	if rep.ReceivedAt.IsZero() {
+		t.Error("expected ReceivedAt to be set")
+	}
+	if rep.Fields["id"] != "NavigatorVibrate" {
+		t.Errorf("expected id field to be passed through, got %v", rep.Fields["id"])
+	}
+	if logBuf.Len() != 0 {
+		t.Errorf("expected nothing to be logged when a sink is configured, got %s", logBuf.String())
+	}
+}
+
+func TestHandlerCountsSinkErrors(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	m := metrics.New(prometheus.NewRegistry())
+	h := &DeprecationReportHandler{Logger: l, Metrics: m, Sink: &recordingSink{err: errors.New("unavailable")}}
+
+	payload, _ := json.Marshal(sampleDeprecationReport("https://example.com/"))
+	req := httptest.NewRequest(http.MethodPost, "/reporting-api/deprecation", bytes.NewReader(payload))
+	recorder := httptest.NewRecorder()
+	h.ServeHTTP(recorder, req)
+
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", recorder.Code)
+	}
+	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("deprecation", "sink_error")); got != 1 {
+		t.Errorf("expected sink_error count 1, got %v", got)
+	}
+	if !bytes.Contains(logBuf.Bytes(), []byte("unavailable")) {
+		t.Errorf("expected sink error to be logged, got %s", logBuf.String())
+	}
+}
+
+func TestHandlerIgnoresFullSinkBuffers(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := logrus.New()
+	l.SetOutput(&logBuf)
+
+	m := metrics.New(prometheus.NewRegistry())
+	full := &recordingSink{err: sink.ErrBufferFull}
+	failing := &recordingSink{err: errors.New("unavailable")}
+
+	for _, tc := range []struct {
+		name string
+		out  sink.Sink
+		want float64
+	}{
+		{"full", full, 0},
+		{"full and failing", sink.Multi(full, failing), 1},
+	} {
+		logBuf.Reset()
+		h := &DeprecationReportHandler{Logger: l, Metrics: m, Sink: tc.out}
+		payload, _ := json.Marshal(sampleDeprecationReport("https://example.com/"))
+		req := httptest.NewRequest(http.MethodPost, "/reporting-api/deprecation", bytes.NewReader(payload))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+
+		if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("deprecation", "sink_error")); got != tc.want {
+			t.Errorf("%s: expected sink_error count %v, got %v", tc.name, tc.want, got)
+		}
+		if bytes.Contains(logBuf.Bytes(), []byte("buffer full")) {
+			t.Errorf("%s: expected the full buffer not to be logged, got %s", tc.name, logBuf.String())
+		}
+	}
+}
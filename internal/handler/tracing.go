@@ -0,0 +1,20 @@
+package handler
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer creates the spans for each stage of handling a report. It is a
+// no-op unless a tracer provider has been registered with otel.
+var tracer = otel.Tracer("github.com/jacobbednarz/go-csp-collector/internal/handler")
+
+// endSpan records err, if any, on span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
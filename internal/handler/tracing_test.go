@@ -0,0 +1,71 @@
+package handler
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// spanRecorder records the handler's spans. The handler's tracer stays
+// bound to the first tracer provider registered with otel, so it is only
+// registered once, however often the tests run.
+var spanRecorder = sync.OnceValue(func() *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	return recorder
+})
+
+func TestHandlerRecordsSpansForEachStage(t *testing.T) {
+	recorder := spanRecorder()
+	recorder.Reset()
+
+	h := &BodyHandler{
+		Handler: &CSPViolationReportHandler{
+			BlockedURIs: []string{"chrome-extension://"},
+			Logger:      logrus.New(),
+			Sink:        &recordingSink{},
+		},
+		HandlerName: "csp",
+		Logger:      logrus.New(),
+	}
+
+	ctx, parent := otel.Tracer("test").Start(t.Context(), "POST /csp")
+	send := func(blockedURI string) {
+		body := `{"csp-report": {"document-uri": "https://example.com/", "blocked-uri": "` + blockedURI + `", "effective-directive": "script-src"}}`
+		req := httptest.NewRequestWithContext(ctx, http.MethodPost, "/csp", strings.NewReader(body))
+		h.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	send("https://evil.example/x.js")
+	send("chrome-extension://abc")
+	parent.End()
+
+	var names []string
+	for _, span := range recorder.Ended() {
+		if span.Name() == "POST /csp" {
+			continue
+		}
+		names = append(names, span.Name())
+		if span.Parent().SpanID() != parent.SpanContext().SpanID() {
+			t.Errorf("expected %s to be a child of the request span", span.Name())
+		}
+	}
+
+	want := "decode body,filter report,enrich report,write report,decode body,filter report"
+	if got := strings.Join(names, ","); got != want {
+		t.Errorf("unexpected spans\n got: %s\nwant: %s", got, want)
+	}
+
+	// A filtered report is expected, not an error.
+	filtered := recorder.Ended()[5]
+	if filtered.Status().Code != codes.Unset {
+		t.Errorf("expected a filtered report not to mark its span as failed, got %v", filtered.Status())
+	}
+}
@@ -0,0 +1,215 @@
+package handler
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/utils"
+	log "github.com/sirupsen/logrus"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+const (
+	// SourceReportURI marks a Violation decoded from a legacy `report-uri`
+	// (`application/csp-report`) body.
+	SourceReportURI = "report-uri"
+
+	// SourceReportingAPI marks a Violation decoded from a Reporting API
+	// (`application/reports+json`) report.
+	SourceReportingAPI = "reporting-api"
+)
+
+// Violation is the normalised form of a `csp-violation` or `network-error`
+// report. Each wire format has an adapter producing a Violation so that
+// filtering, truncation, client IP handling, output and metrics are the same
+// whichever endpoint the report arrived on.
+type Violation struct {
+	// Source is the wire format the report was decoded from, either
+	// SourceReportURI or SourceReportingAPI.
+	Source     string
+	Type       string
+	ReportOnly bool
+	Age        int
+	UserAgent  string
+
+	// URL is the document a CSP violation occurred in, or the request URL
+	// of a network error.
+	URL        string
+	Referrer   string
+	StatusCode int
+
+	// Fields set for `csp-violation` reports.
+	BlockedURL         string
+	ViolatedDirective  string
+	EffectiveDirective string
+	OriginalPolicy     string
+	Disposition        string
+	Sample             string
+	SourceFile         string
+	LineNumber         int
+	ColumnNumber       int
+
+	// Fields set for `network-error` reports.
+	ErrorType        string
+	Phase            string
+	Protocol         string
+	Method           string
+	ServerIP         string
+	ElapsedTime      int
+	SamplingFraction float64
+}
+
+// fields returns the output fields for v. The keys are the same regardless
+// of v.Source.
+func (v Violation) fields() log.Fields {
+	if v.Type == "network-error" {
+		return log.Fields{
+			"source":            v.Source,
+			"report_only":       v.ReportOnly,
+			"url":               v.URL,
+			"referrer":          v.Referrer,
+			"type":              v.ErrorType,
+			"phase":             v.Phase,
+			"protocol":          v.Protocol,
+			"method":            v.Method,
+			"status_code":       v.StatusCode,
+			"elapsed_time":      v.ElapsedTime,
+			"server_ip":         v.ServerIP,
+			"sampling_fraction": v.SamplingFraction,
+		}
+	}
+
+	return log.Fields{
+		"source":              v.Source,
+		"report_only":         v.ReportOnly,
+		"document_uri":        v.URL,
+		"referrer":            v.Referrer,
+		"blocked_uri":         v.BlockedURL,
+		"violated_directive":  v.ViolatedDirective,
+		"effective_directive": v.EffectiveDirective,
+		"original_policy":     v.OriginalPolicy,
+		"disposition":         v.Disposition,
+		"script_sample":       v.Sample,
+		"status_code":         v.StatusCode,
+		"source_file":         v.SourceFile,
+		"line_number":         v.LineNumber,
+		"column_number":       v.ColumnNumber,
+	}
+}
+
+// violationPipeline is the processing shared by every handler that accepts
+// Violations. Handler is the name used in metrics.
+type violationPipeline struct {
+	Handler                     string
+	TruncateQueryStringFragment bool
+	BlockedURIs                 []string
+	BlockedDomains              []string
+
+	LogClientIP          bool
+	LogTruncatedClientIP bool
+
+	Logger  *log.Logger
+	Metrics *metrics.Metrics
+	Sink    sink.Sink
+}
+
+// check applies the blocked URI and domain filters and validates v. When v
+// is rejected the reason used in metrics is returned alongside the error.
+func (p *violationPipeline) check(v Violation) (string, error) {
+	switch v.Type {
+	case "csp-violation":
+		for _, value := range p.BlockedURIs {
+			if strings.HasPrefix(v.BlockedURL, value) {
+				return "blocked_uri", fmt.Errorf("blocked URI ('%s') is an invalid resource", value)
+			}
+		}
+		if isBlockedByDomain(v.BlockedURL, p.BlockedDomains) {
+			return "blocked_domain", fmt.Errorf("blocked URI ('%s') is an invalid resource", v.BlockedURL)
+		}
+		if !strings.HasPrefix(v.URL, "http") {
+			return "validation_error", fmt.Errorf("document URI ('%s') is invalid", v.URL)
+		}
+	case "network-error":
+		if !strings.HasPrefix(v.URL, "http") {
+			return "validation_error", fmt.Errorf("url ('%s') is invalid", v.URL)
+		}
+	}
+
+	return "", nil
+}
+
+// filter runs check for a report being handled in ctx, recording the
+// outcome on a span.
+func (p *violationPipeline) filter(ctx context.Context, v Violation) (string, error) {
+	_, span := tracer.Start(ctx, "filter report")
+	span.SetAttributes(
+		attribute.String("csp_collector.handler", p.Handler),
+		attribute.String("csp_collector.report_type", v.Type),
+	)
+	reason, err := p.check(v)
+	switch reason {
+	case "":
+		span.End()
+	case "blocked_uri", "blocked_domain":
+		// Filtered reports are expected, so they aren't span errors.
+		span.SetAttributes(attribute.String("csp_collector.filtered", reason))
+		span.End()
+	default:
+		endSpan(span, err)
+	}
+	return reason, err
+}
+
+// reject counts a Violation that failed check.
+func (p *violationPipeline) reject(reason string) {
+	if p.Metrics == nil {
+		return
+	}
+
+	switch reason {
+	case "blocked_uri", "blocked_domain":
+		p.Metrics.ReportFiltered.WithLabelValues(p.Handler, reason).Inc()
+	default:
+		p.Metrics.ReportErrors.WithLabelValues(p.Handler, reason).Inc()
+	}
+}
+
+// accept writes a Violation that passed check to the sink and counts it.
+func (p *violationPipeline) accept(r *http.Request, v Violation, metadata interface{}) {
+	_, span := tracer.Start(r.Context(), "enrich report")
+	if p.TruncateQueryStringFragment {
+		v.URL = utils.TruncateQueryStringFragment(v.URL)
+		v.Referrer = utils.TruncateQueryStringFragment(v.Referrer)
+		v.BlockedURL = utils.TruncateQueryStringFragment(v.BlockedURL)
+		v.SourceFile = utils.TruncateQueryStringFragment(v.SourceFile)
+	}
+
+	lf := v.fields()
+	lf["metadata"] = metadata
+	lf["path"] = r.URL.Path
+
+	addClientIP(lf, r, p.LogClientIP, p.LogTruncatedClientIP, p.Logger)
+	span.End()
+
+	writeReport(r, p.Sink, p.Logger, p.Metrics, sink.Report{
+		Handler:    p.Handler,
+		Type:       v.Type,
+		ReportOnly: v.ReportOnly,
+		Fields:     lf,
+	})
+	if p.Metrics != nil {
+		mode := "enforced"
+		if v.ReportOnly {
+			mode = "report_only"
+		}
+		if v.Type == "network-error" {
+			p.Metrics.NELReports.WithLabelValues(mode).Inc()
+		} else {
+			p.Metrics.Reports.WithLabelValues(p.Handler, mode).Inc()
+		}
+	}
+}
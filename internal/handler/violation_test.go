@@ -0,0 +1,181 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+)
+
+const legacyCSPPayloadWithSample = `{"csp-report":{
+	"document-uri":"https://example.com/page?token=secret",
+	"referrer":"https://example.com/",
+	"blocked-uri":"inline",
+	"violated-directive":"script-src-elem",
+	"effective-directive":"script-src-elem",
+	"original-policy":"script-src 'self'",
+	"disposition":"enforce",
+	"script-sample":"alert(1)",
+	"status-code":"200",
+	"source-file":"https://example.com/app.js?v=1",
+	"line-number":3,
+	"column-number":7
+}}`
+
+const reportAPICSPPayloadWithSample = `[{"type":"csp-violation","age":5,"url":"https://example.com/page?token=secret","user_agent":"Mozilla/5.0","body":{
+	"documentURL":"https://example.com/page?token=secret",
+	"referrer":"https://example.com/",
+	"blockedURL":"inline",
+	"effectiveDirective":"script-src-elem",
+	"originalPolicy":"script-src 'self'",
+	"disposition":"enforce",
+	"sample":"alert(1)",
+	"statusCode":200,
+	"sourceFile":"https://example.com/app.js?v=1",
+	"lineNumber":3,
+	"columnNumber":7
+}}]`
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func TestViolationFieldsMatchAcrossWireFormats(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	legacySink := &recordingSink{}
+	legacy := &CSPViolationReportHandler{TruncateQueryStringFragment: true, Logger: l, Sink: legacySink}
+	req := httptest.NewRequest(http.MethodPost, "/csp", bytes.NewBufferString(legacyCSPPayloadWithSample))
+	req.Header.Set("Content-Type", MediaTypeCSPReport)
+	legacy.ServeHTTP(httptest.NewRecorder(), req)
+
+	reportAPISink := &recordingSink{}
+	reportAPI := &ReportAPIViolationReportHandler{TruncateQueryStringFragment: true, Logger: l, Sink: reportAPISink}
+	req = httptest.NewRequest(http.MethodPost, "/csp", bytes.NewBufferString(reportAPICSPPayloadWithSample))
+	req.Header.Set("Content-Type", MediaTypeReportsJSON)
+	reportAPI.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(legacySink.reports) != 1 || len(reportAPISink.reports) != 1 {
+		t.Fatalf("expected one report from each format, got %d and %d", len(legacySink.reports), len(reportAPISink.reports))
+	}
+
+	legacyFields := legacySink.reports[0].Fields
+	reportAPIFields := reportAPISink.reports[0].Fields
+
+	if legacyFields["source"] != SourceReportURI {
+		t.Errorf("expected legacy source %q, got %v", SourceReportURI, legacyFields["source"])
+	}
+	if reportAPIFields["source"] != SourceReportingAPI {
+		t.Errorf("expected Reporting API source %q, got %v", SourceReportingAPI, reportAPIFields["source"])
+	}
+
+	if lk, rk := sortedKeys(legacyFields), sortedKeys(reportAPIFields); len(lk) != len(rk) {
+		t.Fatalf("field keys differ:\nlegacy:        %v\nreporting api: %v", lk, rk)
+	}
+	for k, want := range legacyFields {
+		if k == "source" {
+			continue
+		}
+		if got := reportAPIFields[k]; got != want {
+			t.Errorf("field %s: legacy %v (%T), reporting api %v (%T)", k, want, want, got, got)
+		}
+	}
+
+	if legacyFields["script_sample"] != "alert(1)" {
+		t.Errorf("expected script_sample to be kept, got %v", legacyFields["script_sample"])
+	}
+	if legacyFields["status_code"] != 200 {
+		t.Errorf("expected string status code to be normalised to 200, got %v (%T)", legacyFields["status_code"], legacyFields["status_code"])
+	}
+	if legacyFields["document_uri"] != "https://example.com/page" {
+		t.Errorf("expected document_uri to be truncated, got %v", legacyFields["document_uri"])
+	}
+}
+
+func TestLegacyViolationDirectiveFallback(t *testing.T) {
+	v := CSPReportBody{DocumentURI: "https://example.com", ViolatedDirective: "img-src"}.violation()
+	if v.EffectiveDirective != "img-src" {
+		t.Errorf("expected effective directive to fall back to violated directive, got %q", v.EffectiveDirective)
+	}
+
+	v = CSPReportBody{DocumentURI: "https://example.com", EffectiveDirective: "img-src"}.violation()
+	if v.ViolatedDirective != "img-src" {
+		t.Errorf("expected violated directive to fall back to effective directive, got %q", v.ViolatedDirective)
+	}
+}
+
+func TestLegacyViolationReportOnlyFromDisposition(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	s := &recordingSink{}
+	h := &CSPViolationReportHandler{Logger: l, Metrics: m, Sink: s}
+	payload := `{"csp-report":{"document-uri":"https://example.com","blocked-uri":"https://cdn.example.com/a.js","disposition":"report"}}`
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/csp", bytes.NewBufferString(payload)))
+
+	if len(s.reports) != 1 || !s.reports[0].ReportOnly {
+		t.Fatalf("expected a report-only report, got %+v", s.reports)
+	}
+	if got := testutil.ToFloat64(m.Reports.WithLabelValues("csp", "report_only")); got != 1 {
+		t.Errorf("reports_total report_only = %v, want 1", got)
+	}
+}
+
+func TestReportAPICSPHandlerIgnoresOtherTypes(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	s := &recordingSink{}
+	h := &ReportAPIViolationReportHandler{Logger: l, Metrics: m, Sink: s}
+	payload := `[
+		{"type":"csp-violation","body":{"documentURL":"https://example.com","blockedURL":"https://cdn.example.com/a.js","disposition":"enforce"}},
+		{"type":"deprecation","url":"https://example.com","body":{"id":"X"}}
+	]`
+	req := httptest.NewRequest(http.MethodPost, "/reporting-api/csp", bytes.NewBufferString(payload))
+	req.Header.Set("Content-Type", MediaTypeReportsJSON)
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", rr.Code)
+	}
+	if len(s.reports) != 1 || s.reports[0].Type != "csp-violation" {
+		t.Fatalf("expected only the csp-violation report to be written, got %+v", s.reports)
+	}
+	if got := testutil.ToFloat64(m.ReportIgnored.WithLabelValues("reporting_api_csp", "unsupported_type")); got != 1 {
+		t.Errorf("reports_ignored_total unsupported_type = %v, want 1", got)
+	}
+}
+
+func TestCSPHandlerOmitsUnparseableClientIP(t *testing.T) {
+	l := logrus.New()
+	l.SetOutput(bytes.NewBuffer(nil))
+
+	s := &recordingSink{}
+	h := &CSPViolationReportHandler{LogClientIP: true, Logger: l, Sink: s}
+	payload := `{"csp-report":{"document-uri":"https://example.com","blocked-uri":"https://cdn.example.com/a.js"}}`
+	req := httptest.NewRequest(http.MethodPost, "/csp", bytes.NewBufferString(payload))
+	req.RemoteAddr = "not-an-address"
+	h.ServeHTTP(httptest.NewRecorder(), req)
+
+	if len(s.reports) != 1 {
+		t.Fatalf("expected 1 report, got %d", len(s.reports))
+	}
+	if ip, ok := s.reports[0].Fields["client_ip"]; ok {
+		t.Errorf("expected client_ip to be omitted, got %v", ip)
+	}
+}
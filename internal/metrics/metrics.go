@@ -10,13 +10,29 @@ const (
 )
 
 type Metrics struct {
-	Reports          *prometheus.CounterVec
-	NELReports       *prometheus.CounterVec
-	ReportFiltered   *prometheus.CounterVec
-	ReportIgnored    *prometheus.CounterVec
-	ReportErrors     *prometheus.CounterVec
-	RequestDuration  *prometheus.HistogramVec
-	RequestsInFlight *prometheus.GaugeVec
+	Reports             *prometheus.CounterVec
+	NELReports          *prometheus.CounterVec
+	DeprecationReports  *prometheus.CounterVec
+	InterventionReports *prometheus.CounterVec
+	CrashReports        *prometheus.CounterVec
+	CrossOriginReports  *prometheus.CounterVec
+	PolicyViolations    *prometheus.CounterVec
+	LegacyReports       *prometheus.CounterVec
+	ReportFiltered      *prometheus.CounterVec
+	ReportIgnored       *prometheus.CounterVec
+	ReportErrors        *prometheus.CounterVec
+	SinkReports         *prometheus.CounterVec
+	SinkDeliveryTime    *prometheus.HistogramVec
+	RequestDuration     *prometheus.HistogramVec
+	RequestsInFlight    *prometheus.GaugeVec
+	ArchiveUploads      *prometheus.CounterVec
+	ArchiveSpoolBytes   prometheus.Gauge
+	ArchiveDropped      prometheus.Counter
+	QueueDepth          prometheus.Gauge
+	QueueWaitTime       prometheus.Histogram
+	QueueDropped        *prometheus.CounterVec
+	QueueSpilled        prometheus.Counter
+	QueueWALBytes       prometheus.Gauge
 }
 
 func New(registry *prometheus.Registry) *Metrics {
@@ -37,6 +53,54 @@ func New(registry *prometheus.Registry) *Metrics {
 			},
 			[]string{"mode"},
 		),
+		DeprecationReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "deprecation_reports_total",
+				Help:      "Total number of successfully processed deprecation reports.",
+			},
+			[]string{"id"},
+		),
+		InterventionReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "intervention_reports_total",
+				Help:      "Total number of successfully processed intervention reports.",
+			},
+			[]string{"id"},
+		),
+		CrashReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "crash_reports_total",
+				Help:      "Total number of successfully processed crash reports.",
+			},
+			[]string{"reason"},
+		),
+		CrossOriginReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "cross_origin_reports_total",
+				Help:      "Total number of successfully processed COOP and COEP reports.",
+			},
+			[]string{"policy", "type", "mode"},
+		),
+		PolicyViolations: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "policy_violations_total",
+				Help:      "Total number of successfully processed Permissions-Policy and Document-Policy violation reports.",
+			},
+			[]string{"feature", "disposition"},
+		),
+		LegacyReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "legacy_reports_total",
+				Help:      "Total number of successfully processed Expect-CT and HPKP reports.",
+			},
+			[]string{"type"},
+		),
 		ReportFiltered: prometheus.NewCounterVec(
 			prometheus.CounterOpts{
 				Namespace: namespace,
@@ -61,6 +125,23 @@ func New(registry *prometheus.Registry) *Metrics {
 			},
 			[]string{"handler", "type"},
 		),
+		SinkReports: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "sink_reports_total",
+				Help:      "Total number of reports handled by batching sinks, by result.",
+			},
+			[]string{"sink", "result"},
+		),
+		SinkDeliveryTime: prometheus.NewHistogramVec(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "sink_delivery_duration_seconds",
+				Help:      "Time taken by sinks to deliver a batch, including retries.",
+				Buckets:   prometheus.DefBuckets,
+			},
+			[]string{"sink", "result"},
+		),
 		RequestDuration: prometheus.NewHistogramVec(
 			prometheus.HistogramOpts{
 				Namespace: namespace,
@@ -78,6 +159,65 @@ func New(registry *prometheus.Registry) *Metrics {
 			},
 			[]string{"handler", "route"},
 		),
+		ArchiveUploads: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "archive_uploads_total",
+				Help:      "Total number of archive segment uploads, by result.",
+			},
+			[]string{"result"},
+		),
+		ArchiveSpoolBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "archive_spool_bytes",
+				Help:      "Size of the archive segments held in the local spool.",
+			},
+		),
+		ArchiveDropped: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "archive_dropped_total",
+				Help:      "Total number of requests not archived because too many were waiting to be written.",
+			},
+		),
+		QueueDepth: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "queue_depth",
+				Help:      "Current number of requests held in the in-memory queue.",
+			},
+		),
+		QueueWaitTime: prometheus.NewHistogram(
+			prometheus.HistogramOpts{
+				Namespace: namespace,
+				Name:      "queue_wait_seconds",
+				Help:      "Time requests spent queued before being handled.",
+				Buckets:   prometheus.ExponentialBuckets(0.001, 4, 10),
+			},
+		),
+		QueueDropped: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "queue_dropped_total",
+				Help:      "Total number of requests dropped or rejected by the queue, by reason.",
+			},
+			[]string{"reason"},
+		),
+		QueueSpilled: prometheus.NewCounter(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Name:      "queue_spilled_total",
+				Help:      "Total number of requests spilled to the write-ahead log.",
+			},
+		),
+		QueueWALBytes: prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Namespace: namespace,
+				Name:      "queue_wal_bytes",
+				Help:      "Size of the queue's write-ahead log on disk.",
+			},
+		),
 	}
 
 	registry.MustRegister(
@@ -85,11 +225,27 @@ func New(registry *prometheus.Registry) *Metrics {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 		m.Reports,
 		m.NELReports,
+		m.DeprecationReports,
+		m.InterventionReports,
+		m.CrashReports,
+		m.CrossOriginReports,
+		m.PolicyViolations,
+		m.LegacyReports,
 		m.ReportFiltered,
 		m.ReportIgnored,
 		m.ReportErrors,
+		m.SinkReports,
+		m.SinkDeliveryTime,
 		m.RequestDuration,
 		m.RequestsInFlight,
+		m.ArchiveUploads,
+		m.ArchiveSpoolBytes,
+		m.ArchiveDropped,
+		m.QueueDepth,
+		m.QueueWaitTime,
+		m.QueueDropped,
+		m.QueueSpilled,
+		m.QueueWALBytes,
 	)
 
 	return m
@@ -32,6 +32,7 @@ func TestCountersIncrement(t *testing.T) {
 	m.ReportFiltered.WithLabelValues("csp", "blocked_uri").Inc()
 	m.ReportIgnored.WithLabelValues("nel", "unsupported_type").Inc()
 	m.ReportErrors.WithLabelValues("nel", "decode_error").Inc()
+	m.SinkReports.WithLabelValues("elasticsearch", "delivered").Inc()
 
 	if got := testutil.ToFloat64(m.Reports.WithLabelValues("csp", "enforced")); got != 1 {
 		t.Fatalf("reports_total = %v, want 1", got)
@@ -48,6 +49,9 @@ func TestCountersIncrement(t *testing.T) {
 	if got := testutil.ToFloat64(m.ReportErrors.WithLabelValues("nel", "decode_error")); got != 1 {
 		t.Fatalf("reports_errors_total = %v, want 1", got)
 	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "delivered")); got != 1 {
+		t.Fatalf("sink_reports_total = %v, want 1", got)
+	}
 }
 
 func TestHistogramObserves(t *testing.T) {
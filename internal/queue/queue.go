@@ -0,0 +1,497 @@
+// Package queue decouples accepting report requests from handling them, so
+// that a slow sink doesn't hold up browsers' report uploads.
+package queue
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// Policies for requests that arrive while the queue is full.
+const (
+	// DropNewest drops the request that arrived.
+	DropNewest = "drop-newest"
+
+	// DropOldest drops the request that has been queued longest to make
+	// room.
+	DropOldest = "drop-oldest"
+
+	// Spill appends the request to the write-ahead log, from which it is
+	// handled once the workers catch up.
+	Spill = "spill"
+
+	// Reject answers the request with 503 Service Unavailable, asking the
+	// browser to try again later.
+	Reject = "reject"
+)
+
+// Config configures a Queue.
+type Config struct {
+	// Size is the number of requests held in memory. Must be positive.
+	Size int
+
+	// Workers is the number of requests handled concurrently. Defaults to
+	// 4.
+	Workers int
+
+	// Policy is what happens to a request that arrives while the queue is
+	// full: DropNewest, DropOldest, Spill or Reject. Defaults to Reject.
+	Policy string
+
+	// WALDir is the directory of the write-ahead log. It is required by
+	// Spill, and when set, requests still queued when the queue is closed
+	// are kept in it too. Requests in the log are replayed once the queue
+	// is started, resuming from the last one read. After a crash, up to 100
+	// requests read from the log before it, plus those being handled, are
+	// replayed again.
+	WALDir string
+
+	// WALMaxSize caps the size of the write-ahead log in bytes. Requests
+	// that don't fit are rejected, or dropped at shutdown. Zero disables
+	// the limit.
+	WALMaxSize int64
+
+	// Metrics, if set, tracks queue depth, wait time and drops.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from the workers and the write-ahead
+	// log.
+	OnError func(error)
+}
+
+// job is a queued request. The body has already been read and decoded by
+// the time it is queued.
+type job struct {
+	Route      string      `json:"route"`
+	Method     string      `json:"method"`
+	URL        string      `json:"url"`
+	Host       string      `json:"host"`
+	Header     http.Header `json:"header"`
+	RemoteAddr string      `json:"remote_addr"`
+	Body       []byte      `json:"body"`
+	EnqueuedAt time.Time   `json:"enqueued_at"`
+
+	// ctx carries the request's trace to the worker. Jobs replayed from
+	// the write-ahead log have none.
+	ctx context.Context
+}
+
+// Queue holds accepted report requests in a bounded in-memory queue that
+// a pool of workers hands to the route's handler. Requests are answered
+// with 202 Accepted as soon as they are queued, so the status codes the
+// handler would have sent, e.g. for invalid reports, are not seen by the
+// browser; they are still counted in the metrics.
+type Queue struct {
+	cfg      Config
+	handlers map[string]http.Handler
+
+	mu      sync.Mutex
+	cond    *sync.Cond
+	jobs    []*job
+	closing bool
+
+	// walPending is set while the write-ahead log may hold unread jobs.
+	walPending bool
+	// walAppends counts spilled jobs, so that a worker that found the log
+	// empty can tell whether a job was spilled meanwhile.
+	walAppends int
+	// fromWAL alternates workers between the log and memory so that
+	// neither is starved.
+	fromWAL bool
+
+	// walMu guards the write-ahead log, so that its disk IO doesn't hold
+	// up the in-memory queue. It is never acquired while holding mu.
+	walMu     sync.Mutex
+	wal       *wal
+	walClosed bool
+
+	// stop cancels the context of requests being handled when Close gives
+	// up waiting for them.
+	stopped context.Context
+	stop    context.CancelFunc
+
+	wg sync.WaitGroup
+}
+
+// New validates cfg and opens the write-ahead log, if any. Routes are
+// added with Handler before the workers are started with Start.
+func New(cfg Config) (*Queue, error) {
+	if cfg.Size <= 0 {
+		return nil, fmt.Errorf("queue size must be positive")
+	}
+	if cfg.Workers <= 0 {
+		cfg.Workers = 4
+	}
+	if cfg.Policy == "" {
+		cfg.Policy = Reject
+	}
+	switch cfg.Policy {
+	case DropNewest, DropOldest, Reject:
+	case Spill:
+		if cfg.WALDir == "" {
+			return nil, fmt.Errorf("queue policy '%s' requires a write-ahead log directory", Spill)
+		}
+	default:
+		return nil, fmt.Errorf("unknown queue policy '%s'", cfg.Policy)
+	}
+
+	q := &Queue{cfg: cfg, handlers: make(map[string]http.Handler)}
+	q.cond = sync.NewCond(&q.mu)
+	q.stopped, q.stop = context.WithCancel(context.Background())
+
+	if cfg.WALDir != "" {
+		l, err := openWAL(cfg.WALDir, cfg.WALMaxSize)
+		if err != nil {
+			return nil, fmt.Errorf("unable to open write-ahead log: %w", err)
+		}
+		q.wal = l
+		q.walPending = l.size > 0
+		q.updateWALSize()
+	}
+
+	return q, nil
+}
+
+// Handler returns a handler that queues requests for h. route identifies
+// h in the write-ahead log, so it must be unique and stable across
+// restarts.
+func (q *Queue) Handler(route string, h http.Handler) http.Handler {
+	q.handlers[route] = h
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "unable to read body", http.StatusBadRequest)
+			return
+		}
+
+		j := &job{
+			Route:      route,
+			Method:     r.Method,
+			URL:        r.URL.String(),
+			Host:       r.Host,
+			Header:     r.Header.Clone(),
+			RemoteAddr: r.RemoteAddr,
+			Body:       body,
+			EnqueuedAt: time.Now(),
+			ctx:        context.WithoutCancel(r.Context()),
+		}
+
+		q.mu.Lock()
+		status := q.push(j)
+		q.mu.Unlock()
+		if status == statusSpill {
+			status = q.spill(j)
+		}
+
+		if status == http.StatusServiceUnavailable {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, http.StatusText(status), status)
+			return
+		}
+		w.WriteHeader(status)
+	})
+}
+
+// Start starts the workers. Requests left in the write-ahead log by a
+// previous run are handled alongside new ones.
+func (q *Queue) Start() {
+	q.wg.Add(q.cfg.Workers)
+	for i := 0; i < q.cfg.Workers; i++ {
+		go q.work()
+	}
+}
+
+// Close stops accepting requests and waits for the workers to handle the
+// queued ones until ctx is done. If ctx is done first, the context of the
+// requests being handled is cancelled and Close still waits for their
+// handlers to return, so that nothing is handed to the sinks after Close.
+// Requests that are still queued then are written to the write-ahead log,
+// if there is one, and dropped otherwise. Requests already in the log stay
+// there for the next run.
+func (q *Queue) Close(ctx context.Context) error {
+	q.mu.Lock()
+	q.closing = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		q.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+	}
+
+	// Take what is left so that the workers stop after their current
+	// request.
+	q.mu.Lock()
+	remaining := q.jobs
+	q.jobs = nil
+	q.updateDepth()
+	q.mu.Unlock()
+
+	q.stop()
+	<-done
+
+	q.walMu.Lock()
+	defer q.walMu.Unlock()
+
+	var errs []error
+	for _, j := range remaining {
+		if q.wal == nil {
+			q.drop("shutdown")
+			continue
+		}
+		if err := q.wal.append(j); err != nil {
+			q.drop("shutdown")
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		errs = []error{fmt.Errorf("dropped %d queued requests: %w", len(errs), errs[0])}
+	}
+	if q.wal == nil && len(remaining) > 0 {
+		errs = append(errs, fmt.Errorf("dropped %d queued requests", len(remaining)))
+	}
+	if q.wal != nil {
+		q.updateWALSize()
+		errs = append(errs, q.wal.close())
+		q.walClosed = true
+	}
+	return errors.Join(errs...)
+}
+
+// statusSpill is returned by push for a job that has to be spilled to the
+// write-ahead log.
+const statusSpill = -1
+
+// push queues j, applying the policy if the queue is full, and returns the
+// status to answer the request with, or statusSpill. The caller must hold
+// q.mu.
+func (q *Queue) push(j *job) int {
+	if q.closing {
+		return http.StatusServiceUnavailable
+	}
+
+	if len(q.jobs) < q.cfg.Size {
+		q.jobs = append(q.jobs, j)
+		q.updateDepth()
+		q.cond.Signal()
+		return http.StatusAccepted
+	}
+
+	switch q.cfg.Policy {
+	case DropNewest:
+		q.drop("newest")
+		return http.StatusAccepted
+	case DropOldest:
+		q.pop()
+		q.drop("oldest")
+		q.jobs = append(q.jobs, j)
+		q.updateDepth()
+		q.cond.Signal()
+		return http.StatusAccepted
+	case Spill:
+		return statusSpill
+	default:
+		q.drop("rejected")
+		return http.StatusServiceUnavailable
+	}
+}
+
+// spill appends j to the write-ahead log and returns the status to answer
+// the request with.
+func (q *Queue) spill(j *job) int {
+	q.walMu.Lock()
+	err := errWALClosed
+	if !q.walClosed {
+		err = q.wal.append(j)
+		q.updateWALSize()
+	}
+	q.walMu.Unlock()
+
+	if err != nil {
+		switch {
+		case errors.Is(err, errWALFull):
+			q.drop("wal_full")
+		case errors.Is(err, errWALClosed):
+			q.drop("rejected")
+		default:
+			q.drop("wal_error")
+			q.onError(fmt.Errorf("unable to spill request: %w", err))
+		}
+		return http.StatusServiceUnavailable
+	}
+
+	if q.cfg.Metrics != nil {
+		q.cfg.Metrics.QueueSpilled.Inc()
+	}
+	q.mu.Lock()
+	q.walPending = true
+	q.walAppends++
+	q.cond.Signal()
+	q.mu.Unlock()
+	return http.StatusAccepted
+}
+
+// readWAL returns the next job in the write-ahead log, or nil if it has
+// none.
+func (q *Queue) readWAL() (*job, error) {
+	q.walMu.Lock()
+	defer q.walMu.Unlock()
+
+	if q.walClosed {
+		return nil, nil
+	}
+	j, err := q.wal.next()
+	q.updateWALSize()
+	return j, err
+}
+
+// take returns the next job to handle, blocking until there is one. It
+// returns nil once the queue is closing and empty.
+func (q *Queue) take() *job {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closing {
+			if len(q.jobs) == 0 {
+				return nil
+			}
+			return q.pop()
+		}
+
+		if q.walPending && (len(q.jobs) == 0 || q.fromWAL) {
+			q.fromWAL = false
+			appends := q.walAppends
+
+			q.mu.Unlock()
+			j, err := q.readWAL()
+			q.mu.Lock()
+
+			if err != nil {
+				q.onError(err)
+			}
+			if j != nil {
+				return j
+			}
+			if err == nil && appends == q.walAppends {
+				q.walPending = false
+			}
+			continue
+		}
+
+		if len(q.jobs) > 0 {
+			q.fromWAL = true
+			return q.pop()
+		}
+		q.cond.Wait()
+	}
+}
+
+// pop removes the oldest job from memory. The caller must hold q.mu.
+func (q *Queue) pop() *job {
+	j := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	q.updateDepth()
+	return j
+}
+
+func (q *Queue) work() {
+	defer q.wg.Done()
+	for {
+		j := q.take()
+		if j == nil {
+			return
+		}
+		q.handle(j)
+	}
+}
+
+// handle replays j against its route's handler, discarding the response.
+func (q *Queue) handle(j *job) {
+	if q.cfg.Metrics != nil {
+		q.cfg.Metrics.QueueWaitTime.Observe(time.Since(j.EnqueuedAt).Seconds())
+	}
+
+	defer func() {
+		if err := recover(); err != nil {
+			q.onError(fmt.Errorf("panic handling queued request to %s: %v", j.Route, err))
+		}
+	}()
+
+	h, ok := q.handlers[j.Route]
+	if !ok {
+		q.drop("unknown_route")
+		q.onError(fmt.Errorf("no handler for queued request to %s", j.Route))
+		return
+	}
+
+	ctx := j.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer context.AfterFunc(q.stopped, cancel)()
+
+	req, err := http.NewRequestWithContext(ctx, j.Method, j.URL, bytes.NewReader(j.Body))
+	if err != nil {
+		q.drop("invalid_request")
+		q.onError(fmt.Errorf("unable to replay queued request to %s: %w", j.Route, err))
+		return
+	}
+	req.Host = j.Host
+	req.Header = j.Header
+	req.RemoteAddr = j.RemoteAddr
+	h.ServeHTTP(&discardResponse{header: make(http.Header)}, req)
+}
+
+// drop counts a request dropped for reason.
+func (q *Queue) drop(reason string) {
+	if q.cfg.Metrics != nil {
+		q.cfg.Metrics.QueueDropped.WithLabelValues(reason).Inc()
+	}
+}
+
+func (q *Queue) updateDepth() {
+	if q.cfg.Metrics != nil {
+		q.cfg.Metrics.QueueDepth.Set(float64(len(q.jobs)))
+	}
+}
+
+// updateWALSize tracks the size of the write-ahead log. The caller must
+// hold q.walMu.
+func (q *Queue) updateWALSize() {
+	if q.cfg.Metrics != nil {
+		q.cfg.Metrics.QueueWALBytes.Set(float64(q.wal.size))
+	}
+}
+
+func (q *Queue) onError(err error) {
+	if q.cfg.OnError != nil {
+		q.cfg.OnError(err)
+	}
+}
+
+// discardResponse is the ResponseWriter of queued requests, whose client
+// has already been answered.
+type discardResponse struct {
+	header http.Header
+}
+
+func (d *discardResponse) Header() http.Header         { return d.header }
+func (d *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (d *discardResponse) WriteHeader(int)             {}
@@ -0,0 +1,238 @@
+package queue
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// recordingHandler records the bodies of the requests it handles. If
+// release is set, each request blocks until it is closed or the request's
+// context is done, after announcing itself on started.
+type recordingHandler struct {
+	started chan string
+	release chan struct{}
+
+	mu     sync.Mutex
+	bodies []string
+	done   chan struct{}
+	want   int
+}
+
+func newRecordingHandler(want int, blocking bool) *recordingHandler {
+	h := &recordingHandler{done: make(chan struct{}), want: want, started: make(chan string, 10)}
+	if blocking {
+		h.release = make(chan struct{})
+	}
+	return h
+}
+
+func (h *recordingHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	h.started <- string(body)
+	if h.release != nil {
+		select {
+		case <-h.release:
+		case <-r.Context().Done():
+		}
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.bodies = append(h.bodies, string(body))
+	if len(h.bodies) == h.want {
+		close(h.done)
+	}
+}
+
+func (h *recordingHandler) wait(t *testing.T) []string {
+	t.Helper()
+	select {
+	case <-h.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for queued requests to be handled")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.bodies...)
+}
+
+func post(h http.Handler, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/csp?source=test", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/csp-report")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestQueueHandlesRequestsAsynchronously(t *testing.T) {
+	var got *http.Request
+	h := newRecordingHandler(1, false)
+	q, err := New(Config{Size: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := q.Handler("/csp", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+		h.ServeHTTP(w, r)
+	}))
+
+	rec := post(handler, "report")
+	if rec.Code != http.StatusAccepted {
+		t.Errorf("expected the request to be accepted, got %d", rec.Code)
+	}
+
+	q.Start()
+	if bodies := h.wait(t); len(bodies) != 1 || bodies[0] != "report" {
+		t.Errorf("unexpected bodies %q", bodies)
+	}
+	if got.URL.Query().Get("source") != "test" || got.Header.Get("Content-Type") != "application/csp-report" {
+		t.Errorf("expected the request to be replayed as received, got %s %v", got.URL, got.Header)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestQueuePolicies(t *testing.T) {
+	cases := []struct {
+		policy string
+		status int
+		reason string
+		want   []string
+	}{
+		{Reject, http.StatusServiceUnavailable, "rejected", []string{"1", "2"}},
+		{DropNewest, http.StatusAccepted, "newest", []string{"1", "2"}},
+		{DropOldest, http.StatusAccepted, "oldest", []string{"1", "3"}},
+	}
+	for _, c := range cases {
+		t.Run(c.policy, func(t *testing.T) {
+			m := metrics.New(prometheus.NewRegistry())
+			q, err := New(Config{Size: 1, Workers: 1, Policy: c.policy, Metrics: m})
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := newRecordingHandler(2, true)
+			handler := q.Handler("/csp", h)
+			q.Start()
+
+			// The first request occupies the only worker and the second
+			// fills the queue.
+			post(handler, "1")
+			<-h.started
+			post(handler, "2")
+			if got := testutil.ToFloat64(m.QueueDepth); got != 1 {
+				t.Errorf("queue_depth = %v, want 1", got)
+			}
+
+			rec := post(handler, "3")
+			if rec.Code != c.status {
+				t.Errorf("expected %d when the queue is full, got %d", c.status, rec.Code)
+			}
+			if c.status == http.StatusServiceUnavailable && rec.Header().Get("Retry-After") == "" {
+				t.Error("expected a Retry-After header")
+			}
+			if got := testutil.ToFloat64(m.QueueDropped.WithLabelValues(c.reason)); got != 1 {
+				t.Errorf("queue_dropped_total{reason=%s} = %v, want 1", c.reason, got)
+			}
+
+			close(h.release)
+			if bodies := h.wait(t); strings.Join(bodies, ",") != strings.Join(c.want, ",") {
+				t.Errorf("expected %v to be handled, got %v", c.want, bodies)
+			}
+			if err := q.Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestQueueSpillsAndReplaysAfterRestart(t *testing.T) {
+	dir := t.TempDir()
+	m := metrics.New(prometheus.NewRegistry())
+	q, err := New(Config{Size: 1, Workers: 1, Policy: Spill, WALDir: dir, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := newRecordingHandler(1, true)
+	handler := q.Handler("/csp", h)
+	q.Start()
+
+	post(handler, "1")
+	<-h.started
+	for _, body := range []string{"2", "3", "4"} {
+		if rec := post(handler, body); rec.Code != http.StatusAccepted {
+			t.Fatalf("expected %s to be accepted, got %d", body, rec.Code)
+		}
+	}
+	if got := testutil.ToFloat64(m.QueueSpilled); got != 2 {
+		t.Errorf("queue_spilled_total = %v, want 2", got)
+	}
+
+	// Stopping while the worker is stuck cancels the request it is
+	// handling, waits for it and keeps the queued request too.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := q.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	h.mu.Lock()
+	handled := len(h.bodies)
+	h.mu.Unlock()
+	if handled != 1 {
+		t.Errorf("expected Close to wait for the request being handled, %d handled", handled)
+	}
+	if rec := post(handler, "5"); rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected requests to be refused once closed, got %d", rec.Code)
+	}
+
+	m = metrics.New(prometheus.NewRegistry())
+	q, err = New(Config{Size: 10, Policy: Reject, WALDir: dir, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := testutil.ToFloat64(m.QueueWALBytes); got == 0 {
+		t.Error("expected queue_wal_bytes to count the log left behind")
+	}
+	replayed := newRecordingHandler(3, false)
+	q.Handler("/csp", replayed)
+	q.Start()
+
+	bodies := replayed.wait(t)
+	if strings.Join(bodies, ",") != "3,4,2" {
+		t.Errorf("expected the spilled requests to be replayed in order, got %v", bodies)
+	}
+	// The log is removed once the worker finds nothing more to read.
+	deadline := time.Now().Add(5 * time.Second)
+	for testutil.ToFloat64(m.QueueWALBytes) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the write-ahead log to be removed once replayed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err := q.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	cases := []Config{
+		{},
+		{Size: 1, Policy: "drop-random"},
+		{Size: 1, Policy: Spill},
+	}
+	for _, cfg := range cases {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
@@ -0,0 +1,407 @@
+package queue
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	walExt = ".wal"
+
+	// walFrameHeaderSize is the length and CRC-32 that precede each record.
+	walFrameHeaderSize = 8
+
+	// walSegmentSize rotates the segment being appended to once it grows
+	// beyond this, so that consumed segments can be removed. It also bounds
+	// the size of a record.
+	walSegmentSize = 16 << 20
+
+	// walCheckpointFile holds the position of the reader, so that jobs
+	// already read aren't replayed by the next run.
+	walCheckpointFile = "checkpoint"
+
+	// walCheckpointInterval is the number of jobs read between
+	// checkpoints, which bounds how many are replayed after a crash.
+	walCheckpointInterval = 100
+)
+
+var (
+	// errWALFull is returned by append when the log has reached its size
+	// limit.
+	errWALFull = errors.New("write-ahead log full")
+
+	// errWALRecordTooLarge is returned by append for a job that doesn't fit
+	// in a segment.
+	errWALRecordTooLarge = errors.New("request too large for the write-ahead log")
+
+	// errWALClosed is returned for jobs spilled after the queue closed the
+	// log.
+	errWALClosed = errors.New("write-ahead log closed")
+)
+
+// wal is an append-only log of jobs on disk, split into numbered segments.
+// Jobs are read back in the order they were appended. A segment is removed
+// once every job in it has been read, and the position in the segment
+// being read is checkpointed every walCheckpointInterval jobs and when the
+// log is closed. A later run resumes from the checkpoint, so after a crash
+// up to walCheckpointInterval jobs already read, plus those being handled,
+// are replayed; delivery is at least once.
+//
+// wal is not safe for concurrent use.
+type wal struct {
+	dir     string
+	maxSize int64
+
+	// size is the total size of the segments on disk.
+	size int64
+
+	w     *os.File
+	wSeq  int
+	wSize int64
+
+	r    *bufio.Reader
+	rf   *os.File
+	rSeq int
+	rOff int64
+
+	// unsaved counts the jobs read since the last checkpoint.
+	unsaved int
+}
+
+// walCheckpoint is the position of the next job to read.
+type walCheckpoint struct {
+	Segment int   `json:"segment"`
+	Offset  int64 `json:"offset"`
+}
+
+// openWAL opens the log in dir, keeping segments left by a previous run
+// to be read first, from the checkpoint if there is one. maxSize caps the
+// size of the log; zero disables the limit.
+func openWAL(dir string, maxSize int64) (*wal, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	l := &wal{dir: dir, maxSize: maxSize}
+	seqs, err := l.segments()
+	if err != nil {
+		return nil, err
+	}
+	for _, seq := range seqs {
+		info, err := os.Stat(l.path(seq))
+		if err != nil {
+			return nil, err
+		}
+		l.size += info.Size()
+		l.wSeq = seq
+	}
+
+	cp, err := l.readCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if len(seqs) > 0 && cp.Segment == seqs[0] {
+		l.rSeq, l.rOff = cp.Segment, cp.Offset
+	} else if err := l.removeCheckpoint(); err != nil {
+		// The checkpoint is for a segment that was already removed, and
+		// must not apply to a new one with the same number.
+		return nil, err
+	}
+	return l, nil
+}
+
+// append writes j to the end of the log.
+func (l *wal) append(j *job) error {
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	n := int64(walFrameHeaderSize + len(data))
+	if n > walSegmentSize {
+		return errWALRecordTooLarge
+	}
+	if l.maxSize > 0 && l.size+n > l.maxSize {
+		return errWALFull
+	}
+
+	if l.w == nil || l.wSize+n > walSegmentSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+
+	frame := make([]byte, walFrameHeaderSize, n)
+	binary.BigEndian.PutUint32(frame[0:4], uint32(len(data)))
+	binary.BigEndian.PutUint32(frame[4:8], crc32.ChecksumIEEE(data))
+	frame = append(frame, data...)
+
+	if _, err := l.w.Write(frame); err != nil {
+		return err
+	}
+	l.wSize += n
+	l.size += n
+	return nil
+}
+
+// next returns the oldest unread job, or nil if every job has been read.
+// A torn or corrupt record ends its segment; the rest of it is skipped and
+// the error returned.
+func (l *wal) next() (*job, error) {
+	reopened := false
+	for {
+		if l.r == nil {
+			seqs, err := l.segments()
+			if err != nil {
+				return nil, err
+			}
+			if len(seqs) == 0 {
+				return nil, nil
+			}
+			if err := l.openReader(seqs[0]); err != nil {
+				return nil, err
+			}
+		}
+
+		j, n, err := l.read()
+		if err == nil {
+			l.rOff += n
+			l.unsaved++
+			if l.unsaved >= walCheckpointInterval {
+				err = l.checkpoint()
+			}
+			return j, err
+		}
+
+		active := l.w != nil && l.rSeq == l.wSeq
+		if active && l.rOff < l.wSize && !reopened {
+			// The reader buffered the end of the segment before the
+			// writer appended more.
+			if err := l.openReader(l.rSeq); err != nil {
+				return nil, err
+			}
+			reopened = true
+			continue
+		}
+
+		torn := !errors.Is(err, io.EOF) || (active && l.rOff < l.wSize)
+		path := l.path(l.rSeq)
+		if rmErr := l.removeReadSegment(active); rmErr != nil {
+			return nil, rmErr
+		}
+		if torn {
+			return nil, fmt.Errorf("skipped the rest of write-ahead log segment %s: %w", path, err)
+		}
+		if active {
+			return nil, nil
+		}
+	}
+}
+
+// read decodes the record at the reader's position, returning its size.
+func (l *wal) read() (*job, int64, error) {
+	var header [walFrameHeaderSize]byte
+	if _, err := io.ReadFull(l.r, header[:]); err != nil {
+		return nil, 0, err
+	}
+	// A corrupt length could be anything, so check it before allocating.
+	size := binary.BigEndian.Uint32(header[0:4])
+	if size > walSegmentSize-walFrameHeaderSize {
+		return nil, 0, fmt.Errorf("record size %d exceeds the segment size", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(l.r, data); err != nil {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if crc32.ChecksumIEEE(data) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, 0, errors.New("checksum mismatch")
+	}
+
+	var j job
+	if err := json.Unmarshal(data, &j); err != nil {
+		return nil, 0, err
+	}
+	return &j, int64(walFrameHeaderSize + len(data)), nil
+}
+
+// openReader opens segment seq for reading at the current offset, or the
+// start if it is a different segment.
+func (l *wal) openReader(seq int) error {
+	if l.rf != nil {
+		l.rf.Close()
+	}
+	if seq != l.rSeq {
+		l.rOff = 0
+	}
+	f, err := os.Open(l.path(seq))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Seek(l.rOff, io.SeekStart); err != nil {
+		f.Close()
+		return err
+	}
+	l.rf, l.r, l.rSeq = f, bufio.NewReader(f), seq
+	return nil
+}
+
+// removeReadSegment removes the segment that has been read. If it is the
+// one being appended to, appending continues in a new segment.
+func (l *wal) removeReadSegment(active bool) error {
+	path := l.path(l.rSeq)
+	info, statErr := os.Stat(path)
+
+	// Removing the checkpoint first means a crash in between replays the
+	// segment rather than applying the checkpoint to the next one.
+	if err := l.removeCheckpoint(); err != nil {
+		return err
+	}
+
+	l.rf.Close()
+	l.rf, l.r = nil, nil
+	if active {
+		l.w.Close()
+		l.w, l.wSize = nil, 0
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if statErr == nil {
+		l.size -= info.Size()
+	}
+	// The next segment is read from its start.
+	l.rSeq, l.rOff = 0, 0
+	return nil
+}
+
+// rotate starts a new segment to append to.
+func (l *wal) rotate() error {
+	if l.w != nil {
+		if err := l.w.Close(); err != nil {
+			return err
+		}
+	}
+	l.wSeq++
+	f, err := os.OpenFile(l.path(l.wSeq), os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	l.w, l.wSize = f, 0
+	return nil
+}
+
+// close checkpoints the reader, syncs the segment being appended to and
+// closes the log. Appends are otherwise left to the page cache, so they
+// survive the process stopping but not the host.
+func (l *wal) close() error {
+	var err error
+	if l.rf != nil {
+		if l.unsaved > 0 {
+			err = l.checkpoint()
+		}
+		l.rf.Close()
+		l.rf, l.r = nil, nil
+	}
+	if l.w == nil {
+		return err
+	}
+	if serr := l.w.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := l.w.Close(); err == nil {
+		err = cerr
+	}
+	l.w = nil
+	return err
+}
+
+// checkpoint saves the reader's position. The file is replaced atomically
+// and synced, so a crash leaves either the old or the new checkpoint.
+func (l *wal) checkpoint() error {
+	data, err := json.Marshal(walCheckpoint{Segment: l.rSeq, Offset: l.rOff})
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(l.dir, walCheckpointFile)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if serr := f.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to checkpoint write-ahead log: %w", err)
+	}
+	l.unsaved = 0
+	return nil
+}
+
+// readCheckpoint returns the saved position, or the zero value if there is
+// none. A checkpoint that can't be decoded is ignored, which replays its
+// segment from the start.
+func (l *wal) readCheckpoint() (walCheckpoint, error) {
+	var cp walCheckpoint
+	data, err := os.ReadFile(filepath.Join(l.dir, walCheckpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	if err := json.Unmarshal(data, &cp); err != nil || cp.Offset < 0 {
+		return walCheckpoint{}, nil
+	}
+	return cp, nil
+}
+
+func (l *wal) removeCheckpoint() error {
+	l.unsaved = 0
+	err := os.Remove(filepath.Join(l.dir, walCheckpointFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// segments returns the sequence numbers of the segments on disk, oldest
+// first.
+func (l *wal) segments() ([]int, error) {
+	entries, err := os.ReadDir(l.dir)
+	if err != nil {
+		return nil, err
+	}
+	var seqs []int
+	for _, e := range entries {
+		var seq int
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walExt) {
+			continue
+		}
+		if _, err := fmt.Sscanf(strings.TrimSuffix(name, walExt), "%d", &seq); err == nil {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Ints(seqs)
+	return seqs, nil
+}
+
+func (l *wal) path(seq int) string {
+	return filepath.Join(l.dir, fmt.Sprintf("%016d%s", seq, walExt))
+}
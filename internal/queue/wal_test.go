@@ -0,0 +1,183 @@
+package queue
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestWALSkipsTornRecords(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, route := range []string{"/csp", "/nel"} {
+		if err := l.append(&job{Route: route, Body: []byte("{}")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a crash part way through the second append.
+	path := l.path(1)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	j, err := l.next()
+	if err != nil || j == nil || j.Route != "/csp" {
+		t.Fatalf("expected the intact record, got %+v, %v", j, err)
+	}
+	if j, err := l.next(); err == nil || j != nil {
+		t.Errorf("expected the torn record to be reported, got %+v, %v", j, err)
+	}
+	if j, err := l.next(); err != nil || j != nil {
+		t.Errorf("expected the log to be drained, got %+v, %v", j, err)
+	}
+	if l.size != 0 {
+		t.Errorf("expected the segment to be removed, %d bytes left", l.size)
+	}
+}
+
+func TestWALSkipsRecordsWithCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(&job{Route: "/csp"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Overwrite the length of the record with a huge one.
+	f, err := os.OpenFile(l.path(1), os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{0xff, 0xff, 0xff, 0xff}, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	l, err = openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	if j, err := l.next(); err == nil || j != nil {
+		t.Errorf("expected the corrupt record to be reported, got %+v, %v", j, err)
+	}
+	if l.size != 0 {
+		t.Errorf("expected the segment to be removed, %d bytes left", l.size)
+	}
+}
+
+func TestWALRejectsOversizedRecords(t *testing.T) {
+	l, err := openWAL(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	if err := l.append(&job{Route: "/csp", Body: make([]byte, walSegmentSize)}); err != errWALRecordTooLarge {
+		t.Errorf("expected the record to be rejected, got %v", err)
+	}
+}
+
+func TestWALEnforcesMaxSize(t *testing.T) {
+	l, err := openWAL(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.close()
+
+	if err := l.append(&job{Route: "/csp"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.append(&job{Route: "/csp"}); err != errWALFull {
+		t.Errorf("expected the log to be full, got %v", err)
+	}
+}
+
+func TestWALResumesFromCheckpoint(t *testing.T) {
+	dir := t.TempDir()
+	l, err := openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	total := walCheckpointInterval + 10
+	for i := 0; i < total; i++ {
+		if err := l.append(&job{URL: strconv.Itoa(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Crash after reading past the first checkpoint: only the jobs read
+	// since are replayed.
+	for i := 0; i < walCheckpointInterval+2; i++ {
+		if _, err := l.next(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := l.w.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err := l.next()
+	if err != nil || j == nil || j.URL != strconv.Itoa(walCheckpointInterval) {
+		t.Fatalf("expected to resume from the checkpoint, got %+v, %v", j, err)
+	}
+
+	// Closing checkpoints the position, so nothing is replayed.
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	l, err = openWAL(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	j, err = l.next()
+	if err != nil || j == nil || j.URL != strconv.Itoa(walCheckpointInterval+1) {
+		t.Fatalf("expected to resume after the last job read, got %+v, %v", j, err)
+	}
+
+	// Draining the log removes the checkpoint along with the segment, so
+	// it doesn't apply to the next segment 1.
+	for {
+		j, err := l.next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if j == nil {
+			break
+		}
+	}
+	if err := l.close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, walCheckpointFile)); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed, got %v", err)
+	}
+}
@@ -0,0 +1,279 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// ErrBufferFull is returned by Write when a report had to be dropped to
+// stay within a sink's buffer limit. The report passed to Write is still
+// buffered, and the drop is counted in the sink's metrics.
+var ErrBufferFull = errors.New("buffer full, dropped oldest report")
+
+// BatchConfig configures how a batching sink buffers reports and retries
+// failed sends. Zero values are replaced with the defaults noted on each
+// field, unless the sink documents its own.
+type BatchConfig struct {
+	// BatchSize is the number of reports that triggers a send. Defaults to
+	// 500.
+	BatchSize int
+
+	// FlushInterval is the longest a report is buffered before it is
+	// sent. Defaults to one second.
+	FlushInterval time.Duration
+
+	// MaxBuffered caps the reports held while sends are failing. Once
+	// reached the oldest reports are dropped. Defaults to 10 times
+	// BatchSize.
+	MaxBuffered int
+
+	// MinBackoff and MaxBackoff bound the delay between retries after a
+	// failed send. The delay doubles after each failure. Default to 500ms
+	// and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// batchConfig configures a batcher.
+type batchConfig struct {
+	BatchConfig
+
+	// Name is the sink's label in metrics.
+	Name string
+
+	// Metrics, if set, counts the sink's delivered, failed and dropped
+	// reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background sends.
+	OnError func(error)
+}
+
+// sendFunc delivers a batch. Reports that should be retried are returned,
+// along with an error describing any failure. Reports that are neither
+// returned nor delivered are considered permanently failed.
+type sendFunc func(ctx context.Context, batch []Report) (retry []Report, err error)
+
+// batcher buffers reports for the batching sinks and sends them from a
+// background goroutine, retrying failed sends with exponential backoff.
+type batcher struct {
+	cfg  batchConfig
+	send sendFunc
+
+	mu     sync.Mutex
+	buffer []Report
+
+	// sending serialises sends so that reports returned for retry go back
+	// on the buffer before the next batch is taken.
+	sending sync.Mutex
+
+	kick      chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newBatcher(cfg batchConfig, send sendFunc) *batcher {
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 500
+	}
+	if cfg.FlushInterval <= 0 {
+		cfg.FlushInterval = time.Second
+	}
+	if cfg.MaxBuffered <= 0 {
+		cfg.MaxBuffered = 10 * cfg.BatchSize
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+
+	b := &batcher{
+		cfg:  cfg,
+		send: send,
+		kick: make(chan struct{}, 1),
+		done: make(chan struct{}),
+	}
+
+	b.wg.Add(1)
+	go b.run()
+
+	return b
+}
+
+// add buffers r, dropping the oldest report if the buffer is full.
+func (b *batcher) add(r Report) error {
+	b.mu.Lock()
+	var err error
+	if len(b.buffer) >= b.cfg.MaxBuffered {
+		b.buffer = b.buffer[1:]
+		err = ErrBufferFull
+	}
+	b.buffer = append(b.buffer, r)
+	full := len(b.buffer) >= b.cfg.BatchSize
+	b.mu.Unlock()
+
+	if err != nil {
+		b.count("dropped", 1)
+	}
+	if full {
+		select {
+		case b.kick <- struct{}{}:
+		default:
+		}
+	}
+	return err
+}
+
+// buffered returns the number of reports waiting to be sent.
+func (b *batcher) buffered() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return len(b.buffer)
+}
+
+// flush sends the reports buffered when it is called, in batches of at
+// most BatchSize, retrying with backoff until they are delivered or ctx is done.
+func (b *batcher) flush(ctx context.Context) error {
+	var errs []error
+	remaining := b.buffered()
+	backoff := b.cfg.MinBackoff
+	for {
+		sent, retry, err := b.sendOnce(ctx)
+		if !retry {
+			if err != nil {
+				errs = append(errs, err)
+			}
+			remaining -= sent
+			if remaining <= 0 || sent == 0 {
+				return errors.Join(errs...)
+			}
+			backoff = b.cfg.MinBackoff
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(append(errs, err)...)
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, b.cfg.MaxBackoff)
+	}
+}
+
+// close stops the background loop. It doesn't send anything itself, so it
+// returns promptly; reports still buffered are counted as dropped, and
+// callers that want them delivered must flush with a deadline first.
+func (b *batcher) close() error {
+	b.closeOnce.Do(func() { close(b.done) })
+	b.wg.Wait()
+
+	b.mu.Lock()
+	dropped := len(b.buffer)
+	b.buffer = nil
+	b.mu.Unlock()
+
+	if dropped == 0 {
+		return nil
+	}
+	b.count("dropped", dropped)
+	return fmt.Errorf("closed with %d unsent reports", dropped)
+}
+
+func (b *batcher) run() {
+	defer b.wg.Done()
+
+	ticker := time.NewTicker(b.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.done:
+			return
+		case <-ticker.C:
+		case <-b.kick:
+		}
+
+		// Send until less than a full batch is left, which waits for the
+		// next tick.
+		backoff := b.cfg.MinBackoff
+		for {
+			sent, retry, err := b.sendOnce(context.Background())
+			if err != nil && b.cfg.OnError != nil {
+				if retry {
+					err = fmt.Errorf("%w (retrying in %s)", err, backoff)
+				}
+				b.cfg.OnError(err)
+			}
+			if !retry {
+				if sent == 0 || b.buffered() < b.cfg.BatchSize {
+					break
+				}
+				backoff = b.cfg.MinBackoff
+				continue
+			}
+
+			select {
+			case <-b.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, b.cfg.MaxBackoff)
+		}
+	}
+}
+
+// sendOnce makes a single attempt to send up to BatchSize buffered reports,
+// returning how many were taken from the buffer and whether any need to
+// be retried.
+func (b *batcher) sendOnce(ctx context.Context) (int, bool, error) {
+	b.sending.Lock()
+	defer b.sending.Unlock()
+
+	b.mu.Lock()
+	n := min(len(b.buffer), b.cfg.BatchSize)
+	batch := b.buffer[:n:n]
+	b.buffer = b.buffer[n:]
+	b.mu.Unlock()
+
+	if n == 0 {
+		// Still give the sink a chance to run setup such as migrations.
+		_, err := b.send(ctx, nil)
+		return 0, err != nil, err
+	}
+
+	retry, err := b.send(ctx, batch)
+	if len(retry) == 0 {
+		return n, false, err
+	}
+
+	b.mu.Lock()
+	b.buffer = append(retry, b.buffer...)
+	dropped := len(b.buffer) - b.cfg.MaxBuffered
+	if dropped > 0 {
+		b.buffer = b.buffer[dropped:]
+	}
+	b.mu.Unlock()
+
+	if dropped > 0 {
+		b.count("dropped", dropped)
+	}
+	return n, true, err
+}
+
+// count adds n reports with the given result, `delivered`, `failed` or
+// `dropped`, to the sink's metrics. Sends count their own deliveries and
+// failures; the batcher counts drops.
+func (b *batcher) count(result string, n int) {
+	if b.cfg.Metrics == nil || n == 0 {
+		return
+	}
+	b.cfg.Metrics.SinkReports.WithLabelValues(b.cfg.Name, result).Add(float64(n))
+}
@@ -0,0 +1,88 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestBatcherSendsAtMostSizePerBatch(t *testing.T) {
+	var mu sync.Mutex
+	failing := true
+	var sizes []int
+	delivered := 0
+	send := func(_ context.Context, batch []Report) ([]Report, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(batch) == 0 {
+			return nil, nil
+		}
+		sizes = append(sizes, len(batch))
+		if failing {
+			return batch, errors.New("unavailable")
+		}
+		delivered += len(batch)
+		return nil, nil
+	}
+	b := newBatcher(batchConfig{BatchConfig: BatchConfig{BatchSize: 3, FlushInterval: time.Hour, MaxBuffered: 100, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}}, send)
+	defer b.close()
+
+	for i := 0; i < 10; i++ {
+		_ = b.add(sampleReport(i))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := b.flush(ctx); err == nil {
+		t.Fatal("expected flush to fail while the backend is down")
+	}
+
+	mu.Lock()
+	failing = false
+	mu.Unlock()
+	if err := b.flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if delivered != 10 {
+		t.Errorf("expected all 10 reports to be delivered, got %d", delivered)
+	}
+	for i, n := range sizes {
+		if n > 3 {
+			t.Errorf("send %d: expected at most 3 reports, got %d", i, n)
+		}
+	}
+}
+
+func TestBatcherCloseDropsUnsentReports(t *testing.T) {
+	sent := make(chan []Report, 1)
+	send := func(_ context.Context, batch []Report) ([]Report, error) {
+		if len(batch) > 0 {
+			sent <- batch
+		}
+		return nil, nil
+	}
+	m := metrics.New(prometheus.NewRegistry())
+	b := newBatcher(batchConfig{BatchConfig: BatchConfig{BatchSize: 10, FlushInterval: time.Hour}, Name: "test", Metrics: m}, send)
+
+	_ = b.add(sampleReport(1))
+	if err := b.close(); err == nil {
+		t.Error("expected the unsent report to be reported")
+	}
+	if dropped := testutil.ToFloat64(m.SinkReports.WithLabelValues("test", "dropped")); dropped != 1 {
+		t.Errorf("expected 1 dropped report, got %v", dropped)
+	}
+	select {
+	case batch := <-sent:
+		t.Errorf("expected close not to send, got %d reports", len(batch))
+	default:
+	}
+}
@@ -0,0 +1,285 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+const (
+	// CloudEventTypePrefix prefixes the `type` of every event.
+	CloudEventTypePrefix = "com.csp-collector."
+
+	cloudEventsSpecVersion = "1.0"
+)
+
+// cloudEventTypes names the events of report types whose Reporting API name
+// doesn't describe them well. Other types are used as is.
+var cloudEventTypes = map[string]string{
+	"network-error": "nel-report",
+}
+
+// cloudEventNamespace is the namespace of the name based event IDs.
+var cloudEventNamespace = uuid.MustParse("7c0b3b8e-4a4e-4f0e-9d36-2b1f4e1c6a52")
+
+// CloudEvent is a report in the CloudEvents 1.0 JSON format.
+type CloudEvent struct {
+	SpecVersion     string                 `json:"specversion"`
+	ID              string                 `json:"id"`
+	Source          string                 `json:"source"`
+	Type            string                 `json:"type"`
+	Subject         string                 `json:"subject,omitempty"`
+	Time            string                 `json:"time"`
+	DataContentType string                 `json:"datacontenttype"`
+	Data            map[string]interface{} `json:"data"`
+}
+
+// NewCloudEvent wraps r in a CloudEvent. The event `source` is the
+// document's origin, falling back to `csp-collector`, and `subject` is the
+// effective directive of CSP violations. `id` is derived from the report
+// so that an event keeps its ID across retries and outputs.
+func NewCloudEvent(r Report) (CloudEvent, error) {
+	data := r.Document()
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return CloudEvent{}, err
+	}
+
+	typ, ok := cloudEventTypes[r.Type]
+	if !ok {
+		typ = r.Type
+	}
+	source := r.Origin()
+	if source == "" {
+		source = "csp-collector"
+	}
+	subject, _ := r.Fields["effective_directive"].(string)
+	if subject == "" {
+		subject, _ = r.Fields["violated_directive"].(string)
+	}
+
+	return CloudEvent{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              uuid.NewSHA1(cloudEventNamespace, raw).String(),
+		Source:          source,
+		Type:            CloudEventTypePrefix + typ,
+		Subject:         subject,
+		Time:            r.ReceivedAt.UTC().Format(time.RFC3339Nano),
+		DataContentType: "application/json",
+		Data:            data,
+	}, nil
+}
+
+// CloudEventsWriter writes each report to an io.Writer as a structured mode
+// CloudEvent on a line of its own. It backs the `cloudevents` output format
+// of the log sink.
+type CloudEventsWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewCloudEventsWriter returns a Sink that writes events to w.
+func NewCloudEventsWriter(w io.Writer) *CloudEventsWriter {
+	return &CloudEventsWriter{w: w}
+}
+
+func (c *CloudEventsWriter) Write(_ context.Context, r Report) error {
+	event, err := NewCloudEvent(r)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err = c.w.Write(line)
+	return err
+}
+
+func (c *CloudEventsWriter) Flush(context.Context) error {
+	return nil
+}
+
+func (c *CloudEventsWriter) Close() error {
+	return nil
+}
+
+// CloudEventsConfig configures a CloudEvents HTTP sink.
+type CloudEventsConfig struct {
+	// URL receives every event.
+	URL string
+
+	// Mode is `binary`, which sends the report as the body and the event
+	// attributes as `ce-` headers, or `structured`, which sends the whole
+	// event as `application/cloudevents+json`. Defaults to `binary`.
+	Mode string
+
+	// Headers are added to every request, e.g. for authentication.
+	Headers map[string]string
+
+	// BatchConfig's BatchSize defaults to 100. Events are still sent one
+	// per request.
+	BatchConfig
+
+	// Timeout bounds each request. Defaults to 10s.
+	Timeout time.Duration
+
+	// Client overrides the HTTP client, mainly for tests.
+	Client *http.Client
+
+	// Metrics, if set, counts delivered, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background sends.
+	OnError func(error)
+}
+
+// CloudEvents delivers each report as a CloudEvent over HTTP, following
+// the CloudEvents HTTP protocol binding.
+type CloudEvents struct {
+	cfg    CloudEventsConfig
+	client *http.Client
+	batch  *batcher
+}
+
+// NewCloudEvents starts the background send loop.
+func NewCloudEvents(cfg CloudEventsConfig) (*CloudEvents, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("cloudevents url is not set")
+	}
+	if u, err := url.Parse(cfg.URL); err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid cloudevents url '%s'", cfg.URL)
+	}
+	if cfg.Mode == "" {
+		cfg.Mode = "binary"
+	}
+	if cfg.Mode != "binary" && cfg.Mode != "structured" {
+		return nil, fmt.Errorf("unknown cloudevents mode '%s'", cfg.Mode)
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	s := &CloudEvents{cfg: cfg, client: cfg.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "cloudevents",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+func (s *CloudEvents) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush sends buffered reports, retrying with backoff until they are
+// accepted or ctx is done.
+func (s *CloudEvents) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the send loop. Reports still buffered are dropped; call
+// Flush first to send them.
+func (s *CloudEvents) Close() error {
+	err := s.batch.close()
+	s.client.CloseIdleConnections()
+	return err
+}
+
+// send posts the events of batch in order. Once an event fails with a
+// status worth retrying, it and the rest of the batch are retried; events
+// that are rejected outright are dropped.
+func (s *CloudEvents) send(ctx context.Context, batch []Report) ([]Report, error) {
+	var rejected error
+	for i, r := range batch {
+		event, err := NewCloudEvent(r)
+		if err != nil {
+			s.batch.count("failed", 1)
+			rejected = err
+			continue
+		}
+
+		status, err := s.post(ctx, event)
+		switch {
+		case err != nil:
+			return batch[i:], err
+		case status >= 200 && status <= 299:
+			s.batch.count("delivered", 1)
+		case status == http.StatusTooManyRequests || status >= 500:
+			return batch[i:], fmt.Errorf("cloudevents: %d %s", status, http.StatusText(status))
+		default:
+			s.batch.count("failed", 1)
+			rejected = fmt.Errorf("cloudevents: event %s rejected: %d %s", event.ID, status, http.StatusText(status))
+		}
+	}
+	return nil, rejected
+}
+
+// post sends event in the configured mode and returns the response status.
+func (s *CloudEvents) post(ctx context.Context, event CloudEvent) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	var body []byte
+	var err error
+	if s.cfg.Mode == "structured" {
+		body, err = json.Marshal(event)
+	} else {
+		body, err = json.Marshal(event.Data)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	for k, v := range s.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.cfg.Mode == "structured" {
+		req.Header.Set("Content-Type", "application/cloudevents+json")
+	} else {
+		req.Header.Set("Content-Type", event.DataContentType)
+		req.Header.Set("ce-specversion", event.SpecVersion)
+		req.Header.Set("ce-id", event.ID)
+		req.Header.Set("ce-source", event.Source)
+		req.Header.Set("ce-type", event.Type)
+		req.Header.Set("ce-time", event.Time)
+		if event.Subject != "" {
+			req.Header.Set("ce-subject", event.Subject)
+		}
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return resp.StatusCode, nil
+}
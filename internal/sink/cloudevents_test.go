@@ -0,0 +1,199 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNewCloudEvent(t *testing.T) {
+	r := sampleReport(1)
+	r.Fields["document_uri"] = "https://shop.example/checkout?step=2"
+	r.Fields["effective_directive"] = "script-src"
+
+	event, err := NewCloudEvent(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if event.SpecVersion != "1.0" || event.Type != "com.csp-collector.csp-violation" ||
+		event.Source != "https://shop.example" || event.Subject != "script-src" ||
+		event.Time != "2024-05-01T12:00:00Z" || event.DataContentType != "application/json" {
+		t.Errorf("unexpected event %+v", event)
+	}
+	if event.Data["document_uri"] != "https://shop.example/checkout?step=2" || event.Data["report_type"] != "csp-violation" {
+		t.Errorf("expected the report document as data, got %v", event.Data)
+	}
+
+	again, _ := NewCloudEvent(r)
+	r.Fields["line_number"] = 2
+	other, _ := NewCloudEvent(r)
+	if event.ID == "" || again.ID != event.ID || other.ID == event.ID {
+		t.Errorf("expected IDs to be stable per report and differ between reports, got %s, %s and %s", event.ID, again.ID, other.ID)
+	}
+
+	nel := Report{Handler: "nel", Type: "network-error", ReceivedAt: r.ReceivedAt, Fields: map[string]interface{}{"type": "tcp.refused"}}
+	event, _ = NewCloudEvent(nel)
+	if event.Type != "com.csp-collector.nel-report" || event.Source != "csp-collector" || event.Subject != "" {
+		t.Errorf("unexpected nel event %+v", event)
+	}
+}
+
+func TestCloudEventsWriterWritesStructuredEvents(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewCloudEventsWriter(&buf)
+	for i := 1; i <= 2; i++ {
+		if err := s.Write(context.Background(), sampleReport(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("expected an event per line, got %q", buf.String())
+	}
+	var event map[string]interface{}
+	if err := json.Unmarshal(lines[0], &event); err != nil {
+		t.Fatal(err)
+	}
+	if event["specversion"] != "1.0" || event["source"] != "https://example.com" || event["data"].(map[string]interface{})["line_number"] != 1.0 {
+		t.Errorf("unexpected event %v", event)
+	}
+}
+
+// fakeEventReceiver keeps the requests it receives and answers with the
+// queued statuses, then 202.
+type fakeEventReceiver struct {
+	mu       sync.Mutex
+	statuses []int
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func (f *fakeEventReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	f.headers = append(f.headers, r.Header.Clone())
+	f.bodies = append(f.bodies, body)
+
+	status := http.StatusAccepted
+	if len(f.statuses) > 0 {
+		status, f.statuses = f.statuses[0], f.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+func TestCloudEventsSendsBinaryEvents(t *testing.T) {
+	receiver := &fakeEventReceiver{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s, err := NewCloudEvents(CloudEventsConfig{
+		URL:     server.URL,
+		Headers: map[string]string{"Authorization": "Bearer token"},
+		BatchConfig: BatchConfig{
+			FlushInterval: time.Hour,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    5 * time.Millisecond,
+		},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := sampleReport(3)
+	r.Fields["effective_directive"] = "img-src"
+	_ = s.Write(context.Background(), r)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.headers) != 2 {
+		t.Fatalf("expected the unavailable response to be retried, got %d requests", len(receiver.headers))
+	}
+	h := receiver.headers[1]
+	event, _ := NewCloudEvent(r)
+	if h.Get("Content-Type") != "application/json" || h.Get("Ce-Specversion") != "1.0" ||
+		h.Get("Ce-Type") != "com.csp-collector.csp-violation" || h.Get("Ce-Source") != "https://example.com" ||
+		h.Get("Ce-Subject") != "img-src" || h.Get("Ce-Id") != event.ID || h.Get("Ce-Time") != "2024-05-01T12:00:00Z" ||
+		h.Get("Authorization") != "Bearer token" {
+		t.Errorf("unexpected headers %v", h)
+	}
+	var data map[string]interface{}
+	if err := json.Unmarshal(receiver.bodies[1], &data); err != nil || data["effective_directive"] != "img-src" {
+		t.Errorf("expected the report as the body, got %s", receiver.bodies[1])
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("cloudevents", "delivered")); got != 1 {
+		t.Errorf("sink_reports_total{result=delivered} = %v, want 1", got)
+	}
+}
+
+func TestCloudEventsSendsStructuredEvents(t *testing.T) {
+	receiver := &fakeEventReceiver{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s, err := NewCloudEvents(CloudEventsConfig{
+		URL:         server.URL,
+		Mode:        "structured",
+		BatchConfig: BatchConfig{FlushInterval: time.Hour},
+		Metrics:     m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	_ = s.Write(context.Background(), sampleReport(2))
+	if err := s.Flush(context.Background()); err == nil {
+		t.Error("expected the rejected event to be reported")
+	}
+
+	receiver.mu.Lock()
+	defer receiver.mu.Unlock()
+	if len(receiver.bodies) != 2 {
+		t.Fatalf("expected a request per event, got %d", len(receiver.bodies))
+	}
+	var event CloudEvent
+	if err := json.Unmarshal(receiver.bodies[1], &event); err != nil {
+		t.Fatal(err)
+	}
+	if receiver.headers[1].Get("Content-Type") != "application/cloudevents+json" || receiver.headers[1].Get("Ce-Id") != "" ||
+		event.SpecVersion != "1.0" || event.Data["line_number"] != 2.0 {
+		t.Errorf("unexpected structured event %+v", event)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("cloudevents", "failed")); got != 1 {
+		t.Errorf("sink_reports_total{result=failed} = %v, want 1", got)
+	}
+}
+
+func TestNewCloudEventsValidatesConfig(t *testing.T) {
+	cases := []CloudEventsConfig{
+		{},
+		{URL: "not a url"},
+		{URL: "http://localhost:8080", Mode: "batched"},
+	}
+	for _, cfg := range cases {
+		if _, err := NewCloudEvents(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
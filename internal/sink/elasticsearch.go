@@ -0,0 +1,345 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// DefaultElasticsearchIndex writes to a new index each day.
+const DefaultElasticsearchIndex = "csp-reports-YYYY.MM.DD"
+
+// ElasticsearchConfig configures an Elasticsearch or OpenSearch sink.
+type ElasticsearchConfig struct {
+	// URL is the base URL of the cluster, e.g. `http://localhost:9200`.
+	URL string
+
+	// Index is the index name pattern. `YYYY`, `MM` and `DD` are replaced
+	// with the UTC date the report was received. Defaults to
+	// DefaultElasticsearchIndex.
+	Index string
+
+	// Username and Password enable basic authentication. APIKey, if set,
+	// is sent instead as an `ApiKey` authorization header.
+	Username string
+	Password string
+	APIKey   string
+
+	// Template is the body of an index template installed under
+	// TemplateName before the first documents are indexed. Empty disables
+	// template management. See ElasticsearchTemplate for a default.
+	Template     string
+	TemplateName string
+
+	BatchConfig
+
+	// Timeout bounds each request to the cluster. Defaults to 10s.
+	Timeout time.Duration
+
+	// Client overrides the HTTP client, mainly for tests.
+	Client *http.Client
+
+	// Metrics, if set, counts indexed, failed and dropped documents.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background flushes.
+	OnError func(error)
+}
+
+// Elasticsearch indexes reports through the `_bulk` API. Documents, or
+// whole bulk requests, rejected by the cluster are retried if the failure
+// is transient (429 or 5xx) and otherwise counted as failed and dropped.
+// Bulk requests rejected as too large are split in half until they fit.
+type Elasticsearch struct {
+	cfg    ElasticsearchConfig
+	client *http.Client
+	batch  *batcher
+
+	mu        sync.Mutex
+	installed bool
+}
+
+// NewElasticsearch starts the background flush loop. The cluster doesn't
+// need to be reachable yet; the index template is installed before the
+// first bulk request.
+func NewElasticsearch(cfg ElasticsearchConfig) (*Elasticsearch, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("elasticsearch url is not set")
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Index == "" {
+		cfg.Index = DefaultElasticsearchIndex
+	}
+	if cfg.TemplateName == "" {
+		cfg.TemplateName = "csp-collector"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	s := &Elasticsearch{cfg: cfg, client: cfg.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "elasticsearch",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+// ElasticsearchTemplate returns a composable index template matching every
+// index produced by the index pattern. Strings are mapped as keywords and
+// `received_at` as a date.
+func ElasticsearchTemplate(index string) string {
+	template := map[string]interface{}{
+		"index_patterns": []string{indexWildcard(index)},
+		"template": map[string]interface{}{
+			"mappings": map[string]interface{}{
+				"dynamic_templates": []interface{}{
+					map[string]interface{}{
+						"strings_as_keywords": map[string]interface{}{
+							"match_mapping_type": "string",
+							"mapping": map[string]interface{}{
+								"type":         "keyword",
+								"ignore_above": 8191,
+							},
+						},
+					},
+				},
+				"properties": map[string]interface{}{
+					"received_at": map[string]string{"type": "date"},
+					"report_only": map[string]string{"type": "boolean"},
+				},
+			},
+		},
+	}
+
+	b, _ := json.MarshalIndent(template, "", "  ")
+	return string(b)
+}
+
+func (s *Elasticsearch) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush indexes buffered reports, retrying with backoff until they are
+// accepted or ctx is done.
+func (s *Elasticsearch) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the flush loop. Reports still buffered are dropped; call
+// Flush first to index them.
+func (s *Elasticsearch) Close() error {
+	err := s.batch.close()
+	s.client.CloseIdleConnections()
+	return err
+}
+
+// indexName expands the date placeholders in pattern.
+func indexName(pattern string, t time.Time) string {
+	t = t.UTC()
+	return strings.NewReplacer(
+		"YYYY", fmt.Sprintf("%04d", t.Year()),
+		"MM", fmt.Sprintf("%02d", t.Month()),
+		"DD", fmt.Sprintf("%02d", t.Day()),
+	).Replace(pattern)
+}
+
+// indexWildcard replaces everything from the first date placeholder
+// onwards with `*`.
+func indexWildcard(pattern string) string {
+	cut := len(pattern)
+	for _, placeholder := range []string{"YYYY", "MM", "DD"} {
+		if i := strings.Index(pattern, placeholder); i >= 0 && i < cut {
+			cut = i
+		}
+	}
+	if cut == len(pattern) {
+		return pattern
+	}
+	return pattern[:cut] + "*"
+}
+
+type bulkResponse struct {
+	Errors bool                          `json:"errors"`
+	Items  []map[string]bulkResponseItem `json:"items"`
+}
+
+type bulkResponseItem struct {
+	Status int `json:"status"`
+	Error  *struct {
+		Type   string `json:"type"`
+		Reason string `json:"reason"`
+	} `json:"error"`
+}
+
+// send installs the index template if needed and indexes batch. Documents
+// that failed with a transient error are returned for retry.
+func (s *Elasticsearch) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if err := s.installTemplate(ctx); err != nil {
+		return batch, fmt.Errorf("unable to install elasticsearch index template: %w", err)
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	return s.index(ctx, batch)
+}
+
+// index sends batch in a single bulk request and returns the documents to
+// retry.
+func (s *Elasticsearch) index(ctx context.Context, batch []Report) ([]Report, error) {
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range batch {
+		action := map[string]map[string]string{"index": {"_index": indexName(s.cfg.Index, r.ReceivedAt)}}
+		if err := enc.Encode(action); err != nil {
+			return batch, err
+		}
+		if err := enc.Encode(r.Document()); err != nil {
+			return batch, err
+		}
+	}
+
+	resp, err := s.do(ctx, http.MethodPost, "/_bulk", "application/x-ndjson", &body)
+	var statusErr *elasticsearchStatusError
+	switch {
+	case err == nil:
+	case errors.As(err, &statusErr) && statusErr.status == http.StatusRequestEntityTooLarge && len(batch) > 1:
+		half := len(batch) / 2
+		retry, err := s.index(ctx, batch[:half])
+		retryRest, errRest := s.index(ctx, batch[half:])
+		return slices.Concat(retry, retryRest), errors.Join(err, errRest)
+	case errors.As(err, &statusErr) && statusErr.status != http.StatusTooManyRequests && statusErr.status < 500:
+		s.batch.count("failed", len(batch))
+		return nil, fmt.Errorf("%d documents rejected: %w", len(batch), err)
+	default:
+		return batch, err
+	}
+
+	var result bulkResponse
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return batch, fmt.Errorf("unable to decode bulk response: %w", err)
+	}
+	if !result.Errors {
+		s.batch.count("delivered", len(batch))
+		return nil, nil
+	}
+	if len(result.Items) != len(batch) {
+		return batch, fmt.Errorf("bulk response has %d items for %d documents", len(result.Items), len(batch))
+	}
+
+	var retry []Report
+	var errs []error
+	delivered, failed := 0, 0
+	for i, item := range result.Items {
+		// Each item is keyed by its action, which is always `index`.
+		for _, status := range item {
+			switch {
+			case status.Error == nil:
+				delivered++
+			case status.Status == http.StatusTooManyRequests || status.Status >= 500:
+				retry = append(retry, batch[i])
+			default:
+				failed++
+				if len(errs) == 0 {
+					errs = append(errs, fmt.Errorf("%s: %s", status.Error.Type, status.Error.Reason))
+				}
+			}
+		}
+	}
+	s.batch.count("delivered", delivered)
+	s.batch.count("failed", failed)
+
+	if failed > 0 {
+		errs[0] = fmt.Errorf("%d of %d documents rejected, first error: %w", failed, len(batch), errs[0])
+	}
+	if len(retry) > 0 {
+		errs = append(errs, fmt.Errorf("%d of %d documents rejected with a transient error", len(retry), len(batch)))
+	}
+	return retry, errors.Join(errs...)
+}
+
+// installTemplate puts the configured index template. Once successful it
+// is a no-op for the life of the sink.
+func (s *Elasticsearch) installTemplate(ctx context.Context) error {
+	s.mu.Lock()
+	installed := s.installed
+	s.mu.Unlock()
+	if installed || s.cfg.Template == "" {
+		return nil
+	}
+
+	if _, err := s.do(ctx, http.MethodPut, "/_index_template/"+s.cfg.TemplateName, "application/json", strings.NewReader(s.cfg.Template)); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.installed = true
+	s.mu.Unlock()
+	return nil
+}
+
+// elasticsearchStatusError is returned by do for a response that isn't
+// 2xx.
+type elasticsearchStatusError struct {
+	status int
+	msg    string
+}
+
+func (e *elasticsearchStatusError) Error() string { return e.msg }
+
+// do sends a request to the cluster and returns the response body, or an
+// *elasticsearchStatusError if the status isn't 2xx.
+func (s *Elasticsearch) do(ctx context.Context, method, path, contentType string, body io.Reader) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, method, s.cfg.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	switch {
+	case s.cfg.APIKey != "":
+		req.Header.Set("Authorization", "ApiKey "+s.cfg.APIKey)
+	case s.cfg.Username != "":
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		if len(b) > 512 {
+			b = b[:512]
+		}
+		return nil, &elasticsearchStatusError{
+			status: resp.StatusCode,
+			msg:    fmt.Sprintf("%s %s: %s: %s", method, path, resp.Status, bytes.TrimSpace(b)),
+		}
+	}
+	return b, nil
+}
@@ -0,0 +1,362 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeCluster records requests to `_bulk` and `_index_template`. Each bulk
+// item is answered with the next status from statuses, or 201 once they
+// run out. Bulk requests are answered with bulkStatus if set, and with 413
+// if they hold more than maxDocs documents.
+type fakeCluster struct {
+	mu         sync.Mutex
+	statuses   []int
+	bulkStatus int
+	maxDocs    int
+	bulkSizes  []int
+	templates  []string
+	indexed    []map[string]interface{}
+	indices    []string
+	auth       []string
+}
+
+func (c *fakeCluster) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.auth = append(c.auth, r.Header.Get("Authorization"))
+	body, _ := io.ReadAll(r.Body)
+
+	switch {
+	case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/_index_template/"):
+		c.templates = append(c.templates, string(body))
+		fmt.Fprint(w, `{"acknowledged":true}`)
+	case r.Method == http.MethodPost && r.URL.Path == "/_bulk":
+		if r.Header.Get("Content-Type") != "application/x-ndjson" {
+			http.Error(w, "bad content type", http.StatusNotAcceptable)
+			return
+		}
+		docs := bytes.Count(body, []byte("\n")) / 2
+		c.bulkSizes = append(c.bulkSizes, docs)
+		if c.bulkStatus != 0 {
+			http.Error(w, `{"error":"rejected"}`, c.bulkStatus)
+			return
+		}
+		if c.maxDocs > 0 && docs > c.maxDocs {
+			http.Error(w, `{"error":"too large"}`, http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var items []string
+		hasErrors := false
+		scanner := bufio.NewScanner(bytes.NewReader(body))
+		for scanner.Scan() {
+			var action map[string]map[string]string
+			if err := json.Unmarshal(scanner.Bytes(), &action); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			scanner.Scan()
+			var doc map[string]interface{}
+			if err := json.Unmarshal(scanner.Bytes(), &doc); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			status := http.StatusCreated
+			if len(c.statuses) > 0 {
+				status, c.statuses = c.statuses[0], c.statuses[1:]
+			}
+			if status >= 300 {
+				hasErrors = true
+				items = append(items, fmt.Sprintf(`{"index":{"status":%d,"error":{"type":"mapper_parsing_exception","reason":"failed to parse"}}}`, status))
+				continue
+			}
+			c.indexed = append(c.indexed, doc)
+			c.indices = append(c.indices, action["index"]["_index"])
+			items = append(items, fmt.Sprintf(`{"index":{"status":%d}}`, status))
+		}
+		fmt.Fprintf(w, `{"took":1,"errors":%t,"items":[%s]}`, hasErrors, strings.Join(items, ","))
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (c *fakeCluster) indexedCount() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.indexed)
+}
+
+func newTestElasticsearch(t *testing.T, cfg ElasticsearchConfig) (*Elasticsearch, *fakeCluster) {
+	t.Helper()
+	cluster := &fakeCluster{}
+	server := httptest.NewServer(cluster)
+	t.Cleanup(server.Close)
+
+	cfg.URL = server.URL
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Hour
+	}
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 5 * time.Millisecond
+
+	s, err := NewElasticsearch(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, cluster
+}
+
+func TestElasticsearchBulkIndexesDailyIndices(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	s, cluster := newTestElasticsearch(t, ElasticsearchConfig{APIKey: "secret", Metrics: m})
+	defer s.Close()
+
+	ctx := context.Background()
+	first := sampleReport(1)
+	second := sampleReport(2)
+	second.ReceivedAt = second.ReceivedAt.Add(24 * time.Hour)
+	_ = s.Write(ctx, first)
+	_ = s.Write(ctx, second)
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"csp-reports-2024.05.01", "csp-reports-2024.05.02"}
+	if fmt.Sprint(cluster.indices) != fmt.Sprint(want) {
+		t.Errorf("expected indices %v, got %v", want, cluster.indices)
+	}
+	if cluster.indexed[0]["document_uri"] != "https://example.com/" || cluster.indexed[0]["report_type"] != "csp-violation" {
+		t.Errorf("unexpected document %v", cluster.indexed[0])
+	}
+	if cluster.auth[0] != "ApiKey secret" {
+		t.Errorf("expected api key authorization, got %q", cluster.auth[0])
+	}
+	if len(cluster.templates) != 0 {
+		t.Error("expected no template without configuration")
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "delivered")); got != 2 {
+		t.Errorf("sink_reports_total delivered = %v, want 2", got)
+	}
+}
+
+func TestElasticsearchInstallsTemplateFirst(t *testing.T) {
+	s, cluster := newTestElasticsearch(t, ElasticsearchConfig{
+		Template: ElasticsearchTemplate(DefaultElasticsearchIndex),
+		Username: "elastic",
+		Password: "changeme",
+	})
+	defer s.Close()
+
+	ctx := context.Background()
+	_ = s.Write(ctx, sampleReport(1))
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Write(ctx, sampleReport(2))
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cluster.templates) != 1 {
+		t.Fatalf("expected the template to be installed once, got %d", len(cluster.templates))
+	}
+	var template map[string]interface{}
+	if err := json.Unmarshal([]byte(cluster.templates[0]), &template); err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(template["index_patterns"]) != "[csp-reports-*]" {
+		t.Errorf("unexpected index patterns %v", template["index_patterns"])
+	}
+	if !strings.HasPrefix(cluster.auth[0], "Basic ") {
+		t.Errorf("expected basic authorization, got %q", cluster.auth[0])
+	}
+}
+
+func TestElasticsearchPartialFailure(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	s, cluster := newTestElasticsearch(t, ElasticsearchConfig{Metrics: m})
+	defer s.Close()
+
+	// The first document is indexed, the second rejected outright and the
+	// third throttled, so only the third is retried.
+	cluster.statuses = []int{http.StatusCreated, http.StatusBadRequest, http.StatusTooManyRequests}
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+
+	_, retry, err := s.batch.sendOnce(ctx)
+	if !retry || err == nil || !strings.Contains(err.Error(), "mapper_parsing_exception") {
+		t.Fatalf("expected a retry with the rejection reason, got %v, %v", retry, err)
+	}
+	if buffered := s.batch.buffered(); buffered != 1 {
+		t.Fatalf("expected the throttled document to be buffered, got %d", buffered)
+	}
+
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cluster.indexedCount(); got != 2 {
+		t.Errorf("expected 2 indexed documents, got %d", got)
+	}
+	if cluster.indexed[1]["line_number"] != float64(2) {
+		t.Errorf("expected the throttled document to be retried, got %v", cluster.indexed[1])
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "delivered")); got != 2 {
+		t.Errorf("sink_reports_total delivered = %v, want 2", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "failed")); got != 1 {
+		t.Errorf("sink_reports_total failed = %v, want 1", got)
+	}
+}
+
+func TestElasticsearchDropsRejectedBulkRequests(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	s, cluster := newTestElasticsearch(t, ElasticsearchConfig{Metrics: m})
+	defer s.Close()
+	cluster.bulkStatus = http.StatusUnauthorized
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+
+	if err := s.Flush(ctx); err == nil || !strings.Contains(err.Error(), "401") {
+		t.Fatalf("expected the rejection to be reported, got %v", err)
+	}
+	if buffered := s.batch.buffered(); buffered != 0 {
+		t.Errorf("expected the rejected documents not to be retried, %d buffered", buffered)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "failed")); got != 3 {
+		t.Errorf("sink_reports_total failed = %v, want 3", got)
+	}
+}
+
+func TestElasticsearchSplitsOversizedBulkRequests(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	s, cluster := newTestElasticsearch(t, ElasticsearchConfig{Metrics: m})
+	defer s.Close()
+	cluster.maxDocs = 2
+
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if got := cluster.indexedCount(); got != 5 {
+		t.Errorf("expected all 5 documents to be indexed, got %d", got)
+	}
+	// 5 is split into 2 and 3, and 3 again into 1 and 2.
+	if want := []int{5, 2, 3, 1, 2}; !slices.Equal(cluster.bulkSizes, want) {
+		t.Errorf("expected bulk requests of %v documents, got %v", want, cluster.bulkSizes)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "delivered")); got != 5 {
+		t.Errorf("sink_reports_total delivered = %v, want 5", got)
+	}
+}
+
+func TestElasticsearchRetriesUnavailableCluster(t *testing.T) {
+	var mu sync.Mutex
+	down := true
+	cluster := &fakeCluster{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		isDown := down
+		mu.Unlock()
+		if isDown {
+			http.Error(w, `{"error":"unavailable"}`, http.StatusServiceUnavailable)
+			return
+		}
+		cluster.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s, err := NewElasticsearch(ElasticsearchConfig{
+		URL: server.URL,
+		BatchConfig: BatchConfig{
+			FlushInterval: time.Hour,
+			MaxBuffered:   2,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    5 * time.Millisecond,
+		},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	for i := 0; i < 3; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+	if err := s.Flush(ctx); err == nil {
+		t.Fatalf("expected flush to fail while the cluster is down, got %v", err)
+	}
+
+	mu.Lock()
+	down = false
+	mu.Unlock()
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// A bulk request abandoned when the first flush gave up can still reach
+	// the cluster after it recovered, so documents may be indexed twice.
+	lines := map[interface{}]bool{}
+	cluster.mu.Lock()
+	for _, doc := range cluster.indexed {
+		lines[doc["line_number"]] = true
+	}
+	cluster.mu.Unlock()
+	if len(lines) != 2 || !lines[float64(1)] || !lines[float64(2)] {
+		t.Errorf("expected the 2 newest documents to be indexed once the cluster recovered, got %v", lines)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("elasticsearch", "dropped")); got != 1 {
+		t.Errorf("sink_reports_total dropped = %v, want 1", got)
+	}
+}
+
+func TestElasticsearchIndexPattern(t *testing.T) {
+	at := time.Date(2024, 1, 9, 23, 30, 0, 0, time.FixedZone("AEST", 10*60*60))
+	if got := indexName(DefaultElasticsearchIndex, at); got != "csp-reports-2024.01.09" {
+		t.Errorf("unexpected index %q", got)
+	}
+	if got := indexName("reports-YYYY.MM", at); got != "reports-2024.01" {
+		t.Errorf("unexpected index %q", got)
+	}
+	if got := indexWildcard("reports"); got != "reports" {
+		t.Errorf("unexpected wildcard %q", got)
+	}
+}
+
+func TestNewElasticsearchRequiresURL(t *testing.T) {
+	if _, err := NewElasticsearch(ElasticsearchConfig{}); err == nil {
+		t.Error("expected an error without a url")
+	}
+}
@@ -0,0 +1,412 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FileConfig configures a File sink. A zero limit disables the
+// corresponding rotation or retention rule.
+type FileConfig struct {
+	// Dir is the directory reports are written to. It is created if it
+	// doesn't exist.
+	Dir string
+
+	// Prefix names the files in Dir. The active file is `<Prefix>.ndjson`
+	// and rotated segments are `<Prefix>-<timestamp>.ndjson.gz`. Defaults
+	// to `reports`.
+	Prefix string
+
+	// MaxSize rotates the active file before it grows beyond this many
+	// bytes.
+	MaxSize int64
+
+	// RotateInterval rotates the active file once it has been open this
+	// long. The check happens when a report is written, so an idle
+	// collector doesn't create empty segments.
+	RotateInterval time.Duration
+
+	// MaxAge removes rotated segments last modified longer ago than this.
+	MaxAge time.Duration
+
+	// MaxTotalSize removes the oldest rotated segments until the active
+	// file and the remaining segments fit within this many bytes.
+	MaxTotalSize int64
+
+	// PruneInterval is how often MaxAge and MaxTotalSize are applied, on
+	// top of after each rotation, so that segments still age out while no
+	// reports arrive. Defaults to one minute.
+	PruneInterval time.Duration
+}
+
+const (
+	fileExt            = ".ndjson"
+	segmentTimeLayout  = "20060102T150405.000"
+	defaultFilePrefix  = "reports"
+	compressedFileExt  = fileExt + ".gz"
+	compressingFileExt = compressedFileExt + ".tmp"
+)
+
+// File writes reports as newline delimited JSON, rotating, compressing and
+// pruning segments according to its FileConfig.
+type File struct {
+	cfg FileConfig
+	now func() time.Time
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+
+	// maintenance serialises compression and pruning, which run in the
+	// background after each rotation and every PruneInterval.
+	maintenance sync.Mutex
+	wg          sync.WaitGroup
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewFile opens the active file in cfg.Dir, appending to it if it already
+// exists. Segments left uncompressed by a previous run, including those it
+// was compressing when it stopped, are compressed in the background.
+func NewFile(cfg FileConfig) (*File, error) {
+	if cfg.Dir == "" {
+		return nil, fmt.Errorf("file sink directory is not set")
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = defaultFilePrefix
+	}
+	if cfg.PruneInterval <= 0 {
+		cfg.PruneInterval = time.Minute
+	}
+	if err := os.MkdirAll(cfg.Dir, 0o755); err != nil {
+		return nil, err
+	}
+
+	s := &File{cfg: cfg, now: time.Now, done: make(chan struct{})}
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+
+	s.wg.Add(1)
+	go s.maintain()
+
+	if cfg.MaxAge > 0 || cfg.MaxTotalSize > 0 {
+		s.wg.Add(1)
+		go s.run()
+	}
+
+	return s, nil
+}
+
+// Path returns the path of the active file.
+func (s *File) Path() string {
+	return filepath.Join(s.cfg.Dir, s.cfg.Prefix+fileExt)
+}
+
+func (s *File) Write(_ context.Context, r Report) error {
+	line, err := json.Marshal(r.Document())
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return os.ErrClosed
+	}
+
+	if s.shouldRotate(int64(len(line))) {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := s.f.Write(line)
+	s.size += int64(n)
+	return err
+}
+
+// Flush syncs the active file to disk.
+func (s *File) Flush(context.Context) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return nil
+	}
+	return s.f.Sync()
+}
+
+// Reopen closes and reopens the active file so that a file moved away by
+// an external tool is replaced with a new one. It is called on SIGHUP.
+func (s *File) Reopen() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.f == nil {
+		return os.ErrClosed
+	}
+	if err := s.f.Close(); err != nil {
+		return err
+	}
+	return s.open()
+}
+
+// Close closes the active file, stops the prune loop and waits for
+// background compression and pruning to finish.
+func (s *File) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+
+	s.mu.Lock()
+	var err error
+	if s.f != nil {
+		err = s.f.Close()
+		s.f = nil
+	}
+	s.mu.Unlock()
+
+	s.wg.Wait()
+	return err
+}
+
+// open opens the active file. The caller must hold s.mu.
+func (s *File) open() error {
+	f, err := os.OpenFile(s.Path(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	s.f = f
+	s.size = info.Size()
+	s.opened = s.now()
+	return nil
+}
+
+// shouldRotate reports whether writing n more bytes requires a rotation.
+// The caller must hold s.mu.
+func (s *File) shouldRotate(n int64) bool {
+	if s.size == 0 {
+		return false
+	}
+	if s.cfg.MaxSize > 0 && s.size+n > s.cfg.MaxSize {
+		return true
+	}
+	return s.cfg.RotateInterval > 0 && s.now().Sub(s.opened) >= s.cfg.RotateInterval
+}
+
+// rotate moves the active file to a timestamped segment and opens a new
+// one. If either step fails the sink keeps a usable active file. The caller
+// must hold s.mu.
+func (s *File) rotate() error {
+	stamp := s.now().UTC().Format(segmentTimeLayout)
+	segment := filepath.Join(s.cfg.Dir, s.cfg.Prefix+"-"+stamp+fileExt)
+	// Segments sharing a timestamp get a suffix that sorts after the
+	// unsuffixed name, so retention still removes the oldest first.
+	for i := 1; exists(segment) || exists(segment+".gz"); i++ {
+		segment = filepath.Join(s.cfg.Dir, fmt.Sprintf("%s-%s_%03d%s", s.cfg.Prefix, stamp, i, fileExt))
+	}
+
+	old := s.f
+	if err := os.Rename(s.Path(), segment); err != nil {
+		// The active file may have been moved away by an external tool,
+		// so carry on with a file at the active path.
+		if s.open() == nil {
+			old.Close()
+		}
+		return err
+	}
+	if err := s.open(); err != nil {
+		// Put the segment back and keep appending to it.
+		_ = os.Rename(segment, s.Path())
+		return err
+	}
+	old.Close()
+
+	s.wg.Add(1)
+	go s.maintain()
+
+	return nil
+}
+
+// maintain compresses any uncompressed segments and then applies the
+// retention rules.
+func (s *File) maintain() {
+	defer s.wg.Done()
+
+	s.maintenance.Lock()
+	defer s.maintenance.Unlock()
+
+	// Nothing is being compressed while maintenance is held, so any
+	// temporary file was left by a run that stopped part way through. Its
+	// segment is still there uncompressed and is compressed again below.
+	if tmps, err := filepath.Glob(filepath.Join(s.cfg.Dir, s.cfg.Prefix+"-*"+compressingFileExt)); err == nil {
+		for _, tmp := range tmps {
+			_ = os.Remove(tmp)
+		}
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return
+	}
+
+	for _, segment := range segments {
+		if strings.HasSuffix(segment, fileExt) {
+			_ = compressFile(segment)
+		}
+	}
+
+	s.prune()
+}
+
+// run applies the retention rules every PruneInterval until the sink is
+// closed.
+func (s *File) run() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.PruneInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.maintenance.Lock()
+			s.prune()
+			s.maintenance.Unlock()
+		}
+	}
+}
+
+// segments returns the rotated segments in Dir, oldest first.
+func (s *File) segments() ([]string, error) {
+	entries, err := os.ReadDir(s.cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, s.cfg.Prefix+"-") {
+			continue
+		}
+		if strings.HasSuffix(name, fileExt) || strings.HasSuffix(name, compressedFileExt) {
+			segments = append(segments, filepath.Join(s.cfg.Dir, name))
+		}
+	}
+
+	// The timestamp in the name sorts chronologically.
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// prune removes segments that are too old, then the oldest segments until
+// the total size is within MaxTotalSize.
+func (s *File) prune() {
+	if s.cfg.MaxAge <= 0 && s.cfg.MaxTotalSize <= 0 {
+		return
+	}
+
+	segments, err := s.segments()
+	if err != nil {
+		return
+	}
+
+	var total int64
+	if info, err := os.Stat(s.Path()); err == nil {
+		total = info.Size()
+	}
+
+	cutoff := s.now().Add(-s.cfg.MaxAge)
+	sizes := make([]int64, len(segments))
+	for i, segment := range segments {
+		info, err := os.Stat(segment)
+		if err != nil {
+			continue
+		}
+		if s.cfg.MaxAge > 0 && info.ModTime().Before(cutoff) {
+			_ = os.Remove(segment)
+			segments[i] = ""
+			continue
+		}
+		sizes[i] = info.Size()
+		total += info.Size()
+	}
+
+	if s.cfg.MaxTotalSize <= 0 {
+		return
+	}
+	for i, segment := range segments {
+		if total <= s.cfg.MaxTotalSize {
+			return
+		}
+		if segment == "" {
+			continue
+		}
+		if os.Remove(segment) == nil {
+			total -= sizes[i]
+		}
+	}
+}
+
+// compressFile gzips path to path.gz and removes the original. The
+// compressed file is written under a temporary name first so a partial
+// file is never mistaken for a complete segment.
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmp := strings.TrimSuffix(path, fileExt) + compressingFileExt
+	out, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o644)
+	if err != nil {
+		return err
+	}
+
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if cerr := zw.Close(); err == nil {
+		err = cerr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	if err := os.Rename(tmp, path+".gz"); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(path)
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
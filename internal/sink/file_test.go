@@ -0,0 +1,373 @@
+package sink
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sampleReport(i int) Report {
+	return Report{
+		Handler:    "csp",
+		Type:       "csp-violation",
+		ReceivedAt: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Fields: map[string]interface{}{
+			"document_uri": "https://example.com/",
+			"line_number":  i,
+		},
+	}
+}
+
+func listDir(t *testing.T, dir string) []string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+	return names
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	n := 0
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		n++
+	}
+	return n
+}
+
+func TestFileWritesNDJSON(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Write(context.Background(), sampleReport(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	content, err := os.ReadFile(filepath.Join(dir, "reports.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(content, &doc); err != nil {
+		t.Fatalf("expected a JSON line, got %q: %s", content, err)
+	}
+	if doc["report_type"] != "csp-violation" || doc["handler"] != "csp" || doc["document_uri"] != "https://example.com/" {
+		t.Errorf("unexpected document: %v", doc)
+	}
+	if doc["received_at"] != "2024-05-01T12:00:00Z" {
+		t.Errorf("unexpected received_at: %v", doc["received_at"])
+	}
+}
+
+func TestFileRotatesBySizeAndCompresses(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir, MaxSize: 200})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if err := s.Write(context.Background(), sampleReport(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	total := countLines(t, filepath.Join(dir, "reports.ndjson"))
+	segments := 0
+	for _, name := range listDir(t, dir) {
+		if name == "reports.ndjson" {
+			continue
+		}
+		if !strings.HasPrefix(name, "reports-") || !strings.HasSuffix(name, ".ndjson.gz") {
+			t.Errorf("unexpected file %s", name)
+			continue
+		}
+		segments++
+		total += countLines(t, filepath.Join(dir, name))
+
+		info, _ := os.Stat(filepath.Join(dir, name))
+		if info.Size() == 0 {
+			t.Errorf("segment %s is empty", name)
+		}
+	}
+
+	if segments < 2 {
+		t.Errorf("expected several rotated segments, got %d", segments)
+	}
+	if total != 10 {
+		t.Errorf("expected 10 reports across all files, got %d", total)
+	}
+}
+
+func TestFileRotatesByInterval(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+
+	s, err := NewFile(FileConfig{Dir: dir, RotateInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.now = func() time.Time { return now }
+	s.opened = now
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	now = now.Add(30 * time.Minute)
+	_ = s.Write(context.Background(), sampleReport(2))
+	now = now.Add(time.Hour)
+	_ = s.Write(context.Background(), sampleReport(3))
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segment := filepath.Join(dir, "reports-20240501T133000.000.ndjson.gz")
+	if got := countLines(t, segment); got != 2 {
+		t.Errorf("expected 2 reports in %s, got %d (files: %v)", segment, got, listDir(t, dir))
+	}
+	if got := countLines(t, filepath.Join(dir, "reports.ndjson")); got != 1 {
+		t.Errorf("expected 1 report in the active file, got %d", got)
+	}
+}
+
+func TestFilePrunesByTotalSize(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir, MaxSize: 100, MaxTotalSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 5; i++ {
+		_ = s.Write(context.Background(), sampleReport(i))
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if names := listDir(t, dir); len(names) != 1 || names[0] != "reports.ndjson" {
+		t.Errorf("expected only the active file to remain, got %v", names)
+	}
+}
+
+func TestFilePrunesByAge(t *testing.T) {
+	dir := t.TempDir()
+	old := filepath.Join(dir, "reports-20200101T000000.000.ndjson.gz")
+	recent := filepath.Join(dir, "reports-20240101T000000.000.ndjson.gz")
+	for _, path := range []string{old, recent} {
+		if err := os.WriteFile(path, []byte("x"), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chtimes(old, time.Now().Add(-48*time.Hour), time.Now().Add(-48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFile(FileConfig{Dir: dir, MaxAge: 24 * time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(old); !os.IsNotExist(err) {
+		t.Error("expected old segment to be removed")
+	}
+	if _, err := os.Stat(recent); err != nil {
+		t.Error("expected recent segment to be kept")
+	}
+}
+
+func TestFilePrunesWhileIdle(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir, MaxAge: time.Hour, PruneInterval: 5 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A segment that ages out after the sink last rotated.
+	segment := filepath.Join(dir, "reports-20200101T000000.000.ndjson.gz")
+	if err := os.WriteFile(segment, []byte("x"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(segment, time.Now().Add(-2*time.Hour), time.Now().Add(-2*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for exists(segment) && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if exists(segment) {
+		t.Error("expected the segment to be pruned without a rotation")
+	}
+}
+
+func TestFileCompressesLeftoverSegments(t *testing.T) {
+	dir := t.TempDir()
+	leftover := filepath.Join(dir, "reports-20240101T000000.000.ndjson")
+	if err := os.WriteFile(leftover, []byte("{}\n{}\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// A previous run stopped while compressing it.
+	partial := filepath.Join(dir, "reports-20240101T000000.000"+compressingFileExt)
+	if err := os.WriteFile(partial, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	orphan := filepath.Join(dir, "reports-20230101T000000.000"+compressingFileExt)
+	if err := os.WriteFile(orphan, []byte("partial"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err := NewFile(FileConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("expected uncompressed segment to be removed")
+	}
+	if got := countLines(t, leftover+".gz"); got != 2 {
+		t.Errorf("expected 2 lines in compressed segment, got %d", got)
+	}
+	if names := listDir(t, dir); len(names) != 2 {
+		t.Errorf("expected the temporary files to be removed, got %v", names)
+	}
+}
+
+func TestFileReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+
+	moved := filepath.Join(dir, "moved.ndjson")
+	if err := os.Rename(s.Path(), moved); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Reopen(); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Write(context.Background(), sampleReport(2))
+
+	if got := countLines(t, moved); got != 1 {
+		t.Errorf("expected 1 report in moved file, got %d", got)
+	}
+	if got := countLines(t, s.Path()); got != 1 {
+		t.Errorf("expected 1 report in reopened file, got %d", got)
+	}
+}
+
+func TestFileWriteAfterClose(t *testing.T) {
+	s, err := NewFile(FileConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Close()
+
+	if err := s.Write(context.Background(), sampleReport(1)); err == nil {
+		t.Error("expected an error writing to a closed sink")
+	}
+}
+
+func TestFileRecoversFromFailedRotation(t *testing.T) {
+	dir := t.TempDir()
+	s, err := NewFile(FileConfig{Dir: dir, MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+
+	// Removing the active file makes the next rotation's rename fail.
+	if err := os.Remove(s.Path()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Write(context.Background(), sampleReport(2)); err == nil {
+		t.Fatal("expected the failed rotation to be reported")
+	}
+
+	if err := s.Write(context.Background(), sampleReport(3)); err != nil {
+		t.Fatalf("expected writes to carry on after a failed rotation, got %s", err)
+	}
+	if got := countLines(t, s.Path()); got != 1 {
+		t.Errorf("expected 1 report in the active file, got %d", got)
+	}
+}
+
+func TestFileSegmentsSortCollisionsLast(t *testing.T) {
+	dir := t.TempDir()
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s, err := NewFile(FileConfig{Dir: dir, MaxSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	s.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		_ = s.Write(context.Background(), sampleReport(i))
+	}
+	s.mu.Lock()
+	s.wg.Wait()
+	segments, err := s.segments()
+	s.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"reports-20240501T120000.000.ndjson.gz", "reports-20240501T120000.000_001.ndjson.gz"}
+	if len(segments) != len(want) {
+		t.Fatalf("expected %d segments, got %v", len(want), segments)
+	}
+	for i, segment := range segments {
+		if filepath.Base(segment) != want[i] {
+			t.Errorf("segment %d = %s, want %s", i, filepath.Base(segment), want[i])
+		}
+	}
+}
@@ -0,0 +1,344 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+const (
+	// gelfMaxChunks is the most chunks a GELF message may be split into.
+	gelfMaxChunks = 128
+
+	// gelfChunkHeaderSize is the size of the magic bytes, message ID,
+	// sequence number and sequence count that start every chunk.
+	gelfChunkHeaderSize = 12
+)
+
+// GELFConfig configures a GELF sink.
+type GELFConfig struct {
+	// Network is `udp` or `tcp`. Defaults to `udp`.
+	Network string
+
+	// Address is the `host:port` of the GELF input. Defaults to
+	// `localhost:12201`.
+	Address string
+
+	// Host is the `host` of each message. Defaults to the name of the host.
+	Host string
+
+	// Compression is `gzip`, `zlib` or `none` and only applies to UDP;
+	// GELF over TCP can't be compressed. Defaults to `gzip`.
+	Compression string
+
+	// ChunkSize is the largest UDP datagram sent. Bigger messages are split
+	// into chunks. Defaults to 1420 bytes, which fits the MTU of most
+	// networks.
+	ChunkSize int
+
+	// Timeout bounds connecting and each write. Defaults to 5s.
+	Timeout time.Duration
+
+	// BatchConfig's BatchSize defaults to 100. Messages are still sent
+	// one at a time.
+	BatchConfig
+
+	// Metrics, if set, counts sent, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background writes.
+	OnError func(error)
+}
+
+// GELF writes each report as a GELF 1.1 message, e.g. to Graylog. The
+// report fields become additional fields and the short message is the
+// report's summary. Reports are buffered and written from a background
+// goroutine. The connection is made on first use and remade once if a
+// write fails, after which the write is retried with backoff.
+type GELF struct {
+	cfg   GELFConfig
+	batch *batcher
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+// NewGELF validates cfg. No connection is made until the first report is
+// written.
+func NewGELF(cfg GELFConfig) (*GELF, error) {
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	if cfg.Network != "udp" && cfg.Network != "tcp" {
+		return nil, fmt.Errorf("unknown gelf network '%s'", cfg.Network)
+	}
+	if cfg.Address == "" {
+		cfg.Address = "localhost:12201"
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.Compression == "" {
+		cfg.Compression = "gzip"
+	}
+	switch cfg.Compression {
+	case "gzip", "zlib", "none":
+	default:
+		return nil, fmt.Errorf("unknown gelf compression '%s'", cfg.Compression)
+	}
+	if cfg.ChunkSize <= 0 {
+		cfg.ChunkSize = 1420
+	}
+	if cfg.ChunkSize <= gelfChunkHeaderSize {
+		return nil, fmt.Errorf("gelf chunk size must be larger than %d bytes", gelfChunkHeaderSize)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+
+	s := &GELF{cfg: cfg}
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "gelf",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+func (s *GELF) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush writes buffered reports, retrying with backoff until they are
+// written or ctx is done.
+func (s *GELF) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the write loop and closes the connection. Reports still
+// buffered are dropped; call Flush first to write them.
+func (s *GELF) Close() error {
+	err := s.batch.close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeConn()
+	return err
+}
+
+// send writes the messages of batch in order. Reports that can't be
+// encoded are dropped; once a write fails, it and the rest of the batch
+// are retried.
+func (s *GELF) send(ctx context.Context, batch []Report) ([]Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var errs []error
+	for i, r := range batch {
+		packets, err := s.encode(r)
+		if err != nil {
+			s.batch.count("failed", 1)
+			errs = append(errs, err)
+			continue
+		}
+
+		err = s.write(ctx, packets)
+		if err != nil {
+			// The server may have restarted or dropped an idle
+			// connection, so try once more on a fresh one.
+			s.closeConn()
+			err = s.write(ctx, packets)
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to write to gelf input: %w", err))
+			return batch[i:], errors.Join(errs...)
+		}
+		s.batch.count("delivered", 1)
+	}
+	return nil, errors.Join(errs...)
+}
+
+// encode formats r and frames it for the network.
+func (s *GELF) encode(r Report) ([][]byte, error) {
+	msg, err := s.format(r)
+	if err != nil {
+		return nil, err
+	}
+	return s.packets(msg)
+}
+
+func (s *GELF) write(ctx context.Context, packets [][]byte) error {
+	if s.conn == nil {
+		dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+		conn, err := dialer.DialContext(ctx, s.cfg.Network, s.cfg.Address)
+		if err != nil {
+			return err
+		}
+		s.conn = conn
+	}
+
+	deadline := time.Now().Add(s.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	for _, p := range packets {
+		if _, err := s.conn.Write(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GELF) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// packets frames msg for the network: null terminated over TCP, and
+// compressed and chunked as needed over UDP.
+func (s *GELF) packets(msg []byte) ([][]byte, error) {
+	if s.cfg.Network == "tcp" {
+		return [][]byte{append(msg, 0)}, nil
+	}
+
+	msg, err := s.compress(msg)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) <= s.cfg.ChunkSize {
+		return [][]byte{msg}, nil
+	}
+
+	size := s.cfg.ChunkSize - gelfChunkHeaderSize
+	count := (len(msg) + size - 1) / size
+	if count > gelfMaxChunks {
+		return nil, fmt.Errorf("gelf message of %d bytes needs more than %d chunks", len(msg), gelfMaxChunks)
+	}
+
+	id := rand.Uint64()
+	packets := make([][]byte, 0, count)
+	for i := 0; i < count; i++ {
+		chunk := msg[i*size : min((i+1)*size, len(msg))]
+		p := make([]byte, gelfChunkHeaderSize, gelfChunkHeaderSize+len(chunk))
+		p[0], p[1] = 0x1e, 0x0f
+		binary.BigEndian.PutUint64(p[2:10], id)
+		p[10], p[11] = byte(i), byte(count)
+		packets = append(packets, append(p, chunk...))
+	}
+	return packets, nil
+}
+
+func (s *GELF) compress(msg []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch s.cfg.Compression {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "zlib":
+		w = zlib.NewWriter(&buf)
+	default:
+		return msg, nil
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// format renders r as a GELF 1.1 message. Every field of the report's
+// document except `received_at`, which is the timestamp, becomes an
+// additional field.
+func (s *GELF) format(r Report) ([]byte, error) {
+	level := syslogWarning
+	if r.ReportOnly {
+		level = syslogNotice
+	}
+
+	msg := map[string]interface{}{
+		"version":       "1.1",
+		"host":          s.cfg.Host,
+		"short_message": r.Summary(),
+		"timestamp":     float64(r.ReceivedAt.UnixMicro()) / 1e6,
+		"level":         level,
+	}
+
+	doc := r.Document()
+	delete(doc, "received_at")
+	for name, v := range doc {
+		value := gelfFieldValue(v)
+		if value == nil {
+			continue
+		}
+		msg[gelfFieldName(name)] = value
+	}
+
+	return json.Marshal(msg)
+}
+
+// gelfFieldName returns the additional field name for a report field.
+// Characters GELF doesn't allow become underscores, and `id`, which is
+// reserved, is sent as `_report_id`.
+func gelfFieldName(name string) string {
+	if name == "id" {
+		return "_report_id"
+	}
+	return "_" + strings.Map(func(r rune) rune {
+		if r == '_' || r == '.' || r == '-' ||
+			(r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// gelfFieldValue converts a field to a string or number, the only types
+// GELF allows. Empty values are left out.
+func gelfFieldValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil:
+		return nil
+	case string:
+		if v == "" {
+			return nil
+		}
+		return v
+	case int, int32, int64, uint, uint32, uint64, float32, float64:
+		return v
+	case bool:
+		return fmt.Sprint(v)
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+}
@@ -0,0 +1,268 @@
+package sink
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// readGELFDatagram reads one message from conn, reassembling chunks and
+// decompressing it.
+func readGELFDatagram(t *testing.T, conn net.PacketConn) (map[string]interface{}, int) {
+	t.Helper()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	var msg []byte
+	chunks := map[byte][]byte{}
+	datagrams := 0
+	for {
+		buf := make([]byte, 65536)
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		datagrams++
+		p := buf[:n]
+		if n < 2 || p[0] != 0x1e || p[1] != 0x0f {
+			msg = p
+			break
+		}
+		chunks[p[10]] = p[12:]
+		if len(chunks) == int(p[11]) {
+			for i := 0; i < int(p[11]); i++ {
+				msg = append(msg, chunks[byte(i)]...)
+			}
+			break
+		}
+	}
+
+	var r io.Reader = bytes.NewReader(msg)
+	switch {
+	case msg[0] == 0x1f && msg[1] == 0x8b:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	case msg[0] == 0x78:
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = zr
+	}
+
+	var decoded map[string]interface{}
+	if err := json.NewDecoder(r).Decode(&decoded); err != nil {
+		t.Fatal(err)
+	}
+	return decoded, datagrams
+}
+
+func TestGELFSendsMessagesOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewGELF(GELFConfig{Address: conn.LocalAddr().String(), Host: "collector-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := sampleReport(12)
+	r.Fields["document_uri"] = "https://shop.example/checkout"
+	r.Fields["blocked_uri"] = "https://evil.example"
+	r.Fields["effective_directive"] = "script-src"
+	r.Fields["metadata"] = map[string]string{"env": "prod"}
+	r.Fields["referrer"] = ""
+	if err := s.Write(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, datagrams := readGELFDatagram(t, conn)
+	if datagrams != 1 {
+		t.Errorf("expected a small message in a single datagram, got %d", datagrams)
+	}
+	want := map[string]interface{}{
+		"version":              "1.1",
+		"host":                 "collector-1",
+		"short_message":        "script-src blocked https://evil.example on https://shop.example/checkout",
+		"timestamp":            1714564800.0,
+		"level":                4.0,
+		"_document_uri":        "https://shop.example/checkout",
+		"_effective_directive": "script-src",
+		"_line_number":         12.0,
+		"_handler":             "csp",
+		"_report_type":         "csp-violation",
+		"_report_only":         "false",
+		"_metadata":            `{"env":"prod"}`,
+	}
+	for k, v := range want {
+		if msg[k] != v {
+			t.Errorf("%s = %v, want %v", k, msg[k], v)
+		}
+	}
+	for _, k := range []string{"_referrer", "_received_at"} {
+		if _, ok := msg[k]; ok {
+			t.Errorf("expected %s to be left out", k)
+		}
+	}
+}
+
+func TestGELFChunksLargeMessages(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewGELF(GELFConfig{Address: conn.LocalAddr().String(), Compression: "zlib", ChunkSize: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// A sample that doesn't compress well needs several chunks.
+	var sample strings.Builder
+	for i := 0; i < 100; i++ {
+		sample.WriteString(time.Duration(i * 7919).String())
+	}
+	r := sampleReport(1)
+	r.ReportOnly = true
+	r.Fields["script_sample"] = sample.String()
+	if err := s.Write(context.Background(), r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	msg, datagrams := readGELFDatagram(t, conn)
+	if datagrams < 2 {
+		t.Errorf("expected the message to be chunked, got %d datagram", datagrams)
+	}
+	if msg["_script_sample"] != sample.String() || msg["level"] != 5.0 {
+		t.Errorf("unexpected reassembled message %v", msg)
+	}
+}
+
+func TestGELFSendsMessagesOverTCP(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	msgs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					msg, err := r.ReadString(0)
+					if err != nil {
+						return
+					}
+					msgs <- strings.TrimSuffix(msg, "\x00")
+				}
+			}()
+		}
+	}()
+
+	s, err := NewGELF(GELFConfig{Network: "tcp", Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	nel := Report{Handler: "nel", Type: "network-error", ReceivedAt: time.Now(), Fields: map[string]interface{}{
+		"type": "tcp.refused",
+		"url":  "https://shop.example/",
+		"id":   "abc",
+	}}
+	for i := 0; i < 2; i++ {
+		if err := s.Write(context.Background(), nel); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		var msg map[string]interface{}
+		if err := json.Unmarshal([]byte(receive(t, msgs)), &msg); err != nil {
+			t.Fatal(err)
+		}
+		if msg["short_message"] != "tcp.refused network error on https://shop.example/" || msg["_type"] != "tcp.refused" || msg["_report_id"] != "abc" {
+			t.Errorf("unexpected message %v", msg)
+		}
+		if _, ok := msg["_id"]; ok {
+			t.Error("expected the reserved _id field not to be sent")
+		}
+	}
+}
+
+func TestGELFDropsMessagesTooLargeToChunk(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s, err := NewGELF(GELFConfig{Address: conn.LocalAddr().String(), Compression: "none", ChunkSize: 20, Metrics: m})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	large := sampleReport(1)
+	large.Fields["script_sample"] = strings.Repeat("x", 8*gelfMaxChunks)
+	_ = s.Write(context.Background(), large)
+	if err := s.Flush(context.Background()); err == nil {
+		t.Error("expected the oversized message to be reported")
+	}
+	if got := s.batch.buffered(); got != 0 {
+		t.Errorf("expected the oversized message not to be retried, got %d buffered", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("gelf", "failed")); got != 1 {
+		t.Errorf("sink_reports_total failed = %v, want 1", got)
+	}
+}
+
+func TestNewGELFValidatesConfig(t *testing.T) {
+	cases := []GELFConfig{
+		{Network: "tls"},
+		{Compression: "brotli"},
+		{ChunkSize: 8},
+	}
+	for _, cfg := range cases {
+		if _, err := NewGELF(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
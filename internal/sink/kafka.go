@@ -0,0 +1,219 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/segmentio/kafka-go"
+	"github.com/segmentio/kafka-go/sasl"
+	"github.com/segmentio/kafka-go/sasl/plain"
+	"github.com/segmentio/kafka-go/sasl/scram"
+)
+
+// KafkaConfig configures a Kafka sink.
+type KafkaConfig struct {
+	// Brokers are the `host:port` addresses used to bootstrap the cluster.
+	Brokers []string
+
+	// Topic is the topic reports are published to.
+	Topic string
+
+	// Acks is the acknowledgement required from the cluster: `none`,
+	// `leader` or `all`. Defaults to `all`.
+	Acks string
+
+	// TLS configures encryption to the brokers.
+	TLS TLSConfig
+
+	// SASLMechanism is `plain`, `scram-sha-256` or `scram-sha-512`. Empty
+	// disables SASL authentication.
+	SASLMechanism string
+	SASLUsername  string
+	SASLPassword  string
+
+	BatchConfig
+
+	// Metrics, if set, counts delivered, failed and dropped messages.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background flushes.
+	OnError func(error)
+}
+
+// kafkaWriter is the part of *kafka.Writer used by the Kafka sink.
+type kafkaWriter interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+	Close() error
+}
+
+// Kafka publishes each report as a JSON message keyed by the origin of the
+// page it is about, so that reports from one site stay in order on a single
+// partition. Reports are buffered and published in batches from a
+// background goroutine.
+type Kafka struct {
+	writer kafkaWriter
+	batch  *batcher
+}
+
+// NewKafka creates the producer and starts the background flush loop. No
+// connection is made until the first batch is published.
+func NewKafka(cfg KafkaConfig) (*Kafka, error) {
+	if len(cfg.Brokers) == 0 {
+		return nil, fmt.Errorf("kafka brokers are not set")
+	}
+	if cfg.Topic == "" {
+		return nil, fmt.Errorf("kafka topic is not set")
+	}
+
+	acks, err := kafkaAcks(cfg.Acks)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig, err := cfg.TLS.Config()
+	if err != nil {
+		return nil, err
+	}
+	mechanism, err := kafkaSASL(cfg.SASLMechanism, cfg.SASLUsername, cfg.SASLPassword)
+	if err != nil {
+		return nil, err
+	}
+
+	batchSize := cfg.BatchSize
+	if batchSize <= 0 {
+		batchSize = 500
+	}
+
+	writer := &kafka.Writer{
+		Addr:     kafka.TCP(cfg.Brokers...),
+		Topic:    cfg.Topic,
+		Balancer: &kafka.Hash{},
+		// Batching is done by the sink, so batches are handed straight to
+		// the brokers rather than waiting to fill up again.
+		BatchSize:    batchSize,
+		BatchTimeout: time.Millisecond,
+		RequiredAcks: acks,
+		Transport: &kafka.Transport{
+			ClientID: "go-csp-collector",
+			TLS:      tlsConfig,
+			SASL:     mechanism,
+		},
+	}
+
+	return newKafka(cfg, writer), nil
+}
+
+func newKafka(cfg KafkaConfig, writer kafkaWriter) *Kafka {
+	s := &Kafka{writer: writer}
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "kafka",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+	return s
+}
+
+func kafkaAcks(acks string) (kafka.RequiredAcks, error) {
+	switch acks {
+	case "none":
+		return kafka.RequireNone, nil
+	case "leader":
+		return kafka.RequireOne, nil
+	case "all", "":
+		return kafka.RequireAll, nil
+	default:
+		return 0, fmt.Errorf("unknown kafka acks '%s'", acks)
+	}
+}
+
+func kafkaSASL(mechanism, username, password string) (sasl.Mechanism, error) {
+	switch strings.ToLower(mechanism) {
+	case "":
+		return nil, nil
+	case "plain":
+		return plain.Mechanism{Username: username, Password: password}, nil
+	case "scram-sha-256":
+		return scram.Mechanism(scram.SHA256, username, password)
+	case "scram-sha-512":
+		return scram.Mechanism(scram.SHA512, username, password)
+	default:
+		return nil, fmt.Errorf("unknown kafka sasl mechanism '%s'", mechanism)
+	}
+}
+
+func (s *Kafka) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush publishes buffered reports, retrying with backoff until they are
+// acknowledged or ctx is done.
+func (s *Kafka) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the flush loop and closes the producer. Reports still
+// buffered are dropped; call Flush first to publish them.
+func (s *Kafka) Close() error {
+	err := s.batch.close()
+	return errors.Join(err, s.writer.Close())
+}
+
+// send publishes batch. Messages that failed with a transient error are
+// returned for retry; those the cluster rejected outright are dropped.
+func (s *Kafka) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	msgs := make([]kafka.Message, 0, len(batch))
+	sent := make([]Report, 0, len(batch))
+	var errs []error
+	for _, r := range batch {
+		value, err := json.Marshal(r.Document())
+		if err != nil {
+			s.batch.count("failed", 1)
+			errs = append(errs, fmt.Errorf("unable to encode %s report: %w", r.Type, err))
+			continue
+		}
+		msg := kafka.Message{Value: value, Time: r.ReceivedAt}
+		// Reports without an origin are spread across partitions.
+		if origin := r.Origin(); origin != "" {
+			msg.Key = []byte(origin)
+		}
+		msgs = append(msgs, msg)
+		sent = append(sent, r)
+	}
+
+	err := s.writer.WriteMessages(ctx, msgs...)
+	if err == nil {
+		s.batch.count("delivered", len(sent))
+		return nil, errors.Join(errs...)
+	}
+
+	var writeErrs kafka.WriteErrors
+	if !errors.As(err, &writeErrs) || len(writeErrs) != len(sent) {
+		return sent, errors.Join(append(errs, err)...)
+	}
+
+	var retry []Report
+	delivered, failed := 0, 0
+	for i, e := range writeErrs {
+		var kafkaErr kafka.Error
+		switch {
+		case e == nil:
+			delivered++
+		case errors.As(e, &kafkaErr) && !kafkaErr.Temporary():
+			failed++
+		default:
+			retry = append(retry, sent[i])
+		}
+	}
+	s.batch.count("delivered", delivered)
+	s.batch.count("failed", failed)
+	return retry, errors.Join(append(errs, err)...)
+}
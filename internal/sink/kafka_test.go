@@ -0,0 +1,209 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/segmentio/kafka-go"
+)
+
+// fakeKafkaWriter records published messages. When errs is set the next
+// write fails with it and nothing is recorded for the failed messages.
+type fakeKafkaWriter struct {
+	mu       sync.Mutex
+	messages []kafka.Message
+	errs     []error
+	closed   bool
+}
+
+func (w *fakeKafkaWriter) WriteMessages(_ context.Context, msgs ...kafka.Message) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.errs) == 0 {
+		w.messages = append(w.messages, msgs...)
+		return nil
+	}
+
+	err := w.errs[0]
+	w.errs = w.errs[1:]
+
+	var writeErrs kafka.WriteErrors
+	if errors.As(err, &writeErrs) {
+		for i, e := range writeErrs {
+			if e == nil {
+				w.messages = append(w.messages, msgs[i])
+			}
+		}
+	}
+	return err
+}
+
+func (w *fakeKafkaWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.closed = true
+	return nil
+}
+
+func testKafkaConfig(m *metrics.Metrics) KafkaConfig {
+	return KafkaConfig{
+		BatchConfig: BatchConfig{
+			FlushInterval: time.Hour,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    5 * time.Millisecond,
+		},
+		Metrics: m,
+	}
+}
+
+func TestKafkaPublishesJSONKeyedByOrigin(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	w := &fakeKafkaWriter{}
+	s := newKafka(testKafkaConfig(m), w)
+
+	ctx := context.Background()
+	csp := sampleReport(1)
+	csp.Fields["document_uri"] = "https://shop.example.com/checkout?id=1"
+	nel := Report{Handler: "nel", Type: "network-error", ReceivedAt: time.Now(), Fields: map[string]interface{}{"url": "http://example.org/"}}
+	other := Report{Handler: "crash", Type: "crash", ReceivedAt: time.Now(), Fields: map[string]interface{}{}}
+	for _, r := range []Report{csp, nel, other} {
+		_ = s.Write(ctx, r)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.messages) != 3 {
+		t.Fatalf("expected 3 messages, got %d", len(w.messages))
+	}
+	for i, want := range []string{"https://shop.example.com", "http://example.org", ""} {
+		if got := string(w.messages[i].Key); got != want {
+			t.Errorf("message %d: expected key %q, got %q", i, want, got)
+		}
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.messages[0].Value, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["report_type"] != "csp-violation" || doc["line_number"] != float64(1) {
+		t.Errorf("unexpected message value %v", doc)
+	}
+	if !w.messages[0].Time.Equal(csp.ReceivedAt) {
+		t.Errorf("expected message time %s, got %s", csp.ReceivedAt, w.messages[0].Time)
+	}
+	if !w.closed {
+		t.Error("expected the writer to be closed")
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("kafka", "delivered")); got != 3 {
+		t.Errorf("sink_reports_total delivered = %v, want 3", got)
+	}
+}
+
+func TestKafkaRetriesTransientWriteErrors(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	w := &fakeKafkaWriter{errs: []error{
+		kafka.WriteErrors{nil, kafka.MessageSizeTooLarge, kafka.LeaderNotAvailable},
+	}}
+	s := newKafka(testKafkaConfig(m), w)
+	defer s.Close()
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.messages) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(w.messages))
+	}
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.messages[1].Value, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc["line_number"] != float64(2) {
+		t.Errorf("expected the third report to be retried, got %v", doc)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("kafka", "failed")); got != 1 {
+		t.Errorf("sink_reports_total failed = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("kafka", "delivered")); got != 2 {
+		t.Errorf("sink_reports_total delivered = %v, want 2", got)
+	}
+}
+
+func TestKafkaCountsDrops(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	w := &fakeKafkaWriter{}
+	cfg := testKafkaConfig(m)
+	cfg.MaxBuffered = 2
+	s := newKafka(cfg, w)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		err := s.Write(ctx, sampleReport(i))
+		if i == 2 && !errors.Is(err, ErrBufferFull) {
+			t.Fatalf("expected ErrBufferFull, got %v", err)
+		}
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(w.messages) != 2 {
+		t.Errorf("expected the 2 newest reports to be published, got %d", len(w.messages))
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("kafka", "dropped")); got != 1 {
+		t.Errorf("sink_reports_total dropped = %v, want 1", got)
+	}
+}
+
+func TestNewKafkaValidatesConfig(t *testing.T) {
+	valid := KafkaConfig{Brokers: []string{"localhost:9092"}, Topic: "reports"}
+
+	tests := map[string]func(*KafkaConfig){
+		"no brokers":      func(c *KafkaConfig) { c.Brokers = nil },
+		"no topic":        func(c *KafkaConfig) { c.Topic = "" },
+		"unknown acks":    func(c *KafkaConfig) { c.Acks = "some" },
+		"unknown sasl":    func(c *KafkaConfig) { c.SASLMechanism = "gssapi" },
+		"missing ca file": func(c *KafkaConfig) { c.TLS = TLSConfig{Enabled: true, CAFile: "does-not-exist.pem"} },
+	}
+	for name, modify := range tests {
+		t.Run(name, func(t *testing.T) {
+			cfg := valid
+			modify(&cfg)
+			if _, err := NewKafka(cfg); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+
+	cfg := valid
+	cfg.Acks = "leader"
+	cfg.SASLMechanism = "SCRAM-SHA-512"
+	cfg.SASLUsername = "collector"
+	cfg.SASLPassword = "secret"
+	s, err := NewKafka(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
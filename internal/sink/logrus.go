@@ -0,0 +1,31 @@
+package sink
+
+import (
+	"context"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Logrus writes each report as a single log line using the configured
+// logrus formatter. This is the collector's default output.
+type Logrus struct {
+	Logger *log.Logger
+}
+
+// NewLogrus returns a Sink that logs reports to logger.
+func NewLogrus(logger *log.Logger) *Logrus {
+	return &Logrus{Logger: logger}
+}
+
+func (l *Logrus) Write(_ context.Context, r Report) error {
+	l.Logger.WithFields(r.Fields).Info()
+	return nil
+}
+
+func (l *Logrus) Flush(context.Context) error {
+	return nil
+}
+
+func (l *Logrus) Close() error {
+	return nil
+}
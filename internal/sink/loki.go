@@ -0,0 +1,371 @@
+package sink
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/klauspost/compress/snappy"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// cspDirectives are the directive names used as the `effective_directive`
+// stream label. Anything else is labelled `other`, since report contents
+// are browser supplied and labels must stay low cardinality.
+var cspDirectives = map[string]bool{
+	"base-uri":                  true,
+	"child-src":                 true,
+	"connect-src":               true,
+	"default-src":               true,
+	"fenced-frame-src":          true,
+	"font-src":                  true,
+	"form-action":               true,
+	"frame-ancestors":           true,
+	"frame-src":                 true,
+	"img-src":                   true,
+	"manifest-src":              true,
+	"media-src":                 true,
+	"object-src":                true,
+	"prefetch-src":              true,
+	"report-to":                 true,
+	"require-trusted-types-for": true,
+	"sandbox":                   true,
+	"script-src":                true,
+	"script-src-attr":           true,
+	"script-src-elem":           true,
+	"style-src":                 true,
+	"style-src-attr":            true,
+	"style-src-elem":            true,
+	"trusted-types":             true,
+	"upgrade-insecure-requests": true,
+	"worker-src":                true,
+}
+
+// lokiLabelName matches valid Prometheus style label names.
+var lokiLabelName = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// LokiConfig configures a Loki sink.
+type LokiConfig struct {
+	// URL is the base URL of Loki, e.g. `http://localhost:3100`. Reports
+	// are pushed to `/loki/api/v1/push` under it.
+	URL string
+
+	// TenantID, if set, is sent as `X-Scope-OrgID` for multi-tenant
+	// installations.
+	TenantID string
+
+	// Username and Password enable basic authentication.
+	Username string
+	Password string
+
+	// Format is `protobuf` to send snappy compressed protobuf, or `json`
+	// to send gzip compressed JSON. Defaults to `protobuf`.
+	Format string
+
+	// Labels are added to every stream, e.g. `job`.
+	Labels map[string]string
+
+	BatchConfig
+
+	// Timeout bounds each push. Defaults to 10s.
+	Timeout time.Duration
+
+	// Client overrides the HTTP client, mainly for tests.
+	Client *http.Client
+
+	// Metrics, if set, counts delivered, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background pushes.
+	OnError func(error)
+}
+
+// Loki pushes reports to Loki's push API. Each report becomes a log line
+// holding its fields as JSON, in a stream labelled with the handler, mode
+// and, for CSP violations, the effective directive.
+type Loki struct {
+	cfg    LokiConfig
+	client *http.Client
+	batch  *batcher
+}
+
+// lokiStream is a set of entries sharing the same labels.
+type lokiStream struct {
+	labels  map[string]string
+	entries []lokiEntry
+}
+
+type lokiEntry struct {
+	ts   time.Time
+	line string
+}
+
+// NewLoki starts the background push loop.
+func NewLoki(cfg LokiConfig) (*Loki, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("loki url is not set")
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Format == "" {
+		cfg.Format = "protobuf"
+	}
+	if cfg.Format != "protobuf" && cfg.Format != "json" {
+		return nil, fmt.Errorf("unknown loki format '%s'", cfg.Format)
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	for name := range cfg.Labels {
+		if !lokiLabelName.MatchString(name) {
+			return nil, fmt.Errorf("invalid loki label name '%s'", name)
+		}
+	}
+
+	s := &Loki{cfg: cfg, client: cfg.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "loki",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+func (s *Loki) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush pushes buffered reports, retrying with backoff until they are
+// accepted or ctx is done.
+func (s *Loki) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the push loop. Reports still buffered are dropped; call
+// Flush first to push them.
+func (s *Loki) Close() error {
+	err := s.batch.close()
+	s.client.CloseIdleConnections()
+	return err
+}
+
+// streamLabels returns the stream labels for r.
+func (s *Loki) streamLabels(r Report) map[string]string {
+	labels := make(map[string]string, len(s.cfg.Labels)+3)
+	for k, v := range s.cfg.Labels {
+		labels[k] = v
+	}
+	labels["handler"] = r.Handler
+	labels["mode"] = "enforced"
+	if r.ReportOnly {
+		labels["mode"] = "report_only"
+	}
+	if r.Type == "csp-violation" {
+		directive, _ := r.Fields["effective_directive"].(string)
+		if !cspDirectives[directive] {
+			directive = "other"
+		}
+		labels["effective_directive"] = directive
+	}
+	return labels
+}
+
+// streams groups batch by stream labels. Entries within a stream are
+// sorted by time, as older Loki versions reject out of order writes.
+func (s *Loki) streams(batch []Report) ([]*lokiStream, error) {
+	byKey := make(map[string]*lokiStream)
+	var streams []*lokiStream
+	for _, r := range batch {
+		labels := s.streamLabels(r)
+
+		// Fields carried by the labels or the timestamp are left out of the
+		// line, except for unrecognised directives which are kept verbatim.
+		doc := r.Document()
+		delete(doc, "handler")
+		delete(doc, "report_only")
+		delete(doc, "received_at")
+		if labels["effective_directive"] != "other" {
+			delete(doc, "effective_directive")
+		}
+		line, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+
+		key := lokiLabelString(labels)
+		stream, ok := byKey[key]
+		if !ok {
+			stream = &lokiStream{labels: labels}
+			byKey[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.entries = append(stream.entries, lokiEntry{ts: r.ReceivedAt, line: string(line)})
+	}
+
+	for _, stream := range streams {
+		sort.SliceStable(stream.entries, func(i, j int) bool {
+			return stream.entries[i].ts.Before(stream.entries[j].ts)
+		})
+	}
+	return streams, nil
+}
+
+// send pushes batch in a single request. Rejected batches are dropped;
+// everything else is retried.
+func (s *Loki) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	streams, err := s.streams(batch)
+	if err != nil {
+		s.batch.count("failed", len(batch))
+		return nil, err
+	}
+
+	var body []byte
+	var contentType, contentEncoding string
+	if s.cfg.Format == "json" {
+		body, err = lokiJSON(streams)
+		contentType, contentEncoding = "application/json", "gzip"
+	} else {
+		body = snappy.Encode(nil, lokiProtobuf(streams))
+		contentType = "application/x-protobuf"
+	}
+	if err != nil {
+		s.batch.count("failed", len(batch))
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL+"/loki/api/v1/push", bytes.NewReader(body))
+	if err != nil {
+		return batch, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	if contentEncoding != "" {
+		req.Header.Set("Content-Encoding", contentEncoding)
+	}
+	if s.cfg.TenantID != "" {
+		req.Header.Set("X-Scope-OrgID", s.cfg.TenantID)
+	}
+	if s.cfg.Username != "" {
+		req.SetBasicAuth(s.cfg.Username, s.cfg.Password)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return batch, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		s.batch.count("delivered", len(batch))
+		return nil, nil
+	}
+
+	msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+	err = fmt.Errorf("loki push: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return batch, err
+	}
+	s.batch.count("failed", len(batch))
+	return nil, err
+}
+
+// lokiLabelString renders labels in the `{name="value", ...}` form used by
+// the protobuf API, sorted by name.
+func lokiLabelString(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = name + "=" + strconv.Quote(labels[name])
+	}
+	return "{" + strings.Join(pairs, ", ") + "}"
+}
+
+// lokiJSON encodes streams as a gzip compressed JSON push request.
+func lokiJSON(streams []*lokiStream) ([]byte, error) {
+	type jsonStream struct {
+		Stream map[string]string `json:"stream"`
+		Values [][2]string       `json:"values"`
+	}
+
+	req := struct {
+		Streams []jsonStream `json:"streams"`
+	}{Streams: make([]jsonStream, len(streams))}
+	for i, stream := range streams {
+		values := make([][2]string, len(stream.entries))
+		for j, e := range stream.entries {
+			values[j] = [2]string{strconv.FormatInt(e.ts.UnixNano(), 10), e.line}
+		}
+		req.Streams[i] = jsonStream{Stream: stream.labels, Values: values}
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(req); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// lokiProtobuf encodes streams as a logproto.PushRequest:
+//
+//	message PushRequest { repeated Stream streams = 1; }
+//	message Stream { string labels = 1; repeated Entry entries = 2; }
+//	message Entry { google.protobuf.Timestamp timestamp = 1; string line = 2; }
+func lokiProtobuf(streams []*lokiStream) []byte {
+	var req []byte
+	for _, stream := range streams {
+		var msg []byte
+		msg = protowire.AppendTag(msg, 1, protowire.BytesType)
+		msg = protowire.AppendString(msg, lokiLabelString(stream.labels))
+
+		for _, e := range stream.entries {
+			var ts []byte
+			ts = protowire.AppendTag(ts, 1, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Unix()))
+			ts = protowire.AppendTag(ts, 2, protowire.VarintType)
+			ts = protowire.AppendVarint(ts, uint64(e.ts.Nanosecond()))
+
+			var entry []byte
+			entry = protowire.AppendTag(entry, 1, protowire.BytesType)
+			entry = protowire.AppendBytes(entry, ts)
+			entry = protowire.AppendTag(entry, 2, protowire.BytesType)
+			entry = protowire.AppendString(entry, e.line)
+
+			msg = protowire.AppendTag(msg, 2, protowire.BytesType)
+			msg = protowire.AppendBytes(msg, entry)
+		}
+
+		req = protowire.AppendTag(req, 1, protowire.BytesType)
+		req = protowire.AppendBytes(req, msg)
+	}
+	return req
+}
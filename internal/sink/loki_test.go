@@ -0,0 +1,274 @@
+package sink
+
+import (
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/klauspost/compress/snappy"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// pushedStream is a stream decoded from either push format.
+type pushedStream struct {
+	labels string
+	ts     []time.Time
+	lines  []string
+}
+
+// fakeLoki decodes pushes in either format and answers with status, or
+// 204 if it is zero.
+type fakeLoki struct {
+	mu      sync.Mutex
+	status  int
+	headers []http.Header
+	streams []pushedStream
+}
+
+func (l *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if r.URL.Path != "/loki/api/v1/push" {
+		http.NotFound(w, r)
+		return
+	}
+	l.headers = append(l.headers, r.Header.Clone())
+	if l.status != 0 {
+		http.Error(w, "rate limited", l.status)
+		return
+	}
+
+	var err error
+	switch r.Header.Get("Content-Type") {
+	case "application/json":
+		err = l.decodeJSON(r.Body)
+	case "application/x-protobuf":
+		err = l.decodeProtobuf(r.Body)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (l *fakeLoki) decodeJSON(body io.Reader) error {
+	gz, err := gzip.NewReader(body)
+	if err != nil {
+		return err
+	}
+	var req struct {
+		Streams []struct {
+			Stream map[string]string `json:"stream"`
+			Values [][2]string       `json:"values"`
+		} `json:"streams"`
+	}
+	if err := json.NewDecoder(gz).Decode(&req); err != nil {
+		return err
+	}
+	for _, s := range req.Streams {
+		stream := pushedStream{labels: lokiLabelString(s.Stream)}
+		for _, v := range s.Values {
+			var ns int64
+			if err := json.Unmarshal([]byte(v[0]), &ns); err != nil {
+				return err
+			}
+			stream.ts = append(stream.ts, time.Unix(0, ns))
+			stream.lines = append(stream.lines, v[1])
+		}
+		l.streams = append(l.streams, stream)
+	}
+	return nil
+}
+
+func (l *fakeLoki) decodeProtobuf(body io.Reader) error {
+	compressed, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	b, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range protoFields(b)[1] {
+		fields := protoFields(msg)
+		stream := pushedStream{labels: string(fields[1][0])}
+		for _, entry := range fields[2] {
+			entryFields := protoFields(entry)
+			ts := protoFields(entryFields[1][0])
+			secs, _ := protowire.ConsumeVarint(ts[1][0])
+			nanos, _ := protowire.ConsumeVarint(ts[2][0])
+			stream.ts = append(stream.ts, time.Unix(int64(secs), int64(nanos)))
+			stream.lines = append(stream.lines, string(entryFields[2][0]))
+		}
+		l.streams = append(l.streams, stream)
+	}
+	return nil
+}
+
+// protoFields splits a protobuf message into the raw values of each field.
+// Varints are returned re-encoded so that callers can consume them.
+func protoFields(b []byte) map[protowire.Number][][]byte {
+	fields := map[protowire.Number][][]byte{}
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		b = b[n:]
+		switch typ {
+		case protowire.BytesType:
+			v, n := protowire.ConsumeBytes(b)
+			fields[num] = append(fields[num], v)
+			b = b[n:]
+		case protowire.VarintType:
+			v, n := protowire.ConsumeVarint(b)
+			fields[num] = append(fields[num], protowire.AppendVarint(nil, v))
+			b = b[n:]
+		default:
+			return fields
+		}
+	}
+	return fields
+}
+
+func lokiReports() []Report {
+	at := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	newer := sampleReport(1)
+	newer.ReceivedAt = at.Add(time.Second)
+	newer.Fields["effective_directive"] = "script-src"
+	older := sampleReport(2)
+	older.Fields["effective_directive"] = "script-src"
+	unknown := sampleReport(3)
+	unknown.ReportOnly = true
+	unknown.Fields["effective_directive"] = "made-up-src"
+	nel := Report{Handler: "nel", Type: "network-error", ReceivedAt: at, Fields: map[string]interface{}{"url": "https://example.com/"}}
+	return []Report{newer, older, unknown, nel}
+}
+
+func TestLokiPushesStreams(t *testing.T) {
+	for _, format := range []string{"protobuf", "json"} {
+		t.Run(format, func(t *testing.T) {
+			loki := &fakeLoki{}
+			server := httptest.NewServer(loki)
+			defer server.Close()
+
+			m := metrics.New(prometheus.NewRegistry())
+			s, err := NewLoki(LokiConfig{
+				URL:         server.URL + "/",
+				Format:      format,
+				TenantID:    "security",
+				Labels:      map[string]string{"job": "csp-collector"},
+				BatchConfig: BatchConfig{FlushInterval: time.Hour},
+				Metrics:     m,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			ctx := context.Background()
+			for _, r := range lokiReports() {
+				_ = s.Write(ctx, r)
+			}
+			if err := s.Flush(ctx); err != nil {
+				t.Fatal(err)
+			}
+
+			if got := loki.headers[0].Get("X-Scope-OrgID"); got != "security" {
+				t.Errorf("expected tenant header, got %q", got)
+			}
+			if format == "json" && loki.headers[0].Get("Content-Encoding") != "gzip" {
+				t.Error("expected a gzip encoded body")
+			}
+
+			want := []string{
+				`{effective_directive="script-src", handler="csp", job="csp-collector", mode="enforced"}`,
+				`{effective_directive="other", handler="csp", job="csp-collector", mode="report_only"}`,
+				`{handler="nel", job="csp-collector", mode="enforced"}`,
+			}
+			if len(loki.streams) != len(want) {
+				t.Fatalf("expected %d streams, got %d", len(want), len(loki.streams))
+			}
+			for i, labels := range want {
+				if loki.streams[i].labels != labels {
+					t.Errorf("stream %d: expected labels %s, got %s", i, labels, loki.streams[i].labels)
+				}
+			}
+
+			csp := loki.streams[0]
+			if len(csp.lines) != 2 || !csp.ts[0].Before(csp.ts[1]) {
+				t.Fatalf("expected 2 entries in time order, got %v", csp.ts)
+			}
+			var line map[string]interface{}
+			if err := json.Unmarshal([]byte(csp.lines[0]), &line); err != nil {
+				t.Fatal(err)
+			}
+			if line["line_number"] != float64(2) || line["document_uri"] != "https://example.com/" {
+				t.Errorf("unexpected line %s", csp.lines[0])
+			}
+			if _, ok := line["handler"]; ok {
+				t.Errorf("expected labelled fields to be left out of the line, got %s", csp.lines[0])
+			}
+			if err := json.Unmarshal([]byte(loki.streams[1].lines[0]), &line); err != nil {
+				t.Fatal(err)
+			}
+			if line["effective_directive"] != "made-up-src" {
+				t.Errorf("expected an unrecognised directive to stay in the line, got %v", line)
+			}
+
+			if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("loki", "delivered")); got != 4 {
+				t.Errorf("sink_reports_total delivered = %v, want 4", got)
+			}
+		})
+	}
+}
+
+func TestLokiRetriesRateLimitedPushes(t *testing.T) {
+	loki := &fakeLoki{status: http.StatusTooManyRequests}
+	server := httptest.NewServer(loki)
+	defer server.Close()
+
+	s, err := NewLoki(LokiConfig{URL: server.URL, BatchConfig: BatchConfig{FlushInterval: time.Hour, MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	if _, retry, err := s.batch.sendOnce(context.Background()); !retry || err == nil {
+		t.Fatalf("expected a rate limited push to be retried, got %v, %v", retry, err)
+	}
+
+	loki.mu.Lock()
+	loki.status = 0
+	loki.mu.Unlock()
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if len(loki.streams) != 1 {
+		t.Errorf("expected the report to be pushed once the rate limit lifted, got %d streams", len(loki.streams))
+	}
+}
+
+func TestNewLokiValidatesConfig(t *testing.T) {
+	if _, err := NewLoki(LokiConfig{}); err == nil {
+		t.Error("expected an error without a url")
+	}
+	if _, err := NewLoki(LokiConfig{URL: "http://localhost:3100", Format: "xml"}); err == nil {
+		t.Error("expected an error for an unknown format")
+	}
+	if _, err := NewLoki(LokiConfig{URL: "http://localhost:3100", Labels: map[string]string{"bad-name": "x"}}); err == nil {
+		t.Error("expected an error for an invalid label name")
+	}
+}
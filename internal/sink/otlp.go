@@ -0,0 +1,161 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+)
+
+// otlpAttributes maps report fields onto OpenTelemetry semantic
+// conventions. Fields without a convention are recorded as
+// `csp_collector.report.<field>`. A truncated client_ip is a prefix rather
+// than an address, but is still the best client.address there is.
+var otlpAttributes = map[string]func(interface{}) (attribute.KeyValue, bool){
+	"document_uri":  stringAttribute(semconv.URLFull),
+	"url":           stringAttribute(semconv.URLFull),
+	"user_agent":    stringAttribute(semconv.UserAgentOriginal),
+	"client_ip":     stringAttribute(semconv.ClientAddress),
+	"server_ip":     stringAttribute(semconv.ServerAddress),
+	"method":        stringAttribute(semconv.HTTPRequestMethodKey.String),
+	"source_file":   stringAttribute(semconv.CodeFilePath),
+	"status_code":   intAttribute(semconv.HTTPResponseStatusCode),
+	"line_number":   intAttribute(semconv.CodeLineNumber),
+	"column_number": intAttribute(semconv.CodeColumnNumber),
+}
+
+// OTLPConfig configures an OTLP sink.
+type OTLPConfig struct {
+	// Provider supplies the logger records are emitted with, normally an
+	// SDK provider exporting over OTLP. It is owned by the caller, which
+	// must shut it down after closing the sink.
+	Provider log.LoggerProvider
+}
+
+// OTLP emits each report as an OpenTelemetry log record. The body is the
+// report's summary and the fields become attributes, using semantic
+// conventions where one exists. Records emitted while handling a request
+// are correlated with its span.
+type OTLP struct {
+	provider log.LoggerProvider
+	logger   log.Logger
+}
+
+// NewOTLP creates an OTLP sink.
+func NewOTLP(cfg OTLPConfig) (*OTLP, error) {
+	if cfg.Provider == nil {
+		return nil, fmt.Errorf("otlp logger provider is not set")
+	}
+	return &OTLP{
+		provider: cfg.Provider,
+		logger:   cfg.Provider.Logger("github.com/jacobbednarz/go-csp-collector/internal/sink"),
+	}, nil
+}
+
+func (s *OTLP) Write(ctx context.Context, r Report) error {
+	var rec log.Record
+	rec.SetEventName("csp_collector." + r.Type)
+	rec.SetTimestamp(r.ReceivedAt)
+	rec.SetObservedTimestamp(time.Now())
+	rec.SetBody(attribute.StringValue(r.Summary()))
+
+	// Enforced reports mean something was blocked; report-only ones are
+	// informational.
+	if r.ReportOnly {
+		rec.SetSeverity(log.SeverityInfo)
+		rec.SetSeverityText("INFO")
+	} else {
+		rec.SetSeverity(log.SeverityWarn)
+		rec.SetSeverityText("WARN")
+	}
+
+	rec.AddAttributes(
+		attribute.String("csp_collector.handler", r.Handler),
+		attribute.String("csp_collector.report_type", r.Type),
+		attribute.Bool("csp_collector.report_only", r.ReportOnly),
+	)
+	for k, v := range r.Fields {
+		if k == "report_only" {
+			continue
+		}
+		if attr, ok := otlpAttribute(k, v); ok {
+			rec.AddAttributes(attr)
+		}
+	}
+
+	s.logger.Emit(ctx, rec)
+	return nil
+}
+
+// Flush exports records buffered by the provider, if it buffers.
+func (s *OTLP) Flush(ctx context.Context) error {
+	if f, ok := s.provider.(interface{ ForceFlush(context.Context) error }); ok {
+		return f.ForceFlush(ctx)
+	}
+	return nil
+}
+
+// Close is a no-op; the provider is shut down by its owner.
+func (s *OTLP) Close() error {
+	return nil
+}
+
+// otlpAttribute converts the field k to an attribute. Empty values are left
+// out.
+func otlpAttribute(k string, v interface{}) (attribute.KeyValue, bool) {
+	if convert, ok := otlpAttributes[k]; ok {
+		return convert(v)
+	}
+
+	key := "csp_collector.report." + k
+	switch v := v.(type) {
+	case nil:
+		return attribute.KeyValue{}, false
+	case string:
+		return attribute.String(key, v), v != ""
+	case bool:
+		return attribute.Bool(key, v), true
+	case int:
+		return attribute.Int(key, v), true
+	case int64:
+		return attribute.Int64(key, v), true
+	case uint32:
+		return attribute.Int64(key, int64(v)), true
+	case float64:
+		return attribute.Float64(key, v), true
+	case fmt.Stringer:
+		return attribute.String(key, v.String()), true
+	default:
+		b, err := json.Marshal(v)
+		if err != nil || string(b) == "null" {
+			return attribute.KeyValue{}, false
+		}
+		return attribute.String(key, string(b)), true
+	}
+}
+
+func stringAttribute(attr func(string) attribute.KeyValue) func(interface{}) (attribute.KeyValue, bool) {
+	return func(v interface{}) (attribute.KeyValue, bool) {
+		s, ok := v.(string)
+		if !ok || s == "" {
+			return attribute.KeyValue{}, false
+		}
+		return attr(s), true
+	}
+}
+
+func intAttribute(attr func(int) attribute.KeyValue) func(interface{}) (attribute.KeyValue, bool) {
+	return func(v interface{}) (attribute.KeyValue, bool) {
+		switch v := v.(type) {
+		case int:
+			return attr(v), v != 0
+		case float64:
+			return attr(int(v)), v != 0
+		}
+		return attribute.KeyValue{}, false
+	}
+}
@@ -0,0 +1,167 @@
+package sink
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// recordingExporter keeps the log records exported to it.
+type recordingExporter struct {
+	mu      sync.Mutex
+	records []sdklog.Record
+}
+
+func (e *recordingExporter) Export(_ context.Context, records []sdklog.Record) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, r := range records {
+		e.records = append(e.records, r.Clone())
+	}
+	return nil
+}
+
+func (e *recordingExporter) Shutdown(context.Context) error   { return nil }
+func (e *recordingExporter) ForceFlush(context.Context) error { return nil }
+
+func recordAttributes(r sdklog.Record) map[attribute.Key]attribute.Value {
+	attrs := make(map[attribute.Key]attribute.Value)
+	r.WalkAttributes(func(kv attribute.KeyValue) bool {
+		attrs[kv.Key] = kv.Value
+		return true
+	})
+	return attrs
+}
+
+func TestOTLPEmitsLogRecords(t *testing.T) {
+	exporter := &recordingExporter{}
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(exporter)))
+	defer provider.Shutdown(context.Background())
+
+	s, err := NewOTLP(OTLPConfig{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records written while a span is active are correlated with it.
+	tracer := sdktrace.NewTracerProvider().Tracer("test")
+	ctx, span := tracer.Start(context.Background(), "write report")
+	defer span.End()
+
+	r := sampleReport(7)
+	r.Fields["effective_directive"] = "script-src"
+	r.Fields["blocked_uri"] = "https://evil.example/x.js"
+	r.Fields["user_agent"] = "Mozilla/5.0"
+	r.Fields["column_number"] = 0
+	r.Fields["metadata"] = map[string]string{"env": "prod"}
+	if err := s.Write(ctx, r); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(exporter.records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(exporter.records))
+	}
+	rec := exporter.records[0]
+	if got := rec.Body().AsString(); got != "script-src blocked https://evil.example/x.js on https://example.com/" {
+		t.Errorf("unexpected body %q", got)
+	}
+	if rec.Severity() != log.SeverityWarn || rec.EventName() != "csp_collector.csp-violation" {
+		t.Errorf("unexpected severity %v or event name %q", rec.Severity(), rec.EventName())
+	}
+	if !rec.Timestamp().Equal(r.ReceivedAt) {
+		t.Errorf("expected the received time as timestamp, got %s", rec.Timestamp())
+	}
+	if rec.TraceID() != span.SpanContext().TraceID() {
+		t.Error("expected the record to be correlated with the active span")
+	}
+
+	attrs := recordAttributes(rec)
+	want := map[attribute.Key]attribute.Value{
+		"url.full":                                 attribute.StringValue("https://example.com/"),
+		"user_agent.original":                      attribute.StringValue("Mozilla/5.0"),
+		"code.line.number":                         attribute.IntValue(7),
+		"csp_collector.handler":                    attribute.StringValue("csp"),
+		"csp_collector.report_only":                attribute.BoolValue(false),
+		"csp_collector.report.effective_directive": attribute.StringValue("script-src"),
+		"csp_collector.report.blocked_uri":         attribute.StringValue("https://evil.example/x.js"),
+		"csp_collector.report.metadata":            attribute.StringValue(`{"env":"prod"}`),
+	}
+	for k, v := range want {
+		if attrs[k] != v {
+			t.Errorf("attribute %s = %v, want %v", k, attrs[k].Emit(), v.Emit())
+		}
+	}
+	if _, ok := attrs["code.column.number"]; ok {
+		t.Error("expected an empty column number to be left out")
+	}
+}
+
+func TestOTLPMapsAddressesToSemanticConventions(t *testing.T) {
+	exporter := &recordingExporter{}
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(exporter)))
+	defer provider.Shutdown(context.Background())
+
+	s, err := NewOTLP(OTLPConfig{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With -log-truncated-client-ip the client address is a prefix.
+	for _, clientIP := range []string{"192.0.2.10", "192.0.2.0/24"} {
+		r := sampleReport(1)
+		r.Fields["client_ip"] = clientIP
+		r.Fields["server_ip"] = "198.51.100.1"
+		_ = s.Write(context.Background(), r)
+	}
+
+	if len(exporter.records) != 2 {
+		t.Fatalf("expected 2 records, got %d", len(exporter.records))
+	}
+	for i, clientIP := range []string{"192.0.2.10", "192.0.2.0/24"} {
+		attrs := recordAttributes(exporter.records[i])
+		if got := attrs["client.address"]; got != attribute.StringValue(clientIP) {
+			t.Errorf("client.address = %v, want %s", got.Emit(), clientIP)
+		}
+		if got := attrs["server.address"]; got != attribute.StringValue("198.51.100.1") {
+			t.Errorf("server.address = %v, want 198.51.100.1", got.Emit())
+		}
+		for _, k := range []attribute.Key{"csp_collector.report.client_ip", "csp_collector.report.server_ip"} {
+			if _, ok := attrs[k]; ok {
+				t.Errorf("expected %s to be recorded under its semantic convention only", k)
+			}
+		}
+	}
+}
+
+func TestOTLPReportOnlyIsInfo(t *testing.T) {
+	exporter := &recordingExporter{}
+	provider := sdklog.NewLoggerProvider(sdklog.WithProcessor(sdklog.NewSimpleProcessor(exporter)))
+	defer provider.Shutdown(context.Background())
+
+	s, err := NewOTLP(OTLPConfig{Provider: provider})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := sampleReport(1)
+	r.ReportOnly = true
+	_ = s.Write(context.Background(), r)
+
+	if len(exporter.records) != 1 || exporter.records[0].Severity() != log.SeverityInfo {
+		t.Errorf("expected a single info record, got %v", exporter.records)
+	}
+}
+
+func TestNewOTLPRequiresProvider(t *testing.T) {
+	if _, err := NewOTLP(OTLPConfig{}); err == nil {
+		t.Error("expected an error without a provider")
+	}
+}
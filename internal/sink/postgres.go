@@ -0,0 +1,325 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// PostgresConfig configures a Postgres sink.
+type PostgresConfig struct {
+	// DSN is a libpq style connection string or URL.
+	DSN string
+
+	// MaxConns, MinConns, MaxConnLifetime and MaxConnIdleTime configure the
+	// connection pool. Zero values keep the pgxpool defaults.
+	MaxConns        int32
+	MinConns        int32
+	MaxConnLifetime time.Duration
+	MaxConnIdleTime time.Duration
+
+	BatchConfig
+
+	// Metrics, if set, counts written, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background flushes, which have
+	// no caller to return them to.
+	OnError func(error)
+}
+
+// postgresMigrations are applied in order and recorded in
+// `csp_collector_schema_migrations`. Append new migrations; never edit
+// released ones.
+var postgresMigrations = []string{
+	`CREATE TABLE csp_reports (
+		id                  BIGSERIAL PRIMARY KEY,
+		received_at         TIMESTAMPTZ NOT NULL,
+		handler             TEXT NOT NULL,
+		source              TEXT,
+		report_only         BOOLEAN NOT NULL,
+		document_uri        TEXT,
+		document_host       TEXT,
+		referrer            TEXT,
+		blocked_uri         TEXT,
+		blocked_host        TEXT,
+		violated_directive  TEXT,
+		effective_directive TEXT,
+		original_policy     TEXT,
+		disposition         TEXT,
+		script_sample       TEXT,
+		status_code         INTEGER,
+		source_file         TEXT,
+		line_number         INTEGER,
+		column_number       INTEGER,
+		client_ip           TEXT,
+		metadata            TEXT,
+		path                TEXT
+	);
+	CREATE INDEX csp_reports_received_at ON csp_reports (received_at);
+	CREATE INDEX csp_reports_document_host ON csp_reports (document_host);
+	CREATE INDEX csp_reports_effective_directive ON csp_reports (effective_directive);
+	CREATE INDEX csp_reports_blocked_host ON csp_reports (blocked_host);
+
+	CREATE TABLE nel_reports (
+		id                BIGSERIAL PRIMARY KEY,
+		received_at       TIMESTAMPTZ NOT NULL,
+		handler           TEXT NOT NULL,
+		report_only       BOOLEAN NOT NULL,
+		url               TEXT,
+		url_host          TEXT,
+		referrer          TEXT,
+		type              TEXT,
+		phase             TEXT,
+		protocol          TEXT,
+		method            TEXT,
+		status_code       INTEGER,
+		elapsed_time      INTEGER,
+		server_ip         TEXT,
+		sampling_fraction DOUBLE PRECISION,
+		client_ip         TEXT,
+		metadata          TEXT,
+		path              TEXT
+	);
+	CREATE INDEX nel_reports_received_at ON nel_reports (received_at);
+	CREATE INDEX nel_reports_url_host ON nel_reports (url_host);
+	CREATE INDEX nel_reports_type ON nel_reports (type);
+
+	CREATE TABLE reports (
+		id          BIGSERIAL PRIMARY KEY,
+		received_at TIMESTAMPTZ NOT NULL,
+		handler     TEXT NOT NULL,
+		report_type TEXT NOT NULL,
+		report_only BOOLEAN NOT NULL,
+		url         TEXT,
+		url_host    TEXT,
+		fields      JSONB NOT NULL
+	);
+	CREATE INDEX reports_received_at ON reports (received_at);
+	CREATE INDEX reports_report_type ON reports (report_type);
+	CREATE INDEX reports_url_host ON reports (url_host);`,
+}
+
+// postgresMigrationLock is the advisory lock key held while migrating, so
+// that several collectors starting at once don't race.
+const postgresMigrationLock = 0x637370636f6c
+
+// postgresDB is the part of *pgxpool.Pool used by the Postgres sink.
+type postgresDB interface {
+	Begin(ctx context.Context) (pgx.Tx, error)
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Close()
+}
+
+// Postgres buffers reports and copies them to PostgreSQL in batches using
+// COPY. The schema is created and migrated by the collector. While the
+// database is unavailable reports stay buffered and flushes are retried
+// with exponential backoff. Reports the database rejects as invalid are
+// counted as failed and dropped.
+type Postgres struct {
+	db    postgresDB
+	batch *batcher
+
+	mu       sync.Mutex
+	migrated bool
+}
+
+// NewPostgres creates the connection pool and starts the background flush
+// loop. The database doesn't need to be reachable yet; migrations run
+// before the first flush.
+func NewPostgres(cfg PostgresConfig) (*Postgres, error) {
+	if cfg.DSN == "" {
+		return nil, fmt.Errorf("postgres dsn is not set")
+	}
+
+	poolConfig, err := pgxpool.ParseConfig(cfg.DSN)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.MaxConns > 0 {
+		poolConfig.MaxConns = cfg.MaxConns
+	}
+	if cfg.MinConns > 0 {
+		poolConfig.MinConns = cfg.MinConns
+	}
+	if cfg.MaxConnLifetime > 0 {
+		poolConfig.MaxConnLifetime = cfg.MaxConnLifetime
+	}
+	if cfg.MaxConnIdleTime > 0 {
+		poolConfig.MaxConnIdleTime = cfg.MaxConnIdleTime
+	}
+
+	pool, err := pgxpool.NewWithConfig(context.Background(), poolConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPostgres(cfg, pool), nil
+}
+
+func newPostgres(cfg PostgresConfig, db postgresDB) *Postgres {
+	s := &Postgres{db: db}
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "postgres",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+	return s
+}
+
+func (s *Postgres) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush copies buffered reports to the database, retrying with backoff
+// until they are written or ctx is done.
+func (s *Postgres) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the flush loop and closes the connection pool. Reports still
+// buffered are dropped; call Flush first to write them.
+func (s *Postgres) Close() error {
+	err := s.batch.close()
+	s.db.Close()
+	return err
+}
+
+// send migrates the schema if needed and copies batch. If the database
+// rejects the batch as invalid, the reports are copied one at a time so
+// that only the invalid ones are dropped. On any other failure the
+// reports not yet written are retried.
+func (s *Postgres) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if err := s.migrate(ctx); err != nil {
+		return batch, fmt.Errorf("unable to migrate postgres schema: %w", err)
+	}
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	err := s.copy(ctx, batch)
+	if err == nil {
+		s.batch.count("delivered", len(batch))
+		return nil, nil
+	}
+	if !invalidPostgresData(err) {
+		return batch, err
+	}
+
+	var errs []error
+	for i, r := range batch {
+		err := s.copy(ctx, []Report{r})
+		switch {
+		case err == nil:
+			s.batch.count("delivered", 1)
+		case invalidPostgresData(err):
+			s.batch.count("failed", 1)
+			errs = append(errs, fmt.Errorf("dropped invalid %s report: %w", r.Type, err))
+		default:
+			return batch[i:], errors.Join(append(errs, err)...)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// invalidPostgresData reports whether err was caused by the data copied
+// rather than the database, i.e. a data exception (class 22, such as a NUL
+// character in text) or an integrity constraint violation (class 23).
+// Retrying won't help.
+func invalidPostgresData(err error) bool {
+	var pgErr *pgconn.PgError
+	if !errors.As(err, &pgErr) || len(pgErr.Code) < 2 {
+		return false
+	}
+	class := pgErr.Code[:2]
+	return class == "22" || class == "23"
+}
+
+// copy writes batch in a single transaction with one COPY per table.
+func (s *Postgres) copy(ctx context.Context, batch []Report) error {
+	rows := make(map[string][][]any)
+	columns := make(map[string][]string)
+	for _, r := range batch {
+		table, cols, values, err := reportRow(r)
+		if err != nil {
+			return err
+		}
+		rows[table] = append(rows[table], values)
+		columns[table] = cols
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, table := range reportTables {
+		if len(rows[table]) == 0 {
+			continue
+		}
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{table}, columns[table], pgx.CopyFromRows(rows[table])); err != nil {
+			return fmt.Errorf("unable to copy to %s: %w", table, err)
+		}
+	}
+
+	return tx.Commit(ctx)
+}
+
+// migrate applies any migrations the database hasn't seen yet. Once
+// successful it is a no-op for the life of the sink.
+func (s *Postgres) migrate(ctx context.Context) error {
+	s.mu.Lock()
+	migrated := s.migrated
+	s.mu.Unlock()
+	if migrated {
+		return nil
+	}
+
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, postgresMigrationLock); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `CREATE TABLE IF NOT EXISTS csp_collector_schema_migrations (
+		version    INTEGER PRIMARY KEY,
+		applied_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	)`); err != nil {
+		return err
+	}
+
+	var version int
+	if err := tx.QueryRow(ctx, `SELECT COALESCE(MAX(version), 0) FROM csp_collector_schema_migrations`).Scan(&version); err != nil {
+		return err
+	}
+
+	for i := version; i < len(postgresMigrations); i++ {
+		if _, err := tx.Exec(ctx, postgresMigrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(ctx, `INSERT INTO csp_collector_schema_migrations (version) VALUES ($1)`, i+1); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	s.migrated = true
+	s.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,339 @@
+package sink
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakePostgres is an in-process stand-in for a connection pool. Only the
+// methods used by the sink are implemented.
+type fakePostgres struct {
+	mu        sync.Mutex
+	down      bool
+	version   int
+	execs     []string
+	rows      map[string][][]any
+	columns   map[string][]string
+	committed int
+	closed    bool
+}
+
+func newFakePostgres() *fakePostgres {
+	return &fakePostgres{rows: map[string][][]any{}, columns: map[string][]string{}}
+}
+
+func (db *fakePostgres) setDown(down bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.down = down
+}
+
+func (db *fakePostgres) rowCount(table string) int {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.rows[table])
+}
+
+func (db *fakePostgres) Begin(context.Context) (pgx.Tx, error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.down {
+		return nil, errors.New("connection refused")
+	}
+	return &fakeTx{db: db, rows: map[string][][]any{}}, nil
+}
+
+func (db *fakePostgres) Exec(context.Context, string, ...any) (pgconn.CommandTag, error) {
+	return pgconn.CommandTag{}, nil
+}
+
+func (db *fakePostgres) Close() {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+}
+
+type fakeTx struct {
+	pgx.Tx
+
+	db      *fakePostgres
+	execs   []string
+	version int
+	rows    map[string][][]any
+	columns map[string][]string
+}
+
+func (tx *fakeTx) Exec(_ context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	tx.execs = append(tx.execs, sql)
+	if strings.HasPrefix(sql, "INSERT INTO csp_collector_schema_migrations") {
+		tx.version = args[0].(int)
+	}
+	return pgconn.CommandTag{}, nil
+}
+
+func (tx *fakeTx) QueryRow(context.Context, string, ...any) pgx.Row {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	return fakeRow{version: tx.db.version}
+}
+
+func (tx *fakeTx) CopyFrom(_ context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error) {
+	var n int64
+	for src.Next() {
+		values, err := src.Values()
+		if err != nil {
+			return n, err
+		}
+		if len(values) != len(columns) {
+			return n, errors.New("column count mismatch")
+		}
+		for _, v := range values {
+			// Postgres rejects NUL characters in text.
+			if v, ok := v.(string); ok && strings.ContainsRune(v, 0) {
+				return n, &pgconn.PgError{Code: "22021", Message: "invalid byte sequence for encoding \"UTF8\": 0x00"}
+			}
+		}
+		tx.rows[table[0]] = append(tx.rows[table[0]], values)
+		n++
+	}
+	if tx.columns == nil {
+		tx.columns = map[string][]string{}
+	}
+	tx.columns[table[0]] = columns
+	return n, nil
+}
+
+func (tx *fakeTx) Commit(context.Context) error {
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+	if tx.db.down {
+		return errors.New("connection reset")
+	}
+	tx.db.execs = append(tx.db.execs, tx.execs...)
+	if tx.version > tx.db.version {
+		tx.db.version = tx.version
+	}
+	for table, rows := range tx.rows {
+		tx.db.rows[table] = append(tx.db.rows[table], rows...)
+		tx.db.columns[table] = tx.columns[table]
+	}
+	tx.db.committed++
+	return nil
+}
+
+func (tx *fakeTx) Rollback(context.Context) error { return nil }
+
+type fakeRow struct{ version int }
+
+func (r fakeRow) Scan(dest ...any) error {
+	*dest[0].(*int) = r.version
+	return nil
+}
+
+func testPostgresConfig() PostgresConfig {
+	return PostgresConfig{
+		BatchConfig: BatchConfig{
+			BatchSize:     100,
+			FlushInterval: time.Hour,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    5 * time.Millisecond,
+		},
+	}
+}
+
+func TestPostgresMigratesAndCopiesByTable(t *testing.T) {
+	db := newFakePostgres()
+	s := newPostgres(testPostgresConfig(), db)
+	defer s.Close()
+
+	ctx := context.Background()
+	for _, typ := range []string{"csp-violation", "csp-violation", "network-error", "coop"} {
+		_ = s.Write(ctx, Report{Handler: "test", Type: typ, ReceivedAt: time.Now(), Fields: map[string]interface{}{"url": "https://example.com/"}})
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := db.rowCount(cspReportsTable); got != 2 {
+		t.Errorf("expected 2 csp rows, got %d", got)
+	}
+	if got := db.rowCount(nelReportsTable); got != 1 {
+		t.Errorf("expected 1 nel row, got %d", got)
+	}
+	if got := db.rowCount(reportsTable); got != 1 {
+		t.Errorf("expected 1 generic row, got %d", got)
+	}
+	if db.version != len(postgresMigrations) {
+		t.Errorf("expected schema version %d, got %d", len(postgresMigrations), db.version)
+	}
+
+	// Migrations only run once per sink.
+	execs := len(db.execs)
+	_ = s.Write(ctx, Report{Type: "crash", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(db.execs) != execs {
+		t.Errorf("expected no further migration statements, got %v", db.execs[execs:])
+	}
+}
+
+func TestPostgresSkipsAppliedMigrations(t *testing.T) {
+	db := newFakePostgres()
+	db.version = len(postgresMigrations)
+	s := newPostgres(testPostgresConfig(), db)
+	defer s.Close()
+
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	for _, sql := range db.execs {
+		if strings.Contains(sql, "CREATE TABLE csp_reports") {
+			t.Error("expected applied migration not to run again")
+		}
+	}
+}
+
+func TestPostgresRetriesWhileUnavailable(t *testing.T) {
+	db := newFakePostgres()
+	db.setDown(true)
+
+	var mu sync.Mutex
+	var errs []error
+	cfg := testPostgresConfig()
+	cfg.BatchSize = 2
+	cfg.OnError = func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		errs = append(errs, err)
+	}
+	s := newPostgres(cfg, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	_ = s.Write(ctx, Report{Type: "csp-violation", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+	_ = s.Write(ctx, Report{Type: "csp-violation", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(errs)
+		mu.Unlock()
+		if n >= 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected repeated flush failures to be reported")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	db.setDown(false)
+	for db.rowCount(cspReportsTable) != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected buffered reports to be written once the database recovered, got %d", db.rowCount(cspReportsTable))
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPostgresFlushGivesUpWithContext(t *testing.T) {
+	db := newFakePostgres()
+	db.setDown(true)
+	s := newPostgres(testPostgresConfig(), db)
+	defer s.Close()
+
+	_ = s.Write(context.Background(), Report{Type: "csp-violation", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("expected flush to fail while the database is down")
+	}
+
+	if buffered := s.batch.buffered(); buffered != 1 {
+		t.Errorf("expected the report to stay buffered, got %d", buffered)
+	}
+}
+
+func TestPostgresDropsOldestWhenBufferFull(t *testing.T) {
+	db := newFakePostgres()
+	db.setDown(true)
+	cfg := testPostgresConfig()
+	cfg.MaxBuffered = 2
+	s := newPostgres(cfg, db)
+
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		err := s.Write(ctx, Report{Type: "crash", ReceivedAt: time.Now(), Fields: map[string]interface{}{"id": i}})
+		if i < 2 && err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if i == 2 && !errors.Is(err, ErrBufferFull) {
+			t.Fatalf("expected ErrBufferFull, got %v", err)
+		}
+	}
+
+	db.setDown(false)
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got := db.rowCount(reportsTable); got != 2 {
+		t.Errorf("expected the 2 newest reports to be written once the database recovered, got %d", got)
+	}
+	if !db.closed {
+		t.Error("expected the pool to be closed")
+	}
+}
+
+func TestPostgresDropsInvalidReports(t *testing.T) {
+	db := newFakePostgres()
+	m := metrics.New(prometheus.NewRegistry())
+	cfg := testPostgresConfig()
+	cfg.Metrics = m
+	s := newPostgres(cfg, db)
+	defer s.Close()
+
+	ctx := context.Background()
+	for _, uri := range []string{"https://example.com/a", "https://example.com/\x00", "https://example.com/b"} {
+		_ = s.Write(ctx, Report{Type: "csp-violation", ReceivedAt: time.Now(), Fields: map[string]interface{}{"document_uri": uri}})
+	}
+
+	flushCtx, cancel := context.WithTimeout(ctx, time.Second)
+	defer cancel()
+	if err := s.Flush(flushCtx); err == nil || !strings.Contains(err.Error(), "22021") {
+		t.Errorf("expected the invalid report to be reported, got %v", err)
+	}
+
+	if got := db.rowCount(cspReportsTable); got != 2 {
+		t.Errorf("expected the valid reports to be written, got %d rows", got)
+	}
+	if buffered := s.batch.buffered(); buffered != 0 {
+		t.Errorf("expected the invalid report not to be retried, got %d buffered", buffered)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("postgres", "delivered")); got != 2 {
+		t.Errorf("expected 2 delivered reports, got %v", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("postgres", "failed")); got != 1 {
+		t.Errorf("expected 1 failed report, got %v", got)
+	}
+}
+
+func TestNewPostgresRequiresDSN(t *testing.T) {
+	if _, err := NewPostgres(PostgresConfig{}); err == nil {
+		t.Error("expected an error without a dsn")
+	}
+}
@@ -0,0 +1,83 @@
+package sink
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Report is a single accepted report in the form handed to outputs. Every
+// handler produces the same shape regardless of the wire format it received.
+type Report struct {
+	// Handler is the name of the handler that accepted the report. It
+	// matches the `handler` label used in metrics.
+	Handler string
+
+	// Type is the report type, e.g. `csp-violation` or `network-error`.
+	Type string
+
+	// ReportOnly is set when the report was generated by a policy that is
+	// not being enforced.
+	ReportOnly bool
+
+	// ReceivedAt is when the collector accepted the report.
+	ReceivedAt time.Time
+
+	// Fields are the report fields as they are logged.
+	Fields map[string]interface{}
+}
+
+// Document returns the report as a single flat object for sinks that store
+// structured records. It contains Fields plus `handler`, `report_type`,
+// `report_only` and `received_at` (RFC 3339, UTC).
+func (r Report) Document() map[string]interface{} {
+	doc := make(map[string]interface{}, len(r.Fields)+4)
+	for k, v := range r.Fields {
+		doc[k] = v
+	}
+	doc["handler"] = r.Handler
+	doc["report_type"] = r.Type
+	doc["report_only"] = r.ReportOnly
+	doc["received_at"] = r.ReceivedAt.UTC().Format(time.RFC3339Nano)
+	return doc
+}
+
+// Origin returns the scheme and host of the page the report is about, taken
+// from `document_uri` for CSP reports and `url` for everything else. It is
+// empty if neither holds an absolute URL.
+func (r Report) Origin() string {
+	for _, key := range []string{"document_uri", "url"} {
+		s, _ := r.Fields[key].(string)
+		u, err := url.Parse(s)
+		if err == nil && u.Scheme != "" && u.Host != "" {
+			return u.Scheme + "://" + u.Host
+		}
+	}
+	return ""
+}
+
+// Summary returns a one line description of the report for outputs that
+// carry a human readable message alongside the fields, e.g.
+// "script-src-elem blocked https://evil.example/x.js on https://example.com/".
+func (r Report) Summary() string {
+	field := func(key string) string {
+		s, _ := r.Fields[key].(string)
+		return s
+	}
+
+	switch r.Type {
+	case "csp-violation":
+		directive := field("effective_directive")
+		if directive == "" {
+			directive = field("violated_directive")
+		}
+		return fmt.Sprintf("%s blocked %s on %s", directive, field("blocked_uri"), field("document_uri"))
+	case "network-error":
+		return fmt.Sprintf("%s network error on %s", field("type"), field("url"))
+	}
+
+	if u := field("url"); u != "" {
+		return fmt.Sprintf("%s report on %s", r.Type, u)
+	}
+	return r.Type + " report"
+}
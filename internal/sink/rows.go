@@ -0,0 +1,110 @@
+package sink
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+// The database sinks store reports in one of three tables: CSP violations
+// and NEL reports have their own columns, everything else is kept as a
+// JSON object in `reports`.
+const (
+	cspReportsTable = "csp_reports"
+	nelReportsTable = "nel_reports"
+	reportsTable    = "reports"
+)
+
+var reportTables = []string{cspReportsTable, nelReportsTable, reportsTable}
+
+var (
+	cspReportColumns = []string{
+		"received_at", "handler", "source", "report_only", "document_uri",
+		"document_host", "referrer", "blocked_uri", "blocked_host",
+		"violated_directive", "effective_directive", "original_policy",
+		"disposition", "script_sample", "status_code", "source_file",
+		"line_number", "column_number", "client_ip", "metadata", "path",
+	}
+
+	nelReportColumns = []string{
+		"received_at", "handler", "report_only", "url", "url_host", "referrer",
+		"type", "phase", "protocol", "method", "status_code", "elapsed_time",
+		"server_ip", "sampling_fraction", "client_ip", "metadata", "path",
+	}
+
+	reportColumns = []string{
+		"received_at", "handler", "report_type", "report_only", "url",
+		"url_host", "fields",
+	}
+)
+
+// reportRow maps r onto its table, returning the table name, its columns
+// and the values for them. `received_at` is a time.Time and `fields` a
+// json.RawMessage; callers convert them if their database needs to.
+func reportRow(r Report) (string, []string, []interface{}, error) {
+	f := r.Fields
+
+	switch r.Type {
+	case "csp-violation":
+		documentURI := stringField(f, "document_uri")
+		blockedURI := stringField(f, "blocked_uri")
+		return cspReportsTable, cspReportColumns, []interface{}{
+			r.ReceivedAt, r.Handler, stringField(f, "source"), r.ReportOnly,
+			documentURI, hostOf(documentURI), stringField(f, "referrer"),
+			blockedURI, hostOf(blockedURI), stringField(f, "violated_directive"),
+			stringField(f, "effective_directive"), stringField(f, "original_policy"),
+			stringField(f, "disposition"), stringField(f, "script_sample"),
+			f["status_code"], stringField(f, "source_file"), f["line_number"],
+			f["column_number"], stringField(f, "client_ip"), jsonField(f, "metadata"),
+			stringField(f, "path"),
+		}, nil
+	case "network-error":
+		u := stringField(f, "url")
+		return nelReportsTable, nelReportColumns, []interface{}{
+			r.ReceivedAt, r.Handler, r.ReportOnly, u, hostOf(u),
+			stringField(f, "referrer"), stringField(f, "type"), stringField(f, "phase"),
+			stringField(f, "protocol"), stringField(f, "method"), f["status_code"],
+			f["elapsed_time"], stringField(f, "server_ip"), f["sampling_fraction"],
+			stringField(f, "client_ip"), jsonField(f, "metadata"), stringField(f, "path"),
+		}, nil
+	default:
+		fields, err := json.Marshal(f)
+		if err != nil {
+			return "", nil, nil, err
+		}
+		u := stringField(f, "url")
+		return reportsTable, reportColumns, []interface{}{
+			r.ReceivedAt, r.Handler, r.Type, r.ReportOnly, u, hostOf(u),
+			json.RawMessage(fields),
+		}, nil
+	}
+}
+
+func stringField(f map[string]interface{}, key string) string {
+	s, _ := f[key].(string)
+	return s
+}
+
+// jsonField returns strings unchanged and encodes anything else, such as
+// metadata objects, as JSON.
+func jsonField(f map[string]interface{}, key string) interface{} {
+	switch v := f[key].(type) {
+	case nil:
+		return nil
+	case string:
+		return v
+	default:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil
+		}
+		return string(b)
+	}
+}
+
+func hostOf(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	return u.Hostname()
+}
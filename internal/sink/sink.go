@@ -0,0 +1,64 @@
+package sink
+
+import (
+	"context"
+	"errors"
+)
+
+// Sink receives every report accepted by the handlers.
+type Sink interface {
+	// Write hands a single report to the sink. Implementations that batch
+	// may return before the report has been delivered.
+	Write(ctx context.Context, r Report) error
+
+	// Flush delivers anything the sink has buffered.
+	Flush(ctx context.Context) error
+
+	// Close releases any resources held by the sink. It doesn't block on
+	// delivery, so sinks that buffer in memory drop what is left; call
+	// Flush with a deadline first to deliver it.
+	Close() error
+}
+
+// multi fans reports out to several sinks.
+type multi []Sink
+
+// Multi returns a Sink that writes every report to each of sinks in order.
+// A failure in one sink doesn't prevent delivery to the others; all errors
+// are returned joined together.
+func Multi(sinks ...Sink) Sink {
+	if len(sinks) == 1 {
+		return sinks[0]
+	}
+	return multi(sinks)
+}
+
+func (m multi) Write(ctx context.Context, r Report) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Write(ctx, r); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multi) Flush(ctx context.Context) error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Flush(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (m multi) Close() error {
+	var errs []error
+	for _, s := range m {
+		if err := s.Close(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
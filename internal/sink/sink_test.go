@@ -0,0 +1,120 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// recorder is a Sink that keeps every report written to it.
+type recorder struct {
+	reports []Report
+	err     error
+	flushed int
+	closed  bool
+}
+
+func (r *recorder) Write(_ context.Context, rep Report) error {
+	r.reports = append(r.reports, rep)
+	return r.err
+}
+
+func (r *recorder) Flush(context.Context) error {
+	r.flushed++
+	return r.err
+}
+
+func (r *recorder) Close() error {
+	r.closed = true
+	return r.err
+}
+
+func TestMultiSingleSinkIsReturnedDirectly(t *testing.T) {
+	rec := &recorder{}
+	if s := Multi(rec); s != Sink(rec) {
+		t.Errorf("expected single sink to be returned unwrapped, got %T", s)
+	}
+}
+
+func TestMultiFansOutToEverySink(t *testing.T) {
+	first, second := &recorder{}, &recorder{}
+	s := Multi(first, second)
+
+	rep := Report{Handler: "csp", Type: "csp-violation", Fields: map[string]interface{}{"document_uri": "https://example.com"}}
+	if err := s.Write(context.Background(), rep); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	for i, rec := range []*recorder{first, second} {
+		if len(rec.reports) != 1 || rec.reports[0].Type != "csp-violation" {
+			t.Errorf("sink %d: expected one csp-violation report, got %+v", i, rec.reports)
+		}
+		if rec.flushed != 1 || !rec.closed {
+			t.Errorf("sink %d: expected flush and close, got flushed=%d closed=%t", i, rec.flushed, rec.closed)
+		}
+	}
+}
+
+func TestMultiContinuesAfterFailureAndJoinsErrors(t *testing.T) {
+	errFirst := errors.New("first failed")
+	errThird := errors.New("third failed")
+	first, second, third := &recorder{err: errFirst}, &recorder{}, &recorder{err: errThird}
+
+	err := Multi(first, second, third).Write(context.Background(), Report{Type: "network-error"})
+	if !errors.Is(err, errFirst) || !errors.Is(err, errThird) {
+		t.Fatalf("expected both errors to be returned, got %v", err)
+	}
+	if len(second.reports) != 1 || len(third.reports) != 1 {
+		t.Error("expected later sinks to receive the report despite an earlier failure")
+	}
+}
+
+func TestLogrusWritesFields(t *testing.T) {
+	var logBuf bytes.Buffer
+	l := log.New()
+	l.SetOutput(&logBuf)
+	l.SetFormatter(&log.JSONFormatter{})
+
+	err := NewLogrus(l).Write(context.Background(), Report{
+		Handler: "nel",
+		Type:    "network-error",
+		Fields:  map[string]interface{}{"url": "https://example.com/", "phase": "dns"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	out := logBuf.String()
+	for _, want := range []string{`"level":"info"`, `"url":"https://example.com/"`, `"phase":"dns"`} {
+		if !strings.Contains(out, want) {
+			t.Errorf("expected log output to contain %s, got %s", want, out)
+		}
+	}
+}
+
+func TestReportOrigin(t *testing.T) {
+	tests := []struct {
+		fields map[string]interface{}
+		want   string
+	}{
+		{map[string]interface{}{"document_uri": "https://example.com/path?q=1"}, "https://example.com"},
+		{map[string]interface{}{"url": "http://example.org:8080/"}, "http://example.org:8080"},
+		{map[string]interface{}{"document_uri": "about:blank", "url": "https://example.net/"}, "https://example.net"},
+		{map[string]interface{}{"document_uri": "inline"}, ""},
+	}
+	for _, tt := range tests {
+		if got := (Report{Fields: tt.fields}).Origin(); got != tt.want {
+			t.Errorf("Origin(%v) = %q, want %q", tt.fields, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,425 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// splunkSourceTypes are the default sourcetypes of the common report types.
+// Other types get `<type>:report`.
+var splunkSourceTypes = map[string]string{
+	"csp-violation": "csp:violation",
+	"network-error": "nel:report",
+}
+
+// SplunkConfig configures a Splunk HTTP Event Collector sink.
+type SplunkConfig struct {
+	// URL is the base URL of the HEC endpoint, e.g.
+	// `https://splunk.example.com:8088`.
+	URL string
+
+	// Token is the HEC token.
+	Token string
+
+	// Index, Source and SourceType are set on every event. Empty values
+	// leave Index to the token's default, set Source to `csp-collector`
+	// and derive SourceType from the report type, e.g. `csp:violation`.
+	Index      string
+	Source     string
+	SourceType string
+
+	// Host is sent as the event host. Defaults to the collector's
+	// hostname.
+	Host string
+
+	// Ack enables indexer acknowledgement: a batch only counts as delivered
+	// once Splunk confirms it has been indexed. Acknowledgements are polled
+	// in the background every AckPollInterval (default 1s), so further
+	// batches are sent meanwhile; a batch that isn't acknowledged within
+	// AckTimeout (default 60s) is sent again, which duplicates its events
+	// if Splunk did index them. At most MaxBuffered reports await
+	// acknowledgement at once.
+	Ack             bool
+	AckPollInterval time.Duration
+	AckTimeout      time.Duration
+
+	// TLS configures verification of the HEC endpoint when URL is https.
+	TLS TLSConfig
+
+	BatchConfig
+
+	// Timeout bounds each request. Defaults to 10s.
+	Timeout time.Duration
+
+	// Client overrides the HTTP client, mainly for tests.
+	Client *http.Client
+
+	// Metrics, if set, counts delivered, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background sends.
+	OnError func(error)
+}
+
+// Splunk sends batches of reports to a Splunk HTTP Event Collector. Each
+// report is an event holding the same fields as the file sink.
+type Splunk struct {
+	cfg     SplunkConfig
+	client  *http.Client
+	channel string
+	batch   *batcher
+
+	// pending holds the batches awaiting acknowledgement by ack ID.
+	mu      sync.Mutex
+	pending map[int64]splunkPending
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// splunkPending is a batch Splunk accepted but hasn't yet confirmed as
+// indexed.
+type splunkPending struct {
+	batch  []Report
+	sentAt time.Time
+}
+
+// splunkEvent is the HEC event envelope.
+type splunkEvent struct {
+	Time       float64                `json:"time"`
+	Host       string                 `json:"host,omitempty"`
+	Source     string                 `json:"source"`
+	SourceType string                 `json:"sourcetype"`
+	Index      string                 `json:"index,omitempty"`
+	Event      map[string]interface{} `json:"event"`
+}
+
+// splunkResponse is the body HEC answers with.
+type splunkResponse struct {
+	Text  string `json:"text"`
+	AckID *int64 `json:"ackId"`
+}
+
+// NewSplunk starts the background send loop.
+func NewSplunk(cfg SplunkConfig) (*Splunk, error) {
+	if cfg.URL == "" {
+		return nil, fmt.Errorf("splunk url is not set")
+	}
+	if cfg.Token == "" {
+		return nil, fmt.Errorf("splunk token is not set")
+	}
+	u, err := url.Parse(cfg.URL)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid splunk url '%s'", cfg.URL)
+	}
+	cfg.URL = strings.TrimRight(cfg.URL, "/")
+	if cfg.Source == "" {
+		cfg.Source = "csp-collector"
+	}
+	if cfg.Host == "" {
+		cfg.Host, _ = os.Hostname()
+	}
+	if cfg.AckPollInterval <= 0 {
+		cfg.AckPollInterval = time.Second
+	}
+	if cfg.AckTimeout <= 0 {
+		cfg.AckTimeout = time.Minute
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+
+	s := &Splunk{cfg: cfg, client: cfg.Client, done: make(chan struct{})}
+	if s.client == nil {
+		tlsCfg := cfg.TLS
+		tlsCfg.Enabled = u.Scheme == "https"
+		tlsConfig, err := tlsCfg.Config()
+		if err != nil {
+			return nil, err
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = tlsConfig
+		s.client = &http.Client{Timeout: cfg.Timeout, Transport: transport}
+	}
+	if cfg.Ack {
+		// Acknowledgements are tracked per channel, so every sink instance
+		// uses its own.
+		s.channel = uuid.NewString()
+		s.pending = make(map[int64]splunkPending)
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "splunk",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	if cfg.Ack {
+		s.wg.Add(1)
+		go s.pollAcks()
+	}
+
+	return s, nil
+}
+
+func (s *Splunk) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush sends buffered reports, retrying with backoff until they are
+// accepted or ctx is done. With Ack set it also waits for the reports sent
+// to be acknowledged, sending those that time out again.
+func (s *Splunk) Flush(ctx context.Context) error {
+	for {
+		if err := s.batch.flush(ctx); err != nil {
+			return err
+		}
+		n := s.awaitingAck()
+		if n == 0 {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("splunk hec: %d reports not acknowledged: %w", n, ctx.Err())
+		case <-time.After(s.cfg.AckPollInterval):
+		}
+	}
+}
+
+// Close stops the send and acknowledgement loops. Reports still buffered
+// are dropped, and those awaiting acknowledgement are left unconfirmed;
+// call Flush first to deliver them.
+func (s *Splunk) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+	err := s.batch.close()
+	s.client.CloseIdleConnections()
+
+	if n := s.awaitingAck(); n > 0 {
+		err = errors.Join(err, fmt.Errorf("closed with %d reports not acknowledged", n))
+	}
+	return err
+}
+
+// sourceType returns the sourcetype of r's event.
+func (s *Splunk) sourceType(r Report) string {
+	if s.cfg.SourceType != "" {
+		return s.cfg.SourceType
+	}
+	if st, ok := splunkSourceTypes[r.Type]; ok {
+		return st
+	}
+	return strings.ReplaceAll(r.Type, "-", "_") + ":report"
+}
+
+// send posts batch as a single request of concatenated events. Rejected
+// batches are dropped and everything else is retried. With Ack set,
+// accepted batches are tracked until Splunk acknowledges them.
+func (s *Splunk) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+	if n := s.awaitingAck(); n >= s.batch.cfg.MaxBuffered {
+		return batch, fmt.Errorf("splunk hec: waiting for acknowledgement of %d reports", n)
+	}
+
+	var body bytes.Buffer
+	enc := json.NewEncoder(&body)
+	for _, r := range batch {
+		err := enc.Encode(splunkEvent{
+			Time:       float64(r.ReceivedAt.UnixMilli()) / 1000,
+			Host:       s.cfg.Host,
+			Source:     s.cfg.Source,
+			SourceType: s.sourceType(r),
+			Index:      s.cfg.Index,
+			Event:      r.Document(),
+		})
+		if err != nil {
+			s.batch.count("failed", len(batch))
+			return nil, err
+		}
+	}
+
+	resp, status, err := s.post(ctx, "/services/collector/event", body.Bytes())
+	if err != nil {
+		return batch, err
+	}
+	switch {
+	case status >= 200 && status <= 299:
+	case status == http.StatusTooManyRequests || status >= 500:
+		return batch, fmt.Errorf("splunk hec: %d %s", status, resp.Text)
+	default:
+		s.batch.count("failed", len(batch))
+		return nil, fmt.Errorf("splunk hec: %d %s", status, resp.Text)
+	}
+
+	if s.cfg.Ack {
+		if resp.AckID == nil {
+			return batch, errors.New("splunk hec: no ackId in response, is indexer acknowledgement enabled for the token?")
+		}
+		s.mu.Lock()
+		s.pending[*resp.AckID] = splunkPending{batch: batch, sentAt: time.Now()}
+		s.mu.Unlock()
+		return nil, nil
+	}
+
+	s.batch.count("delivered", len(batch))
+	return nil, nil
+}
+
+// awaitingAck returns the number of reports sent but not yet acknowledged.
+func (s *Splunk) awaitingAck() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+	for _, p := range s.pending {
+		n += len(p.batch)
+	}
+	return n
+}
+
+// pollAcks checks the pending acknowledgements every AckPollInterval until
+// the sink is closed.
+func (s *Splunk) pollAcks() {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(s.cfg.AckPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if err := s.checkAcks(context.Background()); err != nil && s.cfg.OnError != nil {
+			s.cfg.OnError(err)
+		}
+	}
+}
+
+// checkAcks asks Splunk which pending batches have been indexed in a single
+// request and counts them as delivered. Batches pending for longer than
+// AckTimeout are buffered to be sent again.
+func (s *Splunk) checkAcks(ctx context.Context) error {
+	s.mu.Lock()
+	ids := make([]int64, 0, len(s.pending))
+	for id := range s.pending {
+		ids = append(ids, id)
+	}
+	s.mu.Unlock()
+	if len(ids) == 0 {
+		return nil
+	}
+
+	acks, pollErr := s.queryAcks(ctx, ids)
+
+	var expired []Report
+	s.mu.Lock()
+	for _, id := range ids {
+		p, ok := s.pending[id]
+		switch {
+		case !ok:
+		case acks[fmt.Sprint(id)]:
+			delete(s.pending, id)
+			s.batch.count("delivered", len(p.batch))
+		case time.Since(p.sentAt) > s.cfg.AckTimeout:
+			delete(s.pending, id)
+			expired = append(expired, p.batch...)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, r := range expired {
+		_ = s.batch.add(r)
+	}
+	if len(expired) > 0 {
+		return errors.Join(pollErr, fmt.Errorf("splunk hec: %d reports not acknowledged within %s, sending again", len(expired), s.cfg.AckTimeout))
+	}
+	return pollErr
+}
+
+// queryAcks returns which of ids Splunk has indexed, keyed by ID.
+func (s *Splunk) queryAcks(ctx context.Context, ids []int64) (map[string]bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	body, _ := json.Marshal(map[string][]int64{"acks": ids})
+	req, err := s.request(ctx, "/services/collector/ack", body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("splunk hec: ack poll: %w", err)
+	}
+	defer resp.Body.Close()
+
+	var acks struct {
+		Acks map[string]bool `json:"acks"`
+	}
+	err = json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&acks)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("splunk hec: ack poll: %s", resp.Status)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("splunk hec: ack poll: %w", err)
+	}
+	return acks.Acks, nil
+}
+
+// post sends body to path, returning the decoded response and status.
+func (s *Splunk) post(ctx context.Context, path string, body []byte) (splunkResponse, int, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	var resp splunkResponse
+	req, err := s.request(ctx, path, body)
+	if err != nil {
+		return resp, 0, err
+	}
+	r, err := s.client.Do(req)
+	if err != nil {
+		return resp, 0, err
+	}
+	defer r.Body.Close()
+
+	// Error responses explain themselves in the body; don't fail on a body
+	// that isn't JSON though, e.g. from a proxy.
+	_ = json.NewDecoder(io.LimitReader(r.Body, 64<<10)).Decode(&resp)
+	if resp.Text == "" {
+		resp.Text = http.StatusText(r.StatusCode)
+	}
+	return resp, r.StatusCode, nil
+}
+
+func (s *Splunk) request(ctx context.Context, path string, body []byte) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Splunk "+s.cfg.Token)
+	req.Header.Set("Content-Type", "application/json")
+	if s.channel != "" {
+		req.Header.Set("X-Splunk-Request-Channel", s.channel)
+	}
+	return req, nil
+}
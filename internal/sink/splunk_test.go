@@ -0,0 +1,295 @@
+package sink
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// fakeHEC is a Splunk HTTP Event Collector. With ackAfter set it hands out
+// ack IDs and reports them as indexed after that many polls.
+type fakeHEC struct {
+	mu       sync.Mutex
+	status   int
+	ackAfter int
+	polls    int
+	lastAck  int64
+	channels []string
+	events   []splunkEvent
+}
+
+func (h *fakeHEC) eventCount() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.events)
+}
+
+func (h *fakeHEC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if r.Header.Get("Authorization") != "Splunk s3cret" {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = io.WriteString(w, `{"text":"Invalid token","code":4}`)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/services/collector/event":
+		h.channels = append(h.channels, r.Header.Get("X-Splunk-Request-Channel"))
+		if h.status != 0 {
+			w.WriteHeader(h.status)
+			_, _ = io.WriteString(w, `{"text":"Server is busy","code":9}`)
+			return
+		}
+		dec := json.NewDecoder(r.Body)
+		for dec.More() {
+			var e splunkEvent
+			if err := dec.Decode(&e); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			h.events = append(h.events, e)
+		}
+		if h.ackAfter > 0 {
+			h.lastAck++
+			_, _ = fmt.Fprintf(w, `{"text":"Success","code":0,"ackId":%d}`, h.lastAck)
+			return
+		}
+		_, _ = io.WriteString(w, `{"text":"Success","code":0}`)
+	case "/services/collector/ack":
+		var req struct {
+			Acks []int64 `json:"acks"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&req)
+		h.polls++
+		acks := map[string]bool{}
+		for _, id := range req.Acks {
+			acks[fmt.Sprint(id)] = h.polls >= h.ackAfter
+		}
+		_ = json.NewEncoder(w).Encode(map[string]map[string]bool{"acks": acks})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func newTestSplunk(t *testing.T, cfg SplunkConfig) *Splunk {
+	t.Helper()
+	cfg.Token = "s3cret"
+	cfg.FlushInterval = time.Hour
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 5 * time.Millisecond
+	cfg.AckPollInterval = time.Millisecond
+
+	s, err := NewSplunk(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSplunkSendsEvents(t *testing.T) {
+	hec := &fakeHEC{}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s := newTestSplunk(t, SplunkConfig{URL: server.URL + "/", Index: "security", Host: "collector-1", Metrics: m})
+	defer s.Close()
+
+	ctx := context.Background()
+	_ = s.Write(ctx, sampleReport(1))
+	_ = s.Write(ctx, Report{Handler: "nel", Type: "network-error", ReceivedAt: time.Date(2024, 5, 1, 12, 0, 0, 500e6, time.UTC)})
+	_ = s.Write(ctx, Report{Handler: "policy", Type: "permissions-policy-violation"})
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(hec.events) != 3 {
+		t.Fatalf("expected 3 events, got %d", len(hec.events))
+	}
+	e := hec.events[0]
+	if e.Index != "security" || e.Source != "csp-collector" || e.Host != "collector-1" || e.Time != 1714564800 {
+		t.Errorf("unexpected event envelope %+v", e)
+	}
+	if e.Event["line_number"] != float64(1) || e.Event["handler"] != "csp" {
+		t.Errorf("unexpected event %v", e.Event)
+	}
+	for i, want := range []string{"csp:violation", "nel:report", "permissions_policy_violation:report"} {
+		if hec.events[i].SourceType != want {
+			t.Errorf("event %d: expected sourcetype %s, got %s", i, want, hec.events[i].SourceType)
+		}
+	}
+	if hec.events[1].Time != 1714564800.5 {
+		t.Errorf("expected millisecond precision, got %f", hec.events[1].Time)
+	}
+	if hec.channels[0] != "" {
+		t.Errorf("expected no channel without acks, got %s", hec.channels[0])
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("splunk", "delivered")); got != 3 {
+		t.Errorf("sink_reports_total delivered = %v, want 3", got)
+	}
+}
+
+func TestSplunkWaitsForAcks(t *testing.T) {
+	hec := &fakeHEC{ackAfter: 3}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s := newTestSplunk(t, SplunkConfig{URL: server.URL, SourceType: "csp:report", Ack: true, Metrics: m})
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	hec.mu.Lock()
+	defer hec.mu.Unlock()
+	if hec.polls < 3 {
+		t.Errorf("expected at least 3 ack polls, got %d", hec.polls)
+	}
+	if len(hec.channels) != 1 || len(hec.channels[0]) != 36 {
+		t.Errorf("expected a single request on a channel, got %v", hec.channels)
+	}
+	if hec.events[0].SourceType != "csp:report" {
+		t.Errorf("expected the configured sourcetype, got %s", hec.events[0].SourceType)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("splunk", "delivered")); got != 1 {
+		t.Errorf("sink_reports_total delivered = %v, want 1", got)
+	}
+}
+
+func TestSplunkSendsWhileAwaitingAcks(t *testing.T) {
+	hec := &fakeHEC{ackAfter: 1 << 30}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	s := newTestSplunk(t, SplunkConfig{URL: server.URL, Ack: true, BatchConfig: BatchConfig{BatchSize: 10, MaxBuffered: 2}})
+	defer s.Close()
+
+	// Sends don't wait for acknowledgements...
+	for i := 0; i < 2; i++ {
+		_ = s.Write(context.Background(), sampleReport(i))
+		if _, retry, err := s.batch.sendOnce(context.Background()); retry || err != nil {
+			t.Fatalf("expected batch %d to be sent, got %v, %v", i, retry, err)
+		}
+	}
+	if got := s.awaitingAck(); got != 2 {
+		t.Errorf("expected 2 reports awaiting acknowledgement, got %d", got)
+	}
+
+	// ...until MaxBuffered reports are awaiting them.
+	_ = s.Write(context.Background(), sampleReport(3))
+	if _, retry, err := s.batch.sendOnce(context.Background()); !retry || err == nil {
+		t.Fatalf("expected the batch to wait for acknowledgements, got %v, %v", retry, err)
+	}
+	if got := hec.eventCount(); got != 2 {
+		t.Errorf("expected 2 events to be sent, got %d", got)
+	}
+}
+
+func TestSplunkResendsUnacknowledgedBatches(t *testing.T) {
+	hec := &fakeHEC{ackAfter: 1 << 30}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	s := newTestSplunk(t, SplunkConfig{URL: server.URL, Ack: true, AckTimeout: 20 * time.Millisecond})
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	if _, retry, err := s.batch.sendOnce(context.Background()); retry || err != nil {
+		t.Fatalf("expected the batch to be sent, got %v, %v", retry, err)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for s.batch.buffered() != 1 || s.awaitingAck() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the unacknowledged report to be buffered again, got %d buffered", s.batch.buffered())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSplunkRetriesBusyAndDropsRejected(t *testing.T) {
+	hec := &fakeHEC{status: http.StatusServiceUnavailable}
+	server := httptest.NewServer(hec)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s := newTestSplunk(t, SplunkConfig{URL: server.URL, Metrics: m})
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	if _, retry, err := s.batch.sendOnce(context.Background()); !retry || err == nil {
+		t.Fatalf("expected a busy server to be retried, got %v, %v", retry, err)
+	}
+
+	hec.mu.Lock()
+	hec.status = http.StatusBadRequest
+	hec.mu.Unlock()
+	if _, retry, err := s.batch.sendOnce(context.Background()); retry || err == nil {
+		t.Fatalf("expected a rejected batch to be dropped, got %v, %v", retry, err)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("splunk", "failed")); got != 1 {
+		t.Errorf("sink_reports_total failed = %v, want 1", got)
+	}
+}
+
+func TestSplunkVerifiesTLS(t *testing.T) {
+	hec := &fakeHEC{}
+	server := httptest.NewTLSServer(hec)
+	defer server.Close()
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caFile, cert, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, tc := range map[string]struct {
+		tls     TLSConfig
+		wantErr bool
+	}{
+		"system roots": {wantErr: true},
+		"ca file":      {tls: TLSConfig{CAFile: caFile}},
+		"skip verify":  {tls: TLSConfig{InsecureSkipVerify: true}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := newTestSplunk(t, SplunkConfig{URL: server.URL, TLS: tc.tls})
+			defer s.Close()
+
+			_ = s.Write(context.Background(), sampleReport(1))
+			_, _, err := s.batch.sendOnce(context.Background())
+			if (err != nil) != tc.wantErr {
+				t.Errorf("expected error %v, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
+
+func TestNewSplunkValidatesConfig(t *testing.T) {
+	if _, err := NewSplunk(SplunkConfig{Token: "s3cret"}); err == nil {
+		t.Error("expected an error without a url")
+	}
+	if _, err := NewSplunk(SplunkConfig{URL: "https://splunk:8088"}); err == nil {
+		t.Error("expected an error without a token")
+	}
+	if _, err := NewSplunk(SplunkConfig{URL: "https://splunk:8088", Token: "s3cret", TLS: TLSConfig{CAFile: "missing.pem"}}); err == nil {
+		t.Error("expected an error for a missing ca file")
+	}
+}
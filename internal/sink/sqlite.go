@@ -0,0 +1,380 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	// Pure Go SQLite driver, so the collector still builds with
+	// CGO_ENABLED=0.
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteConfig configures a SQLite sink.
+type SQLiteConfig struct {
+	// Path is the database file. It is created if it doesn't exist.
+	Path string
+
+	// BatchConfig's BatchSize defaults to 100. Each batch is inserted in
+	// a single transaction.
+	BatchConfig
+
+	// Retention deletes reports received longer ago than this. Zero keeps
+	// reports forever.
+	Retention time.Duration
+
+	// RetentionInterval is how often the retention job runs. Defaults to
+	// one hour.
+	RetentionInterval time.Duration
+
+	// Metrics, if set, counts inserted, failed and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background inserts and the
+	// retention job, which have no caller to return them to.
+	OnError func(error)
+}
+
+// sqliteSchemaVersion is stored in `PRAGMA user_version` so that future
+// schema changes can migrate existing databases.
+const sqliteSchemaVersion = 1
+
+// sqliteSchema creates a table per report family. `received_at` is stored
+// as milliseconds since the Unix epoch.
+var sqliteSchema = []string{
+	`CREATE TABLE IF NOT EXISTS csp_reports (
+		id                  INTEGER PRIMARY KEY,
+		received_at         INTEGER NOT NULL,
+		handler             TEXT NOT NULL,
+		source              TEXT,
+		report_only         INTEGER NOT NULL,
+		document_uri        TEXT,
+		document_host       TEXT,
+		referrer            TEXT,
+		blocked_uri         TEXT,
+		blocked_host        TEXT,
+		violated_directive  TEXT,
+		effective_directive TEXT,
+		original_policy     TEXT,
+		disposition         TEXT,
+		script_sample       TEXT,
+		status_code         INTEGER,
+		source_file         TEXT,
+		line_number         INTEGER,
+		column_number       INTEGER,
+		client_ip           TEXT,
+		metadata            TEXT,
+		path                TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS csp_reports_received_at ON csp_reports (received_at)`,
+	`CREATE INDEX IF NOT EXISTS csp_reports_document_host ON csp_reports (document_host)`,
+	`CREATE INDEX IF NOT EXISTS csp_reports_effective_directive ON csp_reports (effective_directive)`,
+	`CREATE INDEX IF NOT EXISTS csp_reports_blocked_host ON csp_reports (blocked_host)`,
+
+	`CREATE TABLE IF NOT EXISTS nel_reports (
+		id                INTEGER PRIMARY KEY,
+		received_at       INTEGER NOT NULL,
+		handler           TEXT NOT NULL,
+		report_only       INTEGER NOT NULL,
+		url               TEXT,
+		url_host          TEXT,
+		referrer          TEXT,
+		type              TEXT,
+		phase             TEXT,
+		protocol          TEXT,
+		method            TEXT,
+		status_code       INTEGER,
+		elapsed_time      INTEGER,
+		server_ip         TEXT,
+		sampling_fraction REAL,
+		client_ip         TEXT,
+		metadata          TEXT,
+		path              TEXT
+	)`,
+	`CREATE INDEX IF NOT EXISTS nel_reports_received_at ON nel_reports (received_at)`,
+	`CREATE INDEX IF NOT EXISTS nel_reports_url_host ON nel_reports (url_host)`,
+	`CREATE INDEX IF NOT EXISTS nel_reports_type ON nel_reports (type)`,
+
+	`CREATE TABLE IF NOT EXISTS reports (
+		id          INTEGER PRIMARY KEY,
+		received_at INTEGER NOT NULL,
+		handler     TEXT NOT NULL,
+		report_type TEXT NOT NULL,
+		report_only INTEGER NOT NULL,
+		url         TEXT,
+		url_host    TEXT,
+		fields      TEXT NOT NULL
+	)`,
+	`CREATE INDEX IF NOT EXISTS reports_received_at ON reports (received_at)`,
+	`CREATE INDEX IF NOT EXISTS reports_report_type ON reports (report_type)`,
+	`CREATE INDEX IF NOT EXISTS reports_url_host ON reports (url_host)`,
+}
+
+// SQLite stores reports in an embedded SQLite database. Reports are
+// buffered and inserted in batches from a background goroutine; failed
+// inserts are retried with exponential backoff.
+type SQLite struct {
+	cfg   SQLiteConfig
+	db    *sql.DB
+	now   func() time.Time
+	batch *batcher
+
+	done      chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+// NewSQLite opens the database at cfg.Path, creating the schema if needed,
+// and starts the background insert and retention jobs.
+func NewSQLite(cfg SQLiteConfig) (*SQLite, error) {
+	if cfg.Path == "" {
+		return nil, fmt.Errorf("sqlite database path is not set")
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.RetentionInterval <= 0 {
+		cfg.RetentionInterval = time.Hour
+	}
+
+	db, err := sql.Open("sqlite", cfg.Path+"?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	// A single connection avoids SQLITE_BUSY between the writers.
+	db.SetMaxOpenConns(1)
+
+	if err := migrateSQLite(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("unable to create sqlite schema: %w", err)
+	}
+
+	s := &SQLite{
+		cfg:  cfg,
+		db:   db,
+		now:  time.Now,
+		done: make(chan struct{}),
+	}
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "sqlite",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	s.wg.Add(1)
+	go s.run()
+
+	return s, nil
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	if version >= sqliteSchemaVersion {
+		return nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range sqliteSchema {
+		if _, err := tx.Exec(stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, sqliteSchemaVersion)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLite) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush inserts buffered reports, retrying with backoff until they are
+// written or ctx is done.
+func (s *SQLite) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// send inserts batch in a single transaction. Reports that can't be
+// converted to a row are dropped. If the database rejects the data, the
+// reports are inserted one at a time so that only the rejected ones are
+// dropped; on any other failure the batch is retried.
+func (s *SQLite) send(ctx context.Context, batch []Report) ([]Report, error) {
+	var errs []error
+	inserts := make([]sqliteRow, 0, len(batch))
+	rows := make([]Report, 0, len(batch))
+	for _, r := range batch {
+		query, args, err := sqliteInsert(r)
+		if err != nil {
+			s.batch.count("failed", 1)
+			errs = append(errs, fmt.Errorf("unable to convert %s report: %w", r.Type, err))
+			continue
+		}
+		inserts = append(inserts, sqliteRow{query, args})
+		rows = append(rows, r)
+	}
+	if len(inserts) == 0 {
+		return nil, errors.Join(errs...)
+	}
+
+	err := s.insert(ctx, inserts)
+	if err == nil {
+		s.batch.count("delivered", len(inserts))
+		return nil, errors.Join(errs...)
+	}
+	if !invalidSQLiteData(err) {
+		return rows, errors.Join(append(errs, err)...)
+	}
+
+	for i, row := range inserts {
+		err := s.insert(ctx, []sqliteRow{row})
+		switch {
+		case err == nil:
+			s.batch.count("delivered", 1)
+		case invalidSQLiteData(err):
+			s.batch.count("failed", 1)
+			errs = append(errs, fmt.Errorf("dropped invalid %s report: %w", rows[i].Type, err))
+		default:
+			return rows[i:], errors.Join(append(errs, err)...)
+		}
+	}
+	return nil, errors.Join(errs...)
+}
+
+// invalidSQLiteData reports whether err was caused by the data inserted
+// rather than the database, such as a constraint violation or a value
+// that is too big. Retrying won't help.
+func invalidSQLiteData(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	// Extended result codes keep the primary code in the low byte.
+	switch sqliteErr.Code() & 0xff {
+	case sqlite3.SQLITE_CONSTRAINT, sqlite3.SQLITE_MISMATCH, sqlite3.SQLITE_TOOBIG, sqlite3.SQLITE_RANGE:
+		return true
+	}
+	return false
+}
+
+// sqliteRow is a prepared insert for a single report.
+type sqliteRow struct {
+	query string
+	args  []interface{}
+}
+
+func (s *SQLite) insert(ctx context.Context, rows []sqliteRow) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmts := make(map[string]*sql.Stmt)
+	for _, row := range rows {
+		stmt, ok := stmts[row.query]
+		if !ok {
+			if stmt, err = tx.PrepareContext(ctx, row.query); err != nil {
+				return err
+			}
+			defer stmt.Close()
+			stmts[row.query] = stmt
+		}
+
+		if _, err := stmt.ExecContext(ctx, row.args...); err != nil {
+			return fmt.Errorf("unable to insert report: %w", err)
+		}
+	}
+
+	return tx.Commit()
+}
+
+// Prune deletes reports received before cutoff.
+func (s *SQLite) Prune(ctx context.Context, cutoff time.Time) error {
+	for _, table := range reportTables {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE received_at < ?`, cutoff.UnixMilli()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close stops the background jobs and closes the database. Reports still
+// buffered are dropped; call Flush first to insert them.
+func (s *SQLite) Close() error {
+	s.closeOnce.Do(func() { close(s.done) })
+	s.wg.Wait()
+
+	err := s.batch.close()
+	if cerr := s.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (s *SQLite) run() {
+	defer s.wg.Done()
+
+	retention := time.NewTicker(s.cfg.RetentionInterval)
+	defer retention.Stop()
+
+	if s.cfg.Retention > 0 {
+		s.report(s.Prune(context.Background(), s.now().Add(-s.cfg.Retention)))
+	}
+
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-retention.C:
+			if s.cfg.Retention > 0 {
+				s.report(s.Prune(context.Background(), s.now().Add(-s.cfg.Retention)))
+			}
+		}
+	}
+}
+
+func (s *SQLite) report(err error) {
+	if err != nil && s.cfg.OnError != nil {
+		s.cfg.OnError(err)
+	}
+}
+
+// sqliteInsert returns the insert statement and arguments for r.
+// `received_at` is stored as milliseconds since the Unix epoch.
+func sqliteInsert(r Report) (string, []interface{}, error) {
+	table, columns, values, err := reportRow(r)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i, v := range values {
+		switch v := v.(type) {
+		case time.Time:
+			values[i] = v.UnixMilli()
+		case json.RawMessage:
+			values[i] = string(v)
+		}
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(columns)), ", ")
+	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), placeholders)
+	return query, values, nil
+}
@@ -0,0 +1,263 @@
+package sink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newTestSQLite(t *testing.T, cfg SQLiteConfig) *SQLite {
+	t.Helper()
+	if cfg.Path == "" {
+		cfg.Path = filepath.Join(t.TempDir(), "reports.db")
+	}
+	if cfg.FlushInterval == 0 {
+		cfg.FlushInterval = time.Hour
+	}
+	cfg.OnError = func(err error) { t.Errorf("unexpected background error: %s", err) }
+
+	s, err := NewSQLite(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func countRows(t *testing.T, db *sql.DB, table string) int {
+	t.Helper()
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM ` + table).Scan(&n); err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSQLiteStoresReportsByType(t *testing.T) {
+	s := newTestSQLite(t, SQLiteConfig{})
+	defer s.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	reports := []Report{
+		{Handler: "csp", Type: "csp-violation", ReceivedAt: now, Fields: map[string]interface{}{
+			"source":              "report-uri",
+			"document_uri":        "https://www.example.com/page",
+			"blocked_uri":         "https://cdn.tracker.net/x.js",
+			"effective_directive": "script-src-elem",
+			"status_code":         200,
+			"line_number":         3,
+			"metadata":            map[string]string{"app": "shop"},
+		}},
+		{Handler: "nel", Type: "network-error", ReportOnly: true, ReceivedAt: now, Fields: map[string]interface{}{
+			"url":               "https://api.example.com/v1",
+			"type":              "dns.unreachable",
+			"sampling_fraction": 0.5,
+		}},
+		{Handler: "deprecation", Type: "deprecation", ReceivedAt: now, Fields: map[string]interface{}{
+			"url": "https://example.com/",
+			"id":  "NavigatorVibrate",
+		}},
+	}
+	for _, r := range reports {
+		if err := s.Write(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	var documentHost, blockedHost, directive, metadata string
+	var statusCode int
+	err := s.db.QueryRow(`SELECT document_host, blocked_host, effective_directive, metadata, status_code FROM csp_reports`).
+		Scan(&documentHost, &blockedHost, &directive, &metadata, &statusCode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if documentHost != "www.example.com" || blockedHost != "cdn.tracker.net" || directive != "script-src-elem" || statusCode != 200 {
+		t.Errorf("unexpected csp row: %s %s %s %d", documentHost, blockedHost, directive, statusCode)
+	}
+	if metadata != `{"app":"shop"}` {
+		t.Errorf("expected metadata to be stored as JSON, got %s", metadata)
+	}
+
+	var urlHost, errorType string
+	var reportOnly bool
+	var fraction float64
+	if err := s.db.QueryRow(`SELECT url_host, type, report_only, sampling_fraction FROM nel_reports`).Scan(&urlHost, &errorType, &reportOnly, &fraction); err != nil {
+		t.Fatal(err)
+	}
+	if urlHost != "api.example.com" || errorType != "dns.unreachable" || !reportOnly || fraction != 0.5 {
+		t.Errorf("unexpected nel row: %s %s %t %v", urlHost, errorType, reportOnly, fraction)
+	}
+
+	var reportType, fields string
+	if err := s.db.QueryRow(`SELECT report_type, fields FROM reports`).Scan(&reportType, &fields); err != nil {
+		t.Fatal(err)
+	}
+	var decoded map[string]interface{}
+	if err := json.Unmarshal([]byte(fields), &decoded); err != nil || decoded["id"] != "NavigatorVibrate" || reportType != "deprecation" {
+		t.Errorf("unexpected reports row: %s %s", reportType, fields)
+	}
+}
+
+func TestSQLiteBatchesInserts(t *testing.T) {
+	s := newTestSQLite(t, SQLiteConfig{BatchConfig: BatchConfig{BatchSize: 3}})
+	defer s.Close()
+
+	// A full batch is inserted in the background, so a request's context
+	// being cancelled doesn't affect it.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r := Report{Handler: "csp", Type: "csp-violation", ReceivedAt: time.Now(), Fields: map[string]interface{}{}}
+
+	_ = s.Write(ctx, r)
+	_ = s.Write(ctx, r)
+	if got := countRows(t, s.db, "csp_reports"); got != 0 {
+		t.Fatalf("expected reports to be buffered, got %d rows", got)
+	}
+
+	_ = s.Write(ctx, r)
+	deadline := time.Now().Add(5 * time.Second)
+	for countRows(t, s.db, "csp_reports") != 3 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected a full batch to be inserted")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSQLiteKeepsBatchWhenInsertFails(t *testing.T) {
+	s, err := NewSQLite(SQLiteConfig{
+		Path: filepath.Join(t.TempDir(), "reports.db"),
+		BatchConfig: BatchConfig{
+			FlushInterval: time.Hour,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    time.Millisecond,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// The sink uses a single connection, so this makes every insert fail.
+	if _, err := s.db.Exec(`PRAGMA query_only = ON`); err != nil {
+		t.Fatal(err)
+	}
+	_ = s.Write(context.Background(), Report{Handler: "hpkp", Type: "hpkp", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("expected the insert to fail")
+	}
+	if got := s.batch.buffered(); got != 1 {
+		t.Fatalf("expected the report to stay buffered, got %d", got)
+	}
+
+	if _, err := s.db.Exec(`PRAGMA query_only = OFF`); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := countRows(t, s.db, "reports"); got != 1 {
+		t.Errorf("expected the report to be inserted once the database recovered, got %d rows", got)
+	}
+}
+
+func TestSQLiteDropsRejectedReports(t *testing.T) {
+	m := metrics.New(prometheus.NewRegistry())
+	s, err := NewSQLite(SQLiteConfig{
+		Path: filepath.Join(t.TempDir(), "reports.db"),
+		BatchConfig: BatchConfig{
+			FlushInterval: time.Hour,
+			MinBackoff:    time.Millisecond,
+			MaxBackoff:    time.Millisecond,
+		},
+		Metrics: m,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	// Reject the second report with a constraint error.
+	if _, err := s.db.Exec(`CREATE TRIGGER reject_report BEFORE INSERT ON csp_reports
+		WHEN NEW.line_number = 1 BEGIN SELECT RAISE(ABORT, 'rejected'); END`); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	for i := 0; i < 3; i++ {
+		_ = s.Write(ctx, sampleReport(i))
+	}
+
+	if err := s.Flush(ctx); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Fatalf("expected the rejected report to be reported, got %v", err)
+	}
+	if got := s.batch.buffered(); got != 0 {
+		t.Errorf("expected the rejected report not to be retried, %d buffered", got)
+	}
+	if got := countRows(t, s.db, "csp_reports"); got != 2 {
+		t.Errorf("expected the other 2 reports to be inserted, got %d rows", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("sqlite", "failed")); got != 1 {
+		t.Errorf("sink_reports_total failed = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("sqlite", "delivered")); got != 2 {
+		t.Errorf("sink_reports_total delivered = %v, want 2", got)
+	}
+}
+
+func TestSQLiteReopensExistingDatabase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "reports.db")
+	s := newTestSQLite(t, SQLiteConfig{Path: path})
+	_ = s.Write(context.Background(), Report{Handler: "hpkp", Type: "hpkp", ReceivedAt: time.Now(), Fields: map[string]interface{}{}})
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = newTestSQLite(t, SQLiteConfig{Path: path})
+	defer s.Close()
+	if got := countRows(t, s.db, "reports"); got != 1 {
+		t.Errorf("expected the report to survive reopening, got %d rows", got)
+	}
+}
+
+func TestSQLitePrune(t *testing.T) {
+	s := newTestSQLite(t, SQLiteConfig{})
+	defer s.Close()
+
+	ctx := context.Background()
+	now := time.Now()
+	for _, age := range []time.Duration{0, 2 * time.Hour} {
+		for _, typ := range []string{"csp-violation", "network-error", "crash"} {
+			_ = s.Write(ctx, Report{Handler: "test", Type: typ, ReceivedAt: now.Add(-age), Fields: map[string]interface{}{}})
+		}
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Prune(ctx, now.Add(-time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, table := range reportTables {
+		if got := countRows(t, s.db, table); got != 1 {
+			t.Errorf("%s: expected 1 row after pruning, got %d", table, got)
+		}
+	}
+}
@@ -0,0 +1,414 @@
+package sink
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// syslogFacilities maps facility names to their RFC 5424 codes.
+var syslogFacilities = map[string]int{
+	"kern":     0,
+	"user":     1,
+	"mail":     2,
+	"daemon":   3,
+	"auth":     4,
+	"syslog":   5,
+	"lpr":      6,
+	"news":     7,
+	"uucp":     8,
+	"cron":     9,
+	"authpriv": 10,
+	"ftp":      11,
+	"local0":   16,
+	"local1":   17,
+	"local2":   18,
+	"local3":   19,
+	"local4":   20,
+	"local5":   21,
+	"local6":   22,
+	"local7":   23,
+}
+
+// Syslog severities used for reports. Enforced violations are warnings,
+// report-only ones notices.
+const (
+	syslogWarning = 4
+	syslogNotice  = 5
+)
+
+// SyslogConfig configures a syslog sink.
+type SyslogConfig struct {
+	// Network is `udp`, `tcp`, `tls` or `unix`. Defaults to `udp`.
+	Network string
+
+	// Address is the `host:port` of the server, or the socket path for
+	// `unix`. Defaults to `localhost:514`, or `/dev/log` for `unix`.
+	Address string
+
+	// TLS configures the `tls` transport. Enabled is implied.
+	TLS TLSConfig
+
+	// Facility is the facility name, e.g. `local0`. Defaults to `local0`.
+	Facility string
+
+	// AppName is the APP-NAME of each message. Defaults to `csp-collector`.
+	AppName string
+
+	// Hostname is the HOSTNAME of each message. Defaults to the name of
+	// the host.
+	Hostname string
+
+	// SDID is the ID of the structured-data element holding the report
+	// fields. Defaults to `report@32473`, the enterprise number reserved
+	// for documentation.
+	SDID string
+
+	// MaxMessageSize is the largest message sent, in bytes. Longer
+	// messages lose their longest parameters and then have their text
+	// shortened. Defaults to 2048 for `udp` and `unix`, which RFC 5424
+	// suggests for datagrams, and 8192 for `tcp` and `tls`.
+	MaxMessageSize int
+
+	// Timeout bounds connecting and each write. Defaults to 5s.
+	Timeout time.Duration
+
+	// BatchConfig's BatchSize defaults to 100. Messages are still sent
+	// one at a time.
+	BatchConfig
+
+	// Metrics, if set, counts sent and dropped reports.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background writes.
+	OnError func(error)
+}
+
+// Syslog writes each report as an RFC 5424 message with the report fields
+// in a structured-data element. Stream transports use octet-counting
+// framing (RFC 6587). Reports are buffered and written from a background
+// goroutine, so a slow or unreachable server doesn't hold up requests. The
+// connection is made on first use and remade once if a write fails, after
+// which the write is retried with backoff.
+type Syslog struct {
+	cfg       SyslogConfig
+	tlsConfig *tls.Config
+	facility  int
+	pid       string
+	batch     *batcher
+
+	mu   sync.Mutex
+	conn net.Conn
+	// framed is set for stream connections, which need each message
+	// prefixed with its length.
+	framed bool
+}
+
+// NewSyslog validates cfg. No connection is made until the first report
+// is written.
+func NewSyslog(cfg SyslogConfig) (*Syslog, error) {
+	if cfg.Network == "" {
+		cfg.Network = "udp"
+	}
+	if cfg.Address == "" {
+		cfg.Address = "localhost:514"
+		if cfg.Network == "unix" {
+			cfg.Address = "/dev/log"
+		}
+	}
+	if cfg.Facility == "" {
+		cfg.Facility = "local0"
+	}
+	if cfg.AppName == "" {
+		cfg.AppName = "csp-collector"
+	}
+	if cfg.Hostname == "" {
+		cfg.Hostname, _ = os.Hostname()
+	}
+	if cfg.SDID == "" {
+		cfg.SDID = "report@32473"
+	}
+	if cfg.MaxMessageSize <= 0 {
+		cfg.MaxMessageSize = 2048
+		if cfg.Network == "tcp" || cfg.Network == "tls" {
+			cfg.MaxMessageSize = 8192
+		}
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 5 * time.Second
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+
+	facility, ok := syslogFacilities[cfg.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility '%s'", cfg.Facility)
+	}
+
+	s := &Syslog{
+		cfg:      cfg,
+		facility: facility,
+		pid:      strconv.Itoa(os.Getpid()),
+	}
+
+	switch cfg.Network {
+	case "udp", "tcp", "unix":
+	case "tls":
+		tlsCfg := cfg.TLS
+		tlsCfg.Enabled = true
+		tlsConfig, err := tlsCfg.Config()
+		if err != nil {
+			return nil, err
+		}
+		if host, _, err := net.SplitHostPort(cfg.Address); err == nil && tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		s.tlsConfig = tlsConfig
+	default:
+		return nil, fmt.Errorf("unknown syslog network '%s'", cfg.Network)
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "syslog",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+func (s *Syslog) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush writes buffered reports, retrying with backoff until they are
+// written or ctx is done.
+func (s *Syslog) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the write loop and closes the connection. Reports still
+// buffered are dropped; call Flush first to write them.
+func (s *Syslog) Close() error {
+	err := s.batch.close()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closeConn()
+	return err
+}
+
+// send writes the messages of batch in order. Once a write fails, it and
+// the rest of the batch are retried.
+func (s *Syslog) send(ctx context.Context, batch []Report) ([]Report, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, r := range batch {
+		msg := s.format(r)
+		err := s.write(ctx, msg)
+		if err != nil {
+			// The server may have restarted or dropped an idle
+			// connection, so try once more on a fresh one.
+			s.closeConn()
+			err = s.write(ctx, msg)
+		}
+		if err != nil {
+			s.batch.count("delivered", i)
+			return batch[i:], fmt.Errorf("unable to write to syslog: %w", err)
+		}
+	}
+	s.batch.count("delivered", len(batch))
+	return nil, nil
+}
+
+func (s *Syslog) write(ctx context.Context, msg []byte) error {
+	if s.conn == nil {
+		if err := s.dial(ctx); err != nil {
+			return err
+		}
+	}
+
+	if s.framed {
+		msg = append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	deadline := time.Now().Add(s.cfg.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := s.conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	_, err := s.conn.Write(msg)
+	return err
+}
+
+func (s *Syslog) dial(ctx context.Context) error {
+	dialer := &net.Dialer{Timeout: s.cfg.Timeout}
+
+	var conn net.Conn
+	var err error
+	switch s.cfg.Network {
+	case "tls":
+		conn, err = (&tls.Dialer{NetDialer: dialer, Config: s.tlsConfig}).DialContext(ctx, "tcp", s.cfg.Address)
+		s.framed = true
+	case "unix":
+		// Local daemons normally listen on a datagram socket, but some
+		// only offer a stream one.
+		conn, err = dialer.DialContext(ctx, "unixgram", s.cfg.Address)
+		s.framed = false
+		if err != nil {
+			conn, err = dialer.DialContext(ctx, "unix", s.cfg.Address)
+			s.framed = true
+		}
+	default:
+		conn, err = dialer.DialContext(ctx, s.cfg.Network, s.cfg.Address)
+		s.framed = s.cfg.Network == "tcp"
+	}
+	if err != nil {
+		return err
+	}
+
+	s.conn = conn
+	return nil
+}
+
+func (s *Syslog) closeConn() {
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// format renders r as an RFC 5424 message of at most MaxMessageSize bytes.
+// If r doesn't fit, the longest structured-data parameters are left out
+// until the header and structured data do, and the text is shortened to
+// the space that is left.
+func (s *Syslog) format(r Report) []byte {
+	severity := syslogWarning
+	if r.ReportOnly {
+		severity = syslogNotice
+	}
+
+	header := fmt.Sprintf("<%d>1 %s %s %s %s %s ",
+		s.facility*8+severity,
+		r.ReceivedAt.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(s.cfg.Hostname, 255),
+		syslogHeaderField(s.cfg.AppName, 48),
+		syslogHeaderField(s.pid, 128),
+		syslogHeaderField(r.Type, 32),
+	)
+
+	doc := r.Document()
+	delete(doc, "received_at")
+	names := make([]string, 0, len(doc))
+	for name := range doc {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var params []string
+	size := len(header) + len("[") + len(s.cfg.SDID) + len("]")
+	for _, name := range names {
+		value := syslogParamValue(doc[name])
+		if value == "" {
+			continue
+		}
+		param := fmt.Sprintf(` %s="%s"`, syslogHeaderField(name, 32), value)
+		params = append(params, param)
+		size += len(param)
+	}
+
+	for size > s.cfg.MaxMessageSize && len(params) > 0 {
+		longest := 0
+		for i, param := range params {
+			if len(param) > len(params[longest]) {
+				longest = i
+			}
+		}
+		size -= len(params[longest])
+		params = append(params[:longest], params[longest+1:]...)
+	}
+
+	var b strings.Builder
+	b.WriteString(header)
+	b.WriteString("[")
+	b.WriteString(s.cfg.SDID)
+	for _, param := range params {
+		b.WriteString(param)
+	}
+	b.WriteString("]")
+
+	// The BOM marks the message as UTF-8.
+	const bom = "\ufeff"
+	if room := s.cfg.MaxMessageSize - size - len(" "+bom); room > 0 {
+		b.WriteString(" " + bom)
+		b.WriteString(truncateUTF8(r.Summary(), room))
+	}
+
+	return []byte(b.String())
+}
+
+// truncateUTF8 shortens s to at most n bytes without splitting a rune.
+func truncateUTF8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// syslogHeaderField restricts a header field or parameter name to the
+// printable ASCII allowed by RFC 5424, using NILVALUE when it is empty.
+func syslogHeaderField(s string, maxLen int) string {
+	s = strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return '_'
+		}
+		return r
+	}, s)
+	if len(s) > maxLen {
+		s = s[:maxLen]
+	}
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// syslogParamValue formats a field as a structured-data parameter value,
+// escaping the characters RFC 5424 requires.
+func syslogParamValue(v interface{}) string {
+	var s string
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		s = v
+	case map[string]string, map[string]interface{}:
+		b, err := json.Marshal(v)
+		if err != nil {
+			return ""
+		}
+		s = string(b)
+	default:
+		s = fmt.Sprint(v)
+	}
+
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(s)
+}
@@ -0,0 +1,350 @@
+package sink
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// acceptFramed accepts connections on l and sends every message received
+// on them to the returned channel.
+func acceptFramed(t *testing.T, l net.Listener) <-chan string {
+	t.Helper()
+	msgs := make(chan string, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					length, err := r.ReadString(' ')
+					if err != nil {
+						return
+					}
+					n, _ := strconv.Atoi(strings.TrimSpace(length))
+					msg := make([]byte, n)
+					if _, err := io.ReadFull(r, msg); err != nil {
+						return
+					}
+					msgs <- string(msg)
+				}
+			}()
+		}
+	}()
+	return msgs
+}
+
+func receive(t *testing.T, msgs <-chan string) string {
+	t.Helper()
+	select {
+	case msg := <-msgs:
+		return msg
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a syslog message")
+		return ""
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 to dir and
+// returns it along with the path of its PEM file.
+func writeTestCert(t *testing.T, dir string) (tls.Certificate, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "ca.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, path
+}
+
+func TestSyslogFormat(t *testing.T) {
+	s, err := NewSyslog(SyslogConfig{Hostname: "collector"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := sampleReport(1)
+	r.Fields["effective_directive"] = "script-src"
+	r.Fields["blocked_uri"] = "https://evil.example/x.js"
+	r.Fields["script_sample"] = `alert("]\")`
+	r.Fields["metadata"] = map[string]string{"env": "prod"}
+
+	want := fmt.Sprintf(`<132>1 2024-05-01T12:00:00.000000Z collector csp-collector %d csp-violation `+
+		`[report@32473 blocked_uri="https://evil.example/x.js" document_uri="https://example.com/" `+
+		`effective_directive="script-src" handler="csp" line_number="1" metadata="{\"env\":\"prod\"}" `+
+		`report_only="false" report_type="csp-violation" script_sample="alert(\"\]\\\")"] `+
+		"\ufeffscript-src blocked https://evil.example/x.js on https://example.com/", os.Getpid())
+	if got := string(s.format(r)); got != want {
+		t.Errorf("unexpected message\n got: %s\nwant: %s", got, want)
+	}
+
+	r.ReportOnly = true
+	if got := string(s.format(r)); !strings.HasPrefix(got, "<133>1 ") {
+		t.Errorf("expected report-only reports to be notices, got %s", got)
+	}
+}
+
+func TestSyslogTruncatesLongMessages(t *testing.T) {
+	s, err := NewSyslog(SyslogConfig{Hostname: "collector", MaxMessageSize: 400})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	r := sampleReport(1)
+	r.Fields["original_policy"] = strings.Repeat("script-src 'self'; ", 100)
+	r.Fields["blocked_uri"] = "https://evil.example/" + strings.Repeat("é", 200)
+
+	msg := string(s.format(r))
+	if len(msg) > 400 {
+		t.Errorf("expected at most 400 bytes, got %d", len(msg))
+	}
+	if !utf8.ValidString(msg) {
+		t.Error("expected the message to stay valid UTF-8")
+	}
+	if strings.Contains(msg, "original_policy=") {
+		t.Error("expected the longest parameter to be left out")
+	}
+	if !strings.Contains(msg, `document_uri="https://example.com/"`) || !strings.Contains(msg, "] \ufeff blocked https://evil.example/é") {
+		t.Errorf("expected the other parameters and the start of the text to be kept, got %s", msg)
+	}
+
+	if s, _ := NewSyslog(SyslogConfig{}); s.cfg.MaxMessageSize != 2048 {
+		t.Errorf("expected UDP messages to default to 2048 bytes, got %d", s.cfg.MaxMessageSize)
+	}
+}
+
+func TestSyslogBuffersWhileUnreachable(t *testing.T) {
+	// Nothing listens on addr, so the reports can't be sent and stay
+	// buffered.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	s, err := NewSyslog(SyslogConfig{Network: "tcp", Address: addr, BatchConfig: BatchConfig{FlushInterval: time.Hour, MaxBuffered: 2}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		err := s.Write(context.Background(), sampleReport(i))
+		if i == 2 && !errors.Is(err, ErrBufferFull) {
+			t.Errorf("expected ErrBufferFull once the buffer is full, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected writes to return straight away, took %s", elapsed)
+	}
+	if got := s.batch.buffered(); got != 2 {
+		t.Errorf("expected 2 buffered reports, got %d", got)
+	}
+}
+
+func TestSyslogUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSyslog(SyslogConfig{Network: "udp", Address: conn.LocalAddr().String(), Facility: "daemon"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), sampleReport(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<28>1 ") {
+		t.Errorf("expected an unframed daemon.warning message, got %s", msg)
+	}
+}
+
+func TestSyslogTCPReconnects(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := acceptFramed(t, l)
+
+	s, err := NewSyslog(SyslogConfig{Network: "tcp", Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	ctx := context.Background()
+	if err := s.Write(ctx, sampleReport(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, msgs); !strings.Contains(msg, `line_number="1"`) {
+		t.Errorf("unexpected message %s", msg)
+	}
+
+	// Break the connection underneath the sink; the next write should
+	// reconnect rather than fail.
+	s.mu.Lock()
+	s.conn.Close()
+	s.mu.Unlock()
+
+	if err := s.Write(ctx, sampleReport(2)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, msgs); !strings.Contains(msg, `line_number="2"`) {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
+
+func TestSyslogTLS(t *testing.T) {
+	cert, caFile := writeTestCert(t, t.TempDir())
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	msgs := acceptFramed(t, l)
+
+	s, err := NewSyslog(SyslogConfig{Network: "tls", Address: l.Addr().String(), TLS: TLSConfig{CAFile: caFile}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), sampleReport(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if msg := receive(t, msgs); !strings.HasPrefix(msg, "<132>1 ") {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
+
+func TestSyslogTLSRejectsUnknownCA(t *testing.T) {
+	cert, _ := writeTestCert(t, t.TempDir())
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cert}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	acceptFramed(t, l)
+
+	s, err := NewSyslog(SyslogConfig{Network: "tls", Address: l.Addr().String()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := s.Flush(ctx); err == nil {
+		t.Error("expected an untrusted certificate to be rejected")
+	}
+}
+
+func TestSyslogUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewSyslog(SyslogConfig{Network: "unix", Address: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	if err := s.Write(context.Background(), sampleReport(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg := string(buf[:n]); !strings.HasPrefix(msg, "<132>1 ") {
+		t.Errorf("unexpected message %s", msg)
+	}
+}
+
+func TestNewSyslogValidatesConfig(t *testing.T) {
+	if _, err := NewSyslog(SyslogConfig{Facility: "local9"}); err == nil {
+		t.Error("expected an error for an unknown facility")
+	}
+	if _, err := NewSyslog(SyslogConfig{Network: "carrier-pigeon"}); err == nil {
+		t.Error("expected an error for an unknown network")
+	}
+}
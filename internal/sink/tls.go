@@ -0,0 +1,61 @@
+package sink
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+)
+
+// TLSConfig holds the TLS options shared by the network sinks.
+type TLSConfig struct {
+	// Enabled turns on TLS. The remaining fields are ignored without it.
+	Enabled bool
+
+	// CAFile is a PEM bundle used instead of the system roots to verify
+	// the server.
+	CAFile string
+
+	// CertFile and KeyFile are a PEM client certificate and key presented
+	// to servers that require mutual TLS.
+	CertFile string
+	KeyFile  string
+
+	// InsecureSkipVerify disables server certificate verification. Only
+	// use it for testing.
+	InsecureSkipVerify bool
+}
+
+// Config builds a *tls.Config, or returns nil if TLS is disabled.
+func (c TLSConfig) Config() (*tls.Config, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+
+	if c.CAFile != "" {
+		pem, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read ca file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+
+	return config, nil
+}
@@ -0,0 +1,284 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	mathrand "math/rand/v2"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+)
+
+// WebhookConfig configures a webhook sink.
+type WebhookConfig struct {
+	// URLs receive every batch.
+	URLs []string
+
+	// Secret, if set, is used to sign each request body with
+	// HMAC-SHA256. The signature is sent as `sha256=<hex>` in
+	// SignatureHeader, which defaults to `X-Signature-256`.
+	Secret          string
+	SignatureHeader string
+
+	// BatchConfig's BatchSize defaults to 100. MinBackoff and MaxBackoff
+	// also bound the jittered delay between attempts to send a batch to
+	// a URL.
+	BatchConfig
+
+	// MaxAttempts is the number of times a batch is sent to a URL before
+	// it is dead-lettered. Defaults to 5.
+	MaxAttempts int
+
+	// Timeout bounds each request. Defaults to 10s.
+	Timeout time.Duration
+
+	// DeadLetterDir is where batches that could not be delivered are
+	// written. Empty discards them.
+	DeadLetterDir string
+
+	// Client overrides the HTTP client, mainly for tests.
+	Client *http.Client
+
+	// Metrics, if set, counts delivered, failed and dropped reports and
+	// records delivery latency.
+	Metrics *metrics.Metrics
+
+	// OnError is called with errors from background deliveries.
+	OnError func(error)
+}
+
+// Webhook POSTs batches of reports as a JSON array to one or more URLs.
+// Each URL is retried independently with jittered exponential backoff;
+// batches that still fail, or are rejected with a 4xx status, are written
+// to the dead-letter directory.
+type Webhook struct {
+	cfg    WebhookConfig
+	client *http.Client
+	batch  *batcher
+}
+
+// webhookDeadLetter is the file written for a batch that couldn't be
+// delivered. Reports holds the request body exactly as it was sent.
+type webhookDeadLetter struct {
+	URL      string          `json:"url"`
+	Delivery string          `json:"delivery"`
+	Error    string          `json:"error"`
+	FailedAt time.Time       `json:"failed_at"`
+	Reports  json.RawMessage `json:"reports"`
+}
+
+// NewWebhook starts the background delivery loop.
+func NewWebhook(cfg WebhookConfig) (*Webhook, error) {
+	if len(cfg.URLs) == 0 {
+		return nil, fmt.Errorf("webhook urls are not set")
+	}
+	if cfg.SignatureHeader == "" {
+		cfg.SignatureHeader = "X-Signature-256"
+	}
+	if cfg.BatchSize <= 0 {
+		cfg.BatchSize = 100
+	}
+	if cfg.MaxAttempts <= 0 {
+		cfg.MaxAttempts = 5
+	}
+	if cfg.MinBackoff <= 0 {
+		cfg.MinBackoff = 500 * time.Millisecond
+	}
+	if cfg.MaxBackoff <= 0 {
+		cfg.MaxBackoff = 30 * time.Second
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 10 * time.Second
+	}
+	if cfg.DeadLetterDir != "" {
+		if err := os.MkdirAll(cfg.DeadLetterDir, 0o750); err != nil {
+			return nil, err
+		}
+	}
+
+	s := &Webhook{cfg: cfg, client: cfg.Client}
+	if s.client == nil {
+		s.client = &http.Client{Timeout: cfg.Timeout}
+	}
+
+	s.batch = newBatcher(batchConfig{
+		BatchConfig: cfg.BatchConfig,
+		Name:        "webhook",
+		Metrics:     cfg.Metrics,
+		OnError:     cfg.OnError,
+	}, s.send)
+
+	return s, nil
+}
+
+func (s *Webhook) Write(_ context.Context, r Report) error {
+	return s.batch.add(r)
+}
+
+// Flush delivers buffered reports to every URL.
+func (s *Webhook) Flush(ctx context.Context) error {
+	return s.batch.flush(ctx)
+}
+
+// Close stops the delivery loop. Reports still buffered are dropped; call
+// Flush first to deliver them.
+func (s *Webhook) Close() error {
+	err := s.batch.close()
+	s.client.CloseIdleConnections()
+	return err
+}
+
+// send delivers batch to every URL. Batches are never handed back to the
+// batcher for retry; failures end up in the dead-letter directory.
+func (s *Webhook) send(ctx context.Context, batch []Report) ([]Report, error) {
+	if len(batch) == 0 {
+		return nil, nil
+	}
+
+	docs := make([]map[string]interface{}, len(batch))
+	for i, r := range batch {
+		docs[i] = r.Document()
+	}
+	body, err := json.Marshal(docs)
+	if err != nil {
+		s.batch.count("failed", len(batch))
+		return nil, err
+	}
+	delivery := newDeliveryID()
+
+	var errs []error
+	for i, url := range s.cfg.URLs {
+		start := time.Now()
+		err := s.deliver(ctx, url, delivery, body)
+		if err == nil {
+			s.observe("delivered", time.Since(start))
+			s.batch.count("delivered", len(batch))
+			continue
+		}
+
+		s.observe("failed", time.Since(start))
+		s.batch.count("failed", len(batch))
+		err = fmt.Errorf("unable to deliver %d reports to %s: %w", len(batch), url, err)
+		if dlErr := s.deadLetter(i, url, delivery, body, err); dlErr != nil {
+			err = errors.Join(err, dlErr)
+		}
+		errs = append(errs, err)
+	}
+
+	return nil, errors.Join(errs...)
+}
+
+// deliver POSTs body to url, retrying transient failures.
+func (s *Webhook) deliver(ctx context.Context, url, delivery string, body []byte) error {
+	backoff := s.cfg.MinBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = s.post(ctx, url, delivery, body)
+		if err == nil || !retry || attempt == s.cfg.MaxAttempts {
+			return err
+		}
+
+		// Equal jitter keeps at least half the backoff while spreading out
+		// retries from several collectors.
+		delay := backoff/2 + mathrand.N(backoff/2+1)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(delay):
+		}
+		backoff = min(backoff*2, s.cfg.MaxBackoff)
+	}
+}
+
+// post makes a single request, returning whether a failure is worth
+// retrying.
+func (s *Webhook) post(ctx context.Context, url, delivery string, body []byte) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-csp-collector")
+	req.Header.Set("X-Delivery-ID", delivery)
+	if s.cfg.Secret != "" {
+		req.Header.Set(s.cfg.SignatureHeader, WebhookSignature(s.cfg.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return false, nil
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, errors.New(resp.Status)
+	default:
+		return false, errors.New(resp.Status)
+	}
+}
+
+// WebhookSignature returns the value of the signature header for body, for
+// receivers that want to verify it the same way.
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Webhook) deadLetter(index int, url, delivery string, body []byte, cause error) error {
+	if s.cfg.DeadLetterDir == "" {
+		return nil
+	}
+
+	b, err := json.Marshal(webhookDeadLetter{
+		URL:      url,
+		Delivery: delivery,
+		Error:    cause.Error(),
+		FailedAt: time.Now().UTC(),
+		Reports:  body,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Write under a temporary name so that anything replaying the
+	// directory never sees a partial file.
+	name := fmt.Sprintf("webhook-%s-%s-%d.json", time.Now().UTC().Format("20060102T150405.000"), delivery, index)
+	path := filepath.Join(s.cfg.DeadLetterDir, name)
+	if err := os.WriteFile(path+".tmp", b, 0o640); err != nil {
+		return fmt.Errorf("unable to write dead letter: %w", err)
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func newDeliveryID() string {
+	b := make([]byte, 8)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func (s *Webhook) observe(result string, d time.Duration) {
+	if s.cfg.Metrics == nil {
+		return
+	}
+	s.cfg.Metrics.SinkDeliveryTime.WithLabelValues("webhook", result).Observe(d.Seconds())
+}
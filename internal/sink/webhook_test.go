@@ -0,0 +1,193 @@
+package sink
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// webhookReceiver answers with the next status from statuses, or 204 once
+// they run out, and records the bodies it accepted.
+type webhookReceiver struct {
+	mu         sync.Mutex
+	statuses   []int
+	requests   int
+	batches    [][]map[string]interface{}
+	signatures []string
+	deliveries []string
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	rcv.requests++
+	body, _ := io.ReadAll(r.Body)
+	rcv.signatures = append(rcv.signatures, r.Header.Get("X-Signature-256"))
+	rcv.deliveries = append(rcv.deliveries, r.Header.Get("X-Delivery-ID"))
+
+	// The signature must cover the exact body received.
+	if want := WebhookSignature("s3cret", body); r.Header.Get("X-Signature-256") != "" &&
+		!hmac.Equal([]byte(want), []byte(r.Header.Get("X-Signature-256"))) {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	status := http.StatusNoContent
+	if len(rcv.statuses) > 0 {
+		status, rcv.statuses = rcv.statuses[0], rcv.statuses[1:]
+	}
+	if status < 300 {
+		var batch []map[string]interface{}
+		_ = json.Unmarshal(body, &batch)
+		rcv.batches = append(rcv.batches, batch)
+	}
+	w.WriteHeader(status)
+}
+
+func newTestWebhook(t *testing.T, cfg WebhookConfig) *Webhook {
+	t.Helper()
+	cfg.FlushInterval = time.Hour
+	cfg.MinBackoff = time.Millisecond
+	cfg.MaxBackoff = 5 * time.Millisecond
+
+	s, err := NewWebhook(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestWebhookSignsAndDeliversBatches(t *testing.T) {
+	rcv := &webhookReceiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	m := metrics.New(prometheus.NewRegistry())
+	s := newTestWebhook(t, WebhookConfig{URLs: []string{server.URL, server.URL + "/second"}, Secret: "s3cret", Metrics: m})
+	defer s.Close()
+
+	ctx := context.Background()
+	_ = s.Write(ctx, sampleReport(1))
+	_ = s.Write(ctx, sampleReport(2))
+	if err := s.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(rcv.batches) != 2 {
+		t.Fatalf("expected the batch to be sent to both urls, got %d", len(rcv.batches))
+	}
+	if len(rcv.batches[0]) != 2 || rcv.batches[0][1]["line_number"] != float64(2) {
+		t.Errorf("unexpected batch %v", rcv.batches[0])
+	}
+	if rcv.signatures[0] == "" || rcv.deliveries[0] == "" || rcv.deliveries[0] != rcv.deliveries[1] {
+		t.Errorf("expected signed requests sharing a delivery id, got %v and %v", rcv.signatures, rcv.deliveries)
+	}
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("webhook", "delivered")); got != 4 {
+		t.Errorf("sink_reports_total delivered = %v, want 4", got)
+	}
+	if got := testutil.CollectAndCount(m.SinkDeliveryTime); got != 1 {
+		t.Errorf("expected delivery latency to be observed, got %d series", got)
+	}
+}
+
+func TestWebhookRetriesTransientFailures(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{http.StatusServiceUnavailable, http.StatusTooManyRequests}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	dir := t.TempDir()
+	s := newTestWebhook(t, WebhookConfig{URLs: []string{server.URL}, DeadLetterDir: dir})
+	defer s.Close()
+
+	_ = s.Write(context.Background(), sampleReport(1))
+	if err := s.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if rcv.requests != 3 || len(rcv.batches) != 1 {
+		t.Errorf("expected delivery on the third attempt, got %d requests and %d batches", rcv.requests, len(rcv.batches))
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected no dead letters, got %d", len(entries))
+	}
+}
+
+func TestWebhookDeadLettersFailedBatches(t *testing.T) {
+	rcv := &webhookReceiver{statuses: []int{
+		http.StatusBadRequest,
+		http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway,
+	}}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	dir := filepath.Join(t.TempDir(), "dead-letters")
+	m := metrics.New(prometheus.NewRegistry())
+	s := newTestWebhook(t, WebhookConfig{URLs: []string{server.URL}, DeadLetterDir: dir, MaxAttempts: 3, Metrics: m})
+	defer s.Close()
+
+	ctx := context.Background()
+
+	// A 400 is not retried.
+	_ = s.Write(ctx, sampleReport(1))
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("expected a delivery error")
+	}
+	if rcv.requests != 1 {
+		t.Errorf("expected a rejected batch not to be retried, got %d requests", rcv.requests)
+	}
+
+	// Transient failures are retried up to MaxAttempts.
+	_ = s.Write(ctx, sampleReport(2))
+	if err := s.Flush(ctx); err == nil {
+		t.Fatal("expected a delivery error")
+	}
+	if rcv.requests != 4 {
+		t.Errorf("expected 3 attempts, got %d requests", rcv.requests-1)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 dead letters, got %d", len(entries))
+	}
+	b, err := os.ReadFile(filepath.Join(dir, entries[0].Name()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var letter webhookDeadLetter
+	if err := json.Unmarshal(b, &letter); err != nil {
+		t.Fatal(err)
+	}
+	var reports []map[string]interface{}
+	if err := json.Unmarshal(letter.Reports, &reports); err != nil {
+		t.Fatal(err)
+	}
+	if letter.URL != server.URL || letter.Error == "" || len(reports) != 1 {
+		t.Errorf("unexpected dead letter %s", b)
+	}
+
+	if got := testutil.ToFloat64(m.SinkReports.WithLabelValues("webhook", "failed")); got != 2 {
+		t.Errorf("sink_reports_total failed = %v, want 2", got)
+	}
+}
+
+func TestNewWebhookRequiresURLs(t *testing.T) {
+	if _, err := NewWebhook(WebhookConfig{}); err == nil {
+		t.Error("expected an error without urls")
+	}
+}
@@ -0,0 +1,280 @@
+// Package telemetry sets up OpenTelemetry tracing, logging and metric export
+// over OTLP.
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	otelprom "go.opentelemetry.io/contrib/bridges/prometheus"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploggrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlplog/otlploghttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	sdklog "go.opentelemetry.io/otel/sdk/log"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.43.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Config configures which signals are exported and where to.
+type Config struct {
+	// Endpoint is the URL of the OTLP receiver, e.g.
+	// `http://otel-collector:4317`. An `http` scheme disables TLS. Empty
+	// falls back to the standard OTEL_EXPORTER_OTLP_* environment
+	// variables and then to the exporters' localhost defaults.
+	Endpoint string
+
+	// Protocol is `grpc` or `http` (protobuf over HTTP). Defaults to
+	// `grpc`.
+	Protocol string
+
+	// Headers are sent with every export, e.g. for authentication.
+	Headers map[string]string
+
+	// ServiceName and ServiceVersion identify the collector in the
+	// exported resource.
+	ServiceName    string
+	ServiceVersion string
+
+	// Traces enables span export and registers the tracer provider
+	// globally.
+	Traces bool
+
+	// Logs enables the logger provider used by the otlp sink.
+	Logs bool
+
+	// Metrics, if set, is exported through the meter provider every
+	// MetricsInterval, which defaults to 60s.
+	Metrics         prometheus.Gatherer
+	MetricsInterval time.Duration
+}
+
+// Telemetry holds the providers for the enabled signals. Providers for
+// disabled signals are nil.
+type Telemetry struct {
+	TracerProvider *sdktrace.TracerProvider
+	LoggerProvider *sdklog.LoggerProvider
+	MeterProvider  *sdkmetric.MeterProvider
+}
+
+// New creates the providers for the signals enabled in cfg.
+func New(ctx context.Context, cfg Config) (*Telemetry, error) {
+	if cfg.Protocol == "" {
+		cfg.Protocol = "grpc"
+	}
+	if cfg.Protocol != "grpc" && cfg.Protocol != "http" {
+		return nil, fmt.Errorf("unknown otlp protocol '%s'", cfg.Protocol)
+	}
+	if cfg.ServiceName == "" {
+		cfg.ServiceName = "csp-collector"
+	}
+	if cfg.MetricsInterval <= 0 {
+		cfg.MetricsInterval = time.Minute
+	}
+
+	var host string
+	var insecure bool
+	if cfg.Endpoint != "" {
+		u, err := url.Parse(cfg.Endpoint)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return nil, fmt.Errorf("invalid otlp endpoint '%s', expected http(s)://host:port", cfg.Endpoint)
+		}
+		host, insecure = u.Host, u.Scheme == "http"
+	}
+
+	if !cfg.Traces && !cfg.Logs && cfg.Metrics == nil {
+		return &Telemetry{}, nil
+	}
+
+	res, err := resource.New(ctx,
+		resource.WithFromEnv(),
+		resource.WithTelemetrySDK(),
+		resource.WithSchemaURL(semconv.SchemaURL),
+		resource.WithAttributes(
+			semconv.ServiceName(cfg.ServiceName),
+			semconv.ServiceVersion(cfg.ServiceVersion),
+		),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &Telemetry{}
+	if cfg.Traces {
+		exporter, err := newTraceExporter(ctx, cfg, host, insecure)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create otlp trace exporter: %w", err)
+		}
+		t.TracerProvider = sdktrace.NewTracerProvider(
+			sdktrace.WithBatcher(exporter),
+			sdktrace.WithResource(res),
+		)
+		otel.SetTracerProvider(t.TracerProvider)
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{}, propagation.Baggage{},
+		))
+	}
+
+	if cfg.Logs {
+		exporter, err := newLogExporter(ctx, cfg, host, insecure)
+		if err != nil {
+			_ = t.Shutdown(ctx)
+			return nil, fmt.Errorf("unable to create otlp log exporter: %w", err)
+		}
+		t.LoggerProvider = sdklog.NewLoggerProvider(
+			sdklog.WithProcessor(sdklog.NewBatchProcessor(exporter)),
+			sdklog.WithResource(res),
+		)
+	}
+
+	if cfg.Metrics != nil {
+		exporter, err := newMetricExporter(ctx, cfg, host, insecure)
+		if err != nil {
+			_ = t.Shutdown(ctx)
+			return nil, fmt.Errorf("unable to create otlp metric exporter: %w", err)
+		}
+		// The Prometheus collectors stay the source of truth; the bridge
+		// converts whatever they gather on each collection.
+		t.MeterProvider = sdkmetric.NewMeterProvider(
+			sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exporter,
+				sdkmetric.WithInterval(cfg.MetricsInterval),
+				sdkmetric.WithProducer(otelprom.NewMetricProducer(otelprom.WithGatherer(cfg.Metrics))),
+			)),
+			sdkmetric.WithResource(res),
+		)
+	}
+
+	return t, nil
+}
+
+// Shutdown flushes and stops every provider.
+func (t *Telemetry) Shutdown(ctx context.Context) error {
+	var errs []error
+	if t.TracerProvider != nil {
+		errs = append(errs, t.TracerProvider.Shutdown(ctx))
+	}
+	if t.LoggerProvider != nil {
+		errs = append(errs, t.LoggerProvider.Shutdown(ctx))
+	}
+	if t.MeterProvider != nil {
+		errs = append(errs, t.MeterProvider.Shutdown(ctx))
+	}
+	return errors.Join(errs...)
+}
+
+// Handler wraps a mux router so that every request gets a server span named
+// after the route it matched. Spans for the stages of handling a report are
+// children of it.
+func Handler(r *mux.Router) http.Handler {
+	r.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			if route := mux.CurrentRoute(req); route != nil {
+				if tmpl, err := route.GetPathTemplate(); err == nil {
+					span := trace.SpanFromContext(req.Context())
+					span.SetName(req.Method + " " + tmpl)
+					span.SetAttributes(semconv.HTTPRoute(tmpl))
+				}
+			}
+			next.ServeHTTP(w, req)
+		})
+	})
+	return otelhttp.NewHandler(r, "csp-collector")
+}
+
+func newTraceExporter(ctx context.Context, cfg Config, host string, insecure bool) (sdktrace.SpanExporter, error) {
+	if cfg.Protocol == "http" {
+		var opts []otlptracehttp.Option
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlptracehttp.WithHeaders(cfg.Headers))
+		}
+		if host != "" {
+			opts = append(opts, otlptracehttp.WithEndpoint(host))
+		}
+		if insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(ctx, opts...)
+	}
+
+	var opts []otlptracegrpc.Option
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlptracegrpc.WithHeaders(cfg.Headers))
+	}
+	if host != "" {
+		opts = append(opts, otlptracegrpc.WithEndpoint(host))
+	}
+	if insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(ctx, opts...)
+}
+
+func newLogExporter(ctx context.Context, cfg Config, host string, insecure bool) (sdklog.Exporter, error) {
+	if cfg.Protocol == "http" {
+		var opts []otlploghttp.Option
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlploghttp.WithHeaders(cfg.Headers))
+		}
+		if host != "" {
+			opts = append(opts, otlploghttp.WithEndpoint(host))
+		}
+		if insecure {
+			opts = append(opts, otlploghttp.WithInsecure())
+		}
+		return otlploghttp.New(ctx, opts...)
+	}
+
+	var opts []otlploggrpc.Option
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlploggrpc.WithHeaders(cfg.Headers))
+	}
+	if host != "" {
+		opts = append(opts, otlploggrpc.WithEndpoint(host))
+	}
+	if insecure {
+		opts = append(opts, otlploggrpc.WithInsecure())
+	}
+	return otlploggrpc.New(ctx, opts...)
+}
+
+func newMetricExporter(ctx context.Context, cfg Config, host string, insecure bool) (sdkmetric.Exporter, error) {
+	if cfg.Protocol == "http" {
+		var opts []otlpmetrichttp.Option
+		if len(cfg.Headers) > 0 {
+			opts = append(opts, otlpmetrichttp.WithHeaders(cfg.Headers))
+		}
+		if host != "" {
+			opts = append(opts, otlpmetrichttp.WithEndpoint(host))
+		}
+		if insecure {
+			opts = append(opts, otlpmetrichttp.WithInsecure())
+		}
+		return otlpmetrichttp.New(ctx, opts...)
+	}
+
+	var opts []otlpmetricgrpc.Option
+	if len(cfg.Headers) > 0 {
+		opts = append(opts, otlpmetricgrpc.WithHeaders(cfg.Headers))
+	}
+	if host != "" {
+		opts = append(opts, otlpmetricgrpc.WithEndpoint(host))
+	}
+	if insecure {
+		opts = append(opts, otlpmetricgrpc.WithInsecure())
+	}
+	return otlpmetricgrpc.New(ctx, opts...)
+}
@@ -0,0 +1,165 @@
+package telemetry
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/log"
+	collectorlogs "go.opentelemetry.io/proto/otlp/collector/logs/v1"
+	collectormetrics "go.opentelemetry.io/proto/otlp/collector/metrics/v1"
+	collectortrace "go.opentelemetry.io/proto/otlp/collector/trace/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// receiver is an OTLP/HTTP endpoint that keeps every export it receives.
+type receiver struct {
+	mu      sync.Mutex
+	headers []http.Header
+	traces  []*collectortrace.ExportTraceServiceRequest
+	metrics []*collectormetrics.ExportMetricsServiceRequest
+	logs    []*collectorlogs.ExportLogsServiceRequest
+}
+
+func (rcv *receiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	body, _ := io.ReadAll(r.Body)
+	rcv.headers = append(rcv.headers, r.Header.Clone())
+
+	var err error
+	switch r.URL.Path {
+	case "/v1/traces":
+		req := &collectortrace.ExportTraceServiceRequest{}
+		err = proto.Unmarshal(body, req)
+		rcv.traces = append(rcv.traces, req)
+	case "/v1/metrics":
+		req := &collectormetrics.ExportMetricsServiceRequest{}
+		err = proto.Unmarshal(body, req)
+		rcv.metrics = append(rcv.metrics, req)
+	case "/v1/logs":
+		req := &collectorlogs.ExportLogsServiceRequest{}
+		err = proto.Unmarshal(body, req)
+		rcv.logs = append(rcv.logs, req)
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (rcv *receiver) spanNames() []string {
+	var names []string
+	for _, req := range rcv.traces {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				for _, span := range ss.Spans {
+					names = append(names, span.Name)
+				}
+			}
+		}
+	}
+	return names
+}
+
+func TestTelemetryExportsOverHTTP(t *testing.T) {
+	rcv := &receiver{}
+	server := httptest.NewServer(rcv)
+	defer server.Close()
+
+	registry := prometheus.NewRegistry()
+	counter := prometheus.NewCounter(prometheus.CounterOpts{Name: "test_reports_total", Help: "Test counter."})
+	registry.MustRegister(counter)
+	counter.Add(3)
+
+	// New registers the tracer provider globally.
+	defer otel.SetTracerProvider(otel.GetTracerProvider())
+
+	ctx := context.Background()
+	tel, err := New(ctx, Config{
+		Endpoint:       server.URL,
+		Protocol:       "http",
+		Headers:        map[string]string{"Authorization": "Bearer token"},
+		ServiceVersion: "test",
+		Traces:         true,
+		Logs:           true,
+		Metrics:        registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := mux.NewRouter()
+	r.HandleFunc("/csp/{mode}", func(w http.ResponseWriter, r *http.Request) {
+		_, span := otel.Tracer("test").Start(r.Context(), "write report")
+		span.End()
+		w.WriteHeader(http.StatusNoContent)
+	}).Methods("POST")
+	h := Handler(r)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/csp/report-only", strings.NewReader("{}")))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+
+	var record log.Record
+	record.SetBody(attribute.StringValue("script-src blocked https://evil.example"))
+	tel.LoggerProvider.Logger("test").Emit(ctx, record)
+
+	if err := tel.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+
+	names := rcv.spanNames()
+	if len(names) != 2 || !contains(names, "POST /csp/{mode}") || !contains(names, "write report") {
+		t.Errorf("expected a route span and a child span, got %v", names)
+	}
+	if len(rcv.metrics) == 0 || !strings.Contains(rcv.metrics[0].String(), "test_reports_total") {
+		t.Errorf("expected the prometheus counter to be exported, got %v", rcv.metrics)
+	}
+	if len(rcv.logs) != 1 || !strings.Contains(rcv.logs[0].String(), "script-src blocked") {
+		t.Errorf("expected the log record to be exported, got %v", rcv.logs)
+	}
+	for _, h := range rcv.headers {
+		if h.Get("Authorization") != "Bearer token" {
+			t.Errorf("expected configured headers on every export, got %v", h)
+		}
+	}
+}
+
+func TestNewValidatesConfig(t *testing.T) {
+	ctx := context.Background()
+	if _, err := New(ctx, Config{Protocol: "carrier-pigeon"}); err == nil {
+		t.Error("expected an error for an unknown protocol")
+	}
+	if _, err := New(ctx, Config{Endpoint: "otel-collector:4317"}); err == nil {
+		t.Error("expected an error for an endpoint without a scheme")
+	}
+}
+
+func contains(values []string, want string) bool {
+	for _, v := range values {
+		if v == want {
+			return true
+		}
+	}
+	return false
+}
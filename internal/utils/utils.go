@@ -5,6 +5,7 @@ import (
 	urlverifier "github.com/davidmytton/url-verifier"
 	"net/http"
 	"net/netip"
+	"strconv"
 	"strings"
 )
 
@@ -82,3 +83,75 @@ func ValidateOrigin(origin string) bool {
 	}
 	return ret.IsRFC3986URL
 }
+
+// ParseByteSize parses a size such as "512", "64K" or "4M" into bytes.
+// Suffixes are binary multiples and case insensitive.
+func ParseByteSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "IB"), "B")
+
+	multiplier := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		multiplier = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		multiplier = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		multiplier = 1 << 30
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	return n * multiplier, nil
+}
+
+// ParseByteSizeOverrides parses a comma separated list of `key=size` pairs,
+// such as "/reporting-api=4M,/csp=64K", into a map of sizes in bytes.
+func ParseByteSizeOverrides(s string) (map[string]int64, error) {
+	overrides := make(map[string]int64)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid override %q, expected key=size", pair)
+		}
+
+		size, err := ParseByteSize(value)
+		if err != nil {
+			return nil, err
+		}
+		overrides[strings.TrimSpace(key)] = size
+	}
+
+	return overrides, nil
+}
+
+// ParseKeyValues parses a comma separated list of `key=value` pairs, such
+// as "job=csp-collector,env=prod", into a map.
+func ParseKeyValues(s string) (map[string]string, error) {
+	values := make(map[string]string)
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid pair %q, expected key=value", pair)
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+
+	return values, nil
+}
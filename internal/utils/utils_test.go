@@ -102,3 +102,63 @@ func TestTruncateQueryStringFragment(t *testing.T) {
 		})
 	}
 }
+
+func TestParseByteSize(t *testing.T) {
+	cases := []struct {
+		in   string
+		want int64
+	}{
+		{"512", 512},
+		{"64K", 64 << 10},
+		{"64kb", 64 << 10},
+		{"4M", 4 << 20},
+		{"4MiB", 4 << 20},
+		{"1G", 1 << 30},
+		{"0", 0},
+	}
+
+	for _, tc := range cases {
+		got, err := utils.ParseByteSize(tc.in)
+		if err != nil {
+			t.Errorf("ParseByteSize(%q) returned error: %s", tc.in, err)
+			continue
+		}
+		if got != tc.want {
+			t.Errorf("ParseByteSize(%q) = %d, want %d", tc.in, got, tc.want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", "-1", "1T"} {
+		if _, err := utils.ParseByteSize(in); err == nil {
+			t.Errorf("ParseByteSize(%q) expected error", in)
+		}
+	}
+}
+
+func TestParseByteSizeOverrides(t *testing.T) {
+	got, err := utils.ParseByteSizeOverrides("/reporting-api=4M, /csp=64K")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got["/reporting-api"] != 4<<20 || got["/csp"] != 64<<10 || len(got) != 2 {
+		t.Fatalf("unexpected overrides: %v", got)
+	}
+
+	if _, err := utils.ParseByteSizeOverrides("/csp"); err == nil {
+		t.Fatal("expected error for override without size")
+	}
+}
+
+func TestParseKeyValues(t *testing.T) {
+	got, err := utils.ParseKeyValues("job=csp-collector, env = prod")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if got["job"] != "csp-collector" || got["env"] != "prod" || len(got) != 2 {
+		t.Fatalf("unexpected values: %v", got)
+	}
+
+	if _, err := utils.ParseKeyValues("job"); err == nil {
+		t.Fatal("expected error for pair without value")
+	}
+}
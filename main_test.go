@@ -10,6 +10,7 @@ import (
 
 	"github.com/jacobbednarz/go-csp-collector/internal/handler"
 	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
 	"github.com/jacobbednarz/go-csp-collector/internal/utils"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -125,3 +126,80 @@ func TestMetricsEndpointUsesCustomRegistry(t *testing.T) {
 		}
 	}
 }
+
+func TestNewSink(t *testing.T) {
+	l := logrus.New()
+
+	if _, err := newSink("log", sinkOptions{}, l); err != nil {
+		t.Errorf("unexpected error for 'log': %s", err)
+	}
+	if _, err := newSink("log, log", sinkOptions{}, l); err != nil {
+		t.Errorf("unexpected error for repeated sinks: %s", err)
+	}
+	if _, err := newSink("carrier-pigeon", sinkOptions{}, l); err == nil {
+		t.Error("expected error for unknown sink")
+	}
+	if _, err := newSink(" , ", sinkOptions{}, l); err == nil {
+		t.Error("expected error when no sinks are configured")
+	}
+	if _, err := newSink("file", sinkOptions{}, l); err == nil {
+		t.Error("expected error for file sink without a directory")
+	}
+	if _, err := newSink("elasticsearch", sinkOptions{}, l); err == nil {
+		t.Error("expected error for elasticsearch sink without a url")
+	}
+	if _, err := newSink("elasticsearch", sinkOptions{
+		Elasticsearch:         sink.ElasticsearchConfig{URL: "http://localhost:9200"},
+		ElasticsearchTemplate: "does-not-exist.json",
+	}, l); err == nil {
+		t.Error("expected error for a missing elasticsearch template file")
+	}
+	if _, err := newSink("kafka", sinkOptions{}, l); err == nil {
+		t.Error("expected error for kafka sink without brokers")
+	}
+	if _, err := newSink("syslog", sinkOptions{Syslog: sink.SyslogConfig{Facility: "local9"}}, l); err == nil {
+		t.Error("expected error for syslog sink with an unknown facility")
+	}
+	if _, err := newSink("webhook", sinkOptions{}, l); err == nil {
+		t.Error("expected error for webhook sink without urls")
+	}
+	if _, err := newSink("loki", sinkOptions{}, l); err == nil {
+		t.Error("expected error for loki sink without a url")
+	}
+	if _, err := newSink("otlp", sinkOptions{}, l); err == nil {
+		t.Error("expected error for otlp sink without a logger provider")
+	}
+	if _, err := newSink("splunk", sinkOptions{Splunk: sink.SplunkConfig{URL: "https://splunk:8088"}}, l); err == nil {
+		t.Error("expected error for splunk sink without a token")
+	}
+	if _, err := newSink("cloudevents", sinkOptions{CloudEvents: sink.CloudEventsConfig{URL: "http://bus:8080", Mode: "batched"}}, l); err == nil {
+		t.Error("expected error for cloudevents sink with an unknown mode")
+	}
+	if _, err := newSink("gelf", sinkOptions{GELF: sink.GELFConfig{Network: "tls"}}, l); err == nil {
+		t.Error("expected error for gelf sink with an unsupported network")
+	}
+	if out, err := newSink("log", sinkOptions{OutputFormat: "cloudevents"}, l); err != nil {
+		t.Errorf("unexpected error for 'log' with cloudevents output: %s", err)
+	} else if _, ok := out.(*sink.CloudEventsWriter); !ok {
+		t.Errorf("expected the log sink to write cloudevents, got %T", out)
+	}
+}
+
+func TestHasSink(t *testing.T) {
+	if !hasSink("log, otlp", "otlp") {
+		t.Error("expected otlp to be found")
+	}
+	if hasSink("log,otlpx", "otlp") {
+		t.Error("expected only exact names to match")
+	}
+}
+
+func TestElasticsearchTemplate(t *testing.T) {
+	if got, err := elasticsearchTemplate("", ""); err != nil || got != "" {
+		t.Errorf("expected no template, got %q, %v", got, err)
+	}
+	got, err := elasticsearchTemplate("default", "")
+	if err != nil || !strings.Contains(got, "csp-reports-*") {
+		t.Errorf("expected the built-in template, got %q, %v", got, err)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/archive"
+	"github.com/jacobbednarz/go-csp-collector/internal/handler"
+	"github.com/jacobbednarz/go-csp-collector/internal/queue"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/jacobbednarz/go-csp-collector/internal/telemetry"
+)
+
+// shutdownSignals stop the collector gracefully.
+var shutdownSignals = []os.Signal{syscall.SIGTERM, os.Interrupt}
+
+// collector holds everything that has to be stopped when the collector
+// shuts down. Only server, metricsServer, health and sink are required.
+type collector struct {
+	server        *http.Server
+	metricsServer *http.Server
+	health        *handler.Healthcheck
+	queue         *queue.Queue
+	sink          sink.Sink
+	archive       *archive.Archive
+	telemetry     *telemetry.Telemetry
+}
+
+// shutdown fails the health check and, after delay, stops accepting
+// requests and waits for in-flight requests and the queue to drain, for
+// buffered reports to be flushed and for the archive to upload its spool.
+// gracePeriod bounds all of it, including delay, so that it can be sized
+// to the orchestrator's termination period. The archive, telemetry and the
+// metrics server are stopped last so that the rest of the shutdown is
+// still observable.
+func (c *collector) shutdown(delay, gracePeriod time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+
+	c.health.Fail()
+	select {
+	case <-ctx.Done():
+	case <-time.After(delay):
+	}
+
+	var errs []error
+	if err := c.server.Shutdown(ctx); err != nil {
+		c.server.Close()
+		errs = append(errs, fmt.Errorf("unable to drain in-flight requests: %w", err))
+	}
+	if c.queue != nil {
+		if err := c.queue.Close(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to drain queue: %w", err))
+		}
+	}
+	if err := c.sink.Flush(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("unable to flush sinks: %w", err))
+	}
+	if err := closeWithin(ctx, c.sink.Close); err != nil {
+		errs = append(errs, fmt.Errorf("unable to close sinks: %w", err))
+	}
+	if c.archive != nil {
+		if err := c.archive.Flush(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to flush archive: %w", err))
+		}
+		if err := closeWithin(ctx, c.archive.Close); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close archive: %w", err))
+		}
+	}
+	if c.telemetry != nil {
+		if err := c.telemetry.Shutdown(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("unable to shut down opentelemetry: %w", err))
+		}
+	}
+	if err := c.metricsServer.Shutdown(ctx); err != nil {
+		c.metricsServer.Close()
+	}
+
+	return errors.Join(errs...)
+}
+
+// closeWithin calls close and waits for it to return until ctx is done.
+// Close methods don't take a context, so one that is still blocked then is
+// left to finish in the background while the process exits.
+func closeWithin(ctx context.Context, close func() error) error {
+	done := make(chan error, 1)
+	go func() { done <- close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
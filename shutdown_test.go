@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/handler"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+)
+
+// closingSink records whether it was flushed and closed, in that order. If
+// block is set, Close doesn't return until it is closed.
+type closingSink struct {
+	flushed atomic.Bool
+	closed  atomic.Bool
+	block   chan struct{}
+}
+
+func (s *closingSink) Write(context.Context, sink.Report) error { return nil }
+
+func (s *closingSink) Flush(context.Context) error {
+	s.flushed.Store(!s.closed.Load())
+	return nil
+}
+
+func (s *closingSink) Close() error {
+	s.closed.Store(true)
+	if s.block != nil {
+		<-s.block
+	}
+	return nil
+}
+
+// serve starts srv on a free local port and returns its URL.
+func serve(t *testing.T, srv *http.Server) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	return "http://" + l.Addr().String()
+}
+
+func TestShutdownDrainsRequestsAndFlushesSinks(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	health := &handler.Healthcheck{}
+	mux := http.NewServeMux()
+	mux.Handle("/_healthcheck", health)
+	mux.HandleFunc("/csp", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	server := &http.Server{Handler: mux}
+	url := serve(t, server)
+	metricsServer := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, metricsServer)
+
+	out := &closingSink{}
+	c := &collector{server: server, metricsServer: metricsServer, health: health, sink: out}
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(url+"/csp", "application/csp-report", nil)
+		if err != nil {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+	<-started
+
+	done := make(chan error, 1)
+	go func() { done <- c.shutdown(100*time.Millisecond, 5*time.Second) }()
+
+	// The health check fails while load balancers catch up.
+	time.Sleep(20 * time.Millisecond)
+	resp, err := http.Get(url + "/_healthcheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the health check to fail during shutdown, got %d", resp.StatusCode)
+	}
+
+	close(release)
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if got := <-status; got != http.StatusNoContent {
+		t.Errorf("expected the in-flight request to complete, got %d", got)
+	}
+	if !out.flushed.Load() || !out.closed.Load() {
+		t.Error("expected the sinks to be flushed and then closed")
+	}
+	if _, err := http.Get(url + "/_healthcheck"); err == nil {
+		t.Error("expected the server to stop accepting requests")
+	}
+}
+
+func TestShutdownGivesUpAfterGracePeriod(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/csp", func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	})
+
+	server := &http.Server{Handler: mux}
+	url := serve(t, server)
+	metricsServer := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, metricsServer)
+
+	out := &closingSink{}
+	c := &collector{server: server, metricsServer: metricsServer, health: &handler.Healthcheck{}, sink: out}
+
+	go func() {
+		if resp, err := http.Post(url+"/csp", "application/csp-report", nil); err == nil {
+			resp.Body.Close()
+		}
+	}()
+	<-started
+
+	if err := c.shutdown(0, 50*time.Millisecond); err == nil {
+		t.Error("expected the stuck request to be reported")
+	}
+	// Closing is started regardless but not waited for once the grace
+	// period is over.
+	deadline := time.Now().Add(time.Second)
+	for !out.closed.Load() && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if !out.closed.Load() {
+		t.Error("expected the sinks to be closed regardless")
+	}
+}
+
+func TestShutdownGivesUpOnStuckSinks(t *testing.T) {
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, server)
+	metricsServer := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, metricsServer)
+
+	out := &closingSink{block: make(chan struct{})}
+	defer close(out.block)
+	c := &collector{server: server, metricsServer: metricsServer, health: &handler.Healthcheck{}, sink: out}
+
+	start := time.Now()
+	if err := c.shutdown(0, 50*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the stuck sink to be reported, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected shutdown to give up after the grace period, took %s", elapsed)
+	}
+}
+
+func TestShutdownDelayCountsTowardsGracePeriod(t *testing.T) {
+	server := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, server)
+	metricsServer := &http.Server{Handler: http.NotFoundHandler()}
+	serve(t, metricsServer)
+
+	c := &collector{server: server, metricsServer: metricsServer, health: &handler.Healthcheck{}, sink: &closingSink{}}
+
+	start := time.Now()
+	_ = c.shutdown(time.Hour, 50*time.Millisecond)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("expected the delay to be cut short by the grace period, took %s", elapsed)
+	}
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+
+	"github.com/jacobbednarz/go-csp-collector/internal/metrics"
+	"github.com/jacobbednarz/go-csp-collector/internal/sink"
+	"github.com/sirupsen/logrus"
+)
+
+// sinkOptions holds the configuration for the optional sinks.
+type sinkOptions struct {
+	File          sink.FileConfig
+	SQLite        sink.SQLiteConfig
+	Postgres      sink.PostgresConfig
+	Elasticsearch sink.ElasticsearchConfig
+	Kafka         sink.KafkaConfig
+	Syslog        sink.SyslogConfig
+	Webhook       sink.WebhookConfig
+	Loki          sink.LokiConfig
+	OTLP          sink.OTLPConfig
+	Splunk        sink.SplunkConfig
+	CloudEvents   sink.CloudEventsConfig
+	GELF          sink.GELFConfig
+
+	// OutputFormat is the -output-format flag. With `cloudevents` the log
+	// sink writes structured CloudEvents instead of log lines.
+	OutputFormat string
+
+	// ElasticsearchTemplate is empty to leave index templates alone,
+	// `default` to install the built-in template, or the path of a JSON
+	// file holding a custom one.
+	ElasticsearchTemplate string
+
+	// Metrics is passed to sinks that report delivery counts.
+	Metrics *metrics.Metrics
+}
+
+// newSink builds the output for accepted reports from a comma separated list
+// of sink names. Every named sink receives every report.
+func newSink(names string, opts sinkOptions, logger *logrus.Logger) (sink.Sink, error) {
+	var sinks []sink.Sink
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		switch name {
+		case "":
+			continue
+		case "log":
+			if opts.OutputFormat == "cloudevents" {
+				sinks = append(sinks, sink.NewCloudEventsWriter(logger.Out))
+				continue
+			}
+			sinks = append(sinks, sink.NewLogrus(logger))
+		case "file":
+			f, err := sink.NewFile(opts.File)
+			if err != nil {
+				return nil, fmt.Errorf("file sink: %w", err)
+			}
+			reopenOnHangup(f, logger)
+			sinks = append(sinks, f)
+		case "sqlite":
+			cfg := opts.SQLite
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("sqlite sink: %s", err)
+			}
+			db, err := sink.NewSQLite(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("sqlite sink: %w", err)
+			}
+			sinks = append(sinks, db)
+		case "postgres":
+			cfg := opts.Postgres
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("postgres sink: %s", err)
+			}
+			pg, err := sink.NewPostgres(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("postgres sink: %w", err)
+			}
+			sinks = append(sinks, pg)
+		case "elasticsearch":
+			cfg := opts.Elasticsearch
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("elasticsearch sink: %s", err)
+			}
+			template, err := elasticsearchTemplate(opts.ElasticsearchTemplate, cfg.Index)
+			if err != nil {
+				return nil, fmt.Errorf("elasticsearch sink: %w", err)
+			}
+			cfg.Template = template
+			es, err := sink.NewElasticsearch(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("elasticsearch sink: %w", err)
+			}
+			sinks = append(sinks, es)
+		case "kafka":
+			cfg := opts.Kafka
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("kafka sink: %s", err)
+			}
+			k, err := sink.NewKafka(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("kafka sink: %w", err)
+			}
+			sinks = append(sinks, k)
+		case "syslog":
+			cfg := opts.Syslog
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("syslog sink: %s", err)
+			}
+			sl, err := sink.NewSyslog(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("syslog sink: %w", err)
+			}
+			sinks = append(sinks, sl)
+		case "webhook":
+			cfg := opts.Webhook
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("webhook sink: %s", err)
+			}
+			wh, err := sink.NewWebhook(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("webhook sink: %w", err)
+			}
+			sinks = append(sinks, wh)
+		case "loki":
+			cfg := opts.Loki
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("loki sink: %s", err)
+			}
+			lk, err := sink.NewLoki(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("loki sink: %w", err)
+			}
+			sinks = append(sinks, lk)
+		case "otlp":
+			o, err := sink.NewOTLP(opts.OTLP)
+			if err != nil {
+				return nil, fmt.Errorf("otlp sink: %w", err)
+			}
+			sinks = append(sinks, o)
+		case "splunk":
+			cfg := opts.Splunk
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("splunk sink: %s", err)
+			}
+			sp, err := sink.NewSplunk(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("splunk sink: %w", err)
+			}
+			sinks = append(sinks, sp)
+		case "cloudevents":
+			cfg := opts.CloudEvents
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("cloudevents sink: %s", err)
+			}
+			ce, err := sink.NewCloudEvents(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("cloudevents sink: %w", err)
+			}
+			sinks = append(sinks, ce)
+		case "gelf":
+			cfg := opts.GELF
+			cfg.Metrics = opts.Metrics
+			cfg.OnError = func(err error) {
+				logger.Warnf("gelf sink: %s", err)
+			}
+			g, err := sink.NewGELF(cfg)
+			if err != nil {
+				return nil, fmt.Errorf("gelf sink: %w", err)
+			}
+			sinks = append(sinks, g)
+		default:
+			return nil, fmt.Errorf("unknown sink '%s'", name)
+		}
+	}
+
+	if len(sinks) == 0 {
+		return nil, fmt.Errorf("no sinks configured")
+	}
+
+	return sink.Multi(sinks...), nil
+}
+
+// hasSink reports whether the comma separated list names includes name.
+func hasSink(names, name string) bool {
+	for _, n := range strings.Split(names, ",") {
+		if strings.TrimSpace(n) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// elasticsearchTemplate resolves the -elasticsearch-template flag to the
+// body of the index template to install.
+func elasticsearchTemplate(value, index string) (string, error) {
+	switch value {
+	case "":
+		return "", nil
+	case "default":
+		if index == "" {
+			index = sink.DefaultElasticsearchIndex
+		}
+		return sink.ElasticsearchTemplate(index), nil
+	}
+
+	b, err := os.ReadFile(value)
+	if err != nil {
+		return "", fmt.Errorf("unable to read index template: %w", err)
+	}
+	return string(b), nil
+}
+
+// reopenOnHangup reopens f's active file whenever the process receives
+// SIGHUP, allowing external tools to move it safely.
+func reopenOnHangup(f *sink.File, logger *logrus.Logger) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := f.Reopen(); err != nil {
+				logger.Errorf("unable to reopen %s: %s", f.Path(), err)
+				continue
+			}
+			logger.Debugf("reopened %s", f.Path())
+		}
+	}()
+}